@@ -0,0 +1,219 @@
+package main
+
+import (
+	"math/big"
+)
+
+//Rounding rules decide which syndicate members receive the minor units left over after every
+//member's pro-rata part has been rounded down
+const (
+	RoundingLargestRemainder = "LargestRemainder"
+	RoundingAgentAbsorbs     = "AgentAbsorbs"
+	RoundingLeadLender       = "LeadLender"
+)
+
+var roundingRules = []string{RoundingLargestRemainder, RoundingAgentAbsorbs, RoundingLeadLender}
+
+//Allocate splits total across members by ShareBps. Every part is first rounded towards zero and
+//the residue is then handed out according to rule, so the parts always sum exactly to total.
+//absorberId names the member that takes the residue under RoundingAgentAbsorbs and
+//RoundingLeadLender. Parts are returned in member order.
+func Allocate(total Money, members []SyndicateMember, rule string, absorberId string) ([]Money, error) {
+	if len(members) == 0 {
+		return nil, newError(ErrCodeInvalidArgument, "Cannot allocate %s without members", total)
+	}
+	var weights = make([]int64, len(members))
+	var totalShare int64
+	for i, member := range members {
+		if member.ShareBps <= 0 {
+			return nil, newError(ErrCodeInvalidArgument, "Participant %s must have a positive share", member.ParticipantId)
+		}
+		weights[i] = int64(member.ShareBps)
+		totalShare += weights[i]
+	}
+	if totalShare != FullShareBps {
+		return nil, newError(ErrCodeInvalidArgument, "Shares total %d bps instead of %d", totalShare, FullShareBps)
+	}
+	return allocateByRule(total, members, weights, FullShareBps, rule, absorberId)
+}
+
+//allocateByRule splits total across members in proportion to weights adding up to weightTotal,
+//rounding every part towards zero and handing out the residue according to rule
+func allocateByRule(total Money, members []SyndicateMember, weights []int64, weightTotal int64, rule string, absorberId string) ([]Money, error) {
+	//allocate the magnitude so negative totals, e.g. reversals, round the same way as positive ones
+	var negative = total.IsNegative()
+	var magnitude = big.NewInt(total.Minor)
+	if negative {
+		magnitude.Neg(magnitude)
+	}
+
+	var parts = make([]Money, len(members))
+	var remainders = make([]int64, len(members))
+	var allocated int64
+	for i := range members {
+		var quotient, remainder = new(big.Int).QuoRem(new(big.Int).Mul(magnitude, big.NewInt(weights[i])), big.NewInt(weightTotal), new(big.Int))
+		parts[i] = Money{Minor: quotient.Int64(), Currency: total.Currency}
+		remainders[i] = remainder.Int64()
+		allocated += quotient.Int64()
+	}
+
+	//the residue is below one minor unit per member since each part lost less than one
+	var residue = magnitude.Int64() - allocated
+	if residue > 0 {
+		switch rule {
+		case "", RoundingLargestRemainder:
+			//largest remainders first, ties going to the earlier member
+			var taken = make([]bool, len(members))
+			for ; residue > 0; residue-- {
+				var next = -1
+				for i := range members {
+					if !taken[i] && (next < 0 || remainders[i] > remainders[next]) {
+						next = i
+					}
+				}
+				taken[next] = true
+				parts[next].Minor++
+			}
+		case RoundingAgentAbsorbs, RoundingLeadLender:
+			var absorber = -1
+			for i, member := range members {
+				if member.ParticipantId == absorberId {
+					absorber = i
+				}
+			}
+			if absorber < 0 {
+				return nil, newError(ErrCodeInvalidArgument, "Rounding rule %s needs %s to be a syndicate member", rule, describeAbsorber(absorberId))
+			}
+			parts[absorber].Minor += residue
+		default:
+			return nil, newError(ErrCodeInvalidArgument, "Unknown rounding rule %s", rule)
+		}
+	}
+
+	if negative {
+		for i := range parts {
+			parts[i].Minor = -parts[i].Minor
+		}
+	}
+	return parts, nil
+}
+
+func describeAbsorber(absorberId string) string {
+	if absorberId == "" {
+		return "a residue holder"
+	}
+	return "participant " + absorberId
+}
+
+//Allocate splits total across the syndicate using its rounding rule
+func (syndicate *Syndicate) Allocate(total Money) ([]Money, error) {
+	return Allocate(total, syndicate.Members, syndicate.RoundingRule, syndicate.residueHolder())
+}
+
+//deriveShares sets every member's share from its commitment. Shares are rounded down to whole
+//basis points and the basis points left over are handed out by the syndicate's rounding rule,
+//so the shares always add up to FullShareBps. A share given with the syndicate must match its
+//commitment to within a basis point.
+func (syndicate *Syndicate) deriveShares() error {
+	if len(syndicate.Members) == 0 {
+		return nil
+	}
+	err := validateRoundingRule(*syndicate)
+	if err != nil {
+		return err
+	}
+	var weights = make([]int64, len(syndicate.Members))
+	var total int64
+	for i, member := range syndicate.Members {
+		if !member.CommitmentAmount.IsPositive() {
+			return newError(ErrCodeInvalidArgument, "Participant %s must have a positive commitment and share", member.ParticipantId)
+		}
+		weights[i] = member.CommitmentAmount.Minor
+		total += weights[i]
+	}
+	shares, err := allocateByRule(Money{Minor: FullShareBps}, syndicate.Members, weights, total, syndicate.RoundingRule, syndicate.residueHolder())
+	if err != nil {
+		return err
+	}
+	for i := range syndicate.Members {
+		var member = &syndicate.Members[i]
+		if member.ShareBps != 0 {
+			var exact = new(big.Rat).SetFrac(new(big.Int).Mul(big.NewInt(member.CommitmentAmount.Minor), big.NewInt(FullShareBps)), big.NewInt(total))
+			var difference = exact.Sub(exact, big.NewRat(int64(member.ShareBps), 1))
+			if difference.Abs(difference).Cmp(big.NewRat(1, 1)) >= 0 {
+				return newError(ErrCodeInvalidArgument, "Participant %s share of %d bps does not match its commitment of %s", member.ParticipantId, member.ShareBps, member.CommitmentAmount)
+			}
+		}
+		member.ShareBps = int(shares[i].Minor)
+	}
+	return nil
+}
+
+func (syndicate *Syndicate) residueHolder() string {
+	switch syndicate.RoundingRule {
+	case RoundingAgentAbsorbs:
+		return syndicate.AgentId
+	case RoundingLeadLender:
+		return syndicate.LeadLenderId
+	}
+	return ""
+}
+
+//validateRoundingRule checks the rule is known and that the member taking the residue is in
+//the syndicate; an empty rule means RoundingLargestRemainder
+func validateRoundingRule(syndicate Syndicate) error {
+	if syndicate.RoundingRule == "" {
+		return nil
+	}
+	if !containsString(roundingRules, syndicate.RoundingRule) {
+		return newError(ErrCodeInvalidArgument, "Unknown rounding rule %s", syndicate.RoundingRule)
+	}
+	if syndicate.RoundingRule == RoundingLargestRemainder {
+		return nil
+	}
+	var holder = syndicate.residueHolder()
+	for _, member := range syndicate.Members {
+		if member.ParticipantId == holder {
+			return nil
+		}
+	}
+	return newError(ErrCodeInvalidArgument, "Rounding rule %s needs %s to be a syndicate member", syndicate.RoundingRule, describeAbsorber(holder))
+}
+
+//AllocateByWeights splits total in proportion to weights, e.g. the interest each member has
+//accrued, using largest remainders for the residue. When total does not exceed the sum of the
+//weights no part exceeds its weight.
+func AllocateByWeights(total Money, weights []Money) ([]Money, error) {
+	var sum = ZeroMoney(total.Currency)
+	for _, weight := range weights {
+		if weight.IsNegative() {
+			return nil, newError(ErrCodeInvalidArgument, "Cannot allocate %s by a negative weight %s", total, weight)
+		}
+		sum = sum.Add(weight)
+	}
+	if !sum.IsPositive() {
+		return nil, newError(ErrCodeInvalidArgument, "Cannot allocate %s without a positive weight", total)
+	}
+
+	var parts = make([]Money, len(weights))
+	var remainders = make([]int64, len(weights))
+	var allocated int64
+	for i, weight := range weights {
+		var quotient, remainder = new(big.Int).QuoRem(new(big.Int).Mul(big.NewInt(total.Minor), big.NewInt(weight.Minor)), big.NewInt(sum.Minor), new(big.Int))
+		parts[i] = Money{Minor: quotient.Int64(), Currency: total.Currency}
+		remainders[i] = remainder.Int64()
+		allocated += quotient.Int64()
+	}
+	var taken = make([]bool, len(weights))
+	for residue := total.Minor - allocated; residue > 0; residue-- {
+		var next = -1
+		for i := range weights {
+			if !taken[i] && (next < 0 || remainders[i] > remainders[next]) {
+				next = i
+			}
+		}
+		taken[next] = true
+		parts[next].Minor++
+	}
+	return parts, nil
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const repaymentObjectType = "repayment"
+
+//Repayment profiles say how the deal amount is paid back
+const (
+	RepaymentBullet       = "Bullet"
+	RepaymentStraightLine = "StraightLine"
+	RepaymentAnnuity      = "Annuity"
+	RepaymentCustom       = "Custom"
+)
+
+const (
+	InstalmentDue           = "Due"
+	InstalmentPartiallyPaid = "PartiallyPaid"
+	InstalmentPaid          = "Paid"
+)
+
+//ScheduledRepayment is one principal amount of a custom repayment profile
+type ScheduledRepayment struct {
+	DueDate string `json:"dueDate"`
+	Amount  Money  `json:"amount"`
+}
+
+type RepaymentSchedule struct {
+	LoanId        string       `json:"loanId"`
+	ParticipantId string       `json:"participantId,omitempty"`
+	Profile       string       `json:"profile"`
+	Instalments   []Instalment `json:"instalments"`
+}
+
+//Instalment is a scheduled principal repayment and how much of it has been paid
+type Instalment struct {
+	Number    int    `json:"number"`
+	DueDate   string `json:"dueDate"`
+	Principal Money  `json:"principal"`
+	Paid      Money  `json:"paid"`
+	Status    string `json:"status"`
+}
+
+func repaymentKey(loanId string) string {
+	return compositeKey(repaymentObjectType, loanId)
+}
+
+//buildRepaymentSchedule returns nil for loans without a repayment profile, which are repaid
+//ad hoc. Bullet and custom profiles need the maturity, the others also a repayment frequency,
+//which defaults to the interest frequency.
+func buildRepaymentSchedule(loan *LoanApplication) (*RepaymentSchedule, error) {
+	if loan.RepaymentProfile == "" {
+		return nil, nil
+	}
+	if loan.StartDate == "" || loan.MaturityDate == "" {
+		return nil, newError(ErrCodeInvalidArgument, "Loan application %s needs a start and maturity date for a %s repayment profile", loan.ID, loan.RepaymentProfile)
+	}
+	start, err := ParseDate(loan.StartDate)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "Loan application %s start date: %v", loan.ID, err)
+	}
+	maturity, err := ParseDate(loan.MaturityDate)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "Loan application %s maturity date: %v", loan.ID, err)
+	}
+
+	var dueDates []string
+	var amounts []Money
+	switch loan.RepaymentProfile {
+	case RepaymentBullet:
+		dueDates = []string{loan.MaturityDate}
+		amounts = []Money{loan.DealAmount}
+	case RepaymentCustom:
+		var total = ZeroMoney(loan.Currency)
+		var previous = loan.StartDate
+		for _, repayment := range loan.CustomRepayments {
+			amount, err := repayment.Amount.InCurrency(loan.Currency)
+			if err != nil || !amount.IsPositive() {
+				return nil, newError(ErrCodeInvalidArgument, "Loan application %s has an invalid custom repayment of %s", loan.ID, repayment.Amount)
+			}
+			_, err = ParseDate(repayment.DueDate)
+			if err != nil || repayment.DueDate <= previous || repayment.DueDate > loan.MaturityDate {
+				return nil, newError(ErrCodeInvalidArgument, "Loan application %s custom repayments must fall in order after %s and by maturity", loan.ID, previous)
+			}
+			previous = repayment.DueDate
+			total = total.Add(amount)
+			dueDates = append(dueDates, repayment.DueDate)
+			amounts = append(amounts, amount)
+		}
+		if total.Cmp(loan.DealAmount) != 0 {
+			return nil, newError(ErrCodeInvalidArgument, "Loan application %s custom repayments total %s but the deal amount is %s", loan.ID, total, loan.DealAmount)
+		}
+	case RepaymentStraightLine, RepaymentAnnuity:
+		var frequency = loan.RepaymentFrequency
+		if frequency == "" {
+			frequency = loan.InterestFrequency
+		}
+		periods, err := GenerateInterestPeriods(start, maturity, frequency, loan.StubType)
+		if err != nil {
+			return nil, newError(ErrCodeInvalidArgument, "Loan application %s repayment dates: %v", loan.ID, err)
+		}
+		for _, period := range periods {
+			dueDates = append(dueDates, period.EndDate)
+		}
+		if loan.RepaymentProfile == RepaymentStraightLine {
+			amounts = StraightLineInstalments(loan.DealAmount, len(dueDates))
+		} else {
+			var periodRate = new(big.Rat).Mul(loan.AllInRate.Rat(), big.NewRat(int64(frequencyMonths[frequency]), 1200))
+			amounts = AnnuityInstalments(loan.DealAmount, periodRate, len(dueDates))
+		}
+	default:
+		return nil, newError(ErrCodeInvalidArgument, "Loan application %s has unknown repayment profile %s", loan.ID, loan.RepaymentProfile)
+	}
+
+	var schedule = RepaymentSchedule{LoanId: loan.ID, Profile: loan.RepaymentProfile}
+	for i := range dueDates {
+		schedule.Instalments = append(schedule.Instalments, Instalment{
+			Number:    i + 1,
+			DueDate:   dueDates[i],
+			Principal: amounts[i],
+			Paid:      ZeroMoney(loan.Currency),
+			Status:    InstalmentDue,
+		})
+	}
+	return &schedule, nil
+}
+
+//StraightLineInstalments splits total into n equal instalments; the minor units that do not
+//divide evenly are added to the final instalment
+func StraightLineInstalments(total Money, n int) []Money {
+	var instalments = make([]Money, n)
+	var each = total.MulDiv(1, int64(n))
+	for i := range instalments {
+		instalments[i] = each
+	}
+	instalments[n-1] = total.Sub(each.MulDiv(int64(n-1), 1))
+	return instalments
+}
+
+//AnnuityInstalments returns the principal parts of n equal payments of principal and interest
+//at periodRate per period. Each part is rounded to the minor unit and the final instalment
+//repays whatever is left, so the parts sum exactly to total.
+func AnnuityInstalments(total Money, periodRate *big.Rat, n int) []Money {
+	if periodRate.Sign() == 0 {
+		return StraightLineInstalments(total, n)
+	}
+	//payment = total * r / (1 - (1 + r)^-n) = total * r * g / (g - 1) with g = (1 + r)^n
+	var growth = big.NewRat(1, 1)
+	var onePlusRate = new(big.Rat).Add(big.NewRat(1, 1), periodRate)
+	for i := 0; i < n; i++ {
+		growth.Mul(growth, onePlusRate)
+	}
+	var payment = new(big.Rat).Mul(total.Rat(), periodRate)
+	payment.Mul(payment, growth)
+	payment.Quo(payment, new(big.Rat).Sub(growth, big.NewRat(1, 1)))
+
+	var instalments = make([]Money, n)
+	var balance = total
+	for i := 0; i < n-1; i++ {
+		var interest = new(big.Rat).Mul(balance.Rat(), periodRate)
+		instalments[i] = MoneyFromRat(new(big.Rat).Sub(payment, interest), total.Currency)
+		balance = balance.Sub(instalments[i])
+	}
+	instalments[n-1] = balance
+	return instalments
+}
+
+//applyRepayment pays instalments off oldest first and returns any amount left over
+func (schedule *RepaymentSchedule) applyRepayment(amount Money) Money {
+	for i := range schedule.Instalments {
+		if !amount.IsPositive() {
+			break
+		}
+		var instalment = &schedule.Instalments[i]
+		var due = instalment.Principal.Sub(instalment.Paid)
+		if !due.IsPositive() {
+			continue
+		}
+		var paid = due
+		if amount.Cmp(due) < 0 {
+			paid = amount
+		}
+		instalment.Paid = instalment.Paid.Add(paid)
+		amount = amount.Sub(paid)
+		instalment.Status = InstalmentPartiallyPaid
+		if instalment.Paid.Cmp(instalment.Principal) == 0 {
+			instalment.Status = InstalmentPaid
+		}
+	}
+	return amount
+}
+
+//applyPrepayment pays instalments off latest first, so a prepayment shortens the loan rather
+//than reducing the next instalments, and returns any amount left over
+func (schedule *RepaymentSchedule) applyPrepayment(amount Money) Money {
+	for i := len(schedule.Instalments) - 1; i >= 0 && amount.IsPositive(); i-- {
+		var instalment = &schedule.Instalments[i]
+		var due = instalment.Principal.Sub(instalment.Paid)
+		if !due.IsPositive() {
+			continue
+		}
+		var paid = due
+		if amount.Cmp(due) < 0 {
+			paid = amount
+		}
+		instalment.Paid = instalment.Paid.Add(paid)
+		amount = amount.Sub(paid)
+		instalment.Status = InstalmentPartiallyPaid
+		if instalment.Paid.Cmp(instalment.Principal) == 0 {
+			instalment.Status = InstalmentPaid
+		}
+	}
+	return amount
+}
+
+//dueBy returns the principal of instalments due on or before date that is still unpaid
+func (schedule *RepaymentSchedule) dueBy(date string, currency string) Money {
+	var due = ZeroMoney(currency)
+	for _, instalment := range schedule.Instalments {
+		if instalment.DueDate <= date {
+			due = due.Add(instalment.Principal.Sub(instalment.Paid))
+		}
+	}
+	return due
+}
+
+//forParticipant gives the participant's part of every instalment. What it was paid comes from
+//the payments' distributions, replayed against the instalments in the order received, so it
+//still holds after the shares change; what is unpaid is split by its current share. Principal
+//repaid without a recorded payment, i.e. through SettleLoanSyndication, is split by share too.
+func (schedule *RepaymentSchedule) forParticipant(syndicate *Syndicate, participantId string, payments []Payment) (*RepaymentSchedule, error) {
+	var index = -1
+	for i, member := range syndicate.Members {
+		if member.ParticipantId == participantId {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, newError(ErrCodeNotFound, "Participant %s is not in the syndicate of loan %s", participantId, schedule.LoanId)
+	}
+
+	var replay = RepaymentSchedule{LoanId: schedule.LoanId, Instalments: make([]Instalment, len(schedule.Instalments))}
+	var received = make([]Money, len(schedule.Instalments))
+	for i, instalment := range schedule.Instalments {
+		instalment.Paid = ZeroMoney(instalment.Principal.Currency)
+		replay.Instalments[i] = instalment
+		received[i] = instalment.Paid
+	}
+	var instalments = make([]SyndicateMember, len(schedule.Instalments))
+	for _, payment := range payments {
+		for _, bucket := range payment.Buckets {
+			if (bucket.Bucket != BucketScheduledPrincipal && bucket.Bucket != BucketPrepayment) || !bucket.Paid.IsPositive() {
+				continue
+			}
+			var before = make([]Money, len(replay.Instalments))
+			for i := range replay.Instalments {
+				before[i] = replay.Instalments[i].Paid
+			}
+			if bucket.Bucket == BucketScheduledPrincipal {
+				replay.applyRepayment(bucket.Paid)
+			} else {
+				replay.applyPrepayment(bucket.Paid)
+			}
+			//the participant's part is spread over the instalments as the bucket was
+			var weights = make([]int64, len(replay.Instalments))
+			var weightTotal int64
+			for i := range replay.Instalments {
+				weights[i] = replay.Instalments[i].Paid.Sub(before[i]).Minor
+				weightTotal += weights[i]
+			}
+			if weightTotal == 0 {
+				continue
+			}
+			parts, err := allocateByRule(payment.distributedTo(participantId, bucket.Bucket), instalments, weights, weightTotal, RoundingLargestRemainder, "")
+			if err != nil {
+				return nil, err
+			}
+			for i := range received {
+				received[i] = received[i].Add(parts[i])
+			}
+		}
+	}
+
+	var share = RepaymentSchedule{LoanId: schedule.LoanId, ParticipantId: participantId, Profile: schedule.Profile}
+	for i, instalment := range schedule.Instalments {
+		var recorded = replay.Instalments[i].Paid
+		rest, err := syndicate.Allocate(instalment.Principal.Sub(recorded))
+		if err != nil {
+			return nil, err
+		}
+		var unrecorded = instalment.Paid.Sub(recorded)
+		if unrecorded.IsNegative() {
+			unrecorded = ZeroMoney(unrecorded.Currency)
+		}
+		settled, err := syndicate.Allocate(unrecorded)
+		if err != nil {
+			return nil, err
+		}
+		instalment.Principal = received[i].Add(rest[index])
+		instalment.Paid = received[i].Add(settled[index])
+		share.Instalments = append(share.Instalments, instalment)
+	}
+	return &share, nil
+}
+
+//fetchRepaymentSchedule returns nil without an error when the loan has no repayment profile
+func fetchRepaymentSchedule(stub shim.ChaincodeStubInterface, loanId string) (*RepaymentSchedule, error) {
+	bytes, err := stub.GetState(repaymentKey(loanId))
+	if err != nil {
+		logger.Error("Could not fetch repayment schedule for loan "+loanId+" from ledger", err)
+		return nil, err
+	}
+	if bytes == nil {
+		return nil, nil
+	}
+	var schedule RepaymentSchedule
+	err = json.Unmarshal(bytes, &schedule)
+	if err != nil {
+		logger.Error("Could not unmarshal repayment schedule for loan "+loanId, err)
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+func saveRepaymentSchedule(stub shim.ChaincodeStubInterface, schedule *RepaymentSchedule) error {
+	bytes, err := json.Marshal(schedule)
+	if err != nil {
+		logger.Error("Could not marshal repayment schedule for loan "+schedule.LoanId, err)
+		return err
+	}
+	err = stub.PutState(repaymentKey(schedule.LoanId), bytes)
+	if err != nil {
+		logger.Error("Could not save repayment schedule for loan "+schedule.LoanId+" to ledger", err)
+		return err
+	}
+	return nil
+}
+
+//GetRepaymentSchedule returns the instalments of a loan; args are loan ID and optionally a
+//participant ID to get that participant's share of every instalment
+func GetRepaymentSchedule(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering GetRepaymentSchedule")
+	if len(args) < 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected loan application ID")
+	}
+	schedule, err := fetchRepaymentSchedule(stub, args[0])
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read repayment schedule for loan %s: %v", args[0], err)
+	}
+	if schedule == nil {
+		return nil, newError(ErrCodeNotFound, "Loan %s has no repayment schedule", args[0])
+	}
+	if len(args) > 1 && args[1] != "" {
+		syndicate, err := fetchSyndicate(stub, args[0])
+		if err != nil {
+			return nil, newError(ErrCodeNotFound, "Could not read syndicate for loan %s: %v", args[0], err)
+		}
+		payments, err := fetchPayments(stub, args[0])
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not read payments of loan %s: %v", args[0], err)
+		}
+		schedule, err = schedule.forParticipant(syndicate, args[1], payments)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(schedule)
+}
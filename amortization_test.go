@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestInstalmentProfiles(t *testing.T) {
+	var usd = func(minor int64) Money {
+		return Money{Minor: minor, Currency: "USD"}
+	}
+	var cases = []struct {
+		name     string
+		actual   []Money
+		expected []int64
+	}{
+		{"straight line", StraightLineInstalments(usd(1000000), 3), []int64{333333, 333333, 333334}},
+		{"straight line single", StraightLineInstalments(usd(1000000), 1), []int64{1000000}},
+		{"annuity", AnnuityInstalments(usd(1000000), big.NewRat(1, 100), 3), []int64{330022, 333322, 336656}},
+		{"annuity without interest", AnnuityInstalments(usd(1000000), new(big.Rat), 4), []int64{250000, 250000, 250000, 250000}},
+	}
+	for _, c := range cases {
+		if len(c.actual) != len(c.expected) {
+			t.Fatalf("%s: expected %d instalments, got %v", c.name, len(c.expected), c.actual)
+		}
+		for i := range c.actual {
+			if c.actual[i] != usd(c.expected[i]) {
+				t.Fatalf("%s: expected %v, got %v", c.name, c.expected, c.actual)
+			}
+		}
+	}
+}
+
+func TestApplyRepayment(t *testing.T) {
+	var schedule = RepaymentSchedule{LoanId: "la1", Profile: RepaymentStraightLine}
+	for i, amount := range StraightLineInstalments(NewMoney(300, "USD"), 3) {
+		schedule.Instalments = append(schedule.Instalments, Instalment{Number: i + 1, Principal: amount, Paid: ZeroMoney("USD"), Status: InstalmentDue})
+	}
+	var left = schedule.applyRepayment(NewMoney(150, "USD"))
+	if !left.IsZero() || schedule.Instalments[0].Status != InstalmentPaid || schedule.Instalments[1].Status != InstalmentPartiallyPaid || schedule.Instalments[1].Paid != NewMoney(50, "USD") {
+		t.Fatalf("Expected the oldest instalments to be paid first, got %+v", schedule.Instalments)
+	}
+	left = schedule.applyRepayment(NewMoney(200, "USD"))
+	if left != NewMoney(50, "USD") || schedule.Instalments[2].Status != InstalmentPaid {
+		t.Fatalf("Expected an overpayment to be returned, got %s and %+v", left, schedule.Instalments)
+	}
+}
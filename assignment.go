@@ -0,0 +1,517 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const assignmentObjectType = "assignment"
+
+//Assignment statuses. The seller proposes, the buyer accepts, the agent consents and then
+//settles; the agent may reject an assignment and either counterparty may withdraw it before
+//it settles.
+const (
+	AssignmentProposed  = "Proposed"
+	AssignmentAccepted  = "Accepted"
+	AssignmentConsented = "Consented"
+	AssignmentSettled   = "Settled"
+	AssignmentRejected  = "Rejected"
+	AssignmentWithdrawn = "Withdrawn"
+)
+
+var assignmentTransitions = map[string][]string{
+	AssignmentProposed:  {AssignmentAccepted, AssignmentRejected, AssignmentWithdrawn},
+	AssignmentAccepted:  {AssignmentConsented, AssignmentRejected, AssignmentWithdrawn},
+	AssignmentConsented: {AssignmentSettled, AssignmentRejected, AssignmentWithdrawn},
+}
+
+//tradableStatuses are the loan statuses in which funded positions can change hands
+var tradableStatuses = []string{StatusActive, StatusDefaulted, StatusRestructured}
+
+//Assignment moves part of a lender's commitment in a loan to another lender on the secondary
+//market. Amount is the commitment assigned and Price is in percent of par.
+type Assignment struct {
+	ID             string                `json:"id"`
+	LoanId         string                `json:"loanId"`
+	SellerId       string                `json:"sellerId"`
+	BuyerId        string                `json:"buyerId"`
+	Amount         Money                 `json:"amount"`
+	Price          Rate                  `json:"price"`
+	TradeDate      string                `json:"tradeDate"`
+	SettlementDate string                `json:"settlementDate"`
+	Status         string                `json:"status"`
+	Reason         string                `json:"reason,omitempty"`
+	Settlement     *AssignmentSettlement `json:"settlement,omitempty"`
+	TxId           string                `json:"txId"`
+}
+
+//AssignmentSettlement records what moved when an assignment settled. Interest accrued on the
+//assigned part up to the settlement date is the seller's: the buyer pays it in cash on
+//settlement and takes over the claim on the borrower, so a seller leaving the syndicate is not
+//left with interest no payment reaches. The buyer accrues from then on.
+type AssignmentSettlement struct {
+	Drawn                 Money  `json:"drawn"`
+	Undrawn               Money  `json:"undrawn"`
+	TransferredBps        int    `json:"transferredBps"`
+	SellerAccruedInterest Money  `json:"sellerAccruedInterest"`
+	Consideration         Money  `json:"consideration"`
+	TxId                  string `json:"txId"`
+}
+
+func assignmentKey(assignmentId string) string {
+	return compositeKey(assignmentObjectType, assignmentId)
+}
+
+func fetchAssignment(stub shim.ChaincodeStubInterface, assignmentId string) (*Assignment, error) {
+	bytes, err := stub.GetState(assignmentKey(assignmentId))
+	if err != nil {
+		logger.Error("Could not fetch assignment "+assignmentId+" from ledger", err)
+		return nil, err
+	}
+	if bytes == nil {
+		return nil, nil
+	}
+	var assignment Assignment
+	err = json.Unmarshal(bytes, &assignment)
+	if err != nil {
+		logger.Error("Could not unmarshal assignment "+assignmentId, err)
+		return nil, err
+	}
+	return &assignment, nil
+}
+
+func saveAssignment(stub shim.ChaincodeStubInterface, assignment *Assignment) ([]byte, error) {
+	bytes, err := json.Marshal(assignment)
+	if err != nil {
+		logger.Error("Could not marshal assignment "+assignment.ID, err)
+		return nil, err
+	}
+	err = stub.PutState(assignmentKey(assignment.ID), bytes)
+	if err != nil {
+		logger.Error("Could not save assignment "+assignment.ID+" to ledger", err)
+		return nil, err
+	}
+	return bytes, nil
+}
+
+//positionTransfer holds everything a transfer reads and changes, so it can be checked in full
+//before any of it is written
+type positionTransfer struct {
+	loan       *LoanApplication
+	syndicate  *Syndicate
+	sellerId   string
+	buyerId    string
+	seller     *Asset
+	buyer      *Asset
+	schedule   *InterestSchedule
+	commitment Money
+	settlement AssignmentSettlement
+}
+
+//checkTransfer checks that the seller can assign amount of its commitment in the loan to the
+//buyer on settlementDate, reads the positions the transfer changes and works out the new
+//syndicate shares. It accrues nothing, so a transfer settling on a date whose rates are not
+//fixed yet can still be checked.
+func checkTransfer(stub shim.ChaincodeStubInterface, loanId string, sellerId string, buyerId string, amount Money, price Rate, settlementDate string) (*positionTransfer, error) {
+	if sellerId == buyerId {
+		return nil, newError(ErrCodeInvalidArgument, "Participant %s cannot assign to itself", sellerId)
+	}
+	_, err := ParseDate(settlementDate)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "Invalid settlement date: %v", err)
+	}
+	if !price.IsPositive() {
+		return nil, newError(ErrCodeInvalidArgument, "Price %s must be positive", price)
+	}
+	loan, err := fetchLoan(stub, loanId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read loan application %s: %v", loanId, err)
+	}
+	if loan == nil {
+		return nil, newError(ErrCodeNotFound, "Loan application %s not found", loanId)
+	}
+	if !containsString(tradableStatuses, loan.Status) {
+		return nil, newError(ErrCodeFailedPrecondition, "Positions in loan %s cannot be assigned in status %s", loanId, loan.Status)
+	}
+	if amount.Currency != loan.Currency {
+		return nil, newError(ErrCodeInvalidArgument, "Assignment of %s is not in the loan currency %s", amount, loan.Currency)
+	}
+	if !amount.IsPositive() {
+		return nil, newError(ErrCodeInvalidArgument, "Assignment amount %s must be positive", amount)
+	}
+	buyer, err := fetchParticipant(stub, buyerId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read participant %s: %v", buyerId, err)
+	}
+	err = validateLender(buyer, buyerId)
+	if err != nil {
+		return nil, err
+	}
+	syndicate, err := fetchSyndicate(stub, loanId)
+	if err != nil {
+		return nil, newError(ErrCodeFailedPrecondition, "Loan %s has no syndicate: %v", loanId, err)
+	}
+
+	var transfer = positionTransfer{loan: loan, syndicate: syndicate, sellerId: sellerId, buyerId: buyerId}
+	transfer.seller, err = fetchPosition(stub, sellerId, loanId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read position of %s in loan %s: %v", sellerId, loanId, err)
+	}
+	if transfer.seller == nil {
+		return nil, newError(ErrCodeNotFound, "Participant %s holds no position in loan %s", sellerId, loanId)
+	}
+	transfer.buyer, err = fetchPosition(stub, buyerId, loanId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read position of %s in loan %s: %v", buyerId, loanId, err)
+	}
+	if transfer.buyer == nil {
+		transfer.buyer = &Asset{
+			AssetId:          loanId,
+			Currency:         loan.Currency,
+			ShareAmount:      ZeroMoney(loan.Currency),
+			SyndicatedAmount: ZeroMoney(loan.Currency),
+			AccruedInterest:  ZeroMoney(loan.Currency),
+			AccrualDate:      settlementDate,
+			Commitment:       ZeroMoney(loan.Currency),
+			Undrawn:          ZeroMoney(loan.Currency),
+		}
+	}
+	for _, position := range []*Asset{transfer.seller, transfer.buyer} {
+		err = position.normalizeCurrency(loan.Currency)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	exposure, err := positionExposure(loan, transfer.seller)
+	if err != nil {
+		return nil, err
+	}
+	var commitment = exposure.Commitment
+	if amount.Cmp(commitment) > 0 {
+		return nil, newError(ErrCodeFailedPrecondition, "Participant %s cannot assign %s of its %s commitment in loan %s", sellerId, amount, commitment, loanId)
+	}
+	if transfer.seller.AccrualDate == "" {
+		return nil, newError(ErrCodeFailedPrecondition, "Position of %s in loan %s has no accrual date to accrue interest from", sellerId, loanId)
+	}
+	transfer.commitment = commitment
+
+	transfer.settlement.TransferredBps, err = transferShare(syndicate, sellerId, buyerId, amount, loan.DealAmount)
+	if err != nil {
+		return nil, err
+	}
+	return &transfer, nil
+}
+
+//prepareTransfer checks a transfer as checkTransfer does and works out the new positions on
+//settlementDate. Both positions are accrued to the settlement date first and the interest
+//accrued on the assigned part moves to the buyer, who pays the seller for it.
+func prepareTransfer(stub shim.ChaincodeStubInterface, loanId string, sellerId string, buyerId string, amount Money, price Rate, settlementDate string) (*positionTransfer, error) {
+	transfer, err := checkTransfer(stub, loanId, sellerId, buyerId, amount, price, settlementDate)
+	if err != nil {
+		return nil, err
+	}
+	var loan, commitment = transfer.loan, transfer.commitment
+
+	//accrue both positions to the settlement date before their shares change
+	transfer.schedule, err = fetchInterestSchedule(stub, loanId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read interest schedule for loan %s: %v", loanId, err)
+	}
+	for _, position := range []struct {
+		participantId string
+		asset         *Asset
+	}{{sellerId, transfer.seller}, {buyerId, transfer.buyer}} {
+		interest, err := accrueSince(stub, transfer.schedule, loan, position.participantId, position.asset, settlementDate)
+		if err != nil {
+			return nil, err
+		}
+		position.asset.AccruedInterest = position.asset.AccruedInterest.Add(interest)
+	}
+
+	var settlement = &transfer.settlement
+	settlement.Drawn = transfer.seller.ShareAmount
+	settlement.Undrawn = transfer.seller.Undrawn
+	settlement.SellerAccruedInterest = transfer.seller.AccruedInterest
+	if amount.Cmp(commitment) < 0 {
+		settlement.Drawn = transfer.seller.ShareAmount.MulDiv(amount.Minor, commitment.Minor)
+		settlement.Undrawn = transfer.seller.Undrawn.MulDiv(amount.Minor, commitment.Minor)
+		settlement.SellerAccruedInterest = transfer.seller.AccruedInterest.MulDiv(amount.Minor, commitment.Minor)
+	}
+	var consideration = new(big.Rat).Mul(settlement.Drawn.Rat(), price.Rat())
+	settlement.Consideration = MoneyFromRat(consideration.Quo(consideration, big.NewRat(100, 1)), loan.Currency)
+
+	transfer.seller.AccruedInterest = transfer.seller.AccruedInterest.Sub(settlement.SellerAccruedInterest)
+	transfer.buyer.AccruedInterest = transfer.buyer.AccruedInterest.Add(settlement.SellerAccruedInterest)
+	transfer.seller.Commitment = commitment.Sub(amount)
+	transfer.seller.ShareAmount = transfer.seller.ShareAmount.Sub(settlement.Drawn)
+	transfer.seller.Undrawn = transfer.seller.Undrawn.Sub(settlement.Undrawn)
+	transfer.buyer.Commitment = transfer.buyer.Commitment.Add(amount)
+	transfer.buyer.ShareAmount = transfer.buyer.ShareAmount.Add(settlement.Drawn)
+	transfer.buyer.Undrawn = transfer.buyer.Undrawn.Add(settlement.Undrawn)
+	return transfer, nil
+}
+
+//transferShare moves amount of commitment and its share from seller to buyer in the syndicate,
+//dropping the seller once nothing is left, and returns the basis points moved. All shares are
+//derived again from the new commitments.
+func transferShare(syndicate *Syndicate, sellerId string, buyerId string, amount Money, dealAmount Money) (int, error) {
+	var members []SyndicateMember
+	var sellerBps, buyerFound = 0, false
+	for _, member := range syndicate.Members {
+		switch member.ParticipantId {
+		case sellerId:
+			sellerBps = member.ShareBps
+			member.CommitmentAmount = member.CommitmentAmount.Sub(amount)
+			if member.CommitmentAmount.IsNegative() {
+				return 0, newError(ErrCodeFailedPrecondition, "Participant %s commits less than %s to loan %s", sellerId, amount, syndicate.LoanId)
+			}
+			if member.CommitmentAmount.IsZero() {
+				continue
+			}
+		case buyerId:
+			buyerFound = true
+			member.CommitmentAmount = member.CommitmentAmount.Add(amount)
+		default:
+			members = append(members, member)
+			continue
+		}
+		//the share is derived again below
+		member.ShareBps = 0
+		members = append(members, member)
+	}
+	if sellerBps == 0 {
+		return 0, newError(ErrCodeFailedPrecondition, "Participant %s is not in the syndicate of loan %s", sellerId, syndicate.LoanId)
+	}
+	if !buyerFound {
+		members = append(members, SyndicateMember{ParticipantId: buyerId, CommitmentAmount: amount})
+	}
+
+	var updated = *syndicate
+	updated.Members = members
+	err := updated.deriveShares()
+	if err == nil {
+		err = validateSyndicate(updated, dealAmount)
+	}
+	if err != nil {
+		return 0, newError(ErrCodeFailedPrecondition, "Assigning %s from %s to %s would leave an invalid syndicate: %v", amount, sellerId, buyerId, err)
+	}
+	var transferred = sellerBps
+	for _, member := range members {
+		if member.ParticipantId == sellerId {
+			transferred = sellerBps - member.ShareBps
+		}
+	}
+	syndicate.Members = members
+	return transferred, nil
+}
+
+//save writes both positions, the syndicate and the interest accrued to the settlement date
+func (transfer *positionTransfer) save(stub shim.ChaincodeStubInterface) error {
+	for _, position := range []struct {
+		participantId string
+		asset         *Asset
+	}{{transfer.sellerId, transfer.seller}, {transfer.buyerId, transfer.buyer}} {
+		err := savePosition(stub, position.participantId, position.asset)
+		if err != nil {
+			return newError(ErrCodeLedger, "Could not save position of %s in loan %s: %v", position.participantId, transfer.loan.ID, err)
+		}
+	}
+	err := saveSyndicate(stub, transfer.syndicate)
+	if err != nil {
+		return newError(ErrCodeLedger, "Could not save syndicate of loan %s: %v", transfer.loan.ID, err)
+	}
+	if transfer.schedule != nil {
+		_, err = saveInterestSchedule(stub, transfer.schedule)
+		if err != nil {
+			return newError(ErrCodeLedger, "Could not save interest schedule for loan %s: %v", transfer.loan.ID, err)
+		}
+	}
+	return nil
+}
+
+//ProposeAssignment records a seller's offer to assign part of its commitment; args are the
+//assignment JSON with loanId, sellerId, buyerId, amount, price, tradeDate and settlementDate
+func ProposeAssignment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering ProposeAssignment")
+	if len(args) < 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected assignment")
+	}
+	var assignment Assignment
+	err := json.Unmarshal([]byte(args[0]), &assignment)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "Could not parse assignment: %v", err)
+	}
+	tradeDate, err := ParseDate(assignment.TradeDate)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "Invalid trade date: %v", err)
+	}
+	settlementDate, err := ParseDate(assignment.SettlementDate)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "Invalid settlement date: %v", err)
+	}
+	if settlementDate.Before(tradeDate) {
+		return nil, newError(ErrCodeInvalidArgument, "Assignment settles on %s before its trade date %s", assignment.SettlementDate, assignment.TradeDate)
+	}
+	loan, err := fetchLoan(stub, assignment.LoanId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read loan application %s: %v", assignment.LoanId, err)
+	}
+	if loan == nil {
+		return nil, newError(ErrCodeNotFound, "Loan application %s not found", assignment.LoanId)
+	}
+	assignment.Amount, err = assignment.Amount.InCurrency(loan.Currency)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "%v", err)
+	}
+	//the transfer is checked now and accrued only when the assignment settles
+	_, err = checkTransfer(stub, assignment.LoanId, assignment.SellerId, assignment.BuyerId, assignment.Amount, assignment.Price, assignment.SettlementDate)
+	if err != nil {
+		return nil, err
+	}
+
+	assignment.ID, err = NextID(stub, AssignmentIdPrefix, assignmentKey)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not allocate an assignment ID: %v", err)
+	}
+	assignment.Status = AssignmentProposed
+	assignment.Reason = ""
+	assignment.Settlement = nil
+	assignment.TxId = stub.GetTxID()
+	return writeAssignment(stub, &assignment, "assignment"+AssignmentProposed)
+}
+
+//AcceptAssignment records the buyer's agreement; args are assignment ID and buyer ID
+func AcceptAssignment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering AcceptAssignment")
+	if len(args) < 2 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected assignment ID and buyer ID")
+	}
+	return transitionAssignment(stub, args[0], AssignmentAccepted, func(assignment *Assignment) error {
+		if assignment.BuyerId != args[1] {
+			return newError(ErrCodeAccessDenied, "Only buyer %s can accept assignment %s", assignment.BuyerId, assignment.ID)
+		}
+		return nil
+	})
+}
+
+//ConsentAssignment records the agent's consent to an accepted assignment; args are assignment ID
+func ConsentAssignment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering ConsentAssignment")
+	if len(args) < 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected assignment ID")
+	}
+	return transitionAssignment(stub, args[0], AssignmentConsented, nil)
+}
+
+//RejectAssignment lets the agent refuse an assignment; args are assignment ID and reason
+func RejectAssignment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering RejectAssignment")
+	if len(args) < 2 || args[1] == "" {
+		return nil, newError(ErrCodeInvalidArgument, "Expected assignment ID and reason")
+	}
+	return transitionAssignment(stub, args[0], AssignmentRejected, func(assignment *Assignment) error {
+		assignment.Reason = args[1]
+		return nil
+	})
+}
+
+//WithdrawAssignment lets the seller or buyer call an assignment off before it settles; args are
+//assignment ID and the withdrawing participant ID
+func WithdrawAssignment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering WithdrawAssignment")
+	if len(args) < 2 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected assignment ID and participant ID")
+	}
+	return transitionAssignment(stub, args[0], AssignmentWithdrawn, func(assignment *Assignment) error {
+		if args[1] != assignment.SellerId && args[1] != assignment.BuyerId {
+			return newError(ErrCodeAccessDenied, "Only %s or %s can withdraw assignment %s", assignment.SellerId, assignment.BuyerId, assignment.ID)
+		}
+		assignment.Reason = "Withdrawn by " + args[1]
+		return nil
+	})
+}
+
+//SettleAssignment transfers the positions and syndicate share of a consented assignment on its
+//settlement date; args are assignment ID. Positions and syndicate are written together only
+//once every check has passed.
+func SettleAssignment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering SettleAssignment")
+	if len(args) < 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected assignment ID")
+	}
+	var transfer *positionTransfer
+	return transitionAssignment(stub, args[0], AssignmentSettled, func(assignment *Assignment) error {
+		var err error
+		transfer, err = prepareTransfer(stub, assignment.LoanId, assignment.SellerId, assignment.BuyerId, assignment.Amount, assignment.Price, assignment.SettlementDate)
+		if err != nil {
+			return err
+		}
+		err = transfer.save(stub)
+		if err != nil {
+			return err
+		}
+		transfer.settlement.TxId = stub.GetTxID()
+		assignment.Settlement = &transfer.settlement
+		return nil
+	})
+}
+
+//GetAssignment returns an assignment; args are assignment ID and optionally the participant
+//asking, who must be the seller or the buyer
+func GetAssignment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering GetAssignment")
+	if len(args) < 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected assignment ID")
+	}
+	assignment, err := fetchAssignment(stub, args[0])
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read assignment %s: %v", args[0], err)
+	}
+	if assignment == nil {
+		return nil, newError(ErrCodeNotFound, "Assignment %s not found", args[0])
+	}
+	if len(args) > 1 && args[1] != "" && args[1] != assignment.SellerId && args[1] != assignment.BuyerId {
+		return nil, newError(ErrCodeAccessDenied, "Participant %s is not a party to assignment %s", args[1], assignment.ID)
+	}
+	return json.Marshal(assignment)
+}
+
+//transitionAssignment moves an assignment to status when allowed from its current status,
+//running apply first so it can check or change the assignment
+func transitionAssignment(stub shim.ChaincodeStubInterface, assignmentId string, status string, apply func(assignment *Assignment) error) ([]byte, error) {
+	assignment, err := fetchAssignment(stub, assignmentId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read assignment %s: %v", assignmentId, err)
+	}
+	if assignment == nil {
+		return nil, newError(ErrCodeNotFound, "Assignment %s not found", assignmentId)
+	}
+	if !containsString(assignmentTransitions[assignment.Status], status) {
+		return nil, newError(ErrCodeIllegalTransition, "Assignment %s cannot move from %s to %s", assignmentId, assignment.Status, status)
+	}
+	if apply != nil {
+		err = apply(assignment)
+		if err != nil {
+			return nil, err
+		}
+	}
+	assignment.Status = status
+	assignment.TxId = stub.GetTxID()
+	return writeAssignment(stub, assignment, "assignment"+status)
+}
+
+func writeAssignment(stub shim.ChaincodeStubInterface, assignment *Assignment, eventType string) ([]byte, error) {
+	bytes, err := saveAssignment(stub, assignment)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not save assignment %s: %v", assignment.ID, err)
+	}
+	err = setEvent(stub, eventType, string(bytes))
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Assignment " + assignment.ID + " is " + assignment.Status)
+	return bytes, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Authorizer decides whether the caller of a transaction may run a function. SampleChaincode
+//uses RoleAuthorizer unless another implementation is plugged in.
+type Authorizer interface {
+	Authorize(stub shim.ChaincodeStubInterface, function string, args []string) error
+}
+
+//Caller is the identity read from the transaction certificate attributes
+type Caller struct {
+	Username      string
+	Role          string
+	ParticipantId string
+}
+
+//FunctionPolicy lists the roles allowed to call a function. When OwnParticipant is set,
+//lenders may only call it for the participant ID it returns from the arguments.
+type FunctionPolicy struct {
+	Roles          []string
+	OwnParticipant func(args []string) string
+}
+
+//RoleAuthorizer enforces a FunctionPolicy per function; functions without a policy are denied
+type RoleAuthorizer struct {
+	Policies map[string]FunctionPolicy
+}
+
+var agentOnly = FunctionPolicy{Roles: []string{RoleAgentBank}}
+
+var loanReaders = FunctionPolicy{Roles: []string{RoleAgentBank, RoleLender, RoleBorrower, RoleAuditor, RoleRegulator}}
+
+var rateFixingPublishers = FunctionPolicy{Roles: []string{RoleRatePublisher}}
+
+var rateFixingReaders = FunctionPolicy{Roles: []string{RoleAgentBank, RoleLender, RoleBorrower, RoleAuditor, RoleRegulator, RoleRatePublisher}}
+
+var positionReaders = func(ownParticipant func(args []string) string) FunctionPolicy {
+	return FunctionPolicy{Roles: []string{RoleAgentBank, RoleLender, RoleAuditor, RoleRegulator}, OwnParticipant: ownParticipant}
+}
+
+//counterpartyActions lets the agent act for anyone and a lender act only for itself
+var counterpartyActions = func(ownParticipant func(args []string) string) FunctionPolicy {
+	return FunctionPolicy{Roles: []string{RoleAgentBank, RoleLender}, OwnParticipant: ownParticipant}
+}
+
+var defaultPolicies = map[string]FunctionPolicy{
+	"CreateLoanParticipation":   agentOnly,
+	"SettleLoanSyndication":     agentOnly,
+	"RegisterParticipant":       agentOnly,
+	"UpdateParticipant":         agentOnly,
+	"DeactivateParticipant":     agentOnly,
+	"MigrateLoanList":           agentOnly,
+	"MigrateAmounts":            agentOnly,
+	"ReviewLoan":                agentOnly,
+	"ApproveLoan":               agentOnly,
+	"SyndicateLoan":             agentOnly,
+	"ActivateLoan":              agentOnly,
+	"MarkLoanRepaid":            agentOnly,
+	"DefaultLoan":               agentOnly,
+	"RestructureLoan":           agentOnly,
+	"CancelLoan":                agentOnly,
+	"AccrueInterest":            agentOnly,
+	"PublishRateFixing":         rateFixingPublishers,
+	"TransitionBenchmark":       agentOnly,
+	"ReceivePayment":            agentOnly,
+	"DefineFee":                 agentOnly,
+	"AccrueFee":                 agentOnly,
+	"InvoiceFee":                agentOnly,
+	"Drawdown":                  agentOnly,
+	"Repay":                     agentOnly,
+	"Redraw":                    agentOnly,
+	"CreateDeal":                agentOnly,
+	"PublishFxRate":             rateFixingPublishers,
+	"ProposeAssignment":         counterpartyActions(assignmentSeller),
+	"AcceptAssignment":          counterpartyActions(secondArg),
+	"WithdrawAssignment":        counterpartyActions(secondArg),
+	"ConsentAssignment":         agentOnly,
+	"RejectAssignment":          agentOnly,
+	"SettleAssignment":          agentOnly,
+	"CreateSubParticipation":    counterpartyActions(subParticipationGrantor),
+	"TerminateSubParticipation": counterpartyActions(secondArg),
+	"SubmitTradeConfirmation":   counterpartyActions(tradeSubmitter),
+	"ApproveTrade":              agentOnly,
+	"SettleTrade":               agentOnly,
+	"CancelTrade":               counterpartyActions(secondArg),
+
+	"GetLoanApplication":      loanReaders,
+	"GetSyndicate":            positionReaders(secondArg),
+	"GetLoanParticipant":      positionReaders(firstArg),
+	"GetParticipatedLoans":    positionReaders(firstArg),
+	"QueryLoans":              positionReaders(queryParticipant),
+	"GetInterestSchedule":     positionReaders(secondArg),
+	"GetRateFixing":           rateFixingReaders,
+	"GetRepaymentSchedule":    positionReaders(secondArg),
+	"GetPayments":             positionReaders(secondArg),
+	"GetFeeLedger":            positionReaders(secondArg),
+	"GetDeal":                 loanReaders,
+	"GetDealExposure":         positionReaders(secondArg),
+	"GetFxRate":               rateFixingReaders,
+	"GetPositionReport":       positionReaders(firstArg),
+	"GetAssignment":           positionReaders(secondArg),
+	"GetSubParticipations":    positionReaders(secondArg),
+	"GetTrade":                positionReaders(secondArg),
+	"CalculateTradeEconomics": positionReaders(thirdArg),
+}
+
+func NewRoleAuthorizer() *RoleAuthorizer {
+	return &RoleAuthorizer{Policies: defaultPolicies}
+}
+
+func (a *RoleAuthorizer) Authorize(stub shim.ChaincodeStubInterface, function string, args []string) error {
+	caller := GetCaller(stub)
+
+	policy, ok := a.Policies[function]
+	if !ok {
+		return accessDenied(caller, function)
+	}
+	if !containsString(policy.Roles, caller.Role) {
+		return accessDenied(caller, function)
+	}
+	if caller.Role == RoleLender && policy.OwnParticipant != nil {
+		if caller.ParticipantId == "" || policy.OwnParticipant(args) != caller.ParticipantId {
+			return newError(ErrCodeAccessDenied, "%s may only act for participant %s", caller.Username, caller.ParticipantId)
+		}
+	}
+	return nil
+}
+
+//GetCaller reads the caller attributes; missing attributes are left empty so that they
+//fail the role checks rather than the transaction
+func GetCaller(stub shim.ChaincodeStubInterface) Caller {
+	var caller Caller
+	caller.Username, _ = GetCertAttribute(stub, "username")
+	caller.Role, _ = GetCertAttribute(stub, "role")
+	caller.ParticipantId, _ = GetCertAttribute(stub, "participantId")
+	return caller
+}
+
+func accessDenied(caller Caller, function string) error {
+	return newError(ErrCodeAccessDenied, "%s with role %s does not have access to %s", caller.Username, caller.Role, function)
+}
+
+func firstArg(args []string) string {
+	if len(args) < 1 {
+		return ""
+	}
+	return args[0]
+}
+
+func secondArg(args []string) string {
+	if len(args) < 2 {
+		return ""
+	}
+	return args[1]
+}
+
+func thirdArg(args []string) string {
+	if len(args) < 3 {
+		return ""
+	}
+	return args[2]
+}
+
+//queryParticipant returns the participant filter of a QueryLoans request
+func queryParticipant(args []string) string {
+	var query LoanQuery
+	if len(args) < 1 || json.Unmarshal([]byte(args[0]), &query) != nil {
+		return ""
+	}
+	return query.ParticipantId
+}
+
+//assignmentSeller returns the seller of a ProposeAssignment request
+func assignmentSeller(args []string) string {
+	var assignment Assignment
+	if len(args) < 1 || json.Unmarshal([]byte(args[0]), &assignment) != nil {
+		return ""
+	}
+	return assignment.SellerId
+}
+
+//subParticipationGrantor returns the grantor of a CreateSubParticipation request
+func subParticipationGrantor(args []string) string {
+	var subParticipation SubParticipation
+	if len(args) < 1 || json.Unmarshal([]byte(args[0]), &subParticipation) != nil {
+		return ""
+	}
+	return subParticipation.GrantorId
+}
+
+//tradeSubmitter returns the participant whose side a SubmitTradeConfirmation request confirms
+func tradeSubmitter(args []string) string {
+	var confirmation TradeConfirmation
+	if len(args) < 2 || json.Unmarshal([]byte(args[1]), &confirmation) != nil {
+		return ""
+	}
+	return confirmation.submitter()
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
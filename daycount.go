@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"time"
+)
+
+//Day-count conventions name how the days of an accrual period are turned into a year fraction
+const (
+	DayCountAct360     = "ACT/360"
+	DayCountAct365F    = "ACT/365F"
+	DayCount30360      = "30/360"
+	DayCount30E360     = "30E/360"
+	DayCountActActISDA = "ACT/ACT ISDA"
+)
+
+//DefaultDayCountConvention matches the Actual/365 basis used before loans carried a convention
+const DefaultDayCountConvention = DayCountAct365F
+
+var dayCountConventions = []string{DayCountAct360, DayCountAct365F, DayCount30360, DayCount30E360, DayCountActActISDA}
+
+//DateLayout is the layout of every business date on the ledger, e.g. value and accrual dates
+const DateLayout = "2006-01-02"
+
+func ParseDate(text string) (time.Time, error) {
+	date, err := time.Parse(DateLayout, text)
+	if err != nil {
+		return time.Time{}, errors.New("Invalid date '" + text + "', expected YYYY-MM-DD")
+	}
+	return date, nil
+}
+
+func isValidDayCountConvention(convention string) bool {
+	return containsString(dayCountConventions, convention)
+}
+
+//actualDays counts calendar days from start up to but excluding end
+func actualDays(start time.Time, end time.Time) int {
+	var from = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	var to = time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, time.UTC)
+	return int(to.Sub(from).Hours() / 24)
+}
+
+func isLeapYear(year int) bool {
+	return year%4 == 0 && (year%100 != 0 || year%400 == 0)
+}
+
+//DayCount returns the number of days in the period as counted by the convention
+func DayCount(convention string, start time.Time, end time.Time) (int, error) {
+	if end.Before(start) {
+		return 0, errors.New("Accrual period ends " + end.Format(DateLayout) + " before it starts " + start.Format(DateLayout))
+	}
+	var d1, d2 = start.Day(), end.Day()
+	switch convention {
+	case DayCountAct360, DayCountAct365F, DayCountActActISDA:
+		return actualDays(start, end), nil
+	case DayCount30360:
+		//30/360 bond basis: the end day is only cut to 30 when the start day already was
+		if d1 == 31 {
+			d1 = 30
+		}
+		if d2 == 31 && d1 == 30 {
+			d2 = 30
+		}
+	case DayCount30E360:
+		if d1 == 31 {
+			d1 = 30
+		}
+		if d2 == 31 {
+			d2 = 30
+		}
+	default:
+		return 0, errors.New("Unknown day-count convention " + convention)
+	}
+	return 360*(end.Year()-start.Year()) + 30*(int(end.Month())-int(start.Month())) + d2 - d1, nil
+}
+
+//YearFraction returns the period as an exact fraction of a year under the convention
+func YearFraction(convention string, start time.Time, end time.Time) (*big.Rat, error) {
+	days, err := DayCount(convention, start, end)
+	if err != nil {
+		return nil, err
+	}
+	switch convention {
+	case DayCountAct360, DayCount30360, DayCount30E360:
+		return big.NewRat(int64(days), 360), nil
+	case DayCountAct365F:
+		return big.NewRat(int64(days), 365), nil
+	}
+
+	//ACT/ACT ISDA splits the period at year ends and divides each part by the length of its year
+	var fraction = new(big.Rat)
+	for from := start; from.Before(end); {
+		var yearEnd = time.Date(from.Year()+1, time.January, 1, 0, 0, 0, 0, time.UTC)
+		var to = end
+		if yearEnd.Before(end) {
+			to = yearEnd
+		}
+		var basis int64 = 365
+		if isLeapYear(from.Year()) {
+			basis = 366
+		}
+		fraction.Add(fraction, big.NewRat(int64(actualDays(from, to)), basis))
+		from = to
+	}
+	return fraction, nil
+}
+
+//AccruedInterest returns principal * ratePercent/100 * year fraction, rounded to the minor unit
+func AccruedInterest(principal Money, ratePercent *big.Rat, convention string, start time.Time, end time.Time) (Money, error) {
+	fraction, err := YearFraction(convention, start, end)
+	if err != nil {
+		return Money{}, err
+	}
+	var interest = new(big.Rat).Mul(principal.Rat(), ratePercent)
+	interest.Mul(interest, fraction)
+	interest.Quo(interest, big.NewRat(100, 1))
+	return MoneyFromRat(interest, principal.Currency), nil
+}
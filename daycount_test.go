@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestYearFraction(t *testing.T) {
+	var cases = []struct {
+		convention string
+		start      string
+		end        string
+		days       int
+		fraction   *big.Rat
+	}{
+		{DayCountAct360, "2017-01-15", "2017-04-15", 90, big.NewRat(90, 360)},
+		{DayCountAct360, "2016-02-01", "2016-03-01", 29, big.NewRat(29, 360)},
+		{DayCountAct365F, "2016-01-01", "2017-01-01", 366, big.NewRat(366, 365)},
+		{DayCountAct365F, "2017-01-15", "2017-02-14", 30, big.NewRat(30, 365)},
+		{DayCount30360, "2017-01-31", "2017-03-31", 60, big.NewRat(60, 360)},
+		{DayCount30360, "2017-01-30", "2017-03-31", 60, big.NewRat(60, 360)},
+		{DayCount30360, "2017-01-29", "2017-03-31", 62, big.NewRat(62, 360)},
+		{DayCount30360, "2017-02-28", "2017-03-31", 33, big.NewRat(33, 360)},
+		{DayCount30E360, "2017-01-29", "2017-03-31", 61, big.NewRat(61, 360)},
+		{DayCount30E360, "2017-01-31", "2017-02-28", 28, big.NewRat(28, 360)},
+		{DayCountActActISDA, "2017-01-01", "2018-01-01", 365, big.NewRat(1, 1)},
+		{DayCountActActISDA, "2015-12-15", "2016-01-15", 31, new(big.Rat).Add(big.NewRat(17, 365), big.NewRat(14, 366))},
+		{DayCountActActISDA, "2016-07-01", "2018-07-01", 730, new(big.Rat).Add(new(big.Rat).Add(big.NewRat(184, 366), big.NewRat(1, 1)), big.NewRat(181, 365))},
+		{DayCountAct360, "2017-05-05", "2017-05-05", 0, new(big.Rat)},
+	}
+	for _, c := range cases {
+		start, _ := ParseDate(c.start)
+		end, _ := ParseDate(c.end)
+		days, err := DayCount(c.convention, start, end)
+		if err != nil || days != c.days {
+			t.Fatalf("%s %s to %s: expected %d days, got %d (%v)", c.convention, c.start, c.end, c.days, days, err)
+		}
+		fraction, err := YearFraction(c.convention, start, end)
+		if err != nil || fraction.Cmp(c.fraction) != 0 {
+			t.Fatalf("%s %s to %s: expected %s, got %s (%v)", c.convention, c.start, c.end, c.fraction, fraction, err)
+		}
+	}
+}
+
+func TestYearFractionRejectsBadInput(t *testing.T) {
+	start, _ := ParseDate("2017-03-01")
+	end, _ := ParseDate("2017-02-01")
+	if _, err := YearFraction(DayCountAct360, start, end); err == nil {
+		t.Fatalf("Expected a period ending before it starts to be refused")
+	}
+	if _, err := YearFraction("ACT/999", end, start); err == nil {
+		t.Fatalf("Expected an unknown convention to be refused")
+	}
+	if _, err := ParseDate("01/02/2017"); err == nil {
+		t.Fatalf("Expected a non ISO date to be refused")
+	}
+}
+
+func TestAccruedInterest(t *testing.T) {
+	var cases = []struct {
+		convention string
+		expected   string
+	}{
+		//32000 at 5% from 2017-01-31 to 2017-04-30: 89 actual days, 90 days on both 30/360 bases
+		{DayCountAct360, "395.56 USD"},
+		{DayCountAct365F, "390.14 USD"},
+		{DayCount30360, "400.00 USD"},
+		{DayCount30E360, "400.00 USD"},
+		{DayCountActActISDA, "390.14 USD"},
+	}
+	start, _ := ParseDate("2017-01-31")
+	end, _ := ParseDate("2017-04-30")
+	for _, c := range cases {
+		interest, err := AccruedInterest(NewMoney(32000, "USD"), big.NewRat(5, 1), c.convention, start, end)
+		if err != nil || interest.String() != c.expected {
+			t.Fatalf("%s: expected %s, got %s (%v)", c.convention, c.expected, interest, err)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const dealObjectType = "deal"
+
+//Deal is a credit agreement grouping tranches such as a Term Loan A, a Term Loan B and a
+//revolver. Every tranche is a loan application with its own currency, rate terms, schedules
+//and syndicate; tranches join the deal when they are created with its deal ID.
+type Deal struct {
+	ID         string        `json:"id"`
+	Name       string        `json:"name"`
+	BorrowerId string        `json:"borrowerId,omitempty"`
+	AgentId    string        `json:"agentId,omitempty"`
+	Tranches   []DealTranche `json:"tranches"`
+	TxId       string        `json:"txId"`
+}
+
+type DealTranche struct {
+	LoanId string `json:"loanId"`
+	Name   string `json:"name"`
+}
+
+//Exposure totals commitments in one currency
+type Exposure struct {
+	Currency   string `json:"currency"`
+	Commitment Money  `json:"commitment"`
+	Drawn      Money  `json:"drawn"`
+	Undrawn    Money  `json:"undrawn"`
+}
+
+//TrancheExposure is the exposure to a single loan, either the whole loan or one participant's
+//position in it
+type TrancheExposure struct {
+	LoanId       string `json:"loanId"`
+	DealId       string `json:"dealId,omitempty"`
+	Tranche      string `json:"tranche,omitempty"`
+	FacilityType string `json:"facilityType"`
+	Status       string `json:"status"`
+	Exposure
+}
+
+//DealExposure rolls tranche exposures up to their deal, with one total per currency. Loans
+//outside any deal are rolled up under an empty deal ID.
+type DealExposure struct {
+	DealId        string            `json:"dealId"`
+	Name          string            `json:"name,omitempty"`
+	ParticipantId string            `json:"participantId,omitempty"`
+	Tranches      []TrancheExposure `json:"tranches"`
+	Totals        []Exposure        `json:"totals"`
+}
+
+func dealKey(dealId string) string {
+	return compositeKey(dealObjectType, dealId)
+}
+
+//fetchDeal returns nil without an error when the deal is not on the ledger
+func fetchDeal(stub shim.ChaincodeStubInterface, dealId string) (*Deal, error) {
+	bytes, err := stub.GetState(dealKey(dealId))
+	if err != nil {
+		logger.Error("Could not fetch deal "+dealId+" from ledger", err)
+		return nil, err
+	}
+	if bytes == nil {
+		return nil, nil
+	}
+	var deal Deal
+	err = json.Unmarshal(bytes, &deal)
+	if err != nil {
+		logger.Error("Could not unmarshal deal "+dealId, err)
+		return nil, err
+	}
+	return &deal, nil
+}
+
+func saveDeal(stub shim.ChaincodeStubInterface, deal *Deal) ([]byte, error) {
+	bytes, err := json.Marshal(deal)
+	if err != nil {
+		logger.Error("Could not marshal deal "+deal.ID, err)
+		return nil, err
+	}
+	err = stub.PutState(dealKey(deal.ID), bytes)
+	if err != nil {
+		logger.Error("Could not save deal "+deal.ID+" to ledger", err)
+		return nil, err
+	}
+	return bytes, nil
+}
+
+//CreateDeal records a credit agreement that tranches can then be created under; args are deal
+//ID and the deal JSON. An empty deal ID is allocated with NextID.
+func CreateDeal(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering CreateDeal")
+	if len(args) < 2 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected deal ID and deal")
+	}
+	var deal Deal
+	err := json.Unmarshal([]byte(args[1]), &deal)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "Could not parse deal: %v", err)
+	}
+	var dealId = args[0]
+	if dealId == "" {
+		dealId = deal.ID
+	}
+	if deal.ID != "" && deal.ID != dealId {
+		return nil, newError(ErrCodeInvalidArgument, "Deal ID %s does not match argument %s", deal.ID, dealId)
+	}
+	if dealId != "" {
+		err = validateKeyAttribute("Deal ID", dealId)
+		if err != nil {
+			return nil, newError(ErrCodeInvalidArgument, err.Error())
+		}
+	}
+	if deal.Name == "" {
+		return nil, newError(ErrCodeInvalidArgument, "Deal %s is missing a name", dealId)
+	}
+	if len(deal.Tranches) > 0 {
+		return nil, newError(ErrCodeInvalidArgument, "Deal %s must be created without tranches; tranches join it when they are created", deal.Name)
+	}
+	for _, party := range []struct{ id, role string }{{deal.BorrowerId, RoleBorrower}, {deal.AgentId, RoleAgentBank}} {
+		if party.id == "" {
+			continue
+		}
+		participant, err := fetchParticipant(stub, party.id)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not read participant %s: %v", party.id, err)
+		}
+		if participant == nil || !hasRole(participant, party.role) {
+			return nil, newError(ErrCodeInvalidParticipant, "Participant %s is not a registered %s", party.id, party.role)
+		}
+	}
+	//allocate an ID only once the deal is valid so a rejected deal does not use up a sequence number
+	if dealId == "" {
+		dealId, err = NextID(stub, DealIdPrefix, dealKey)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not allocate a deal ID: %v", err)
+		}
+	}
+	deal.ID = dealId
+	existing, err := fetchDeal(stub, deal.ID)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read deal %s: %v", deal.ID, err)
+	}
+	if existing != nil {
+		return nil, newError(ErrCodeAlreadyExists, "Deal %s already exists", deal.ID)
+	}
+
+	deal.Tranches = []DealTranche{}
+	deal.TxId = stub.GetTxID()
+	bytes, err := saveDeal(stub, &deal)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not save deal %s: %v", deal.ID, err)
+	}
+	err = setEvent(stub, "dealCreation", string(bytes))
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Created deal " + deal.ID)
+	return bytes, nil
+}
+
+//dealForTranche returns the deal a new loan is a tranche of, or nil for a standalone loan. The
+//tranche needs a name that is unique within its deal.
+func dealForTranche(stub shim.ChaincodeStubInterface, loan *LoanApplication) (*Deal, error) {
+	if loan.DealId == "" {
+		if loan.Tranche != "" {
+			return nil, newError(ErrCodeInvalidArgument, "Loan application %s names tranche %s without a deal", loan.ID, loan.Tranche)
+		}
+		return nil, nil
+	}
+	deal, err := fetchDeal(stub, loan.DealId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read deal %s: %v", loan.DealId, err)
+	}
+	if deal == nil {
+		return nil, newError(ErrCodeNotFound, "Deal %s not found", loan.DealId)
+	}
+	if loan.Tranche == "" {
+		return nil, newError(ErrCodeInvalidArgument, "Loan application %s needs a tranche name in deal %s", loan.ID, deal.ID)
+	}
+	for _, tranche := range deal.Tranches {
+		if tranche.Name == loan.Tranche {
+			return nil, newError(ErrCodeAlreadyExists, "Deal %s already has a tranche %s", deal.ID, loan.Tranche)
+		}
+	}
+	return deal, nil
+}
+
+//GetDeal returns a deal with its tranches; args are deal ID
+func GetDeal(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering GetDeal")
+	if len(args) < 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected deal ID")
+	}
+	deal, err := fetchDeal(stub, args[0])
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read deal %s: %v", args[0], err)
+	}
+	if deal == nil {
+		return nil, newError(ErrCodeNotFound, "Deal %s not found", args[0])
+	}
+	return json.Marshal(deal)
+}
+
+//GetDealExposure rolls a deal's tranches up into commitments, drawn and undrawn amounts per
+//currency; args are deal ID and optionally a participant ID to roll up only its positions
+func GetDealExposure(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering GetDealExposure")
+	if len(args) < 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected deal ID")
+	}
+	deal, err := fetchDeal(stub, args[0])
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read deal %s: %v", args[0], err)
+	}
+	if deal == nil {
+		return nil, newError(ErrCodeNotFound, "Deal %s not found", args[0])
+	}
+	var participantId = ""
+	if len(args) > 1 {
+		participantId = args[1]
+	}
+
+	var tranches []TrancheExposure
+	for _, tranche := range deal.Tranches {
+		loan, err := fetchLoan(stub, tranche.LoanId)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not read loan application %s: %v", tranche.LoanId, err)
+		}
+		if loan == nil {
+			return nil, newError(ErrCodeNotFound, "Tranche %s of deal %s not found", tranche.LoanId, deal.ID)
+		}
+		if participantId == "" {
+			tranches = append(tranches, loanExposure(loan))
+			continue
+		}
+		position, err := fetchPosition(stub, participantId, loan.ID)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not read position of %s in loan %s: %v", participantId, loan.ID, err)
+		}
+		if position != nil {
+			exposure, err := positionExposure(loan, position)
+			if err != nil {
+				return nil, err
+			}
+			tranches = append(tranches, exposure)
+		}
+	}
+	var exposures = rollUpByDeal(tranches, map[string]string{deal.ID: deal.Name}, participantId)
+	if len(exposures) == 0 {
+		return json.Marshal(DealExposure{DealId: deal.ID, Name: deal.Name, ParticipantId: participantId, Tranches: []TrancheExposure{}, Totals: []Exposure{}})
+	}
+	return json.Marshal(exposures[0])
+}
+
+//loanExposure is the exposure to the whole loan
+func loanExposure(loan *LoanApplication) TrancheExposure {
+	return TrancheExposure{
+		LoanId:       loan.ID,
+		DealId:       loan.DealId,
+		Tranche:      loan.Tranche,
+		FacilityType: loan.facilityType(),
+		Status:       loan.Status,
+		Exposure:     Exposure{Currency: loan.Currency, Commitment: loan.commitment(), Drawn: loan.drawn(), Undrawn: loan.undrawn()},
+	}
+}
+
+//positionExposure is a participant's exposure to a loan. Positions written before commitments
+//were tracked count what they hold as their commitment.
+func positionExposure(loan *LoanApplication, position *Asset) (TrancheExposure, error) {
+	err := position.normalizeCurrency(loan.Currency)
+	if err != nil {
+		return TrancheExposure{}, err
+	}
+	var commitment = position.Commitment
+	if commitment.IsZero() {
+		commitment = position.ShareAmount.Add(position.Undrawn)
+	}
+	return TrancheExposure{
+		LoanId:       loan.ID,
+		DealId:       loan.DealId,
+		Tranche:      loan.Tranche,
+		FacilityType: loan.facilityType(),
+		Status:       loan.Status,
+		Exposure:     Exposure{Currency: loan.Currency, Commitment: commitment, Drawn: position.ShareAmount, Undrawn: position.Undrawn},
+	}, nil
+}
+
+//rollUpByDeal groups tranche exposures by deal, keeping the order in which deals are first
+//seen, and totals each deal per currency; dealNames maps deal IDs to their names
+func rollUpByDeal(tranches []TrancheExposure, dealNames map[string]string, participantId string) []DealExposure {
+	var exposures []DealExposure
+	var index = map[string]int{}
+	for _, tranche := range tranches {
+		i, found := index[tranche.DealId]
+		if !found {
+			i = len(exposures)
+			index[tranche.DealId] = i
+			exposures = append(exposures, DealExposure{DealId: tranche.DealId, Name: dealNames[tranche.DealId], ParticipantId: participantId})
+		}
+		exposures[i].Tranches = append(exposures[i].Tranches, tranche)
+		exposures[i].Totals = addExposure(exposures[i].Totals, tranche.Exposure)
+	}
+	return exposures
+}
+
+//addExposure adds exposure to the total in its currency
+func addExposure(totals []Exposure, exposure Exposure) []Exposure {
+	for i := range totals {
+		if totals[i].Currency == exposure.Currency {
+			totals[i].Commitment = totals[i].Commitment.Add(exposure.Commitment)
+			totals[i].Drawn = totals[i].Drawn.Add(exposure.Drawn)
+			totals[i].Undrawn = totals[i].Undrawn.Add(exposure.Undrawn)
+			return totals
+		}
+	}
+	return append(totals, exposure)
+}
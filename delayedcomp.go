@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//standardSettlementDays is the number of business days after the trade date by which a trade
+//is expected to settle under its documentation and trade type. A trade settling later owes the
+//buyer delayed compensation from that day on.
+var standardSettlementDays = map[string]int{
+	DocumentationLSTA + TradeTypePar:        7,
+	DocumentationLSTA + TradeTypeDistressed: 20,
+	DocumentationLMA + TradeTypePar:         10,
+	DocumentationLMA + TradeTypeDistressed:  20,
+}
+
+//Cash obligations between trade counterparties
+const (
+	ObligationPurchasePrice       = "PurchasePrice"
+	ObligationDelayedCompensation = "DelayedCompensation"
+	ObligationAccruedInterest     = "AccruedInterest"
+)
+
+//TradeEconomics splits the economics of a traded position between trade date and settlement
+//date. The seller remains lender of record until settlement and keeps the interest and fees
+//accrued until then, the buyer paying it the interest accrued on the traded part, but from the
+//standard settlement date on it owes the buyer the interest and fees on the traded part, less
+//the buyer's cost of carry on the purchase price.
+type TradeEconomics struct {
+	TradeDate              string           `json:"tradeDate"`
+	StandardSettlementDate string           `json:"standardSettlementDate"`
+	SettlementDate         string           `json:"settlementDate"`
+	AccruedInterest        Money            `json:"accruedInterest"`
+	AccruedFees            Money            `json:"accruedFees"`
+	DelayedInterest        Money            `json:"delayedInterest"`
+	DelayedFees            Money            `json:"delayedFees"`
+	CostOfCarry            Money            `json:"costOfCarry"`
+	DelayedCompensation    Money            `json:"delayedCompensation"`
+	Segments               []RateSegment    `json:"segments"`
+	Obligations            []CashObligation `json:"obligations"`
+}
+
+//RateSegment is a part of the period between trade and settlement date at a single rate. The
+//benchmark is the fixing of a floating rate period and prices the cost of carry.
+type RateSegment struct {
+	StartDate   string `json:"startDate"`
+	EndDate     string `json:"endDate"`
+	Delayed     bool   `json:"delayed,omitempty"`
+	AllInRate   Rate   `json:"allInRate"`
+	Benchmark   *Rate  `json:"benchmark,omitempty"`
+	Interest    Money  `json:"interest"`
+	Fees        Money  `json:"fees"`
+	CostOfCarry Money  `json:"costOfCarry"`
+}
+
+//CashObligation is an amount one counterparty owes the other when a trade settles
+type CashObligation struct {
+	Type    string `json:"type"`
+	PayerId string `json:"payerId"`
+	PayeeId string `json:"payeeId"`
+	Amount  Money  `json:"amount"`
+}
+
+//standardSettlementDate is the trade date plus the standard settlement days of the trade
+func standardSettlementDate(terms *TradeConfirmation) (string, error) {
+	tradeDate, err := ParseDate(terms.TradeDate)
+	if err != nil {
+		return "", err
+	}
+	return addBusinessDays(tradeDate, standardSettlementDays[terms.Documentation+terms.TradeType]).Format(DateLayout), nil
+}
+
+//rateHistory splits start to end at the loan's interest periods and prices every segment at
+//the rate of its period as splitAccrual does, so a period not yet accrued uses the fixing
+//known at its start rather than the loan's latest rate. The benchmark of the fixing prices the
+//cost of carry.
+func rateHistory(stub shim.ChaincodeStubInterface, loan *LoanApplication, start string, end string) ([]RateSegment, error) {
+	schedule, err := fetchInterestSchedule(stub, loan.ID)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read interest schedule for loan %s: %v", loan.ID, err)
+	}
+	parts, err := splitAccrual(stub, schedule, loan, start, end)
+	if err != nil {
+		return nil, err
+	}
+	var segments []RateSegment
+	for _, part := range parts {
+		var segment = RateSegment{StartDate: part.StartDate, EndDate: part.EndDate, AllInRate: part.AllInRate}
+		if part.Fixing != nil {
+			var benchmark = part.Fixing.BaseRate
+			segment.Benchmark = &benchmark
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+//tradedFees is the lenders' share of the periodic fees on the traded part of a position over a
+//year fraction. Fees paid to the agent alone are not traded with the position.
+func tradedFees(loan *LoanApplication, settlement *AssignmentSettlement, fraction *big.Rat) Money {
+	var total = ZeroMoney(loan.Currency)
+	for i := range loan.Fees {
+		var fee = &loan.Fees[i]
+		if fee.isOneOff() || fee.Type == FeePrepayment || fee.allocation() != FeeProRata {
+			continue
+		}
+		switch fee.Basis {
+		case FeeBasisCommitment:
+			total = total.Add(bpsOf(settlement.Drawn.Add(settlement.Undrawn), fee.RateBps, fraction))
+		case FeeBasisUndrawn:
+			total = total.Add(bpsOf(settlement.Undrawn, fee.RateBps, fraction))
+		case FeeBasisTieredUtilization:
+			var utilization = 0
+			if loan.commitment().IsPositive() {
+				utilization = shareOf(loan.drawn(), loan.commitment())
+			}
+			total = total.Add(bpsOf(settlement.Drawn, fee.tierRate(utilization), fraction))
+		}
+	}
+	return total
+}
+
+//tradeEconomics works out the interest and fees on the traded part of a position between trade
+//and settlement date from the loan's rate history, the delayed compensation the seller owes
+//the buyer and the resulting cash obligations
+func tradeEconomics(stub shim.ChaincodeStubInterface, loan *LoanApplication, terms *TradeConfirmation, settlement *AssignmentSettlement, settlementDate string) (*TradeEconomics, error) {
+	standardDate, err := standardSettlementDate(terms)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "Invalid trade date: %v", err)
+	}
+	var economics = TradeEconomics{
+		TradeDate:              terms.TradeDate,
+		StandardSettlementDate: standardDate,
+		SettlementDate:         settlementDate,
+		AccruedInterest:        ZeroMoney(loan.Currency),
+		AccruedFees:            ZeroMoney(loan.Currency),
+		DelayedInterest:        ZeroMoney(loan.Currency),
+		DelayedFees:            ZeroMoney(loan.Currency),
+		CostOfCarry:            ZeroMoney(loan.Currency),
+		Segments:               []RateSegment{},
+	}
+
+	var delayedFrom = settlementDate
+	if standardDate < settlementDate {
+		delayedFrom = standardDate
+	}
+	if delayedFrom < terms.TradeDate {
+		delayedFrom = terms.TradeDate
+	}
+	undelayed, err := rateHistory(stub, loan, terms.TradeDate, delayedFrom)
+	if err != nil {
+		return nil, err
+	}
+	delayed, err := rateHistory(stub, loan, delayedFrom, settlementDate)
+	if err != nil {
+		return nil, err
+	}
+	for i := range delayed {
+		delayed[i].Delayed = true
+	}
+	for _, segment := range append(undelayed, delayed...) {
+		start, err := ParseDate(segment.StartDate)
+		if err != nil {
+			return nil, err
+		}
+		end, err := ParseDate(segment.EndDate)
+		if err != nil {
+			return nil, err
+		}
+		fraction, err := YearFraction(loan.dayCountConvention(), start, end)
+		if err != nil {
+			return nil, newError(ErrCodeInvalidArgument, "%v", err)
+		}
+		segment.Interest, err = AccruedInterest(settlement.Drawn, segment.AllInRate.Rat(), loan.dayCountConvention(), start, end)
+		if err != nil {
+			return nil, newError(ErrCodeInvalidArgument, "%v", err)
+		}
+		segment.Fees = tradedFees(loan, settlement, fraction)
+		segment.CostOfCarry = ZeroMoney(loan.Currency)
+		economics.AccruedInterest = economics.AccruedInterest.Add(segment.Interest)
+		economics.AccruedFees = economics.AccruedFees.Add(segment.Fees)
+		if segment.Delayed {
+			if segment.Benchmark != nil && segment.Benchmark.IsPositive() {
+				var carry = new(big.Rat).Mul(settlement.Consideration.Rat(), segment.Benchmark.Rat())
+				carry.Mul(carry, fraction)
+				segment.CostOfCarry = MoneyFromRat(carry.Quo(carry, big.NewRat(100, 1)), loan.Currency)
+			}
+			economics.DelayedInterest = economics.DelayedInterest.Add(segment.Interest)
+			economics.DelayedFees = economics.DelayedFees.Add(segment.Fees)
+			economics.CostOfCarry = economics.CostOfCarry.Add(segment.CostOfCarry)
+		}
+		economics.Segments = append(economics.Segments, segment)
+	}
+
+	economics.DelayedCompensation = economics.DelayedInterest.Add(economics.DelayedFees).Sub(economics.CostOfCarry)
+	if economics.DelayedCompensation.IsNegative() {
+		economics.DelayedCompensation = ZeroMoney(loan.Currency)
+	}
+	economics.Obligations = []CashObligation{{Type: ObligationPurchasePrice, PayerId: terms.BuyerId, PayeeId: terms.SellerId, Amount: settlement.Consideration}}
+	if economics.DelayedCompensation.IsPositive() {
+		economics.Obligations = append(economics.Obligations, CashObligation{Type: ObligationDelayedCompensation, PayerId: terms.SellerId, PayeeId: terms.BuyerId, Amount: economics.DelayedCompensation})
+	}
+	if settlement.SellerAccruedInterest.IsPositive() {
+		economics.Obligations = append(economics.Obligations, CashObligation{Type: ObligationAccruedInterest, PayerId: terms.BuyerId, PayeeId: terms.SellerId, Amount: settlement.SellerAccruedInterest})
+	}
+	return &economics, nil
+}
+
+//CalculateTradeEconomics previews the delayed compensation and cash obligations of a matched
+//or approved trade if it settled on a given date; args are trade ID, settlement date, which
+//defaults to the confirmed settlement date, and optionally the participant asking, who must be
+//a party to the trade
+func CalculateTradeEconomics(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering CalculateTradeEconomics")
+	if len(args) < 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected trade ID")
+	}
+	trade, err := fetchTradeIn(stub, args[0], TradeMatched, TradeAgentApproved)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) > 2 && args[2] != "" && !trade.isParty(args[2]) {
+		return nil, newError(ErrCodeAccessDenied, "Participant %s is not a party to trade %s", args[2], trade.ID)
+	}
+	_, economics, err := settleTradeOn(stub, trade, args[1:])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(economics)
+}
+
+//settleTradeOn prepares the transfer of a trade settling on the date in args, defaulting to the
+//confirmed settlement date, and calculates its economics
+func settleTradeOn(stub shim.ChaincodeStubInterface, trade *Trade, args []string) (*positionTransfer, *TradeEconomics, error) {
+	var terms = trade.Sell
+	var settlementDate = terms.SettlementDate
+	if len(args) > 0 && args[0] != "" {
+		settlementDate = args[0]
+	}
+	if settlementDate < terms.TradeDate {
+		return nil, nil, newError(ErrCodeInvalidArgument, "Trade %s cannot settle on %s before its trade date %s", trade.ID, settlementDate, terms.TradeDate)
+	}
+	transfer, err := prepareTransfer(stub, terms.LoanId, terms.SellerId, terms.BuyerId, terms.Amount, terms.Price, settlementDate)
+	if err != nil {
+		return nil, nil, err
+	}
+	economics, err := tradeEconomics(stub, transfer.loan, terms, &transfer.settlement, settlementDate)
+	if err != nil {
+		return nil, nil, err
+	}
+	return transfer, economics, nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Facility types. Term loans are funded in full when created; revolving and delayed-draw
+//facilities start undrawn and are funded by drawdowns during their availability period.
+//Amounts repaid on a revolving facility can be redrawn, on a delayed-draw facility they cannot.
+const (
+	FacilityTerm        = "Term"
+	FacilityRevolving   = "Revolving"
+	FacilityDelayedDraw = "DelayedDraw"
+)
+
+//Facility movements
+const (
+	MovementDrawdown  = "Drawdown"
+	MovementRepayment = "Repayment"
+	MovementRedraw    = "Redraw"
+)
+
+var facilityTypes = []string{FacilityTerm, FacilityRevolving, FacilityDelayedDraw}
+
+//FacilityMovement records a drawdown, repayment or redraw and each lender's part of it
+type FacilityMovement struct {
+	LoanId      string               `json:"loanId"`
+	Type        string               `json:"type"`
+	Amount      Money                `json:"amount"`
+	ValueDate   string               `json:"valueDate"`
+	Allocations []MovementAllocation `json:"allocations"`
+	Drawn       Money                `json:"drawn"`
+	Undrawn     Money                `json:"undrawn"`
+	Redrawable  Money                `json:"redrawable"`
+	TxId        string               `json:"txId"`
+}
+
+type MovementAllocation struct {
+	ParticipantId string `json:"participantId"`
+	Amount        Money  `json:"amount"`
+}
+
+func (loan *LoanApplication) facilityType() string {
+	if loan.FacilityType == "" {
+		return FacilityTerm
+	}
+	return loan.FacilityType
+}
+
+//isFacility reports whether the loan is funded by drawdowns rather than on creation
+func (loan *LoanApplication) isFacility() bool {
+	return loan.facilityType() != FacilityTerm
+}
+
+//commitment is the committed amount of the loan, the deal amount
+func (loan *LoanApplication) commitment() Money {
+	return loan.DealAmount
+}
+
+//drawn is the amount the borrower currently owes in principal
+func (loan *LoanApplication) drawn() Money {
+	return loan.OutStandingSettlementAmount
+}
+
+//undrawn is the commitment the borrower can still draw, including repaid revolving amounts
+func (loan *LoanApplication) undrawn() Money {
+	return loan.UndrawnAmount.Add(loan.RedrawableAmount)
+}
+
+//availability returns the period in which the facility can be drawn. It defaults to the start
+//and maturity dates; an empty bound leaves that side open.
+func (loan *LoanApplication) availability() (string, string) {
+	var start, end = loan.AvailabilityStart, loan.AvailabilityEnd
+	if start == "" {
+		start = loan.StartDate
+	}
+	if end == "" {
+		end = loan.MaturityDate
+	}
+	return start, end
+}
+
+//repayPrincipal reduces the amount drawn; repayments of a revolving facility can be redrawn
+func (loan *LoanApplication) repayPrincipal(amount Money) {
+	loan.OutStandingSettlementAmount = loan.OutStandingSettlementAmount.Sub(amount)
+	if loan.facilityType() == FacilityRevolving {
+		loan.RedrawableAmount = loan.RedrawableAmount.Add(amount)
+	}
+}
+
+//repayPrincipal reduces the position by its part of a repayment and, on a revolving facility,
+//makes it available to draw again
+func (asset *Asset) repayPrincipal(loan *LoanApplication, part Money) {
+	asset.ShareAmount = asset.ShareAmount.Sub(part)
+	if loan.facilityType() == FacilityRevolving {
+		asset.Undrawn = asset.Undrawn.Add(part)
+	}
+}
+
+func validateFacility(loan LoanApplication) error {
+	if !containsString(facilityTypes, loan.facilityType()) {
+		return newError(ErrCodeInvalidArgument, "Loan application %s has unknown facility type %s", loan.ID, loan.FacilityType)
+	}
+	var start, end = loan.availability()
+	for _, date := range []string{start, end} {
+		if date == "" {
+			continue
+		}
+		_, err := ParseDate(date)
+		if err != nil {
+			return newError(ErrCodeInvalidArgument, "Loan application %s availability period: %v", loan.ID, err)
+		}
+	}
+	if start != "" && end != "" && start > end {
+		return newError(ErrCodeInvalidArgument, "Loan application %s availability period ends before it starts", loan.ID)
+	}
+	if !loan.isFacility() {
+		return nil
+	}
+	if loan.RepaymentProfile != "" {
+		return newError(ErrCodeInvalidArgument, "Loan application %s is a %s facility and cannot have a repayment profile", loan.ID, loan.FacilityType)
+	}
+	if loan.drawn().Add(loan.undrawn()).Cmp(loan.commitment()) > 0 {
+		return newError(ErrCodeInvalidArgument, "Loan application %s draws more than its commitment of %s", loan.ID, loan.commitment())
+	}
+	return nil
+}
+
+//Drawdown funds part of the undrawn commitment; args are loan ID, amount and value date
+func Drawdown(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering Drawdown")
+	return moveFacility(stub, args, MovementDrawdown)
+}
+
+//Repay repays principal drawn on a facility; args are loan ID, amount and value date
+func Repay(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering Repay")
+	return moveFacility(stub, args, MovementRepayment)
+}
+
+//Redraw draws amounts repaid on a revolving facility again; args are loan ID, amount and
+//value date
+func Redraw(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering Redraw")
+	return moveFacility(stub, args, MovementRedraw)
+}
+
+//moveFacility checks a drawdown, repayment or redraw against the facility's availability and
+//limits, then funds or repays each lender's pro-rata share of it. Each position is accrued to
+//the value date first so interest up to then is charged on the amount drawn before the movement.
+//Principal repaid is passed through to the lenders' funded sub-participants.
+func moveFacility(stub shim.ChaincodeStubInterface, args []string, movement string) ([]byte, error) {
+	if len(args) < 3 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected loan application ID, amount and value date")
+	}
+	var loanId, valueDate = args[0], args[2]
+	_, err := ParseDate(valueDate)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "Invalid value date: %v", err)
+	}
+	loan, err := fetchLoan(stub, loanId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read loan application %s: %v", loanId, err)
+	}
+	if loan == nil {
+		return nil, newError(ErrCodeNotFound, "Loan application %s not found", loanId)
+	}
+	if !loan.isFacility() || (movement == MovementRedraw && loan.facilityType() != FacilityRevolving) {
+		return nil, newError(ErrCodeFailedPrecondition, "%s is not possible on loan %s, a %s facility", movement, loanId, loan.facilityType())
+	}
+	amount, err := ParseMoney(args[1], loan.Currency)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "%v", err)
+	}
+	if amount.Currency != loan.Currency {
+		return nil, newError(ErrCodeInvalidArgument, "%s of %s is not in the loan currency %s", movement, amount, loan.Currency)
+	}
+	if !amount.IsPositive() {
+		return nil, newError(ErrCodeInvalidArgument, "%s amount %s must be positive", movement, amount)
+	}
+
+	var limit Money
+	switch movement {
+	case MovementRepayment:
+		if !containsString(repaymentStatuses, loan.Status) {
+			return nil, newError(ErrCodeFailedPrecondition, "Loan %s cannot be repaid in status %s", loanId, loan.Status)
+		}
+		limit = loan.drawn()
+	default:
+		if loan.Status != StatusActive {
+			return nil, newError(ErrCodeFailedPrecondition, "Loan %s cannot be drawn in status %s", loanId, loan.Status)
+		}
+		var start, end = loan.availability()
+		if (start != "" && valueDate < start) || (end != "" && valueDate > end) {
+			return nil, newError(ErrCodeFailedPrecondition, "Loan %s can only be drawn between %s and %s", loanId, start, end)
+		}
+		limit = loan.UndrawnAmount
+		if movement == MovementRedraw {
+			limit = loan.RedrawableAmount
+		}
+	}
+	if amount.Cmp(limit) > 0 {
+		return nil, newError(ErrCodeFailedPrecondition, "%s of %s exceeds the %s available on loan %s", movement, amount, limit, loanId)
+	}
+
+	syndicate, err := fetchSyndicate(stub, loanId)
+	if err != nil {
+		return nil, newError(ErrCodeFailedPrecondition, "Loan %s has no syndicate: %v", loanId, err)
+	}
+	parts, err := syndicate.Allocate(amount)
+	if err != nil {
+		return nil, err
+	}
+	schedule, err := fetchInterestSchedule(stub, loanId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read interest schedule for loan %s: %v", loanId, err)
+	}
+	//read and check every position before writing any so a failure leaves the ledger untouched
+	var positions = make([]*Asset, len(syndicate.Members))
+	for i, member := range syndicate.Members {
+		positions[i], err = fetchPosition(stub, member.ParticipantId, loanId)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not read position of %s in loan %s: %v", member.ParticipantId, loanId, err)
+		}
+		if positions[i] == nil {
+			return nil, newError(ErrCodeNotFound, "Participant %s holds no position in loan %s", member.ParticipantId, loanId)
+		}
+		err = positions[i].normalizeCurrency(loan.Currency)
+		if err != nil {
+			return nil, err
+		}
+		var available = positions[i].Undrawn
+		if movement == MovementRepayment {
+			available = positions[i].ShareAmount
+		}
+		if parts[i].Cmp(available) > 0 {
+			return nil, newError(ErrCodeFailedPrecondition, "%s share of %s for %s exceeds its %s available", movement, parts[i], member.ParticipantId, available)
+		}
+		interest, err := accrueSince(stub, schedule, loan, member.ParticipantId, positions[i], valueDate)
+		if err != nil {
+			return nil, err
+		}
+		positions[i].AccruedInterest = positions[i].AccruedInterest.Add(interest)
+	}
+
+	var record = FacilityMovement{LoanId: loanId, Type: movement, Amount: amount, ValueDate: valueDate, TxId: stub.GetTxID()}
+	switch movement {
+	case MovementDrawdown:
+		loan.UndrawnAmount = loan.UndrawnAmount.Sub(amount)
+	case MovementRedraw:
+		loan.RedrawableAmount = loan.RedrawableAmount.Sub(amount)
+	}
+	if movement == MovementRepayment {
+		loan.repayPrincipal(amount)
+	} else {
+		loan.OutStandingSettlementAmount = loan.OutStandingSettlementAmount.Add(amount)
+	}
+	for i, member := range syndicate.Members {
+		if movement == MovementRepayment {
+			positions[i].repayPrincipal(loan, parts[i])
+		} else {
+			positions[i].ShareAmount = positions[i].ShareAmount.Add(parts[i])
+			positions[i].Undrawn = positions[i].Undrawn.Sub(parts[i])
+		}
+		err = savePosition(stub, member.ParticipantId, positions[i])
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not save position of %s in loan %s: %v", member.ParticipantId, loanId, err)
+		}
+		if movement == MovementRepayment {
+			err = passThrough(stub, loanId, member.ParticipantId, valueDate, parts[i], ZeroMoney(loan.Currency))
+			if err != nil {
+				return nil, err
+			}
+		}
+		record.Allocations = append(record.Allocations, MovementAllocation{ParticipantId: member.ParticipantId, Amount: parts[i]})
+	}
+	if schedule != nil {
+		_, err = saveInterestSchedule(stub, schedule)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not save interest schedule for loan %s: %v", loanId, err)
+		}
+	}
+	_, err = saveLoan(stub, loan)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not save loan application %s: %v", loanId, err)
+	}
+	record.Drawn = loan.drawn()
+	record.Undrawn = loan.UndrawnAmount
+	record.Redrawable = loan.RedrawableAmount
+
+	bytes, err := json.Marshal(&record)
+	if err != nil {
+		return nil, err
+	}
+	err = setEvent(stub, "facilityMovement", string(bytes))
+	if err != nil {
+		return nil, err
+	}
+	logger.Info(movement + " of " + amount.String() + " on loan " + loanId)
+	return bytes, nil
+}
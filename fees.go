@@ -0,0 +1,628 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const feeLedgerObjectType = "feeledger"
+
+//Fee types; agency fees are collected through the AgencyFees bucket of the payment waterfall,
+//every other type through the Fees bucket
+const (
+	FeeUpfront     = "Upfront"
+	FeeCommitment  = "Commitment"
+	FeeAgency      = "Agency"
+	FeeUtilization = "Utilization"
+	FeePrepayment  = "Prepayment"
+)
+
+//Fee bases say what a fee is calculated on. Periodic fees scale the result by the year fraction
+//accrued, one-off fees charge it once.
+const (
+	FeeBasisFlat              = "Flat"
+	FeeBasisCommitment        = "BpsOfCommitment"
+	FeeBasisUndrawn           = "BpsOfUndrawn"
+	FeeBasisTieredUtilization = "TieredUtilization"
+	FeeBasisAmount            = "BpsOfAmount"
+)
+
+//Fee allocations say who receives a fee
+const (
+	FeeProRata   = "ProRata"
+	FeeAgentOnly = "AgentOnly"
+)
+
+//Fee ledger entry events
+const (
+	FeeAccrued  = "Accrued"
+	FeeInvoiced = "Invoiced"
+	FeePaid     = "Paid"
+)
+
+var feeTypes = []string{FeeUpfront, FeeCommitment, FeeAgency, FeeUtilization, FeePrepayment}
+
+//feeBases lists the bases each fee type may use
+var feeBases = map[string][]string{
+	FeeUpfront:     {FeeBasisFlat, FeeBasisCommitment},
+	FeeCommitment:  {FeeBasisFlat, FeeBasisCommitment, FeeBasisUndrawn},
+	FeeAgency:      {FeeBasisFlat, FeeBasisCommitment},
+	FeeUtilization: {FeeBasisTieredUtilization},
+	FeePrepayment:  {FeeBasisFlat, FeeBasisAmount},
+}
+
+//FeeDefinition is a fee the agent has set up on a loan. Flat periodic fees are an amount per
+//annum. Accrued is what has accrued since the last invoice, Invoiced the total invoiced so far.
+type FeeDefinition struct {
+	ID             string            `json:"id"`
+	Type           string            `json:"type"`
+	Basis          string            `json:"basis"`
+	Amount         *Money            `json:"amount,omitempty"`
+	RateBps        int               `json:"rateBps,omitempty"`
+	Tiers          []UtilizationTier `json:"tiers,omitempty"`
+	Allocation     string            `json:"allocation,omitempty"`
+	AccruedThrough string            `json:"accruedThrough,omitempty"`
+	Accrued        Money             `json:"accrued"`
+	Invoiced       Money             `json:"invoiced"`
+}
+
+//UtilizationTier applies RateBps on the drawn amount once utilization reaches FromBps of the
+//commitment
+type UtilizationTier struct {
+	FromBps int `json:"fromBps"`
+	RateBps int `json:"rateBps"`
+}
+
+//FeeLedger tracks one participant's fees on a loan, kept apart from its accrued interest
+type FeeLedger struct {
+	LoanId        string           `json:"loanId"`
+	ParticipantId string           `json:"participantId"`
+	Balances      []FeeBalance     `json:"balances"`
+	Entries       []FeeLedgerEntry `json:"entries"`
+}
+
+type FeeBalance struct {
+	FeeId    string `json:"feeId"`
+	Type     string `json:"type"`
+	Accrued  Money  `json:"accrued"`
+	Invoiced Money  `json:"invoiced"`
+	Paid     Money  `json:"paid"`
+}
+
+type FeeLedgerEntry struct {
+	FeeId  string `json:"feeId"`
+	Event  string `json:"event"`
+	Date   string `json:"date"`
+	Amount Money  `json:"amount"`
+	TxId   string `json:"txId"`
+}
+
+//FeeShare is a participant's part of a fee payment or charge; Ledger is nil for fees owed
+//without a ledger, e.g. set on loans before the fee engine
+type FeeShare struct {
+	ParticipantId string
+	Amount        Money
+	Ledger        *FeeLedger
+}
+
+func feeLedgerKey(loanId string, participantId string) string {
+	return compositeKey(feeLedgerObjectType, loanId, participantId)
+}
+
+//feeBucket returns the waterfall bucket a fee type is collected through
+func feeBucket(feeType string) string {
+	if feeType == FeeAgency {
+		return BucketAgencyFees
+	}
+	return BucketFees
+}
+
+func (fee *FeeDefinition) allocation() string {
+	if fee.Allocation != "" {
+		return fee.Allocation
+	}
+	if fee.Type == FeeAgency {
+		return FeeAgentOnly
+	}
+	return FeeProRata
+}
+
+func (fee *FeeDefinition) isOneOff() bool {
+	return fee.Type == FeeUpfront || fee.Type == FeePrepayment
+}
+
+func (loan *LoanApplication) fee(feeId string) *FeeDefinition {
+	for i := range loan.Fees {
+		if loan.Fees[i].ID == feeId {
+			return &loan.Fees[i]
+		}
+	}
+	return nil
+}
+
+func validateFees(loan LoanApplication) error {
+	var seen = map[string]bool{}
+	for _, fee := range loan.Fees {
+		err := validateFee(loan, fee)
+		if err != nil {
+			return err
+		}
+		if seen[fee.ID] {
+			return newError(ErrCodeInvalidArgument, "Loan application %s defines fee %s twice", loan.ID, fee.ID)
+		}
+		seen[fee.ID] = true
+	}
+	return nil
+}
+
+func validateFee(loan LoanApplication, fee FeeDefinition) error {
+	err := validateKeyAttribute("Fee ID", fee.ID)
+	if err != nil {
+		return newError(ErrCodeInvalidArgument, err.Error())
+	}
+	if !containsString(feeTypes, fee.Type) {
+		return newError(ErrCodeInvalidArgument, "Fee %s has unknown type %s", fee.ID, fee.Type)
+	}
+	if !containsString(feeBases[fee.Type], fee.Basis) {
+		return newError(ErrCodeInvalidArgument, "Fee %s of type %s cannot use basis %s", fee.ID, fee.Type, fee.Basis)
+	}
+	if fee.Allocation != "" && fee.Allocation != FeeProRata && fee.Allocation != FeeAgentOnly {
+		return newError(ErrCodeInvalidArgument, "Fee %s has unknown allocation %s", fee.ID, fee.Allocation)
+	}
+	switch fee.Basis {
+	case FeeBasisFlat:
+		if fee.Amount == nil || !fee.Amount.IsPositive() || fee.Amount.Currency != loan.Currency {
+			return newError(ErrCodeInvalidArgument, "Flat fee %s needs a positive amount in %s", fee.ID, loan.Currency)
+		}
+	case FeeBasisTieredUtilization:
+		if len(fee.Tiers) == 0 {
+			return newError(ErrCodeInvalidArgument, "Utilization fee %s needs at least one tier", fee.ID)
+		}
+		for i, tier := range fee.Tiers {
+			if tier.FromBps < 0 || tier.FromBps > FullShareBps || tier.RateBps < 0 || (i > 0 && tier.FromBps <= fee.Tiers[i-1].FromBps) {
+				return newError(ErrCodeInvalidArgument, "Utilization fee %s tiers must start between 0 and %d bps in increasing order with non-negative rates", fee.ID, FullShareBps)
+			}
+		}
+	default:
+		if fee.RateBps <= 0 {
+			return newError(ErrCodeInvalidArgument, "Fee %s needs a positive rate in bps", fee.ID)
+		}
+	}
+	return nil
+}
+
+//tierRate returns the rate of the highest tier the utilization has reached
+func (fee *FeeDefinition) tierRate(utilizationBps int) int {
+	var rate = 0
+	for _, tier := range fee.Tiers {
+		if utilizationBps >= tier.FromBps {
+			rate = tier.RateBps
+		}
+	}
+	return rate
+}
+
+//bpsOf returns amount * bps / 10000 * fraction rounded to the minor unit
+func bpsOf(amount Money, bps int, fraction *big.Rat) Money {
+	var result = new(big.Rat).Mul(amount.Rat(), big.NewRat(int64(bps), FullShareBps))
+	result.Mul(result, fraction)
+	return MoneyFromRat(result, amount.Currency)
+}
+
+//feeAmount calculates a periodic fee over the year fraction, or a one-off fee when fraction is
+//one. Drawn and undrawn amounts are taken as they stand when the fee is accrued.
+func (loan *LoanApplication) feeAmount(fee *FeeDefinition, fraction *big.Rat) Money {
+	switch fee.Basis {
+	case FeeBasisFlat:
+		return MoneyFromRat(new(big.Rat).Mul(fee.Amount.Rat(), fraction), loan.Currency)
+	case FeeBasisCommitment:
+		return bpsOf(loan.commitment(), fee.RateBps, fraction)
+	case FeeBasisUndrawn:
+		return bpsOf(loan.undrawn(), fee.RateBps, fraction)
+	case FeeBasisTieredUtilization:
+		var utilization = 0
+		if loan.commitment().IsPositive() {
+			utilization = shareOf(loan.drawn(), loan.commitment())
+		}
+		return bpsOf(loan.drawn(), fee.tierRate(utilization), fraction)
+	}
+	return ZeroMoney(loan.Currency)
+}
+
+//splitFee allocates a fee amount to the agent or pro rata to the syndicate
+func splitFee(fee *FeeDefinition, amount Money, syndicate *Syndicate) ([]FeeShare, error) {
+	if fee.allocation() == FeeAgentOnly {
+		if syndicate.AgentId == "" {
+			return nil, newError(ErrCodeFailedPrecondition, "Fee %s is paid to the agent but the syndicate of loan %s names no agent", fee.ID, syndicate.LoanId)
+		}
+		return []FeeShare{{ParticipantId: syndicate.AgentId, Amount: amount}}, nil
+	}
+	parts, err := syndicate.Allocate(amount)
+	if err != nil {
+		return nil, err
+	}
+	var shares []FeeShare
+	for i, member := range syndicate.Members {
+		shares = append(shares, FeeShare{ParticipantId: member.ParticipantId, Amount: parts[i]})
+	}
+	return shares, nil
+}
+
+//balance returns the ledger's balance for a fee, adding it when the fee is new to the ledger
+func (ledger *FeeLedger) balance(fee *FeeDefinition, currency string) *FeeBalance {
+	for i := range ledger.Balances {
+		if ledger.Balances[i].FeeId == fee.ID {
+			return &ledger.Balances[i]
+		}
+	}
+	ledger.Balances = append(ledger.Balances, FeeBalance{FeeId: fee.ID, Type: fee.Type, Accrued: ZeroMoney(currency), Invoiced: ZeroMoney(currency), Paid: ZeroMoney(currency)})
+	return &ledger.Balances[len(ledger.Balances)-1]
+}
+
+func (ledger *FeeLedger) record(feeId string, event string, date string, amount Money, txId string) {
+	ledger.Entries = append(ledger.Entries, FeeLedgerEntry{FeeId: feeId, Event: event, Date: date, Amount: amount, TxId: txId})
+}
+
+//outstanding returns what has been invoiced and not yet paid on fees collected through bucket
+func (ledger *FeeLedger) outstanding(bucket string, currency string) Money {
+	var total = ZeroMoney(currency)
+	for _, balance := range ledger.Balances {
+		if feeBucket(balance.Type) == bucket {
+			total = total.Add(balance.Invoiced.Sub(balance.Paid))
+		}
+	}
+	return total
+}
+
+//pay settles invoiced fees collected through bucket in the order they were defined
+func (ledger *FeeLedger) pay(bucket string, amount Money, date string, txId string) {
+	for i := range ledger.Balances {
+		var balance = &ledger.Balances[i]
+		var due = balance.Invoiced.Sub(balance.Paid)
+		if feeBucket(balance.Type) != bucket || !due.IsPositive() || !amount.IsPositive() {
+			continue
+		}
+		if amount.Cmp(due) < 0 {
+			due = amount
+		}
+		balance.Paid = balance.Paid.Add(due)
+		amount = amount.Sub(due)
+		ledger.record(balance.FeeId, FeePaid, date, due, txId)
+	}
+}
+
+//ledgerFor returns the participant's ledger, adding an empty one when it has none yet
+func ledgerFor(ledgers *[]*FeeLedger, loanId string, participantId string) *FeeLedger {
+	for _, ledger := range *ledgers {
+		if ledger.ParticipantId == participantId {
+			return ledger
+		}
+	}
+	var ledger = &FeeLedger{LoanId: loanId, ParticipantId: participantId}
+	*ledgers = append(*ledgers, ledger)
+	return ledger
+}
+
+func fetchFeeLedgers(stub shim.ChaincodeStubInterface, loanId string) ([]*FeeLedger, error) {
+	var ledgers []*FeeLedger
+	err := rangeQueryByPartialKey(stub, func(key string, value []byte) error {
+		var ledger FeeLedger
+		err := json.Unmarshal(value, &ledger)
+		if err != nil {
+			logger.Error("Could not unmarshal fee ledger "+key, err)
+			return err
+		}
+		ledgers = append(ledgers, &ledger)
+		return nil
+	}, feeLedgerObjectType, loanId)
+	if err != nil {
+		return nil, err
+	}
+	return ledgers, nil
+}
+
+func saveFeeLedgers(stub shim.ChaincodeStubInterface, ledgers []*FeeLedger) error {
+	for _, ledger := range ledgers {
+		bytes, err := json.Marshal(ledger)
+		if err != nil {
+			return err
+		}
+		err = stub.PutState(feeLedgerKey(ledger.LoanId, ledger.ParticipantId), bytes)
+		if err != nil {
+			logger.Error("Could not save fee ledger of "+ledger.ParticipantId+" in loan "+ledger.LoanId+" to ledger", err)
+			return newError(ErrCodeLedger, "Could not save fee ledger of %s in loan %s: %v", ledger.ParticipantId, ledger.LoanId, err)
+		}
+	}
+	return nil
+}
+
+//feeStatuses are the loan statuses in which fees can be defined and accrued
+var feeStatuses = []string{StatusSubmitted, StatusUnderReview, StatusApproved, StatusSyndicated, StatusActive, StatusDefaulted, StatusRestructured}
+
+//fetchFeeLoan reads a loan whose fees are being changed along with the named fee
+func fetchFeeLoan(stub shim.ChaincodeStubInterface, loanId string, feeId string) (*LoanApplication, *FeeDefinition, error) {
+	loan, err := fetchLoan(stub, loanId)
+	if err != nil {
+		return nil, nil, newError(ErrCodeLedger, "Could not read loan application %s: %v", loanId, err)
+	}
+	if loan == nil {
+		return nil, nil, newError(ErrCodeNotFound, "Loan application %s not found", loanId)
+	}
+	if !containsString(feeStatuses, loan.Status) {
+		return nil, nil, newError(ErrCodeFailedPrecondition, "Loan %s takes no fees in status %s", loanId, loan.Status)
+	}
+	if feeId == "" {
+		return loan, nil, nil
+	}
+	var fee = loan.fee(feeId)
+	if fee == nil {
+		return nil, nil, newError(ErrCodeNotFound, "Loan %s has no fee %s", loanId, feeId)
+	}
+	return loan, fee, nil
+}
+
+//DefineFee adds a fee to a loan; args are loan ID and the fee definition JSON
+func DefineFee(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering DefineFee")
+	if len(args) < 2 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected loan application ID and fee definition")
+	}
+	loan, _, err := fetchFeeLoan(stub, args[0], "")
+	if err != nil {
+		return nil, err
+	}
+	var fee FeeDefinition
+	err = json.Unmarshal([]byte(args[1]), &fee)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "Invalid fee definition: %v", err)
+	}
+	if fee.Amount != nil {
+		amount, err := fee.Amount.InCurrency(loan.Currency)
+		if err != nil {
+			return nil, newError(ErrCodeInvalidArgument, "Fee %s: %v", fee.ID, err)
+		}
+		fee.Amount = &amount
+	}
+	fee.AccruedThrough = ""
+	fee.Accrued = ZeroMoney(loan.Currency)
+	fee.Invoiced = ZeroMoney(loan.Currency)
+	loan.Fees = append(loan.Fees, fee)
+	err = validateFees(*loan)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = saveLoan(stub, loan)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not save loan application %s: %v", loan.ID, err)
+	}
+	bytes, err := json.Marshal(&fee)
+	if err != nil {
+		return nil, err
+	}
+	err = setEvent(stub, "feeDefined", string(bytes))
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Defined fee " + fee.ID + " on loan " + loan.ID)
+	return bytes, nil
+}
+
+//AccrueFee accrues a fee up to a date; args are loan ID, fee ID and date (YYYY-MM-DD).
+//Periodic fees accrue from where they were last accrued, or the loan start date, one-off
+//upfront fees are charged once. Prepayment fees are charged by ReceivePayment instead.
+func AccrueFee(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering AccrueFee")
+	if len(args) < 3 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected loan application ID, fee ID and accrual date")
+	}
+	loan, fee, err := fetchFeeLoan(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	var date = args[2]
+	end, err := ParseDate(date)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, err.Error())
+	}
+
+	var amount Money
+	switch {
+	case fee.Type == FeePrepayment:
+		return nil, newError(ErrCodeFailedPrecondition, "Prepayment fee %s is charged when a prepayment is received", fee.ID)
+	case fee.isOneOff():
+		if fee.AccruedThrough != "" {
+			return nil, newError(ErrCodeFailedPrecondition, "Fee %s was already charged on %s", fee.ID, fee.AccruedThrough)
+		}
+		amount = loan.feeAmount(fee, big.NewRat(1, 1))
+	default:
+		var from = fee.AccruedThrough
+		if from == "" {
+			from = loan.StartDate
+		}
+		if from == "" {
+			return nil, newError(ErrCodeFailedPrecondition, "Loan %s needs a start date to accrue fee %s", loan.ID, fee.ID)
+		}
+		start, err := ParseDate(from)
+		if err != nil {
+			return nil, newError(ErrCodeInvalidArgument, err.Error())
+		}
+		if !end.After(start) {
+			return nil, newError(ErrCodeFailedPrecondition, "Fee %s is already accrued through %s", fee.ID, from)
+		}
+		fraction, err := YearFraction(loan.dayCountConvention(), start, end)
+		if err != nil {
+			return nil, newError(ErrCodeInvalidArgument, "%v", err)
+		}
+		amount = loan.feeAmount(fee, fraction)
+	}
+	syndicate, err := fetchSyndicate(stub, loan.ID)
+	if err != nil {
+		return nil, newError(ErrCodeFailedPrecondition, "Loan %s cannot accrue fees: %v", loan.ID, err)
+	}
+	shares, err := splitFee(fee, amount, syndicate)
+	if err != nil {
+		return nil, err
+	}
+	ledgers, err := fetchFeeLedgers(stub, loan.ID)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read fee ledgers of loan %s: %v", loan.ID, err)
+	}
+
+	fee.AccruedThrough = date
+	fee.Accrued = fee.Accrued.Add(amount)
+	var changed []*FeeLedger
+	for _, share := range shares {
+		var ledger = ledgerFor(&ledgers, loan.ID, share.ParticipantId)
+		var balance = ledger.balance(fee, loan.Currency)
+		balance.Accrued = balance.Accrued.Add(share.Amount)
+		ledger.record(fee.ID, FeeAccrued, date, share.Amount, stub.GetTxID())
+		changed = append(changed, ledger)
+	}
+	_, err = saveLoan(stub, loan)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not save loan application %s: %v", loan.ID, err)
+	}
+	err = saveFeeLedgers(stub, changed)
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := json.Marshal(fee)
+	if err != nil {
+		return nil, err
+	}
+	err = setEvent(stub, "feeAccrued", string(bytes))
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Accrued " + amount.String() + " of fee " + fee.ID + " on loan " + loan.ID)
+	return bytes, nil
+}
+
+//InvoiceFee bills everything accrued on a fee so it is collected by the payment waterfall; args
+//are loan ID, fee ID and invoice date (YYYY-MM-DD)
+func InvoiceFee(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering InvoiceFee")
+	if len(args) < 3 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected loan application ID, fee ID and invoice date")
+	}
+	loan, fee, err := fetchFeeLoan(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	_, err = ParseDate(args[2])
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, err.Error())
+	}
+	if !fee.Accrued.IsPositive() {
+		return nil, newError(ErrCodeFailedPrecondition, "Fee %s has nothing accrued to invoice", fee.ID)
+	}
+	ledgers, err := fetchFeeLedgers(stub, loan.ID)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read fee ledgers of loan %s: %v", loan.ID, err)
+	}
+
+	var amount = fee.Accrued
+	if feeBucket(fee.Type) == BucketAgencyFees {
+		loan.AgencyFeesDue = loan.AgencyFeesDue.Add(amount)
+	} else {
+		loan.FeesDue = loan.FeesDue.Add(amount)
+	}
+	fee.Invoiced = fee.Invoiced.Add(amount)
+	fee.Accrued = ZeroMoney(loan.Currency)
+	for _, ledger := range ledgers {
+		for i := range ledger.Balances {
+			var balance = &ledger.Balances[i]
+			if balance.FeeId != fee.ID || !balance.Accrued.IsPositive() {
+				continue
+			}
+			ledger.record(fee.ID, FeeInvoiced, args[2], balance.Accrued, stub.GetTxID())
+			balance.Invoiced = balance.Invoiced.Add(balance.Accrued)
+			balance.Accrued = ZeroMoney(loan.Currency)
+		}
+	}
+	_, err = saveLoan(stub, loan)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not save loan application %s: %v", loan.ID, err)
+	}
+	err = saveFeeLedgers(stub, ledgers)
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := json.Marshal(fee)
+	if err != nil {
+		return nil, err
+	}
+	err = setEvent(stub, "feeInvoiced", string(bytes))
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Invoiced " + amount.String() + " of fee " + fee.ID + " on loan " + loan.ID)
+	return bytes, nil
+}
+
+//splitFeePayment shares what was paid in a fee bucket by what each participant's ledger has
+//outstanding. Anything beyond the ledgers, i.e. fees owed without a ledger, goes to the agent
+//for agency fees and pro rata to the syndicate otherwise.
+func splitFeePayment(bucket string, paid Money, ledgers []*FeeLedger, syndicate *Syndicate) ([]FeeShare, error) {
+	var shares []FeeShare
+	var weights []Money
+	var owed = ZeroMoney(paid.Currency)
+	for _, ledger := range ledgers {
+		var outstanding = ledger.outstanding(bucket, paid.Currency)
+		weights = append(weights, outstanding)
+		owed = owed.Add(outstanding)
+	}
+	var fromLedgers = paid
+	if owed.Cmp(paid) < 0 {
+		fromLedgers = owed
+	}
+	if fromLedgers.IsPositive() {
+		parts, err := AllocateByWeights(fromLedgers, weights)
+		if err != nil {
+			return nil, err
+		}
+		for i, ledger := range ledgers {
+			if parts[i].IsPositive() {
+				shares = append(shares, FeeShare{ParticipantId: ledger.ParticipantId, Amount: parts[i], Ledger: ledger})
+			}
+		}
+	}
+
+	var rest = paid.Sub(fromLedgers)
+	if !rest.IsPositive() {
+		return shares, nil
+	}
+	if bucket == BucketAgencyFees && syndicate.AgentId != "" {
+		return append(shares, FeeShare{ParticipantId: syndicate.AgentId, Amount: rest}), nil
+	}
+	parts, err := syndicate.Allocate(rest)
+	if err != nil {
+		return nil, err
+	}
+	for i, member := range syndicate.Members {
+		if parts[i].IsPositive() {
+			shares = append(shares, FeeShare{ParticipantId: member.ParticipantId, Amount: parts[i]})
+		}
+	}
+	return shares, nil
+}
+
+//GetFeeLedger returns a participant's fee ledger for a loan; args are loan ID and participant ID
+func GetFeeLedger(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering GetFeeLedger")
+	if len(args) < 2 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected loan application ID and participant ID")
+	}
+	bytes, err := stub.GetState(feeLedgerKey(args[0], args[1]))
+	if err != nil {
+		logger.Error("Could not fetch fee ledger of "+args[1]+" in loan "+args[0]+" from ledger", err)
+		return nil, newError(ErrCodeLedger, "Could not read fee ledger of %s in loan %s: %v", args[1], args[0], err)
+	}
+	if bytes == nil {
+		return nil, newError(ErrCodeNotFound, "Participant %s has no fees in loan %s", args[1], args[0])
+	}
+	return bytes, nil
+}
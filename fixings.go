@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const fixingObjectType = "fixing"
+
+//fixingLookbackDays is how far before the fixing date a published fixing may be, so that a
+//period fixing on a weekend or holiday uses the last business day's fixing
+const fixingLookbackDays = 5
+
+//RateFixing is a benchmark rate published for a tenor on a date, e.g. LIBOR 3M on 2017-01-13
+type RateFixing struct {
+	Benchmark   string `json:"benchmark"`
+	Tenor       string `json:"tenor"`
+	Date        string `json:"date"`
+	Rate        Rate   `json:"rate"`
+	PublishedBy string `json:"publishedBy"`
+	TxId        string `json:"txId"`
+}
+
+//AppliedFixing records which fixing an interest period used and how its all-in rate was built.
+//Compounded risk-free rates list every daily observation instead of a single fixing.
+type AppliedFixing struct {
+	Benchmark              string            `json:"benchmark"`
+	Tenor                  string            `json:"tenor"`
+	FixingDate             string            `json:"fixingDate,omitempty"`
+	Fixing                 Rate              `json:"fixing"`
+	FixingTxId             string            `json:"fixingTxId,omitempty"`
+	Observations           []RateObservation `json:"observations,omitempty"`
+	Floor                  *Rate             `json:"floor,omitempty"`
+	Cap                    *Rate             `json:"cap,omitempty"`
+	BaseRate               Rate              `json:"baseRate"`
+	Spread                 Rate              `json:"spread"`
+	CreditAdjustmentSpread *Rate             `json:"creditAdjustmentSpread,omitempty"`
+}
+
+func fixingKey(benchmark string, tenor string, date string) string {
+	return compositeKey(fixingObjectType, benchmark, tenor, date)
+}
+
+//PublishRateFixing records a benchmark fixing; args are benchmark, tenor, date (YYYY-MM-DD) and
+//rate in percent. Published fixings are immutable since interest periods refer to them.
+func PublishRateFixing(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering PublishRateFixing")
+	if len(args) < 4 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected benchmark, tenor, date and rate")
+	}
+	var fixing = RateFixing{Benchmark: args[0], Tenor: args[1], Date: args[2]}
+	for _, attribute := range []struct{ name, value string }{{"Benchmark", fixing.Benchmark}, {"Tenor", fixing.Tenor}} {
+		err := validateKeyAttribute(attribute.name, attribute.value)
+		if err != nil {
+			return nil, newError(ErrCodeInvalidArgument, err.Error())
+		}
+	}
+	_, err := ParseDate(fixing.Date)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, err.Error())
+	}
+	fixing.Rate, err = ParseRate(args[3])
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, err.Error())
+	}
+
+	var key = fixingKey(fixing.Benchmark, fixing.Tenor, fixing.Date)
+	existing, err := stub.GetState(key)
+	if err != nil {
+		logger.Error("Could not fetch fixing "+key+" from ledger", err)
+		return nil, newError(ErrCodeLedger, "Could not read fixing %s: %v", key, err)
+	}
+	if existing != nil {
+		return nil, newError(ErrCodeAlreadyExists, "%s %s is already fixed for %s", fixing.Benchmark, fixing.Tenor, fixing.Date)
+	}
+	fixing.PublishedBy = GetCaller(stub).Username
+	fixing.TxId = stub.GetTxID()
+
+	bytes, err := json.Marshal(&fixing)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		logger.Error("Could not save fixing "+key+" to ledger", err)
+		return nil, newError(ErrCodeLedger, "Could not save fixing %s: %v", key, err)
+	}
+	err = setEvent(stub, "rateFixingPublished", string(bytes))
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Published fixing " + key)
+	return bytes, nil
+}
+
+//GetRateFixing returns the fixing a period fixing on the given date would use; args are
+//benchmark, tenor and date
+func GetRateFixing(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering GetRateFixing")
+	if len(args) < 3 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected benchmark, tenor and date")
+	}
+	fixing, err := lookupFixing(stub, args[0], args[1], args[2])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(fixing)
+}
+
+//lookupFixing returns the latest fixing on or at most fixingLookbackDays before date
+func lookupFixing(stub shim.ChaincodeStubInterface, benchmark string, tenor string, date string) (*RateFixing, error) {
+	fixingDate, err := ParseDate(date)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, err.Error())
+	}
+	var earliest = fixingDate.AddDate(0, 0, -fixingLookbackDays).Format(DateLayout)
+	iter, err := stub.RangeQueryState(fixingKey(benchmark, tenor, earliest), fixingKey(benchmark, tenor, date))
+	if err != nil {
+		logger.Error("Could not run range query for "+benchmark+" "+tenor+" fixings", err)
+		return nil, newError(ErrCodeLedger, "Could not read %s %s fixings: %v", benchmark, tenor, err)
+	}
+	defer iter.Close()
+
+	var latest []byte
+	for iter.HasNext() {
+		_, value, err := iter.Next()
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not read %s %s fixings: %v", benchmark, tenor, err)
+		}
+		latest = value
+	}
+	if latest == nil {
+		return nil, newError(ErrCodeNotFound, "No %s %s fixing published between %s and %s", benchmark, tenor, earliest, date)
+	}
+	var fixing RateFixing
+	err = json.Unmarshal(latest, &fixing)
+	if err != nil {
+		logger.Error("Could not unmarshal "+benchmark+" "+tenor+" fixing", err)
+		return nil, err
+	}
+	return &fixing, nil
+}
+
+//periodRate returns the all-in rate of an interest period under the rate terms in force when
+//it starts. Fixed-rate loans use AllInRate as given. Term benchmarks use the fixing taken
+//FixingLagDays before the period start, risk-free rates are compounded in arrears over the
+//period. The loan's floor and cap apply to the benchmark before the spreads are added.
+func periodRate(stub shim.ChaincodeStubInterface, loan *LoanApplication, period *InterestPeriod) (Rate, *AppliedFixing, error) {
+	var terms = loan.rateTermsOn(period.StartDate)
+	var applied = AppliedFixing{
+		Benchmark:              terms.BaseRateType,
+		Tenor:                  terms.RateTenor,
+		Floor:                  loan.RateFloor,
+		Cap:                    loan.RateCap,
+		Spread:                 terms.Spread,
+		CreditAdjustmentSpread: terms.CreditAdjustmentSpread,
+	}
+	if isRFR(terms.BaseRateType) {
+		compounded, observations, err := compoundedPeriodRate(stub, terms, period)
+		if err != nil {
+			return Rate{}, nil, err
+		}
+		applied.Tenor = RFRTenor
+		applied.Fixing = compounded
+		applied.Observations = observations
+	} else if terms.RateTenor != "" {
+		start, err := ParseDate(period.StartDate)
+		if err != nil {
+			return Rate{}, nil, err
+		}
+		var fixingDate = start.AddDate(0, 0, -terms.FixingLagDays).Format(DateLayout)
+		fixing, err := lookupFixing(stub, terms.BaseRateType, terms.RateTenor, fixingDate)
+		if err != nil {
+			return Rate{}, nil, err
+		}
+		applied.FixingDate = fixing.Date
+		applied.Fixing = fixing.Rate
+		applied.FixingTxId = fixing.TxId
+	} else {
+		return loan.AllInRate, nil, nil
+	}
+
+	applied.BaseRate = applied.Fixing
+	if loan.RateFloor != nil && applied.BaseRate.Cmp(*loan.RateFloor) < 0 {
+		applied.BaseRate = *loan.RateFloor
+	}
+	if loan.RateCap != nil && applied.BaseRate.Cmp(*loan.RateCap) > 0 {
+		applied.BaseRate = *loan.RateCap
+	}
+	var allInRate = applied.BaseRate.Add(terms.Spread)
+	if terms.CreditAdjustmentSpread != nil {
+		allInRate = allInRate.Add(*terms.CreditAdjustmentSpread)
+	}
+	return allInRate, &applied, nil
+}
+
+//isFloating reports whether the loan's rate is reset from benchmark fixings; loans on a term
+//benchmark without a rate tenor keep the AllInRate they were created with
+func (loan *LoanApplication) isFloating() bool {
+	return loan.RateTenor != "" || isRFR(loan.BaseRateType)
+}
+
+func validateFloatingRate(loan LoanApplication) error {
+	if loan.FixingLagDays < 0 {
+		return newError(ErrCodeInvalidArgument, "Loan application %s has a negative fixing lag", loan.ID)
+	}
+	if loan.RateFloor != nil && loan.RateCap != nil && loan.RateFloor.Cmp(*loan.RateCap) > 0 {
+		return newError(ErrCodeInvalidArgument, "Loan application %s rate floor %s is above its cap %s", loan.ID, loan.RateFloor, loan.RateCap)
+	}
+	if isRFR(loan.BaseRateType) {
+		return validateRFRTerms(loan.ID, loan.rateTerms())
+	}
+	if !loan.isFloating() {
+		return nil
+	}
+	for _, attribute := range []struct{ name, value string }{{"Base rate type", loan.BaseRateType}, {"Rate tenor", loan.RateTenor}} {
+		err := validateKeyAttribute(attribute.name, attribute.value)
+		if err != nil {
+			return newError(ErrCodeInvalidArgument, "Loan application %s: %v", loan.ID, err)
+		}
+	}
+	return nil
+}
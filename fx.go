@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const fxRateObjectType = "fxrate"
+
+//fxRateDecimals is the precision of an ExchangeRate
+const fxRateDecimals = 8
+
+//fxLookbackDays is how far before the reporting date a published FX rate may be, so that a
+//report dated on a weekend or holiday uses the last business day's rate
+const fxLookbackDays = 5
+
+//ExchangeRate is the price of one unit of a base currency in a quote currency, held with
+//fxRateDecimals fixed decimals. It is encoded in JSON as a string such as "1.0825".
+type ExchangeRate struct {
+	Scaled int64
+}
+
+//ParseExchangeRate reads a positive rate such as "1.0825"; more than fxRateDecimals decimals is an error
+func ParseExchangeRate(text string) (ExchangeRate, error) {
+	scaled, exact, err := parseDecimal(strings.TrimSpace(text), fxRateDecimals)
+	if err != nil {
+		return ExchangeRate{}, errors.New("Invalid exchange rate '" + text + "'")
+	}
+	if !exact {
+		return ExchangeRate{}, errors.New("Exchange rate '" + text + "' has more than " + strconv.Itoa(fxRateDecimals) + " decimals")
+	}
+	if scaled <= 0 {
+		return ExchangeRate{}, errors.New("Exchange rate '" + text + "' must be positive")
+	}
+	return ExchangeRate{Scaled: scaled}, nil
+}
+
+func (r ExchangeRate) Rat() *big.Rat {
+	return new(big.Rat).SetFrac(big.NewInt(r.Scaled), big.NewInt(pow10(fxRateDecimals)))
+}
+
+//String drops trailing zeros, so 1.08250000 is "1.0825"
+func (r ExchangeRate) String() string {
+	var text = strconv.FormatInt(r.Scaled/pow10(fxRateDecimals), 10)
+	var fraction = strconv.FormatInt(r.Scaled%pow10(fxRateDecimals), 10)
+	fraction = strings.TrimRight(strings.Repeat("0", fxRateDecimals-len(fraction))+fraction, "0")
+	if fraction != "" {
+		text = text + "." + fraction
+	}
+	return text
+}
+
+func (r ExchangeRate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func (r *ExchangeRate) UnmarshalJSON(data []byte) error {
+	var text string
+	err := json.Unmarshal(data, &text)
+	if err != nil {
+		return err
+	}
+	*r, err = ParseExchangeRate(text)
+	return err
+}
+
+//FxRate is an exchange rate published for a currency pair on a date, e.g. EUR/USD on 2017-03-31
+type FxRate struct {
+	Base        string       `json:"base"`
+	Quote       string       `json:"quote"`
+	Date        string       `json:"date"`
+	Rate        ExchangeRate `json:"rate"`
+	PublishedBy string       `json:"publishedBy"`
+	TxId        string       `json:"txId"`
+}
+
+//AppliedFxRate records which published rate converted an amount from one currency to another.
+//When only the opposite pair was published its rate is inverted.
+type AppliedFxRate struct {
+	From     string       `json:"from"`
+	To       string       `json:"to"`
+	Rate     ExchangeRate `json:"rate"`
+	Inverted bool         `json:"inverted,omitempty"`
+	RateDate string       `json:"rateDate"`
+	TxId     string       `json:"txId"`
+}
+
+//rat is the number of units of To per unit of From
+func (applied *AppliedFxRate) rat() *big.Rat {
+	if applied.Inverted {
+		return new(big.Rat).Inv(applied.Rate.Rat())
+	}
+	return applied.Rate.Rat()
+}
+
+//convert converts an amount in From into To, rounding to the minor unit of To
+func (applied *AppliedFxRate) convert(amount Money) Money {
+	return MoneyFromRat(new(big.Rat).Mul(amount.Rat(), applied.rat()), applied.To)
+}
+
+func fxRateKey(base string, quote string, date string) string {
+	return compositeKey(fxRateObjectType, base, quote, date)
+}
+
+//PublishFxRate records an exchange rate; args are base currency, quote currency, date
+//(YYYY-MM-DD) and the price of one unit of base in quote. Published rates are immutable since
+//reports refer to them.
+func PublishFxRate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering PublishFxRate")
+	if len(args) < 4 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected base currency, quote currency, date and rate")
+	}
+	var fxRate = FxRate{Base: args[0], Quote: args[1], Date: args[2]}
+	for _, currency := range []string{fxRate.Base, fxRate.Quote} {
+		err := validateCurrency(currency)
+		if err != nil {
+			return nil, newError(ErrCodeInvalidArgument, err.Error())
+		}
+	}
+	if fxRate.Base == fxRate.Quote {
+		return nil, newError(ErrCodeInvalidArgument, "An exchange rate needs two different currencies, got %s twice", fxRate.Base)
+	}
+	_, err := ParseDate(fxRate.Date)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, err.Error())
+	}
+	fxRate.Rate, err = ParseExchangeRate(args[3])
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, err.Error())
+	}
+
+	var key = fxRateKey(fxRate.Base, fxRate.Quote, fxRate.Date)
+	existing, err := stub.GetState(key)
+	if err != nil {
+		logger.Error("Could not fetch FX rate "+key+" from ledger", err)
+		return nil, newError(ErrCodeLedger, "Could not read FX rate %s: %v", key, err)
+	}
+	if existing != nil {
+		return nil, newError(ErrCodeAlreadyExists, "%s/%s is already published for %s", fxRate.Base, fxRate.Quote, fxRate.Date)
+	}
+	fxRate.PublishedBy = GetCaller(stub).Username
+	fxRate.TxId = stub.GetTxID()
+
+	bytes, err := json.Marshal(&fxRate)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		logger.Error("Could not save FX rate "+key+" to ledger", err)
+		return nil, newError(ErrCodeLedger, "Could not save FX rate %s: %v", key, err)
+	}
+	err = setEvent(stub, "fxRatePublished", string(bytes))
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Published FX rate " + key)
+	return bytes, nil
+}
+
+//GetFxRate returns the rate a conversion on the given date would use; args are the currency to
+//convert from, the currency to convert to and the date
+func GetFxRate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering GetFxRate")
+	if len(args) < 3 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected from currency, to currency and date")
+	}
+	applied, err := lookupFxRate(stub, args[0], args[1], args[2])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(applied)
+}
+
+//lookupFxRate returns the latest rate converting from into to that was published on or at most
+//fxLookbackDays before date, using the opposite pair when it is more recent. Converting a
+//currency into itself needs no rate and returns nil.
+func lookupFxRate(stub shim.ChaincodeStubInterface, from string, to string, date string) (*AppliedFxRate, error) {
+	for _, currency := range []string{from, to} {
+		err := validateCurrency(currency)
+		if err != nil {
+			return nil, newError(ErrCodeInvalidArgument, err.Error())
+		}
+	}
+	rateDate, err := ParseDate(date)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, err.Error())
+	}
+	if from == to {
+		return nil, nil
+	}
+	var earliest = rateDate.AddDate(0, 0, -fxLookbackDays).Format(DateLayout)
+	direct, err := latestFxRate(stub, from, to, earliest, date)
+	if err != nil {
+		return nil, err
+	}
+	inverse, err := latestFxRate(stub, to, from, earliest, date)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case direct != nil && (inverse == nil || direct.Date >= inverse.Date):
+		return &AppliedFxRate{From: from, To: to, Rate: direct.Rate, RateDate: direct.Date, TxId: direct.TxId}, nil
+	case inverse != nil:
+		return &AppliedFxRate{From: from, To: to, Rate: inverse.Rate, Inverted: true, RateDate: inverse.Date, TxId: inverse.TxId}, nil
+	}
+	return nil, newError(ErrCodeNotFound, "No %s/%s rate published between %s and %s", from, to, earliest, date)
+}
+
+//latestFxRate returns the last base/quote rate published between earliest and latest, or nil
+func latestFxRate(stub shim.ChaincodeStubInterface, base string, quote string, earliest string, latest string) (*FxRate, error) {
+	iter, err := stub.RangeQueryState(fxRateKey(base, quote, earliest), fxRateKey(base, quote, latest))
+	if err != nil {
+		logger.Error("Could not run range query for "+base+"/"+quote+" rates", err)
+		return nil, newError(ErrCodeLedger, "Could not read %s/%s rates: %v", base, quote, err)
+	}
+	defer iter.Close()
+
+	var last []byte
+	for iter.HasNext() {
+		_, value, err := iter.Next()
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not read %s/%s rates: %v", base, quote, err)
+		}
+		last = value
+	}
+	if last == nil {
+		return nil, nil
+	}
+	var fxRate FxRate
+	err = json.Unmarshal(last, &fxRate)
+	if err != nil {
+		logger.Error("Could not unmarshal "+base+"/"+quote+" rate", err)
+		return nil, err
+	}
+	return &fxRate, nil
+}
+
+//PositionReport lists a participant's positions converted into a reporting currency
+type PositionReport struct {
+	ParticipantId     string             `json:"participantId"`
+	ReportingCurrency string             `json:"reportingCurrency"`
+	Date              string             `json:"date"`
+	Positions         []ReportedPosition `json:"positions"`
+	Totals            Exposure           `json:"totals"`
+}
+
+//ReportedPosition is a position in its loan currency, the same amounts in the reporting
+//currency and the rate used, which is omitted when the loan is in the reporting currency
+type ReportedPosition struct {
+	TrancheExposure
+	Reported Exposure       `json:"reported"`
+	FxRate   *AppliedFxRate `json:"fxRate,omitempty"`
+}
+
+//GetPositionReport converts every position of a participant into a reporting currency at the
+//rates published on or shortly before a date; args are participant ID, reporting currency and
+//date. Each position records the rate and rate date it was converted at.
+func GetPositionReport(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering GetPositionReport")
+	if len(args) < 3 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected participant ID, reporting currency and date")
+	}
+	var report = PositionReport{ParticipantId: args[0], ReportingCurrency: args[1], Date: args[2], Positions: []ReportedPosition{}}
+	err := validateCurrency(report.ReportingCurrency)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, err.Error())
+	}
+	_, err = ParseDate(report.Date)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, err.Error())
+	}
+	report.Totals = Exposure{
+		Currency:   report.ReportingCurrency,
+		Commitment: ZeroMoney(report.ReportingCurrency),
+		Drawn:      ZeroMoney(report.ReportingCurrency),
+		Undrawn:    ZeroMoney(report.ReportingCurrency),
+	}
+
+	positions, err := fetchPositions(stub, report.ParticipantId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read positions of %s: %v", report.ParticipantId, err)
+	}
+	//positions in the same currency share one rate lookup
+	var rates = map[string]*AppliedFxRate{}
+	for i := range positions {
+		loan, err := fetchLoan(stub, positions[i].AssetId)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not read loan application %s: %v", positions[i].AssetId, err)
+		}
+		if loan == nil {
+			logger.Warning("Skipping position of " + report.ParticipantId + " in unknown loan " + positions[i].AssetId)
+			continue
+		}
+		exposure, err := positionExposure(loan, &positions[i])
+		if err != nil {
+			return nil, err
+		}
+		applied, found := rates[exposure.Currency]
+		if !found {
+			applied, err = lookupFxRate(stub, exposure.Currency, report.ReportingCurrency, report.Date)
+			if err != nil {
+				return nil, err
+			}
+			rates[exposure.Currency] = applied
+		}
+		var reported = exposure.Exposure
+		if applied != nil {
+			reported = Exposure{
+				Currency:   report.ReportingCurrency,
+				Commitment: applied.convert(exposure.Commitment),
+				Drawn:      applied.convert(exposure.Drawn),
+				Undrawn:    applied.convert(exposure.Undrawn),
+			}
+		}
+		report.Positions = append(report.Positions, ReportedPosition{TrancheExposure: exposure, Reported: reported, FxRate: applied})
+		report.Totals = addExposure([]Exposure{report.Totals}, reported)[0]
+	}
+	return json.Marshal(&report)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	LoanIdPrefix             = "la"
+	TradeIdPrefix            = "tr"
+	PaymentIdPrefix          = "pm"
+	DealIdPrefix             = "dl"
+	AssignmentIdPrefix       = "as"
+	SubParticipationIdPrefix = "sp"
+)
+
+//maxIDAttempts bounds the search for a free ID when IDs were also assigned by hand
+const maxIDAttempts = 1000
+
+const sequenceObjectType = "seq"
+
+//NextID allocates the next ID for a prefix from a counter kept on the ledger under
+//seq~<prefix>, so every endorsing peer derives the same ID. IDs already used by an object
+//stored under keyFor(id), e.g. a loan created with an explicit ID, are skipped.
+func NextID(stub shim.ChaincodeStubInterface, prefix string, keyFor func(id string) string) (string, error) {
+	var counterKey = compositeKey(sequenceObjectType, prefix)
+	bytes, err := stub.GetState(counterKey)
+	if err != nil {
+		logger.Error("Could not fetch sequence "+prefix+" from ledger", err)
+		return "", err
+	}
+	var sequence = 0
+	if bytes != nil {
+		sequence, err = strconv.Atoi(string(bytes))
+		if err != nil {
+			logger.Error("Could not parse sequence "+prefix, err)
+			return "", err
+		}
+	}
+
+	for attempt := 0; attempt < maxIDAttempts; attempt++ {
+		sequence++
+		var id = prefix + strconv.Itoa(sequence)
+		existing, err := stub.GetState(keyFor(id))
+		if err != nil {
+			logger.Error("Could not check ID "+id+" against the ledger", err)
+			return "", err
+		}
+		if existing != nil {
+			logger.Warning("Skipping ID " + id + " which is already in use")
+			continue
+		}
+		err = stub.PutState(counterKey, []byte(strconv.Itoa(sequence)))
+		if err != nil {
+			logger.Error("Could not save sequence "+prefix+" to ledger", err)
+			return "", err
+		}
+		return id, nil
+	}
+	return "", newError(ErrCodeAlreadyExists, "Could not find a free %s ID after %d attempts", prefix, maxIDAttempts)
+}
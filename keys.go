@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//compositeKeySeparator joins the object type and attributes of a ledger key, e.g. position~part1~la1
+const compositeKeySeparator = "~"
+
+const (
+	loanObjectType        = "loan"
+	participantObjectType = "participant"
+	positionObjectType    = "position"
+	syndicateObjectType   = "syndicate"
+	leiObjectType         = "lei"
+)
+
+//compositeKey builds a namespaced key; IDs are checked with validateKeyAttribute when they are
+//created, since a separator inside an attribute would make partial-key range queries ambiguous
+func compositeKey(objectType string, attributes ...string) string {
+	return strings.Join(append([]string{objectType}, attributes...), compositeKeySeparator)
+}
+
+func splitCompositeKey(key string) (string, []string) {
+	parts := strings.Split(key, compositeKeySeparator)
+	return parts[0], parts[1:]
+}
+
+func validateKeyAttribute(name string, value string) error {
+	if value == "" {
+		return errors.New(name + " is required")
+	}
+	if strings.Contains(value, compositeKeySeparator) {
+		return errors.New(name + " must not contain '" + compositeKeySeparator + "'")
+	}
+	return nil
+}
+
+func loanKey(loanId string) string {
+	return compositeKey(loanObjectType, loanId)
+}
+
+func participantKey(participantID string) string {
+	return compositeKey(participantObjectType, participantID)
+}
+
+func positionKey(participantID string, loanId string) string {
+	return compositeKey(positionObjectType, participantID, loanId)
+}
+
+func syndicateKey(loanId string) string {
+	return compositeKey(syndicateObjectType, loanId)
+}
+
+func leiKey(lei string) string {
+	return compositeKey(leiObjectType, lei)
+}
+
+//rangeQueryByPartialKey iterates every key that starts with the given object type and
+//leading attributes, passing each key and value to visit in key order
+func rangeQueryByPartialKey(stub shim.ChaincodeStubInterface, visit func(key string, value []byte) error, objectType string, attributes ...string) error {
+	var prefix = compositeKey(objectType, attributes...) + compositeKeySeparator
+	iter, err := stub.RangeQueryState(prefix, prefix+string(utf8.MaxRune))
+	if err != nil {
+		logger.Error("Could not run range query for "+prefix, err)
+		return err
+	}
+	defer iter.Close()
+
+	for iter.HasNext() {
+		key, value, err := iter.Next()
+		if err != nil {
+			logger.Error("Could not read next range query result for "+prefix, err)
+			return err
+		}
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		err = visit(key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//fetchLoan returns nil without an error when the loan is not on the ledger
+func fetchLoan(stub shim.ChaincodeStubInterface, loanId string) (*LoanApplication, error) {
+	bytes, err := stub.GetState(loanKey(loanId))
+	if err != nil {
+		logger.Error("Could not fetch loan application with id "+loanId+" from ledger", err)
+		return nil, err
+	}
+	if bytes == nil {
+		return nil, nil
+	}
+	var loan LoanApplication
+	err = json.Unmarshal(bytes, &loan)
+	if err != nil {
+		logger.Error("Could not unmarshal loan application with id "+loanId, err)
+		return nil, err
+	}
+	err = loan.normalizeCurrency()
+	if err != nil {
+		return nil, err
+	}
+	return &loan, nil
+}
+
+func saveLoan(stub shim.ChaincodeStubInterface, loan *LoanApplication) ([]byte, error) {
+	bytes, err := json.Marshal(loan)
+	if err != nil {
+		logger.Error("Could not marshal loan application "+loan.ID, err)
+		return nil, err
+	}
+	err = stub.PutState(loanKey(loan.ID), bytes)
+	if err != nil {
+		logger.Error("Could not save loan application "+loan.ID+" to ledger", err)
+		return nil, err
+	}
+	return bytes, nil
+}
+
+//fetchPosition returns nil without an error when the participant holds no position in the loan
+func fetchPosition(stub shim.ChaincodeStubInterface, participantID string, loanId string) (*Asset, error) {
+	bytes, err := stub.GetState(positionKey(participantID, loanId))
+	if err != nil {
+		logger.Error("Could not fetch position of "+participantID+" in loan "+loanId+" from ledger", err)
+		return nil, err
+	}
+	if bytes == nil {
+		return nil, nil
+	}
+	var asset Asset
+	err = json.Unmarshal(bytes, &asset)
+	if err != nil {
+		logger.Error("Could not unmarshal position of "+participantID+" in loan "+loanId, err)
+		return nil, err
+	}
+	return &asset, nil
+}
+
+func savePosition(stub shim.ChaincodeStubInterface, participantID string, asset *Asset) error {
+	bytes, err := json.Marshal(asset)
+	if err != nil {
+		logger.Error("Could not marshal position of "+participantID+" in loan "+asset.AssetId, err)
+		return err
+	}
+	err = stub.PutState(positionKey(participantID, asset.AssetId), bytes)
+	if err != nil {
+		logger.Error("Could not save position of "+participantID+" in loan "+asset.AssetId+" to ledger", err)
+		return err
+	}
+	return nil
+}
+
+//fetchPositions returns every position held by a participant, ordered by loan ID
+func fetchPositions(stub shim.ChaincodeStubInterface, participantID string) ([]Asset, error) {
+	var positions []Asset
+	err := rangeQueryByPartialKey(stub, func(key string, value []byte) error {
+		var asset Asset
+		err := json.Unmarshal(value, &asset)
+		if err != nil {
+			logger.Error("Could not unmarshal position "+key, err)
+			return err
+		}
+		positions = append(positions, asset)
+		return nil
+	}, positionObjectType, participantID)
+	if err != nil {
+		return nil, err
+	}
+	return positions, nil
+}
+
+//fetchLoans returns every loan on the ledger, ordered by loan ID
+func fetchLoans(stub shim.ChaincodeStubInterface) ([]LoanApplication, error) {
+	var loans []LoanApplication
+	err := rangeQueryByPartialKey(stub, func(key string, value []byte) error {
+		var loan LoanApplication
+		err := json.Unmarshal(value, &loan)
+		if err != nil {
+			logger.Error("Could not unmarshal loan application "+key, err)
+			return err
+		}
+		err = loan.normalizeCurrency()
+		if err != nil {
+			return err
+		}
+		loans = append(loans, loan)
+		return nil
+	}, loanObjectType)
+	if err != nil {
+		return nil, err
+	}
+	return loans, nil
+}
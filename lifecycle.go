@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	StatusSubmitted    = "Submitted"
+	StatusUnderReview  = "UnderReview"
+	StatusApproved     = "Approved"
+	StatusSyndicated   = "Syndicated"
+	StatusActive       = "Active"
+	StatusRepaid       = "Repaid"
+	StatusDefaulted    = "Defaulted"
+	StatusRestructured = "Restructured"
+	StatusCancelled    = "Cancelled"
+)
+
+//loanTransitions lists the statuses a loan may move to from each status; Repaid and
+//Cancelled are terminal
+var loanTransitions = map[string][]string{
+	StatusSubmitted:    {StatusUnderReview, StatusCancelled},
+	StatusUnderReview:  {StatusApproved, StatusCancelled},
+	StatusApproved:     {StatusSyndicated, StatusCancelled},
+	StatusSyndicated:   {StatusActive, StatusCancelled},
+	StatusActive:       {StatusRepaid, StatusDefaulted, StatusRestructured},
+	StatusDefaulted:    {StatusRestructured, StatusRepaid},
+	StatusRestructured: {StatusActive, StatusDefaulted, StatusRepaid},
+}
+
+//loanStatusGuards hold the conditions a loan must meet before entering a status
+var loanStatusGuards = map[string]func(stub shim.ChaincodeStubInterface, loan *LoanApplication) error{
+	StatusApproved: func(stub shim.ChaincodeStubInterface, loan *LoanApplication) error {
+		if !loan.ApprovedAmount.IsPositive() {
+			return newError(ErrCodeFailedPrecondition, "Loan %s cannot be approved without a positive approved amount", loan.ID)
+		}
+		return nil
+	},
+	StatusSyndicated: func(stub shim.ChaincodeStubInterface, loan *LoanApplication) error {
+		if !loan.ApprovedAmount.IsPositive() {
+			return newError(ErrCodeFailedPrecondition, "Loan %s cannot be syndicated before an approved amount is set", loan.ID)
+		}
+		if loan.ReviewerId == "" {
+			return newError(ErrCodeFailedPrecondition, "Loan %s cannot be syndicated before a reviewer is recorded", loan.ID)
+		}
+		syndicate, err := fetchSyndicate(stub, loan.ID)
+		if err != nil {
+			return newError(ErrCodeFailedPrecondition, "Loan %s cannot be syndicated: %v", loan.ID, err)
+		}
+		//every member must still be able to take up its position
+		for _, member := range syndicate.Members {
+			participant, err := fetchParticipant(stub, member.ParticipantId)
+			if err != nil {
+				return newError(ErrCodeLedger, "Could not read participant %s: %v", member.ParticipantId, err)
+			}
+			err = validateLender(participant, member.ParticipantId)
+			if err != nil {
+				return err
+			}
+			position, err := fetchPosition(stub, member.ParticipantId, loan.ID)
+			if err != nil {
+				return newError(ErrCodeLedger, "Could not read position of %s in loan %s: %v", member.ParticipantId, loan.ID, err)
+			}
+			if position != nil {
+				return newError(ErrCodeAlreadyExists, "Participant %s already holds a position in loan %s", member.ParticipantId, loan.ID)
+			}
+		}
+		return nil
+	},
+	StatusRepaid: func(stub shim.ChaincodeStubInterface, loan *LoanApplication) error {
+		if !loan.OutStandingSettlementAmount.IsZero() {
+			return newError(ErrCodeFailedPrecondition, "Loan %s still has %s outstanding", loan.ID, loan.OutStandingSettlementAmount)
+		}
+		return nil
+	},
+}
+
+type LoanStatusChange struct {
+	LoanId string `json:"loanId"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Reason string `json:"reason,omitempty"`
+}
+
+//ReviewLoan takes a submitted loan under review; args are loan ID and reviewer ID
+func ReviewLoan(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering ReviewLoan")
+	if len(args) < 2 || args[1] == "" {
+		return nil, newError(ErrCodeInvalidArgument, "Expected loan application ID and reviewer ID")
+	}
+	return transitionLoan(stub, args[0], StatusUnderReview, "", func(loan *LoanApplication) error {
+		loan.ReviewerId = args[1]
+		return nil
+	})
+}
+
+//ApproveLoan approves a reviewed loan; args are loan ID and approved amount
+func ApproveLoan(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering ApproveLoan")
+	if len(args) < 2 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected loan application ID and approved amount")
+	}
+	return transitionLoan(stub, args[0], StatusApproved, "", func(loan *LoanApplication) error {
+		approvedAmount, err := ParseMoney(args[1], loan.Currency)
+		if err != nil || approvedAmount.Currency != loan.Currency {
+			return newError(ErrCodeInvalidArgument, "Invalid approved amount %s for a %s loan", args[1], loan.Currency)
+		}
+		if approvedAmount.Cmp(loan.DealAmount) > 0 {
+			return newError(ErrCodeInvalidArgument, "Approved amount %s exceeds the deal amount %s", approvedAmount, loan.DealAmount)
+		}
+		loan.ApprovedAmount = approvedAmount
+		return nil
+	})
+}
+
+//SyndicateLoan syndicates an approved loan and opens the position of every syndicate member, so
+//no lender has a commitment or exposure in a loan before it is syndicated; args are loan ID and
+//an optional reason
+func SyndicateLoan(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering SyndicateLoan")
+	bytes, err := transitionLoanArgs(stub, args, StatusSyndicated)
+	if err != nil {
+		return nil, err
+	}
+	//the guard has checked every member, from here on any failure aborts the transaction
+	loan, err := fetchLoan(stub, args[0])
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read loan application %s: %v", args[0], err)
+	}
+	syndicate, err := fetchSyndicate(stub, args[0])
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read syndicate for loan %s: %v", args[0], err)
+	}
+	for _, member := range syndicate.Members {
+		err = ParticipateLoan(stub, member, loan)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bytes, nil
+}
+
+func ActivateLoan(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering ActivateLoan")
+	return transitionLoanArgs(stub, args, StatusActive)
+}
+
+func MarkLoanRepaid(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering MarkLoanRepaid")
+	return transitionLoanArgs(stub, args, StatusRepaid)
+}
+
+func DefaultLoan(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering DefaultLoan")
+	return transitionLoanArgs(stub, args, StatusDefaulted)
+}
+
+func RestructureLoan(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering RestructureLoan")
+	return transitionLoanArgs(stub, args, StatusRestructured)
+}
+
+func CancelLoan(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering CancelLoan")
+	return transitionLoanArgs(stub, args, StatusCancelled)
+}
+
+//transitionLoanArgs handles the transitions that take a loan ID and an optional reason
+func transitionLoanArgs(stub shim.ChaincodeStubInterface, args []string, to string) ([]byte, error) {
+	if len(args) < 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Missing loan application ID")
+	}
+	var reason = ""
+	if len(args) > 1 {
+		reason = args[1]
+	}
+	return transitionLoan(stub, args[0], to, reason, nil)
+}
+
+//transitionLoan applies update to the loan, then checks the transition is allowed and the
+//guard for the target status holds before saving the loan and raising a loanStatusChange event
+func transitionLoan(stub shim.ChaincodeStubInterface, loanId string, to string, reason string, update func(loan *LoanApplication) error) ([]byte, error) {
+	loan, err := fetchLoan(stub, loanId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read loan application %s: %v", loanId, err)
+	}
+	if loan == nil {
+		return nil, newError(ErrCodeNotFound, "Loan application %s does not exist", loanId)
+	}
+
+	var from = loan.Status
+	if !canTransition(from, to) {
+		return nil, newError(ErrCodeIllegalTransition, "Loan %s cannot move from %s to %s", loanId, from, to)
+	}
+	if update != nil {
+		err = update(loan)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if guard, ok := loanStatusGuards[to]; ok {
+		err = guard(stub, loan)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	loan.Status = to
+	bytes, err := saveLoan(stub, loan)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not save loan application %s: %v", loanId, err)
+	}
+	err = raiseStatusChange(stub, LoanStatusChange{LoanId: loanId, From: from, To: to, Reason: reason})
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Loan " + loanId + " moved from " + from + " to " + to)
+	return bytes, nil
+}
+
+func canTransition(from string, to string) bool {
+	for _, allowed := range loanTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+func raiseStatusChange(stub shim.ChaincodeStubInterface, change LoanStatusChange) error {
+	bytes, err := json.Marshal(&change)
+	if err != nil {
+		return err
+	}
+	return setEvent(stub, "loanStatusChange", string(bytes))
+}
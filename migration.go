@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//legacyLoanListKey held a copy of every loan before loans were stored under loan~<id>
+const legacyLoanListKey = "loanlist"
+
+//legacyParticipant is the participant layout stored under the bare participant ID, with a
+//global share and its positions inline
+type legacyParticipant struct {
+	Participant
+	SharePerCent int `json:"share"`
+}
+
+//AmountMigrationSummary counts the records rewritten with currency-labelled string amounts
+type AmountMigrationSummary struct {
+	Loans      int `json:"loans"`
+	Syndicates int `json:"syndicates"`
+	Positions  int `json:"positions"`
+}
+
+type MigrationSummary struct {
+	Loans        int `json:"loans"`
+	Participants int `json:"participants"`
+	Positions    int `json:"positions"`
+	Syndicates   int `json:"syndicates"`
+}
+
+//MigrateLoanList moves state written by earlier versions onto composite keys. It converts the
+//"loanlist" key and any loans stored under their bare ID, splits inline AssetLists into position
+//keys and rebuilds syndicates from the legacy global shares. Participants stored under their bare
+//ID are only known to the caller, so their IDs are passed as arguments. Running it twice is harmless.
+func MigrateLoanList(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering MigrateLoanList")
+
+	var summary MigrationSummary
+
+	listBytes, err := stub.GetState(legacyLoanListKey)
+	if err != nil {
+		logger.Error("Could not fetch loanlist from ledger", err)
+		return nil, err
+	}
+	var legacyLoans []LoanApplication
+	if listBytes != nil {
+		err = json.Unmarshal(listBytes, &legacyLoans)
+		if err != nil {
+			logger.Error("Could not unmarshal loanlist", err)
+			return nil, err
+		}
+	}
+	for _, listed := range legacyLoans {
+		migrated, err := migrateLegacyLoan(stub, listed)
+		if err != nil {
+			return nil, err
+		}
+		if migrated {
+			summary.Loans++
+		}
+	}
+	if listBytes != nil {
+		err = stub.DelState(legacyLoanListKey)
+		if err != nil {
+			logger.Error("Could not delete loanlist from ledger", err)
+			return nil, err
+		}
+	}
+
+	var legacyMembers = make(map[string][]SyndicateMember)
+	for _, participantID := range args {
+		migrated, err := migrateLegacyParticipant(stub, participantID, legacyMembers, &summary)
+		if err != nil {
+			return nil, err
+		}
+		if migrated {
+			summary.Participants++
+		}
+	}
+
+	//participants registered under participant~<id> may still carry their positions inline
+	var inline []Participant
+	err = rangeQueryByPartialKey(stub, func(key string, value []byte) error {
+		var participant Participant
+		err := json.Unmarshal(value, &participant)
+		if err != nil {
+			logger.Error("Could not unmarshal participant "+key, err)
+			return err
+		}
+		if len(participant.AssetList) > 0 {
+			inline = append(inline, participant)
+		}
+		return nil
+	}, participantObjectType)
+	if err != nil {
+		return nil, err
+	}
+	for i := range inline {
+		moved, err := movePositions(stub, inline[i].ID, inline[i].AssetList)
+		if err != nil {
+			return nil, err
+		}
+		summary.Positions += moved
+		_, err = saveParticipant(stub, &inline[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	//sort the loan IDs so every peer writes the syndicates in the same order
+	var loanIds []string
+	for loanId := range legacyMembers {
+		loanIds = append(loanIds, loanId)
+	}
+	sort.Strings(loanIds)
+	for _, loanId := range loanIds {
+		rebuilt, err := rebuildLegacySyndicate(stub, loanId, legacyMembers[loanId])
+		if err != nil {
+			return nil, err
+		}
+		if rebuilt {
+			summary.Syndicates++
+		}
+	}
+
+	bytes, err := json.Marshal(&summary)
+	if err != nil {
+		return nil, err
+	}
+	err = setEvent(stub, "loanListMigration", string(bytes))
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Successfully migrated legacy loan state")
+	return bytes, nil
+}
+
+//migrateLegacyLoan prefers the copy stored under the bare loan ID, which settlements kept up to
+//date, over the snapshot taken into the loan list at creation time
+func migrateLegacyLoan(stub shim.ChaincodeStubInterface, listed LoanApplication) (bool, error) {
+	if listed.ID == "" {
+		return false, errors.New("Found a loan without an ID in the loanlist")
+	}
+	existing, err := fetchLoan(stub, listed.ID)
+	if err != nil {
+		return false, err
+	}
+	if existing != nil {
+		return false, nil
+	}
+
+	var loan = listed
+	rawBytes, err := stub.GetState(listed.ID)
+	if err != nil {
+		logger.Error("Could not fetch legacy loan "+listed.ID+" from ledger", err)
+		return false, err
+	}
+	if rawBytes != nil {
+		err = json.Unmarshal(rawBytes, &loan)
+		if err != nil {
+			logger.Error("Could not unmarshal legacy loan "+listed.ID, err)
+			return false, err
+		}
+		err = stub.DelState(listed.ID)
+		if err != nil {
+			logger.Error("Could not delete legacy loan "+listed.ID+" from ledger", err)
+			return false, err
+		}
+	}
+	err = loan.normalizeCurrency()
+	if err != nil {
+		return false, err
+	}
+	_, err = saveLoan(stub, &loan)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func migrateLegacyParticipant(stub shim.ChaincodeStubInterface, participantID string, legacyMembers map[string][]SyndicateMember, summary *MigrationSummary) (bool, error) {
+	rawBytes, err := stub.GetState(participantID)
+	if err != nil {
+		logger.Error("Could not fetch legacy participant "+participantID+" from ledger", err)
+		return false, err
+	}
+	if rawBytes == nil {
+		return false, nil
+	}
+	var legacy legacyParticipant
+	err = json.Unmarshal(rawBytes, &legacy)
+	if err != nil {
+		logger.Error("Could not unmarshal legacy participant "+participantID, err)
+		return false, err
+	}
+	if legacy.ID == "" {
+		legacy.ID = participantID
+	}
+
+	for _, asset := range legacy.AssetList {
+		legacyMembers[asset.AssetId] = append(legacyMembers[asset.AssetId], SyndicateMember{
+			ParticipantId: legacy.ID,
+			ShareBps:      legacy.SharePerCent * FullShareBps / 100,
+		})
+	}
+	moved, err := movePositions(stub, legacy.ID, legacy.AssetList)
+	if err != nil {
+		return false, err
+	}
+	summary.Positions += moved
+
+	//legacy participants carry no LEI, roles or settlement account; they keep working for
+	//existing positions and must be completed with UpdateParticipant before joining new loans
+	existing, err := fetchParticipant(stub, legacy.ID)
+	if err != nil {
+		return false, err
+	}
+	if existing == nil {
+		var participant = legacy.Participant
+		if participant.Status == "" {
+			participant.Status = ParticipantActive
+		}
+		_, err = saveParticipant(stub, &participant)
+		if err != nil {
+			return false, err
+		}
+	}
+	err = stub.DelState(participantID)
+	if err != nil {
+		logger.Error("Could not delete legacy participant "+participantID+" from ledger", err)
+		return false, err
+	}
+	return true, nil
+}
+
+func movePositions(stub shim.ChaincodeStubInterface, participantID string, assets []Asset) (int, error) {
+	var moved = 0
+	for i := range assets {
+		existing, err := fetchPosition(stub, participantID, assets[i].AssetId)
+		if err != nil {
+			return moved, err
+		}
+		if existing != nil {
+			continue
+		}
+		err = savePosition(stub, participantID, &assets[i])
+		if err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+//rebuildLegacySyndicate derives commitments from the legacy percentage shares; loans whose
+//legacy shares do not add up to a valid syndicate are left for the agent to fix by hand
+func rebuildLegacySyndicate(stub shim.ChaincodeStubInterface, loanId string, members []SyndicateMember) (bool, error) {
+	existing, err := stub.GetState(syndicateKey(loanId))
+	if err != nil {
+		logger.Error("Could not fetch syndicate for loan "+loanId+" from ledger", err)
+		return false, err
+	}
+	if existing != nil {
+		return false, nil
+	}
+	loan, err := fetchLoan(stub, loanId)
+	if err != nil {
+		return false, err
+	}
+	if loan == nil {
+		logger.Warning("Skipping syndicate for unknown legacy loan " + loanId)
+		return false, nil
+	}
+
+	var syndicate = Syndicate{LoanId: loanId, Members: members}
+	err = deriveCommitments(&syndicate, loan.DealAmount)
+	if err == nil {
+		err = syndicate.deriveShares()
+	}
+	if err == nil {
+		err = validateSyndicate(syndicate, loan.DealAmount)
+	}
+	if err != nil {
+		logger.Warning("Could not rebuild syndicate for legacy loan " + loanId + ": " + err.Error())
+		return false, nil
+	}
+	err = saveSyndicate(stub, &syndicate)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+//MigrateAmounts rewrites loans, syndicates and positions whose amounts were stored as plain
+//JSON numbers, including the float settlement fees, as Money strings in the loan currency.
+//Reads already accept the old numbers, so this only makes the stored state uniform.
+func MigrateAmounts(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering MigrateAmounts")
+
+	var summary AmountMigrationSummary
+	loans, err := fetchLoans(stub)
+	if err != nil {
+		return nil, err
+	}
+	var currencies = make(map[string]string)
+	for i := range loans {
+		currencies[loans[i].ID] = loans[i].Currency
+		_, err = saveLoan(stub, &loans[i])
+		if err != nil {
+			return nil, err
+		}
+		summary.Loans++
+
+		syndicateBytes, err := stub.GetState(syndicateKey(loans[i].ID))
+		if err != nil {
+			logger.Error("Could not fetch syndicate for loan "+loans[i].ID+" from ledger", err)
+			return nil, err
+		}
+		if syndicateBytes == nil {
+			continue
+		}
+		syndicate, err := fetchSyndicate(stub, loans[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		syndicate.LoanId = loans[i].ID
+		for j := range syndicate.Members {
+			syndicate.Members[j].CommitmentAmount, err = syndicate.Members[j].CommitmentAmount.InCurrency(loans[i].Currency)
+			if err != nil {
+				return nil, newError(ErrCodeInvalidArgument, "Syndicate for loan %s: %v", loans[i].ID, err)
+			}
+		}
+		err = saveSyndicate(stub, syndicate)
+		if err != nil {
+			return nil, err
+		}
+		summary.Syndicates++
+	}
+
+	//collect first so the range query is not open while positions are written back
+	var holders []string
+	var positions []Asset
+	err = rangeQueryByPartialKey(stub, func(key string, value []byte) error {
+		var asset Asset
+		err := json.Unmarshal(value, &asset)
+		if err != nil {
+			logger.Error("Could not unmarshal position "+key, err)
+			return err
+		}
+		_, attributes := splitCompositeKey(key)
+		holders = append(holders, attributes[0])
+		positions = append(positions, asset)
+		return nil
+	}, positionObjectType)
+	if err != nil {
+		return nil, err
+	}
+	for i := range positions {
+		currency, ok := currencies[positions[i].AssetId]
+		if !ok {
+			logger.Warning("Skipping position of " + holders[i] + " in unknown loan " + positions[i].AssetId)
+			continue
+		}
+		err = positions[i].normalizeCurrency(currency)
+		if err != nil {
+			return nil, err
+		}
+		err = savePosition(stub, holders[i], &positions[i])
+		if err != nil {
+			return nil, err
+		}
+		summary.Positions++
+	}
+
+	bytes, err := json.Marshal(&summary)
+	if err != nil {
+		return nil, err
+	}
+	err = setEvent(stub, "amountMigration", string(bytes))
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Successfully migrated amounts to Money")
+	return bytes, nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+//DefaultCurrency is assumed for loans written before amounts carried a currency
+const DefaultCurrency = "USD"
+
+//defaultMinorUnits applies to amounts whose currency has not been set yet
+const defaultMinorUnits = 2
+
+//currencyMinorUnits lists the active ISO 4217 currencies with their number of minor units.
+//Loans, positions and FX rates may only use these codes.
+var currencyMinorUnits = map[string]int{
+	"AED": 2, "AFN": 2, "ALL": 2, "AMD": 2, "ANG": 2, "AOA": 2, "ARS": 2, "AUD": 2, "AWG": 2, "AZN": 2,
+	"BAM": 2, "BBD": 2, "BDT": 2, "BGN": 2, "BHD": 3, "BIF": 0, "BMD": 2, "BND": 2, "BOB": 2, "BRL": 2,
+	"BSD": 2, "BTN": 2, "BWP": 2, "BYN": 2, "BZD": 2, "CAD": 2, "CDF": 2, "CHF": 2, "CLP": 0, "CNY": 2,
+	"COP": 2, "CRC": 2, "CUP": 2, "CVE": 2, "CZK": 2, "DJF": 0, "DKK": 2, "DOP": 2, "DZD": 2, "EGP": 2,
+	"ERN": 2, "ETB": 2, "EUR": 2, "FJD": 2, "FKP": 2, "GBP": 2, "GEL": 2, "GHS": 2, "GIP": 2, "GMD": 2,
+	"GNF": 0, "GTQ": 2, "GYD": 2, "HKD": 2, "HNL": 2, "HTG": 2, "HUF": 2, "IDR": 2, "ILS": 2, "INR": 2,
+	"IQD": 3, "IRR": 2, "ISK": 0, "JMD": 2, "JOD": 3, "JPY": 0, "KES": 2, "KGS": 2, "KHR": 2, "KMF": 0,
+	"KPW": 2, "KRW": 0, "KWD": 3, "KYD": 2, "KZT": 2, "LAK": 2, "LBP": 2, "LKR": 2, "LRD": 2, "LSL": 2,
+	"LYD": 3, "MAD": 2, "MDL": 2, "MGA": 2, "MKD": 2, "MMK": 2, "MNT": 2, "MOP": 2, "MRU": 2, "MUR": 2,
+	"MVR": 2, "MWK": 2, "MXN": 2, "MYR": 2, "MZN": 2, "NAD": 2, "NGN": 2, "NIO": 2, "NOK": 2, "NPR": 2,
+	"NZD": 2, "OMR": 3, "PAB": 2, "PEN": 2, "PGK": 2, "PHP": 2, "PKR": 2, "PLN": 2, "PYG": 0, "QAR": 2,
+	"RON": 2, "RSD": 2, "RUB": 2, "RWF": 0, "SAR": 2, "SBD": 2, "SCR": 2, "SDG": 2, "SEK": 2, "SGD": 2,
+	"SHP": 2, "SLE": 2, "SOS": 2, "SRD": 2, "SSP": 2, "STN": 2, "SVC": 2, "SYP": 2, "SZL": 2, "THB": 2,
+	"TJS": 2, "TMT": 2, "TND": 3, "TOP": 2, "TRY": 2, "TTD": 2, "TWD": 2, "TZS": 2, "UAH": 2, "UGX": 0,
+	"USD": 2, "UYU": 2, "UZS": 2, "VES": 2, "VND": 0, "VUV": 0, "WST": 2, "XAF": 0, "XCD": 2, "XOF": 0,
+	"XPF": 0, "YER": 2, "ZAR": 2, "ZMW": 2, "ZWL": 2,
+}
+
+//Money is a fixed-point amount held as an integer count of the minor unit of its currency,
+//e.g. cents for USD. It is encoded in JSON as a string such as "40000.00 USD"; bare JSON
+//numbers written by earlier versions are still accepted when decoding.
+type Money struct {
+	Minor    int64
+	Currency string
+}
+
+//validateCurrency checks that currency is an active ISO 4217 code
+func validateCurrency(currency string) error {
+	if _, ok := currencyMinorUnits[currency]; !ok {
+		return errors.New("Unknown ISO 4217 currency '" + currency + "'")
+	}
+	return nil
+}
+
+func minorUnits(currency string) int {
+	if units, ok := currencyMinorUnits[currency]; ok {
+		return units
+	}
+	return defaultMinorUnits
+}
+
+func pow10(n int) int64 {
+	var result int64 = 1
+	for i := 0; i < n; i++ {
+		result *= 10
+	}
+	return result
+}
+
+//NewMoney returns a whole number of major units, e.g. NewMoney(40000, "USD") is 40000.00 USD
+func NewMoney(units int64, currency string) Money {
+	return Money{Minor: units * pow10(minorUnits(currency)), Currency: currency}
+}
+
+func ZeroMoney(currency string) Money {
+	return Money{Currency: currency}
+}
+
+//ParseMoney reads "1250.50" or "1250.50 EUR". The currency in the text wins over
+//defaultCurrency, and more decimals than the currency allows is an error rather than a rounding.
+func ParseMoney(text string, defaultCurrency string) (Money, error) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || len(fields) > 2 {
+		return Money{}, errors.New("Invalid amount '" + text + "'")
+	}
+	var currency = defaultCurrency
+	if len(fields) == 2 {
+		currency = fields[1]
+		err := validateCurrency(currency)
+		if err != nil {
+			return Money{}, err
+		}
+	}
+	minor, exact, err := parseDecimal(fields[0], minorUnits(currency))
+	if err != nil {
+		return Money{}, err
+	}
+	if !exact {
+		return Money{}, errors.New("Amount '" + text + "' has more decimals than " + currencyLabel(currency) + " allows")
+	}
+	return Money{Minor: minor, Currency: currency}, nil
+}
+
+//parseDecimal converts a plain decimal string to an integer scaled by 10^scale, rounding half
+//away from zero; exact reports whether any digits were dropped
+func parseDecimal(text string, scale int) (int64, bool, error) {
+	var negative = strings.HasPrefix(text, "-")
+	var digits = strings.TrimPrefix(strings.TrimPrefix(text, "-"), "+")
+	parts := strings.SplitN(digits, ".", 2)
+	var whole, fraction = parts[0], ""
+	if len(parts) == 2 {
+		fraction = parts[1]
+	}
+	if whole == "" && fraction == "" || strings.ContainsAny(digits, "eE") {
+		return 0, false, errors.New("Invalid amount '" + text + "'")
+	}
+	if whole == "" {
+		whole = "0"
+	}
+
+	var exact = true
+	var roundUp = false
+	if len(fraction) > scale {
+		roundUp = fraction[scale] >= '5'
+		exact = strings.Trim(fraction[scale:], "0") == ""
+		fraction = fraction[:scale]
+	}
+	fraction = fraction + strings.Repeat("0", scale-len(fraction))
+
+	value, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return 0, false, errors.New("Invalid amount '" + text + "'")
+	}
+	if roundUp {
+		value++
+	}
+	if negative {
+		value = -value
+	}
+	return value, exact, nil
+}
+
+func currencyLabel(currency string) string {
+	if currency == "" {
+		return "an amount without currency"
+	}
+	return currency
+}
+
+func (m Money) String() string {
+	var units = minorUnits(m.Currency)
+	var minor = m.Minor
+	var sign = ""
+	if minor < 0 {
+		sign = "-"
+		minor = -minor
+	}
+	var text = strconv.FormatInt(minor/pow10(units), 10)
+	if units > 0 {
+		var fraction = strconv.FormatInt(minor%pow10(units), 10)
+		text = text + "." + strings.Repeat("0", units-len(fraction)) + fraction
+	}
+	if m.Currency != "" {
+		text = text + " " + m.Currency
+	}
+	return sign + text
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+//UnmarshalJSON accepts the string form and, for state written before Money existed, plain
+//numbers in major units such as 40000 or the float settlement fees 131.5068493150685
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var text string
+	if len(data) > 0 && data[0] == '"' {
+		err := json.Unmarshal(data, &text)
+		if err != nil {
+			return err
+		}
+		if text == "" {
+			*m = Money{}
+			return nil
+		}
+		parsed, err := ParseMoney(text, "")
+		if err != nil {
+			return err
+		}
+		*m = parsed
+		return nil
+	}
+
+	var number json.Number
+	err := json.Unmarshal(data, &number)
+	if err != nil {
+		return err
+	}
+	var decimal = number.String()
+	if strings.ContainsAny(decimal, "eE") {
+		value, err := number.Float64()
+		if err != nil {
+			return err
+		}
+		decimal = strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	minor, _, err := parseDecimal(decimal, defaultMinorUnits)
+	if err != nil {
+		return err
+	}
+	*m = Money{Minor: minor}
+	return nil
+}
+
+//InCurrency labels an amount that has no currency yet, rescaling it to the currency's minor
+//units. Amounts that already have a different currency are rejected; use FX conversion instead.
+func (m Money) InCurrency(currency string) (Money, error) {
+	if m.Currency == currency {
+		return m, nil
+	}
+	if m.Currency != "" {
+		return m, errors.New("Amount " + m.String() + " is not in " + currency)
+	}
+	var from, to = minorUnits(m.Currency), minorUnits(currency)
+	var minor = m.Minor
+	if to > from {
+		minor = minor * pow10(to-from)
+	} else if to < from {
+		if minor%pow10(from-to) != 0 {
+			return m, errors.New("Amount " + m.String() + " has more decimals than " + currency + " allows")
+		}
+		minor = minor / pow10(from-to)
+	}
+	return Money{Minor: minor, Currency: currency}, nil
+}
+
+//Add and Sub assume both amounts share a currency, which is checked when amounts enter the
+//ledger; the result keeps whichever currency is set
+func (m Money) Add(other Money) Money {
+	return Money{Minor: m.Minor + other.Minor, Currency: pickCurrency(m, other)}
+}
+
+func (m Money) Sub(other Money) Money {
+	return Money{Minor: m.Minor - other.Minor, Currency: pickCurrency(m, other)}
+}
+
+func pickCurrency(a Money, b Money) string {
+	if a.Currency != "" {
+		return a.Currency
+	}
+	return b.Currency
+}
+
+func (m Money) Cmp(other Money) int {
+	switch {
+	case m.Minor < other.Minor:
+		return -1
+	case m.Minor > other.Minor:
+		return 1
+	}
+	return 0
+}
+
+func (m Money) IsZero() bool {
+	return m.Minor == 0
+}
+
+func (m Money) IsPositive() bool {
+	return m.Minor > 0
+}
+
+func (m Money) IsNegative() bool {
+	return m.Minor < 0
+}
+
+//MulDiv returns m * numerator / denominator truncated towards zero in minor units
+func (m Money) MulDiv(numerator int64, denominator int64) Money {
+	var result = new(big.Int).Mul(big.NewInt(m.Minor), big.NewInt(numerator))
+	result.Quo(result, big.NewInt(denominator))
+	return Money{Minor: result.Int64(), Currency: m.Currency}
+}
+
+//Rat returns the amount in major units
+func (m Money) Rat() *big.Rat {
+	return new(big.Rat).SetFrac(big.NewInt(m.Minor), big.NewInt(pow10(minorUnits(m.Currency))))
+}
+
+//MoneyFromRat rounds an amount in major units to the nearest minor unit, halves away from zero
+func MoneyFromRat(value *big.Rat, currency string) Money {
+	var scaled = new(big.Rat).Mul(value, new(big.Rat).SetInt64(pow10(minorUnits(currency))))
+	return Money{Minor: roundRat(scaled), Currency: currency}
+}
+
+func roundRat(value *big.Rat) int64 {
+	var quotient, remainder = new(big.Int).QuoRem(value.Num(), value.Denom(), new(big.Int))
+	var twice = new(big.Int).Mul(new(big.Int).Abs(remainder), big.NewInt(2))
+	if twice.Cmp(value.Denom()) >= 0 {
+		if value.Sign() < 0 {
+			quotient.Sub(quotient, big.NewInt(1))
+		} else {
+			quotient.Add(quotient, big.NewInt(1))
+		}
+	}
+	return quotient.Int64()
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const paymentObjectType = "payment"
+
+//Waterfall buckets an incoming borrower payment is applied to
+const (
+	BucketAgencyFees         = "AgencyFees"
+	BucketDefaultInterest    = "DefaultInterest"
+	BucketAccruedInterest    = "AccruedInterest"
+	BucketFees               = "Fees"
+	BucketScheduledPrincipal = "ScheduledPrincipal"
+	BucketPrepayment         = "Prepayment"
+)
+
+//DefaultPaymentWaterfall is the order in which payments are applied on loans that do not set
+//their own PaymentWaterfall
+var DefaultPaymentWaterfall = []string{BucketAgencyFees, BucketDefaultInterest, BucketAccruedInterest, BucketFees, BucketScheduledPrincipal, BucketPrepayment}
+
+//Payment records how a borrower payment was applied through the waterfall and what every
+//participant received from each bucket
+type Payment struct {
+	ID            string                `json:"id"`
+	LoanId        string                `json:"loanId"`
+	Amount        Money                 `json:"amount"`
+	ValueDate     string                `json:"valueDate"`
+	Buckets       []PaymentBucket       `json:"buckets"`
+	Distributions []PaymentDistribution `json:"distributions"`
+	Charges       []FeeCharge           `json:"charges,omitempty"`
+	ReceivedBy    string                `json:"receivedBy"`
+	TxId          string                `json:"txId"`
+}
+
+//FeeCharge is a fee the payment triggered, e.g. a prepayment fee, which is invoiced at once and
+//collected by later payments
+type FeeCharge struct {
+	FeeId  string `json:"feeId"`
+	Amount Money  `json:"amount"`
+}
+
+//PaymentBucket is what was owed in a bucket when the payment arrived and how much of it was paid
+type PaymentBucket struct {
+	Bucket string `json:"bucket"`
+	Due    Money  `json:"due"`
+	Paid   Money  `json:"paid"`
+}
+
+type PaymentDistribution struct {
+	ParticipantId string         `json:"participantId"`
+	Total         Money          `json:"total"`
+	Buckets       []BucketAmount `json:"buckets"`
+}
+
+type BucketAmount struct {
+	Bucket string `json:"bucket"`
+	Amount Money  `json:"amount"`
+}
+
+func paymentKey(loanId string, paymentId string) string {
+	return compositeKey(paymentObjectType, loanId, paymentId)
+}
+
+//fetchPayments returns the payments received on a loan in the order they were received
+func fetchPayments(stub shim.ChaincodeStubInterface, loanId string) ([]Payment, error) {
+	var payments = []Payment{}
+	err := rangeQueryByPartialKey(stub, func(key string, value []byte) error {
+		var payment Payment
+		err := json.Unmarshal(value, &payment)
+		if err != nil {
+			logger.Error("Could not unmarshal payment "+key, err)
+			return err
+		}
+		payments = append(payments, payment)
+		return nil
+	}, paymentObjectType, loanId)
+	if err != nil {
+		return nil, err
+	}
+	//keys sort pm10 before pm2, the sequence number gives the order of receipt
+	var sequence = func(payment Payment) int {
+		number, _ := strconv.Atoi(strings.TrimPrefix(payment.ID, PaymentIdPrefix))
+		return number
+	}
+	sort.SliceStable(payments, func(i, j int) bool {
+		return sequence(payments[i]) < sequence(payments[j])
+	})
+	return payments, nil
+}
+
+//distributedTo returns what the participant received from a bucket of the payment
+func (payment *Payment) distributedTo(participantId string, bucket string) Money {
+	var total = ZeroMoney(payment.Amount.Currency)
+	for _, distribution := range payment.Distributions {
+		if distribution.ParticipantId != participantId {
+			continue
+		}
+		for _, amount := range distribution.Buckets {
+			if amount.Bucket == bucket {
+				total = total.Add(amount.Amount)
+			}
+		}
+	}
+	return total
+}
+
+//validateWaterfall accepts any order of known buckets; a bucket left out is never paid from
+//borrower payments, an empty waterfall means DefaultPaymentWaterfall
+func validateWaterfall(waterfall []string) error {
+	var seen = map[string]bool{}
+	for _, bucket := range waterfall {
+		if !containsString(DefaultPaymentWaterfall, bucket) {
+			return newError(ErrCodeInvalidArgument, "Unknown payment waterfall bucket %s", bucket)
+		}
+		if seen[bucket] {
+			return newError(ErrCodeInvalidArgument, "Payment waterfall lists %s twice", bucket)
+		}
+		seen[bucket] = true
+	}
+	return nil
+}
+
+func (loan *LoanApplication) paymentWaterfall() []string {
+	if len(loan.PaymentWaterfall) == 0 {
+		return DefaultPaymentWaterfall
+	}
+	return loan.PaymentWaterfall
+}
+
+//ReceivePayment applies a borrower payment through the loan's waterfall; args are loan ID,
+//amount and value date (YYYY-MM-DD). Every position is first accrued to the value date. Each
+//bucket is paid in full before the next one and is split across the syndicate pro rata:
+//accrued interest by what each position has accrued,
+//fees by what each participant's fee ledger has invoiced and principal by share. Payments
+//beyond what is owed are rejected. Principal paid ahead of the repayment schedule, or before
+//maturity on a loan without one, is a prepayment and charges the loan's prepayment fees.
+//Principal and interest a member receives are passed through to its funded sub-participants.
+func ReceivePayment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering ReceivePayment")
+	if len(args) < 3 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected loan application ID, amount and value date")
+	}
+	var loanId = args[0]
+	var valueDate = args[2]
+	_, err := ParseDate(valueDate)
+	if err != nil {
+		return nil, rejectPayment(stub, loanId, args[1], newError(ErrCodeInvalidArgument, "Invalid value date: %v", err))
+	}
+
+	loan, err := fetchLoan(stub, loanId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read loan application %s: %v", loanId, err)
+	}
+	if loan == nil {
+		return nil, rejectPayment(stub, loanId, args[1], newError(ErrCodeNotFound, "Loan application %s not found", loanId))
+	}
+	if !containsString(repaymentStatuses, loan.Status) {
+		return nil, rejectPayment(stub, loanId, args[1], newError(ErrCodeFailedPrecondition, "Loan %s cannot receive payments in status %s", loanId, loan.Status))
+	}
+	amount, err := ParseMoney(args[1], loan.Currency)
+	if err != nil {
+		return nil, rejectPayment(stub, loanId, args[1], newError(ErrCodeInvalidArgument, "%v", err))
+	}
+	if amount.Currency != loan.Currency {
+		return nil, rejectPayment(stub, loanId, args[1], newError(ErrCodeInvalidArgument, "Payment %s is not in the loan currency %s", amount, loan.Currency))
+	}
+	if !amount.IsPositive() {
+		return nil, rejectPayment(stub, loanId, args[1], newError(ErrCodeInvalidArgument, "Payment amount %s must be positive", amount))
+	}
+	syndicate, err := fetchSyndicate(stub, loanId)
+	if err != nil {
+		return nil, rejectPayment(stub, loanId, args[1], newError(ErrCodeFailedPrecondition, "Loan %s cannot receive payments: %v", loanId, err))
+	}
+
+	schedule, err := fetchInterestSchedule(stub, loanId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read interest schedule for loan %s: %v", loanId, err)
+	}
+
+	//read every position before writing any so a missing one leaves the ledger untouched, and
+	//accrue it to the value date before any principal is repaid
+	var positions = make([]*Asset, len(syndicate.Members))
+	var accrued = make([]Money, len(syndicate.Members))
+	var accruedTotal = ZeroMoney(loan.Currency)
+	for i, member := range syndicate.Members {
+		positions[i], err = fetchPosition(stub, member.ParticipantId, loanId)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not read position of %s in loan %s: %v", member.ParticipantId, loanId, err)
+		}
+		if positions[i] == nil {
+			return nil, newError(ErrCodeNotFound, "Participant %s holds no position in loan %s", member.ParticipantId, loanId)
+		}
+		err = positions[i].normalizeCurrency(loan.Currency)
+		if err != nil {
+			return nil, err
+		}
+		interest, err := accrueSince(stub, schedule, loan, member.ParticipantId, positions[i], valueDate)
+		if err != nil {
+			return nil, err
+		}
+		positions[i].AccruedInterest = positions[i].AccruedInterest.Add(interest)
+		accrued[i] = positions[i].AccruedInterest
+		accruedTotal = accruedTotal.Add(accrued[i])
+	}
+	repayments, err := fetchRepaymentSchedule(stub, loanId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read repayment schedule for loan %s: %v", loanId, err)
+	}
+	ledgers, err := fetchFeeLedgers(stub, loanId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read fee ledgers of loan %s: %v", loanId, err)
+	}
+	//principal owed by the value date is scheduled and only what is paid ahead of that is a
+	//prepayment: a matured loan owes all of it, a loan without a repayment schedule is repaid
+	//in one bullet at maturity, and one without a maturity either is repaid ad hoc
+	var scheduledDue = ZeroMoney(loan.Currency)
+	switch {
+	case loan.MaturityDate != "" && valueDate >= loan.MaturityDate:
+		scheduledDue = loan.OutStandingSettlementAmount
+	case repayments != nil:
+		scheduledDue = repayments.dueBy(valueDate, loan.Currency)
+	case loan.MaturityDate == "":
+		scheduledDue = loan.OutStandingSettlementAmount
+	}
+	if scheduledDue.Cmp(loan.OutStandingSettlementAmount) > 0 {
+		scheduledDue = loan.OutStandingSettlementAmount
+	}
+	var due = map[string]Money{
+		BucketAgencyFees:         loan.AgencyFeesDue,
+		BucketDefaultInterest:    loan.DefaultInterestDue,
+		BucketAccruedInterest:    accruedTotal,
+		BucketFees:               loan.FeesDue,
+		BucketScheduledPrincipal: scheduledDue,
+		BucketPrepayment:         loan.OutStandingSettlementAmount.Sub(scheduledDue),
+	}
+
+	var payment = Payment{LoanId: loanId, Amount: amount, ValueDate: valueDate, ReceivedBy: GetCaller(stub).Username, TxId: stub.GetTxID()}
+	var remaining = amount
+	for _, bucket := range loan.paymentWaterfall() {
+		var paid = due[bucket]
+		if remaining.Cmp(paid) < 0 {
+			paid = remaining
+		}
+		remaining = remaining.Sub(paid)
+		payment.Buckets = append(payment.Buckets, PaymentBucket{Bucket: bucket, Due: due[bucket], Paid: paid})
+	}
+	if remaining.IsPositive() {
+		return nil, rejectPayment(stub, loanId, args[1], newError(ErrCodeFailedPrecondition, "Payment %s exceeds what is owed on loan %s by %s", amount, loanId, remaining))
+	}
+
+	//split every bucket before applying any of them; an agent outside the syndicate is listed
+	//after the members
+	var distributions []PaymentDistribution
+	var distributionIndex = map[string]int{}
+	var addDistribution = func(participantId string) int {
+		distributionIndex[participantId] = len(distributions)
+		distributions = append(distributions, PaymentDistribution{ParticipantId: participantId, Total: ZeroMoney(loan.Currency)})
+		return len(distributions) - 1
+	}
+	for _, member := range syndicate.Members {
+		addDistribution(member.ParticipantId)
+	}
+	var distribute = func(participantId string, bucket string, share Money) {
+		index, found := distributionIndex[participantId]
+		if !found {
+			index = addDistribution(participantId)
+		}
+		distributions[index].Total = distributions[index].Total.Add(share)
+		distributions[index].Buckets = append(distributions[index].Buckets, BucketAmount{Bucket: bucket, Amount: share})
+	}
+	var shares = map[string][]Money{}
+	var feeShares = map[string][]FeeShare{}
+	for _, paid := range payment.Buckets {
+		if !paid.Paid.IsPositive() {
+			continue
+		}
+		if paid.Bucket == BucketAgencyFees || paid.Bucket == BucketFees {
+			feeShares[paid.Bucket], err = splitFeePayment(paid.Bucket, paid.Paid, ledgers, syndicate)
+			if err != nil {
+				return nil, err
+			}
+			for _, share := range feeShares[paid.Bucket] {
+				distribute(share.ParticipantId, paid.Bucket, share.Amount)
+			}
+			continue
+		}
+		var parts []Money
+		if paid.Bucket == BucketAccruedInterest {
+			parts, err = AllocateByWeights(paid.Paid, accrued)
+		} else {
+			parts, err = syndicate.Allocate(paid.Paid)
+		}
+		if err != nil {
+			return nil, err
+		}
+		shares[paid.Bucket] = parts
+		for i, member := range syndicate.Members {
+			if parts[i].IsPositive() {
+				distribute(member.ParticipantId, paid.Bucket, parts[i])
+			}
+		}
+	}
+	payment.Distributions = distributions
+
+	var prepaid = ZeroMoney(loan.Currency)
+	for _, paid := range payment.Buckets {
+		if paid.Bucket == BucketPrepayment {
+			prepaid = paid.Paid
+		}
+	}
+	var chargeShares [][]FeeShare
+	for i := range loan.Fees {
+		var fee = &loan.Fees[i]
+		if fee.Type != FeePrepayment || !prepaid.IsPositive() {
+			continue
+		}
+		var charge = bpsOf(prepaid, fee.RateBps, big.NewRat(1, 1))
+		if fee.Basis == FeeBasisFlat {
+			charge = *fee.Amount
+		}
+		split, err := splitFee(fee, charge, syndicate)
+		if err != nil {
+			return nil, err
+		}
+		payment.Charges = append(payment.Charges, FeeCharge{FeeId: fee.ID, Amount: charge})
+		chargeShares = append(chargeShares, split)
+	}
+
+	//everything has been validated, from here on any failure aborts the transaction
+	for _, paid := range payment.Buckets {
+		switch paid.Bucket {
+		case BucketAgencyFees:
+			loan.AgencyFeesDue = loan.AgencyFeesDue.Sub(paid.Paid)
+		case BucketDefaultInterest:
+			loan.DefaultInterestDue = loan.DefaultInterestDue.Sub(paid.Paid)
+		case BucketFees:
+			loan.FeesDue = loan.FeesDue.Sub(paid.Paid)
+		case BucketAccruedInterest:
+			for i, share := range shares[paid.Bucket] {
+				positions[i].AccruedInterest = positions[i].AccruedInterest.Sub(share)
+			}
+		case BucketScheduledPrincipal, BucketPrepayment:
+			loan.repayPrincipal(paid.Paid)
+			for i, share := range shares[paid.Bucket] {
+				positions[i].repayPrincipal(loan, share)
+			}
+			if repayments == nil {
+				continue
+			}
+			if paid.Bucket == BucketScheduledPrincipal {
+				repayments.applyRepayment(paid.Paid)
+			} else {
+				repayments.applyPrepayment(paid.Paid)
+			}
+		}
+		for _, share := range feeShares[paid.Bucket] {
+			if share.Ledger != nil {
+				share.Ledger.pay(paid.Bucket, share.Amount, valueDate, stub.GetTxID())
+			}
+		}
+	}
+	for i, charge := range payment.Charges {
+		var fee = loan.fee(charge.FeeId)
+		fee.Invoiced = fee.Invoiced.Add(charge.Amount)
+		loan.FeesDue = loan.FeesDue.Add(charge.Amount)
+		for _, share := range chargeShares[i] {
+			var ledger = ledgerFor(&ledgers, loanId, share.ParticipantId)
+			var balance = ledger.balance(fee, loan.Currency)
+			balance.Invoiced = balance.Invoiced.Add(share.Amount)
+			ledger.record(fee.ID, FeeInvoiced, valueDate, share.Amount, stub.GetTxID())
+		}
+	}
+
+	payment.ID, err = NextID(stub, PaymentIdPrefix, func(id string) string { return paymentKey(loanId, id) })
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not allocate a payment ID: %v", err)
+	}
+	_, err = saveLoan(stub, loan)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not save loan application %s: %v", loanId, err)
+	}
+	if repayments != nil {
+		err = saveRepaymentSchedule(stub, repayments)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not save repayment schedule for loan %s: %v", loanId, err)
+		}
+	}
+	if schedule != nil {
+		_, err = saveInterestSchedule(stub, schedule)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not save interest schedule for loan %s: %v", loanId, err)
+		}
+	}
+	//what each member received of the given buckets
+	var received = func(i int, buckets ...string) Money {
+		var total = ZeroMoney(loan.Currency)
+		for _, bucket := range buckets {
+			if parts, found := shares[bucket]; found {
+				total = total.Add(parts[i])
+			}
+		}
+		return total
+	}
+	for i, member := range syndicate.Members {
+		err = savePosition(stub, member.ParticipantId, positions[i])
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not save position of %s in loan %s: %v", member.ParticipantId, loanId, err)
+		}
+		err = passThrough(stub, loanId, member.ParticipantId, valueDate, received(i, BucketScheduledPrincipal, BucketPrepayment), received(i, BucketAccruedInterest, BucketDefaultInterest))
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = saveFeeLedgers(stub, ledgers)
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := json.Marshal(&payment)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(paymentKey(loanId, payment.ID), bytes)
+	if err != nil {
+		logger.Error("Could not save payment "+payment.ID+" to ledger", err)
+		return nil, newError(ErrCodeLedger, "Could not save payment %s: %v", payment.ID, err)
+	}
+	err = setEvent(stub, "paymentReceived", string(bytes))
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Received payment " + payment.ID + " of " + amount.String() + " on loan " + loanId)
+	return bytes, nil
+}
+
+//GetPayments returns the payments received on a loan; args are loan ID and optionally a
+//participant ID, which limits the distributions to what that participant received
+func GetPayments(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering GetPayments")
+	if len(args) < 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected loan application ID")
+	}
+	payments, err := fetchPayments(stub, args[0])
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read payments of loan %s: %v", args[0], err)
+	}
+	if len(args) > 1 && args[1] != "" {
+		for i := range payments {
+			var distributions = payments[i].Distributions
+			payments[i].Distributions = nil
+			for _, distribution := range distributions {
+				if distribution.ParticipantId == args[1] {
+					payments[i].Distributions = append(payments[i].Distributions, distribution)
+				}
+			}
+		}
+	}
+	return json.Marshal(payments)
+}
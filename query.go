@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+const (
+	SortAscending  = "asc"
+	SortDescending = "desc"
+)
+
+//LoanQuery filters are combined with AND; empty strings and nil amounts match everything.
+//Amount bounds without a currency compare by value, with a currency they also match on it.
+type LoanQuery struct {
+	Status               string `json:"status"`
+	DealType             string `json:"dealType"`
+	DealId               string `json:"dealId"`
+	BaseRateType         string `json:"baseRateType"`
+	ParticipantId        string `json:"participantId"`
+	SpRating             string `json:"spRating"`
+	MoodyRating          string `json:"moodyRating"`
+	MinDealAmount        *Money `json:"minDealAmount"`
+	MaxDealAmount        *Money `json:"maxDealAmount"`
+	MinOutstandingAmount *Money `json:"minOutstandingAmount"`
+	MaxOutstandingAmount *Money `json:"maxOutstandingAmount"`
+	SortBy               string `json:"sortBy"`
+	SortOrder            string `json:"sortOrder"`
+	PageSize             int    `json:"pageSize"`
+	Bookmark             string `json:"bookmark"`
+}
+
+//LoanPage is the envelope returned by QueryLoans; Bookmark is empty on the last page
+type LoanPage struct {
+	Loans      []LoanApplication `json:"loans"`
+	Count      int               `json:"count"`
+	TotalCount int               `json:"totalCount"`
+	Bookmark   string            `json:"bookmark"`
+}
+
+//loanSortFields maps the sortBy values to a string that orders the same way as the field
+var loanSortFields = map[string]func(loan *LoanApplication) string{
+	"id":                          func(loan *LoanApplication) string { return loan.ID },
+	"status":                      func(loan *LoanApplication) string { return loan.Status },
+	"dealType":                    func(loan *LoanApplication) string { return loan.DealType },
+	"dealId":                      func(loan *LoanApplication) string { return loan.DealId },
+	"dealAmount":                  func(loan *LoanApplication) string { return sortableMoney(loan.DealAmount) },
+	"outstandingSettlementAmount": func(loan *LoanApplication) string { return sortableMoney(loan.OutStandingSettlementAmount) },
+	"lastModifiedDate":            func(loan *LoanApplication) string { return loan.LastModifiedDate },
+}
+
+//QueryLoans takes an optional LoanQuery JSON and returns one page of matching loans. Pages are
+//keyed on the sort value and loan ID of the last loan returned, so inserting loans between calls
+//never repeats or skips a loan that was already ahead of the bookmark.
+func QueryLoans(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering QueryLoans")
+
+	var query LoanQuery
+	if len(args) > 0 && args[0] != "" {
+		err := json.Unmarshal([]byte(args[0]), &query)
+		if err != nil {
+			logger.Error("Could not unmarshal loan query", err)
+			return nil, newError(ErrCodeInvalidArgument, "Could not parse loan query: %v", err)
+		}
+	}
+	err := normalizeLoanQuery(&query)
+	if err != nil {
+		return nil, err
+	}
+
+	loans, err := fetchLoans(stub)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read loans: %v", err)
+	}
+	var participantLoans map[string]bool
+	if query.ParticipantId != "" {
+		positions, err := fetchPositions(stub, query.ParticipantId)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not read positions of %s: %v", query.ParticipantId, err)
+		}
+		participantLoans = make(map[string]bool)
+		for _, asset := range positions {
+			participantLoans[asset.AssetId] = true
+		}
+	}
+
+	var matches []LoanApplication
+	for i := range loans {
+		if participantLoans != nil && !participantLoans[loans[i].ID] {
+			continue
+		}
+		if loanMatches(&loans[i], &query) {
+			matches = append(matches, loans[i])
+		}
+	}
+
+	var sortValue = loanSortFields[query.SortBy]
+	var descending = query.SortOrder == SortDescending
+	var less = func(aValue string, aId string, bValue string, bId string) bool {
+		if aValue != bValue {
+			return (aValue < bValue) != descending
+		}
+		if aId != bId {
+			return (aId < bId) != descending
+		}
+		return false
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return less(sortValue(&matches[i]), matches[i].ID, sortValue(&matches[j]), matches[j].ID)
+	})
+
+	var start = 0
+	if query.Bookmark != "" {
+		bookmarkValue, bookmarkId, err := decodeBookmark(query.Bookmark)
+		if err != nil {
+			return nil, err
+		}
+		start = sort.Search(len(matches), func(i int) bool {
+			return less(bookmarkValue, bookmarkId, sortValue(&matches[i]), matches[i].ID)
+		})
+	}
+	var end = start + query.PageSize
+	if end > len(matches) {
+		end = len(matches)
+	}
+
+	var page = LoanPage{Loans: []LoanApplication{}, TotalCount: len(matches)}
+	page.Loans = append(page.Loans, matches[start:end]...)
+	page.Count = len(page.Loans)
+	if end < len(matches) {
+		var last = &matches[end-1]
+		page.Bookmark = encodeBookmark(sortValue(last), last.ID)
+	}
+
+	bytes, err := json.Marshal(&page)
+	if err != nil {
+		logger.Error("Could not marshal loan page", err)
+		return nil, err
+	}
+	return bytes, nil
+}
+
+func normalizeLoanQuery(query *LoanQuery) error {
+	if query.SortBy == "" {
+		query.SortBy = "id"
+	}
+	if _, ok := loanSortFields[query.SortBy]; !ok {
+		return newError(ErrCodeInvalidArgument, "Cannot sort loans by %s", query.SortBy)
+	}
+	if query.SortOrder == "" {
+		query.SortOrder = SortAscending
+	}
+	if query.SortOrder != SortAscending && query.SortOrder != SortDescending {
+		return newError(ErrCodeInvalidArgument, "Sort order must be %s or %s", SortAscending, SortDescending)
+	}
+	if query.PageSize == 0 {
+		query.PageSize = defaultPageSize
+	}
+	if query.PageSize < 0 || query.PageSize > maxPageSize {
+		return newError(ErrCodeInvalidArgument, "Page size must be between 1 and %d", maxPageSize)
+	}
+	return nil
+}
+
+func loanMatches(loan *LoanApplication, query *LoanQuery) bool {
+	if query.Status != "" && loan.Status != query.Status {
+		return false
+	}
+	if query.DealType != "" && loan.DealType != query.DealType {
+		return false
+	}
+	if query.DealId != "" && loan.DealId != query.DealId {
+		return false
+	}
+	if query.BaseRateType != "" && loan.BaseRateType != query.BaseRateType {
+		return false
+	}
+	if query.SpRating != "" && loan.FinancialInfo.SpRating != query.SpRating {
+		return false
+	}
+	if query.MoodyRating != "" && loan.FinancialInfo.MoodyRating != query.MoodyRating {
+		return false
+	}
+	return inRange(loan.DealAmount, query.MinDealAmount, query.MaxDealAmount) &&
+		inRange(loan.OutStandingSettlementAmount, query.MinOutstandingAmount, query.MaxOutstandingAmount)
+}
+
+func inRange(value Money, min *Money, max *Money) bool {
+	if min != nil && (!sameOrNoCurrency(value, *min) || value.Rat().Cmp(min.Rat()) < 0) {
+		return false
+	}
+	if max != nil && (!sameOrNoCurrency(value, *max) || value.Rat().Cmp(max.Rat()) > 0) {
+		return false
+	}
+	return true
+}
+
+func sameOrNoCurrency(value Money, bound Money) bool {
+	return bound.Currency == "" || bound.Currency == value.Currency
+}
+
+//sortableMoney pads amounts, scaled to three decimals, so they sort numerically as strings;
+//amounts are never negative
+func sortableMoney(value Money) string {
+	const sortScale = 3
+	return fmt.Sprintf("%020d", value.Minor*pow10(sortScale-minorUnits(value.Currency)))
+}
+
+func encodeBookmark(sortValue string, loanId string) string {
+	return base64.URLEncoding.EncodeToString([]byte(sortValue + "\x00" + loanId))
+}
+
+func decodeBookmark(bookmark string) (string, string, error) {
+	decoded, err := base64.URLEncoding.DecodeString(bookmark)
+	if err != nil {
+		return "", "", newError(ErrCodeInvalidArgument, "Invalid bookmark %s", bookmark)
+	}
+	parts := strings.SplitN(string(decoded), "\x00", 2)
+	if len(parts) != 2 {
+		return "", "", newError(ErrCodeInvalidArgument, "Invalid bookmark %s", bookmark)
+	}
+	return parts[0], parts[1], nil
+}
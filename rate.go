@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+//rateDecimals is the precision of a Rate in decimals of a percent
+const rateDecimals = 6
+
+//Rate is an annual percentage held with rateDecimals fixed decimals, so 5.25% is
+//Rate{Scaled: 5250000}. It is encoded in JSON as a string such as "5.25"; the integer
+//percentages written by earlier versions are still accepted when decoding.
+type Rate struct {
+	Scaled int64
+}
+
+func NewRate(percent int64) Rate {
+	return Rate{Scaled: percent * pow10(rateDecimals)}
+}
+
+//ParseRate reads a percentage such as "5.25" or "-0.1"; more than rateDecimals decimals is an error
+func ParseRate(text string) (Rate, error) {
+	scaled, exact, err := parseDecimal(strings.TrimSpace(text), rateDecimals)
+	if err != nil {
+		return Rate{}, errors.New("Invalid rate '" + text + "'")
+	}
+	if !exact {
+		return Rate{}, errors.New("Rate '" + text + "' has more than " + strconv.Itoa(rateDecimals) + " decimals")
+	}
+	return Rate{Scaled: scaled}, nil
+}
+
+//RateFromRat rounds a percentage to rateDecimals, halves away from zero
+func RateFromRat(percent *big.Rat) Rate {
+	var scaled = new(big.Rat).Mul(percent, new(big.Rat).SetInt64(pow10(rateDecimals)))
+	return Rate{Scaled: roundRat(scaled)}
+}
+
+//String drops trailing zeros, so NewRate(5) is "5" and 5.25% is "5.25"
+func (r Rate) String() string {
+	var scaled = r.Scaled
+	var sign = ""
+	if scaled < 0 {
+		sign = "-"
+		scaled = -scaled
+	}
+	var text = strconv.FormatInt(scaled/pow10(rateDecimals), 10)
+	var fraction = strconv.FormatInt(scaled%pow10(rateDecimals), 10)
+	fraction = strings.TrimRight(strings.Repeat("0", rateDecimals-len(fraction))+fraction, "0")
+	if fraction != "" {
+		text = text + "." + fraction
+	}
+	return sign + text
+}
+
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func (r *Rate) UnmarshalJSON(data []byte) error {
+	var text string
+	if len(data) > 0 && data[0] == '"' {
+		err := json.Unmarshal(data, &text)
+		if err != nil {
+			return err
+		}
+	} else {
+		var number json.Number
+		err := json.Unmarshal(data, &number)
+		if err != nil {
+			return err
+		}
+		text = number.String()
+	}
+	if text == "" {
+		*r = Rate{}
+		return nil
+	}
+	parsed, err := ParseRate(text)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+//Rat returns the rate as a percentage
+func (r Rate) Rat() *big.Rat {
+	return big.NewRat(r.Scaled, pow10(rateDecimals))
+}
+
+func (r Rate) Add(other Rate) Rate {
+	return Rate{Scaled: r.Scaled + other.Scaled}
+}
+
+func (r Rate) Cmp(other Rate) int {
+	switch {
+	case r.Scaled < other.Scaled:
+		return -1
+	case r.Scaled > other.Scaled:
+		return 1
+	}
+	return 0
+}
+
+func (r Rate) IsNegative() bool {
+	return r.Scaled < 0
+}
+
+func (r Rate) IsPositive() bool {
+	return r.Scaled > 0
+}
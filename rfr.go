@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//Risk-free rate benchmarks are overnight rates published daily under RFRTenor and compounded in
+//arrears over each interest period
+const (
+	BenchmarkSOFR  = "SOFR"
+	BenchmarkSONIA = "SONIA"
+	BenchmarkESTR  = "ESTR"
+
+	RFRTenor = "ON"
+)
+
+//rfrDayBasis is the number of days in the year each benchmark is quoted on
+var rfrDayBasis = map[string]int64{
+	BenchmarkSOFR:  360,
+	BenchmarkSONIA: 365,
+	BenchmarkESTR:  360,
+}
+
+func isRFR(benchmark string) bool {
+	_, ok := rfrDayBasis[benchmark]
+	return ok
+}
+
+//RateObservation is one daily rate used in a compounded period: Rate was published on
+//FixingDate and applies for Days calendar days from Date
+type RateObservation struct {
+	Date       string `json:"date"`
+	FixingDate string `json:"fixingDate"`
+	Rate       Rate   `json:"rate"`
+	Days       int    `json:"days"`
+}
+
+//RateTerms are the rate fields of a loan that a benchmark transition replaces
+type RateTerms struct {
+	BaseRateType           string `json:"baseRateType"`
+	RateTenor              string `json:"rateTenor,omitempty"`
+	Spread                 Rate   `json:"spread"`
+	FixingLagDays          int    `json:"fixingLagDays,omitempty"`
+	CreditAdjustmentSpread *Rate  `json:"creditAdjustmentSpread,omitempty"`
+	LookbackDays           int    `json:"lookbackDays,omitempty"`
+	ObservationShift       bool   `json:"observationShift,omitempty"`
+	LockoutDays            int    `json:"lockoutDays,omitempty"`
+}
+
+//BenchmarkTransition is kept on the loan for every amendment; periods starting before
+//EffectiveDate keep using Previous
+type BenchmarkTransition struct {
+	EffectiveDate string    `json:"effectiveDate"`
+	Previous      RateTerms `json:"previous"`
+	Current       RateTerms `json:"current"`
+	TxId          string    `json:"txId"`
+}
+
+func (loan *LoanApplication) rateTerms() RateTerms {
+	return RateTerms{
+		BaseRateType:           loan.BaseRateType,
+		RateTenor:              loan.RateTenor,
+		Spread:                 loan.Spread,
+		FixingLagDays:          loan.FixingLagDays,
+		CreditAdjustmentSpread: loan.CreditAdjustmentSpread,
+		LookbackDays:           loan.LookbackDays,
+		ObservationShift:       loan.ObservationShift,
+		LockoutDays:            loan.LockoutDays,
+	}
+}
+
+func (loan *LoanApplication) applyRateTerms(terms RateTerms) {
+	loan.BaseRateType = terms.BaseRateType
+	loan.RateTenor = terms.RateTenor
+	loan.Spread = terms.Spread
+	loan.FixingLagDays = terms.FixingLagDays
+	loan.CreditAdjustmentSpread = terms.CreditAdjustmentSpread
+	loan.LookbackDays = terms.LookbackDays
+	loan.ObservationShift = terms.ObservationShift
+	loan.LockoutDays = terms.LockoutDays
+}
+
+//rateTermsOn returns the terms in force for a period starting on startDate, undoing later
+//benchmark transitions
+func (loan *LoanApplication) rateTermsOn(startDate string) RateTerms {
+	var terms = loan.rateTerms()
+	for i := len(loan.BenchmarkHistory) - 1; i >= 0; i-- {
+		if startDate < loan.BenchmarkHistory[i].EffectiveDate {
+			terms = loan.BenchmarkHistory[i].Previous
+		}
+	}
+	return terms
+}
+
+func validateRFRTerms(loanId string, terms RateTerms) error {
+	if terms.RateTenor != "" && terms.RateTenor != RFRTenor {
+		return newError(ErrCodeInvalidArgument, "Loan application %s on %s cannot use the term tenor %s", loanId, terms.BaseRateType, terms.RateTenor)
+	}
+	if terms.LookbackDays < 0 || terms.LockoutDays < 0 {
+		return newError(ErrCodeInvalidArgument, "Loan application %s has a negative lookback or lockout", loanId)
+	}
+	if terms.ObservationShift && terms.LookbackDays == 0 {
+		return newError(ErrCodeInvalidArgument, "Loan application %s needs a lookback for an observation shift", loanId)
+	}
+	if terms.CreditAdjustmentSpread != nil && terms.CreditAdjustmentSpread.IsNegative() {
+		return newError(ErrCodeInvalidArgument, "Loan application %s has a negative credit adjustment spread", loanId)
+	}
+	return nil
+}
+
+//Holidays are not modelled: every weekday is a business day, and a weekday without a
+//published fixing falls back to the latest earlier fixing like term benchmarks do
+func isBusinessDay(date time.Time) bool {
+	return date.Weekday() != time.Saturday && date.Weekday() != time.Sunday
+}
+
+func previousBusinessDay(date time.Time) time.Time {
+	for !isBusinessDay(date) {
+		date = date.AddDate(0, 0, -1)
+	}
+	return date
+}
+
+//addBusinessDays moves a business day by n business days, backwards when n is negative
+func addBusinessDays(date time.Time, n int) time.Time {
+	var step = 1
+	if n < 0 {
+		step, n = -1, -n
+	}
+	for n > 0 {
+		date = date.AddDate(0, 0, step)
+		if isBusinessDay(date) {
+			n--
+		}
+	}
+	return date
+}
+
+//RFRObservationDates lists the business days of a period and the calendar days each one's rate
+//applies for. Without an observation shift the period itself is observed and each rate is the
+//one published lookbackDays business days earlier; with a shift the whole window moves back by
+//lookbackDays. The last lockoutDays rates repeat the rate before them. The returned window
+//length is the day count the compounded rate is annualised over.
+func RFRObservationDates(start time.Time, end time.Time, lookbackDays int, observationShift bool, lockoutDays int) ([]RateObservation, int) {
+	var from, to = start, end
+	if observationShift {
+		from = addBusinessDays(previousBusinessDay(start), -lookbackDays)
+		to = addBusinessDays(previousBusinessDay(end), -lookbackDays)
+	}
+
+	var observations []RateObservation
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		var business = previousBusinessDay(day)
+		if len(observations) > 0 && observations[len(observations)-1].Date == business.Format(DateLayout) {
+			observations[len(observations)-1].Days++
+			continue
+		}
+		var fixingDate = business
+		if !observationShift {
+			fixingDate = addBusinessDays(business, -lookbackDays)
+		}
+		observations = append(observations, RateObservation{Date: business.Format(DateLayout), FixingDate: fixingDate.Format(DateLayout), Days: 1})
+	}
+
+	if lockoutDays > 0 && len(observations) > 1 {
+		var last = len(observations) - 1 - lockoutDays
+		if last < 0 {
+			last = 0
+		}
+		for i := last + 1; i < len(observations); i++ {
+			observations[i].FixingDate = observations[last].FixingDate
+		}
+	}
+	return observations, actualDays(from, to)
+}
+
+//CompoundedRate compounds daily rates in arrears and annualises the result over windowDays:
+//(prod(1 + r_i * n_i / basis) - 1) * basis / windowDays
+func CompoundedRate(observations []RateObservation, dayBasis int64, windowDays int) Rate {
+	if windowDays <= 0 {
+		return Rate{}
+	}
+	var product = big.NewRat(1, 1)
+	for _, observation := range observations {
+		var factor = new(big.Rat).Mul(observation.Rate.Rat(), big.NewRat(int64(observation.Days), 100*dayBasis))
+		product.Mul(product, factor.Add(factor, big.NewRat(1, 1)))
+	}
+	product.Sub(product, big.NewRat(1, 1))
+	product.Mul(product, big.NewRat(100*dayBasis, int64(windowDays)))
+	return RateFromRat(product)
+}
+
+//compoundedPeriodRate observes the published daily fixings of an RFR for a period
+func compoundedPeriodRate(stub shim.ChaincodeStubInterface, terms RateTerms, period *InterestPeriod) (Rate, []RateObservation, error) {
+	start, err := ParseDate(period.StartDate)
+	if err != nil {
+		return Rate{}, nil, err
+	}
+	end, err := ParseDate(period.EndDate)
+	if err != nil {
+		return Rate{}, nil, err
+	}
+	observations, windowDays := RFRObservationDates(start, end, terms.LookbackDays, terms.ObservationShift, terms.LockoutDays)
+	for i := range observations {
+		fixing, err := lookupFixing(stub, terms.BaseRateType, RFRTenor, observations[i].FixingDate)
+		if err != nil {
+			return Rate{}, nil, err
+		}
+		observations[i].FixingDate = fixing.Date
+		observations[i].Rate = fixing.Rate
+	}
+	return CompoundedRate(observations, rfrDayBasis[terms.BaseRateType], windowDays), observations, nil
+}
+
+//TransitionBenchmark amends a term-rate loan, e.g. on LIBOR, to a risk-free rate from an
+//effective date; args are loan ID and the new RateTerms as JSON plus "effectiveDate". With an
+//interest schedule the effective date must start a period that has not been accrued yet.
+func TransitionBenchmark(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering TransitionBenchmark")
+	if len(args) < 2 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected loan application ID and new rate terms")
+	}
+	var loanId = args[0]
+	var amendment struct {
+		RateTerms
+		EffectiveDate string `json:"effectiveDate"`
+	}
+	err := json.Unmarshal([]byte(args[1]), &amendment)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "Could not parse rate terms: %v", err)
+	}
+	_, err = ParseDate(amendment.EffectiveDate)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "Invalid effective date: %v", err)
+	}
+	if !isRFR(amendment.BaseRateType) {
+		return nil, newError(ErrCodeInvalidArgument, "%s is not a supported risk-free rate", amendment.BaseRateType)
+	}
+	amendment.RateTenor = RFRTenor
+	amendment.FixingLagDays = 0
+	err = validateRFRTerms(loanId, amendment.RateTerms)
+	if err != nil {
+		return nil, err
+	}
+
+	loan, err := fetchLoan(stub, loanId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read loan application %s: %v", loanId, err)
+	}
+	if loan == nil {
+		return nil, newError(ErrCodeNotFound, "Loan application %s not found", loanId)
+	}
+	if len(loanTransitions[loan.Status]) == 0 {
+		return nil, newError(ErrCodeFailedPrecondition, "Loan %s is %s and can no longer be amended", loanId, loan.Status)
+	}
+	if isRFR(loan.BaseRateType) {
+		return nil, newError(ErrCodeFailedPrecondition, "Loan %s already references %s", loanId, loan.BaseRateType)
+	}
+	var history = loan.BenchmarkHistory
+	if len(history) > 0 && amendment.EffectiveDate <= history[len(history)-1].EffectiveDate {
+		return nil, newError(ErrCodeInvalidArgument, "Effective date %s must follow the previous transition on %s", amendment.EffectiveDate, history[len(history)-1].EffectiveDate)
+	}
+
+	schedule, err := fetchInterestSchedule(stub, loanId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read interest schedule for loan %s: %v", loanId, err)
+	}
+	if schedule != nil {
+		var startsPeriod = false
+		for _, period := range schedule.Periods {
+			if period.StartDate == amendment.EffectiveDate {
+				startsPeriod = period.Status != PeriodAccrued
+			}
+			if period.Status == PeriodAccrued && period.EndDate > amendment.EffectiveDate {
+				return nil, newError(ErrCodeFailedPrecondition, "Loan %s has already accrued period %d past %s", loanId, period.Number, amendment.EffectiveDate)
+			}
+		}
+		if !startsPeriod {
+			return nil, newError(ErrCodeInvalidArgument, "Effective date %s does not start an open interest period of loan %s", amendment.EffectiveDate, loanId)
+		}
+	}
+
+	var transition = BenchmarkTransition{
+		EffectiveDate: amendment.EffectiveDate,
+		Previous:      loan.rateTerms(),
+		Current:       amendment.RateTerms,
+		TxId:          stub.GetTxID(),
+	}
+	loan.applyRateTerms(amendment.RateTerms)
+	loan.BenchmarkHistory = append(loan.BenchmarkHistory, transition)
+	loanBytes, err := saveLoan(stub, loan)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not save loan application %s: %v", loanId, err)
+	}
+
+	bytes, err := json.Marshal(&transition)
+	if err != nil {
+		return nil, err
+	}
+	err = setEvent(stub, "benchmarkTransition", string(bytes))
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Transitioned loan " + loanId + " to " + amendment.BaseRateType)
+	return loanBytes, nil
+}
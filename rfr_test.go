@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRFRObservationDates(t *testing.T) {
+	var cases = []struct {
+		name        string
+		lookback    int
+		shift       bool
+		lockout     int
+		dates       []string
+		fixingDates []string
+		days        []int
+		windowDays  int
+	}{
+		{"in arrears", 0, false, 0,
+			[]string{"2017-03-06", "2017-03-07", "2017-03-08", "2017-03-09", "2017-03-10"},
+			[]string{"2017-03-06", "2017-03-07", "2017-03-08", "2017-03-09", "2017-03-10"},
+			[]int{1, 1, 1, 1, 3}, 7},
+		{"lookback without shift", 2, false, 0,
+			[]string{"2017-03-06", "2017-03-07", "2017-03-08", "2017-03-09", "2017-03-10"},
+			[]string{"2017-03-02", "2017-03-03", "2017-03-06", "2017-03-07", "2017-03-08"},
+			[]int{1, 1, 1, 1, 3}, 7},
+		{"observation shift", 2, true, 0,
+			[]string{"2017-03-02", "2017-03-03", "2017-03-06", "2017-03-07", "2017-03-08"},
+			[]string{"2017-03-02", "2017-03-03", "2017-03-06", "2017-03-07", "2017-03-08"},
+			[]int{1, 3, 1, 1, 1}, 7},
+		{"lockout", 0, false, 2,
+			[]string{"2017-03-06", "2017-03-07", "2017-03-08", "2017-03-09", "2017-03-10"},
+			[]string{"2017-03-06", "2017-03-07", "2017-03-08", "2017-03-08", "2017-03-08"},
+			[]int{1, 1, 1, 1, 3}, 7},
+	}
+	start, _ := ParseDate("2017-03-06")
+	end, _ := ParseDate("2017-03-13")
+	for _, c := range cases {
+		observations, windowDays := RFRObservationDates(start, end, c.lookback, c.shift, c.lockout)
+		if len(observations) != len(c.dates) || windowDays != c.windowDays {
+			t.Fatalf("%s: expected %d observations over %d days, got %+v over %d", c.name, len(c.dates), c.windowDays, observations, windowDays)
+		}
+		for i, observation := range observations {
+			if observation.Date != c.dates[i] || observation.FixingDate != c.fixingDates[i] || observation.Days != c.days[i] {
+				t.Fatalf("%s: unexpected observation %d %+v", c.name, i, observation)
+			}
+		}
+	}
+}
+
+func TestCompoundedRate(t *testing.T) {
+	var rate = func(text string) Rate {
+		parsed, _ := ParseRate(text)
+		return parsed
+	}
+	var cases = []struct {
+		observations []RateObservation
+		basis        int64
+		windowDays   int
+		expected     string
+	}{
+		{[]RateObservation{{Rate: rate("3.65"), Days: 7}}, 365, 7, "3.65"},
+		{[]RateObservation{{Rate: rate("3.6"), Days: 1}, {Rate: rate("3.6"), Days: 1}}, 360, 2, "3.60018"},
+		{[]RateObservation{{Rate: rate("1"), Days: 1}, {Rate: rate("2"), Days: 3}}, 360, 4, "1.750042"},
+		{nil, 360, 0, "0"},
+	}
+	for _, c := range cases {
+		compounded := CompoundedRate(c.observations, c.basis, c.windowDays)
+		if compounded.String() != c.expected {
+			t.Fatalf("Expected %s, got %s", c.expected, compounded)
+		}
+	}
+}
@@ -4,9 +4,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math/rand"
+	"math/big"
 	"strconv"
-	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 )
@@ -15,6 +14,8 @@ import (
 var logger = shim.NewLogger("mylogger")
 
 type SampleChaincode struct {
+	//Authorizer checks every Invoke and Query; nil means the default RoleAuthorizer
+	Authorizer Authorizer
 }
 
 type PersonalInfo struct {
@@ -26,8 +27,8 @@ type PersonalInfo struct {
 }
 
 type FinancialInfo struct {
-	spRating      string `json:"spRating"`
-	moodyRating        string `json:"moodyRating"`
+	SpRating      string `json:"spRating"`
+	MoodyRating        string `json:"moodyRating"`
 	dcr   			   int `json:"dcr"`
 	turnover	   int `json:"turnover"`
 }
@@ -35,9 +36,20 @@ type FinancialInfo struct {
 type LoanApplication struct {
 	ID                     string        `json:"id"`
 	DealType			   string 		 `json:"dealType"`
+	DealId                 string        `json:"dealId,omitempty"`
+	Tranche                string        `json:"tranche,omitempty"`
 	BaseRateType		   string        `json:"baseRateType"`
-	AllInRate			   int			 `json:"allInRate"`
-	Spread				   int			 `json:"spread"`
+	AllInRate			   Rate			 `json:"allInRate"`
+	Spread				   Rate			 `json:"spread"`
+	RateTenor              string        `json:"rateTenor,omitempty"`
+	FixingLagDays          int           `json:"fixingLagDays,omitempty"`
+	RateFloor              *Rate         `json:"rateFloor,omitempty"`
+	RateCap                *Rate         `json:"rateCap,omitempty"`
+	CreditAdjustmentSpread *Rate         `json:"creditAdjustmentSpread,omitempty"`
+	LookbackDays           int           `json:"lookbackDays,omitempty"`
+	ObservationShift       bool          `json:"observationShift,omitempty"`
+	LockoutDays            int           `json:"lockoutDays,omitempty"`
+	BenchmarkHistory       []BenchmarkTransition `json:"benchmarkHistory,omitempty"`
 	PropertyId             string        `json:"propertyId"`
 	LandId                 string        `json:"landId"`
 	PermitId               string        `json:"permitId"`
@@ -47,11 +59,31 @@ type LoanApplication struct {
 	PersonalInfo           PersonalInfo  `json:"personalInfo"`
 	FinancialInfo          FinancialInfo `json:"financialInfo"`
 	Status                 string        `json:"status"`
-	RequestedAmount        int           `json:"requestedAmount"`
-	FairMarketValue        int           `json:"fairMarketValue"`
-	ApprovedAmount         int           `json:"approvedAmount"`
-	DealAmount         int          	 `json:"dealAmount"`
-	OutStandingSettlementAmount      int `json:"outstandingSettlementAmount"`
+	Currency               string        `json:"currency"`
+	RequestedAmount        Money         `json:"requestedAmount"`
+	FairMarketValue        Money         `json:"fairMarketValue"`
+	ApprovedAmount         Money         `json:"approvedAmount"`
+	DealAmount             Money         `json:"dealAmount"`
+	OutStandingSettlementAmount      Money `json:"outstandingSettlementAmount"`
+	DayCountConvention     string        `json:"dayCountConvention,omitempty"`
+	StartDate              string        `json:"startDate,omitempty"`
+	MaturityDate           string        `json:"maturityDate,omitempty"`
+	InterestFrequency      string        `json:"interestFrequency,omitempty"`
+	StubType               string        `json:"stubType,omitempty"`
+	RepaymentProfile       string        `json:"repaymentProfile,omitempty"`
+	RepaymentFrequency     string        `json:"repaymentFrequency,omitempty"`
+	CustomRepayments       []ScheduledRepayment `json:"customRepayments,omitempty"`
+	PaymentWaterfall       []string      `json:"paymentWaterfall,omitempty"`
+	DefaultMargin          *Rate         `json:"defaultMargin,omitempty"`
+	AgencyFeesDue          Money         `json:"agencyFeesDue"`
+	DefaultInterestDue     Money         `json:"defaultInterestDue"`
+	FeesDue                Money         `json:"feesDue"`
+	Fees                   []FeeDefinition `json:"fees,omitempty"`
+	FacilityType           string        `json:"facilityType,omitempty"`
+	AvailabilityStart      string        `json:"availabilityStart,omitempty"`
+	AvailabilityEnd        string        `json:"availabilityEnd,omitempty"`
+	UndrawnAmount          Money         `json:"undrawnAmount"`
+	RedrawableAmount       Money         `json:"redrawableAmount"`
 	ReviewerId             string        `json:"reviewerId"`
 	LastModifiedDate       string        `json:"lastModifiedDate"`
 }
@@ -63,17 +95,166 @@ type LoanList struct {
 type Participant struct {
 	ID                     string        `json:"id"`
 	Name                   string        `json:"name"`
-	SharePerCent           int           `json:"share"`
-	AssetList []Asset
+	LegalName              string        `json:"legalName"`
+	LEI                    string        `json:"lei"`
+	Roles                  []string      `json:"roles"`
+	SettlementAccount      SettlementAccount `json:"settlementAccount"`
+	Status                 string        `json:"status"`
+	AssetList []Asset                    `json:"AssetList,omitempty"`
+}
+
+//Syndicate records how a single loan is split between its lenders
+type Syndicate struct {
+	LoanId       string            `json:"loanId"`
+	Members      []SyndicateMember `json:"members"`
+	RoundingRule string            `json:"roundingRule,omitempty"`
+	AgentId      string            `json:"agentId,omitempty"`
+	LeadLenderId string            `json:"leadLenderId,omitempty"`
+}
+
+//SyndicateMember shares are in basis points, so a full syndicate sums to FullShareBps
+type SyndicateMember struct {
+	ParticipantId    string `json:"participantId"`
+	CommitmentAmount Money  `json:"commitmentAmount"`
+	ShareBps         int    `json:"shareBps"`
+}
+
+//ChaincodeError carries a stable code so clients can tell failures apart without parsing messages
+type ChaincodeError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ChaincodeError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func newError(code string, format string, args ...interface{}) *ChaincodeError {
+	return &ChaincodeError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+type SettlementAccount struct {
+	AccountName   string `json:"accountName"`
+	AccountNumber string `json:"accountNumber"`
+	BIC           string `json:"bic"`
 }
 type Asset struct{
 	AssetId								 string        `json:"loanId"`
 	
-	ShareAmount            int 					 `json:"shareAmount"`
-	SyndicatedAmount 			 int					 `json:"syndicatedAmount"`
-	SettlementFees		   float64                 `json:"settlementFees"`
+	ShareAmount            Money 					 `json:"shareAmount"`
+	SyndicatedAmount 			 Money					 `json:"syndicatedAmount"`
+	AccruedInterest		   Money                 `json:"accruedInterest"`
+	AccrualDate            string                `json:"accrualDate,omitempty"`
+	Commitment             Money                 `json:"commitment"`
+	Undrawn                Money                 `json:"undrawn"`
+	Currency               string                `json:"currency"`
 }
 
+//UnmarshalJSON also reads positions written before accrued interest was split from fees, which
+//kept it under settlementFees
+func (asset *Asset) UnmarshalJSON(data []byte) error {
+	type plainAsset Asset
+	var decoded struct {
+		plainAsset
+		SettlementFees *Money `json:"settlementFees"`
+	}
+	err := json.Unmarshal(data, &decoded)
+	if err != nil {
+		return err
+	}
+	*asset = Asset(decoded.plainAsset)
+	if decoded.SettlementFees != nil && asset.AccruedInterest == (Money{}) {
+		asset.AccruedInterest = *decoded.SettlementFees
+	}
+	return nil
+}
+
+//dayCountConvention falls back to DefaultDayCountConvention for loans created without one
+func (loan *LoanApplication) dayCountConvention() string {
+	if loan.DayCountConvention == "" {
+		return DefaultDayCountConvention
+	}
+	return loan.DayCountConvention
+}
+
+//normalizeCurrency labels every amount of the loan with the loan currency; loans written
+//before amounts carried a currency default to DefaultCurrency
+func (loan *LoanApplication) normalizeCurrency() error {
+	if loan.Currency == "" {
+		loan.Currency = DefaultCurrency
+	}
+	for _, amount := range []*Money{&loan.RequestedAmount, &loan.FairMarketValue, &loan.ApprovedAmount, &loan.DealAmount, &loan.OutStandingSettlementAmount, &loan.AgencyFeesDue, &loan.DefaultInterestDue, &loan.FeesDue, &loan.UndrawnAmount, &loan.RedrawableAmount} {
+		converted, err := amount.InCurrency(loan.Currency)
+		if err != nil {
+			return newError(ErrCodeInvalidArgument, "Loan application %s: %v", loan.ID, err)
+		}
+		*amount = converted
+	}
+	for i := range loan.Fees {
+		var fee = &loan.Fees[i]
+		for _, amount := range []*Money{fee.Amount, &fee.Accrued, &fee.Invoiced} {
+			if amount == nil {
+				continue
+			}
+			converted, err := amount.InCurrency(loan.Currency)
+			if err != nil {
+				return newError(ErrCodeInvalidArgument, "Loan application %s fee %s: %v", loan.ID, fee.ID, err)
+			}
+			*amount = converted
+		}
+	}
+	return nil
+}
+
+//normalizeCurrency labels the position and its amounts with the currency of its loan;
+//positions written before they carried a currency take it over from the loan
+func (asset *Asset) normalizeCurrency(currency string) error {
+	if asset.Currency == "" {
+		asset.Currency = currency
+	}
+	if asset.Currency != currency {
+		return newError(ErrCodeInvalidArgument, "Position in loan %s is in %s, not %s", asset.AssetId, asset.Currency, currency)
+	}
+	for _, amount := range []*Money{&asset.ShareAmount, &asset.SyndicatedAmount, &asset.AccruedInterest, &asset.Commitment, &asset.Undrawn} {
+		converted, err := amount.InCurrency(currency)
+		if err != nil {
+			return newError(ErrCodeInvalidArgument, "Position in loan %s: %v", asset.AssetId, err)
+		}
+		*amount = converted
+	}
+	return nil
+}
+
+const (
+	ParticipantActive   = "Active"
+	ParticipantInactive = "Inactive"
+)
+
+const (
+	RoleAgentBank = "AgentBank"
+	RoleLender    = "Lender"
+	RoleBorrower  = "Borrower"
+	RoleAuditor   = "Auditor"
+	RoleRegulator = "Regulator"
+	//RoleRatePublisher publishes benchmark fixings and holds no positions
+	RoleRatePublisher = "RatePublisher"
+)
+
+const FullShareBps = 10000
+
+const (
+	ErrCodeInvalidArgument    = "INVALID_ARGUMENT"
+	ErrCodeNotFound           = "NOT_FOUND"
+	ErrCodeAlreadyExists      = "ALREADY_EXISTS"
+	ErrCodeInvalidParticipant = "INVALID_PARTICIPANT"
+	ErrCodeFailedPrecondition = "FAILED_PRECONDITION"
+	ErrCodeIllegalTransition  = "ILLEGAL_TRANSITION"
+	ErrCodeAccessDenied       = "ACCESS_DENIED"
+	ErrCodeLedger             = "LEDGER_ERROR"
+)
+
+var participantRoles = []string{RoleAgentBank, RoleLender, RoleBorrower, RoleAuditor, RoleRegulator, RoleRatePublisher}
+
 
 
 func GetLoanApplication(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
@@ -85,7 +266,7 @@ func GetLoanApplication(stub shim.ChaincodeStubInterface, args []string) ([]byte
 	}
 
 	var loanApplicationId = args[0]
-	bytes, err := stub.GetState(loanApplicationId)
+	bytes, err := stub.GetState(loanKey(loanApplicationId))
 	if err != nil {
 		logger.Error("Could not fetch loan application with id "+loanApplicationId+" from ledger", err)
 		return nil, err
@@ -93,12 +274,73 @@ func GetLoanApplication(stub shim.ChaincodeStubInterface, args []string) ([]byte
 	return bytes, nil
 }
 
+//GroupByDeal asks GetParticipatedLoans to roll exposures up to deals instead of listing loans
+const GroupByDeal = "deal"
+
+//GetParticipatedLoans returns every loan, or only the loans a participant holds a position in
+//when a participant ID is passed. With GroupByDeal as second argument it returns a
+//DealExposure per deal instead, totalling the loans or the participant's positions.
 func GetParticipatedLoans(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	logger.Debug("Entering GetParticipatedLoans")
 
-	bytes, err := stub.GetState("loanlist")
+	var loanList = []LoanApplication{}
+	var exposures []TrancheExposure
+	var participantId = ""
+	if len(args) > 0 && args[0] != "" {
+		participantId = args[0]
+		positions, err := fetchPositions(stub, args[0])
+		if err != nil {
+			return nil, err
+		}
+		for i, asset := range positions {
+			loan, err := fetchLoan(stub, asset.AssetId)
+			if err != nil {
+				return nil, err
+			}
+			if loan != nil {
+				loanList = append(loanList, *loan)
+				exposure, err := positionExposure(loan, &positions[i])
+				if err != nil {
+					return nil, err
+				}
+				exposures = append(exposures, exposure)
+			}
+		}
+	} else {
+		loans, err := fetchLoans(stub)
+		if err != nil {
+			return nil, err
+		}
+		loanList = append(loanList, loans...)
+		for i := range loans {
+			exposures = append(exposures, loanExposure(&loans[i]))
+		}
+	}
+
+	if len(args) > 1 && args[1] == GroupByDeal {
+		var dealNames = map[string]string{}
+		for _, exposure := range exposures {
+			if _, found := dealNames[exposure.DealId]; found || exposure.DealId == "" {
+				continue
+			}
+			deal, err := fetchDeal(stub, exposure.DealId)
+			if err != nil {
+				return nil, err
+			}
+			if deal != nil {
+				dealNames[deal.ID] = deal.Name
+			}
+		}
+		var deals = rollUpByDeal(exposures, dealNames, participantId)
+		if deals == nil {
+			deals = []DealExposure{}
+		}
+		return json.Marshal(deals)
+	}
+
+	bytes, err := json.Marshal(&loanList)
 	if err != nil {
-		logger.Error("Could not fetch loanlist from ledger", err)
+		logger.Error("Could not marshal loan list", err)
 		return nil, err
 	}
 	return bytes, nil
@@ -114,353 +356,971 @@ func GetLoanParticipant(stub shim.ChaincodeStubInterface, args []string) ([]byte
 	}
 
 	var participantID = args[0]
-	bytes, err := stub.GetState(participantID)
+	participant, err := fetchParticipant(stub, participantID)
+	if err != nil || participant == nil {
+		return nil, err
+	}
+	participant.AssetList, err = fetchPositions(stub, participantID)
 	if err != nil {
-		logger.Error("Could not fetch participant with id "+participantID+" from ledger", err)
+		return nil, err
+	}
+	bytes, err := json.Marshal(participant)
+	if err != nil {
+		logger.Error("Could not marshal participant with id "+participantID, err)
 		return nil, err
 	}
 	return bytes, nil
 }
 
-func CreateParticipants(stub shim.ChaincodeStubInterface,args []string)([]byte,error){
+//CreateParticipants registers every participant JSON passed to Init
+func CreateParticipants(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	logger.Debug("Entering CreateParticipants")
-	
+
+	for _, participantInput := range args {
+		_, err := RegisterParticipant(stub, []string{participantInput})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func RegisterParticipant(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering RegisterParticipant")
 
 	if len(args) < 1 {
 		logger.Error("Invalid number of arguments")
-		return nil, errors.New("Missing participant ID")
+		return nil, errors.New("Missing participant details")
 	}
-	
-	var firstParticipant Participant
-	
-	var participantID = args[0]
-	
-	var secondParticipant Participant
-
-	/*secondParticipant = Participant{ID:"part1",Name:"DeucheBank",
-								AssetList: []Asset{
-									{AssetId:"la1",
-									SharePerCent:80,
-									ShareAmount:0,
-									SyndicatedAmount:1000},
-								},
-						}*/
-	
-	firstParticipant = Participant{ID:participantID ,Name:"DeucheBank",SharePerCent:80}
-	
-	secondParticipant = Participant{ID:"part2",Name:"CitiBank",SharePerCent:20}
 
-	bytes, err1 := json.Marshal (&firstParticipant)
-	 if err1 != nil {
-		         fmt.Println("Could not marshal firstParticipant object", err1)
-			         return nil, err1
-				  }
+	var participant Participant
+	err := json.Unmarshal([]byte(args[0]), &participant)
+	if err != nil {
+		logger.Error("Could not unmarshal participant", err)
+		return nil, err
+	}
+	err = validateParticipant(participant)
+	if err != nil {
+		return nil, err
+	}
 
-	err := stub.PutState(participantID, bytes )
+	existing, err := fetchParticipant(stub, participant.ID)
 	if err != nil {
-			logger.Error("Could not save firstParticipant to ledger", err)
+		return nil, err
+	}
+	if existing != nil {
+		return nil, errors.New("Participant " + participant.ID + " already exists")
+	}
+	err = checkLEIAvailable(stub, participant.LEI, participant.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	participant.Status = ParticipantActive
+	err = stub.PutState(leiKey(participant.LEI), []byte(participant.ID))
+	if err != nil {
+		logger.Error("Could not save LEI index to ledger", err)
+		return nil, err
+	}
+	bytes, err := saveParticipant(stub, &participant)
+	if err != nil {
+		return nil, err
+	}
+
+	err = setEvent(stub, "participantRegistration", participant.ID+" successfully registered")
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Successfully registered participant " + participant.ID)
+	return bytes, nil
+}
+
+func UpdateParticipant(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering UpdateParticipant")
+
+	if len(args) < 1 {
+		logger.Error("Invalid number of arguments")
+		return nil, errors.New("Missing participant details")
+	}
+
+	var participant Participant
+	err := json.Unmarshal([]byte(args[0]), &participant)
+	if err != nil {
+		logger.Error("Could not unmarshal participant", err)
+		return nil, err
+	}
+	err = validateParticipant(participant)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := fetchParticipant(stub, participant.ID)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		return nil, errors.New("Participant " + participant.ID + " does not exist")
+	}
+
+	if existing.LEI != participant.LEI {
+		err = checkLEIAvailable(stub, participant.LEI, participant.ID)
+		if err != nil {
 			return nil, err
 		}
+		err = stub.DelState(leiKey(existing.LEI))
+		if err != nil {
+			logger.Error("Could not remove LEI index from ledger", err)
+			return nil, err
+		}
+		err = stub.PutState(leiKey(participant.LEI), []byte(participant.ID))
+		if err != nil {
+			logger.Error("Could not save LEI index to ledger", err)
+			return nil, err
+		}
+	}
 
-		
-	bytes2, err2 := json.Marshal (&secondParticipant)
-	 if err2 != nil {
-		         fmt.Println("Could not marshal secondParticipant object", err2)
-			         return nil, err2
-				  }
+	//status is not editable through an update
+	participant.Status = existing.Status
+	bytes, err := saveParticipant(stub, &participant)
+	if err != nil {
+		return nil, err
+	}
+
+	err = setEvent(stub, "participantUpdate", participant.ID+" successfully updated")
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Successfully updated participant " + participant.ID)
+	return bytes, nil
+}
 
-	err3 := stub.PutState("part2", bytes2 )
-	if err3 != nil {
-			logger.Error("Could not save secondParticipant to ledger", err3)
-			return nil, err3
+func DeactivateParticipant(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering DeactivateParticipant")
+
+	if len(args) < 1 {
+		logger.Error("Invalid number of arguments")
+		return nil, errors.New("Missing participant ID")
+	}
+
+	participant, err := fetchParticipant(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if participant == nil {
+		return nil, errors.New("Participant " + args[0] + " does not exist")
+	}
+	if participant.Status == ParticipantInactive {
+		return nil, errors.New("Participant " + args[0] + " is already inactive")
+	}
+
+	participant.Status = ParticipantInactive
+	bytes, err := saveParticipant(stub, participant)
+	if err != nil {
+		return nil, err
+	}
+
+	err = setEvent(stub, "participantDeactivation", participant.ID+" successfully deactivated")
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Successfully deactivated participant " + participant.ID)
+	return bytes, nil
+}
+
+//fetchParticipant returns nil without an error when the participant is not on the ledger
+func fetchParticipant(stub shim.ChaincodeStubInterface, participantID string) (*Participant, error) {
+	bytes, err := stub.GetState(participantKey(participantID))
+	if err != nil {
+		logger.Error("Could not fetch participant with id "+participantID+" from ledger", err)
+		return nil, err
+	}
+	if bytes == nil {
+		return nil, nil
+	}
+	var participant Participant
+	err = json.Unmarshal(bytes, &participant)
+	if err != nil {
+		logger.Error("Could not unmarshal participant with id "+participantID, err)
+		return nil, err
+	}
+	return &participant, nil
+}
+
+//saveParticipant stores the participant without its AssetList, positions live under their own keys
+func saveParticipant(stub shim.ChaincodeStubInterface, participant *Participant) ([]byte, error) {
+	var stored = *participant
+	stored.AssetList = nil
+	bytes, err := json.Marshal(&stored)
+	if err != nil {
+		logger.Error("Could not marshal participant "+participant.ID, err)
+		return nil, err
+	}
+	err = stub.PutState(participantKey(participant.ID), bytes)
+	if err != nil {
+		logger.Error("Could not save participant "+participant.ID+" to ledger", err)
+		return nil, err
+	}
+	return bytes, nil
+}
+
+func checkLEIAvailable(stub shim.ChaincodeStubInterface, lei string, participantID string) error {
+	owner, err := stub.GetState(leiKey(lei))
+	if err != nil {
+		logger.Error("Could not fetch LEI index from ledger", err)
+		return err
+	}
+	if owner != nil && string(owner) != participantID {
+		return errors.New("LEI " + lei + " is already registered to participant " + string(owner))
+	}
+	return nil
+}
+
+func validateParticipant(participant Participant) error {
+	err := validateKeyAttribute("Participant ID", participant.ID)
+	if err != nil {
+		return err
+	}
+	if participant.LegalName == "" {
+		return errors.New("Participant " + participant.ID + " is missing a legal name")
+	}
+	if !isValidLEI(participant.LEI) {
+		return errors.New("Participant " + participant.ID + " has an invalid LEI " + participant.LEI)
+	}
+	if len(participant.Roles) == 0 {
+		return errors.New("Participant " + participant.ID + " must have at least one role")
+	}
+	for _, role := range participant.Roles {
+		if !isKnownRole(role) {
+			return errors.New("Participant " + participant.ID + " has an unknown role " + role)
+		}
+	}
+	if participant.SettlementAccount.AccountNumber == "" || participant.SettlementAccount.BIC == "" {
+		return errors.New("Participant " + participant.ID + " is missing settlement account details")
+	}
+	return nil
+}
+
+//isValidLEI checks the ISO 17442 format: 18 alphanumerics followed by two MOD 97-10 check digits
+func isValidLEI(lei string) bool {
+	if len(lei) != 20 {
+		return false
+	}
+	var remainder = 0
+	for _, c := range lei {
+		var digits string
+		switch {
+		case c >= '0' && c <= '9':
+			digits = string(c)
+		case c >= 'A' && c <= 'Z':
+			digits = strconv.Itoa(int(c-'A') + 10)
+		default:
+			return false
+		}
+		for _, d := range digits {
+			remainder = (remainder*10 + int(d-'0')) % 97
+		}
+	}
+	return remainder == 1
+}
+
+func isKnownRole(role string) bool {
+	for _, known := range participantRoles {
+		if role == known {
+			return true
+		}
+	}
+	return false
+}
+
+func hasRole(participant *Participant, role string) bool {
+	for _, r := range participant.Roles {
+		if r == role {
+			return true
 		}
-				
-		return nil,nil
+	}
+	return false
+}
 
+func setEvent(stub shim.ChaincodeStubInterface, eventType string, description string) error {
+	customEvent, err := json.Marshal(map[string]string{"eventType": eventType, "description": description})
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent("evtSender", customEvent)
 }
 
+//CreateLoanParticipation validates the loan, its syndicate and every referenced participant
+//before writing anything, so a failure never leaves a partially created loan behind. An empty
+//loan application ID is allocated with NextID. The members' positions are opened when the loan
+//is syndicated.
 func CreateLoanParticipation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	logger.Debug("Entering CreateLoanParticipation")
 
-	if len(args) < 2 {
+	if len(args) < 3 {
 		logger.Error("Invalid number of args")
-		return nil, errors.New("Expected atleast two arguments for loan application creation")
+		return nil, newError(ErrCodeInvalidArgument, "Expected loan application ID, loan application and syndicate for loan application creation")
 	}
 
 	var loanApplicationId = args[0]
 	var loanApplicationInput = args[1]
+	var syndicateInput = args[2]
 
-	err := stub.PutState(loanApplicationId, []byte(loanApplicationInput))
+	var participatedLoan LoanApplication
+	err := json.Unmarshal([]byte(loanApplicationInput), &participatedLoan)
+	if err != nil {
+		logger.Error("Could not unmarshal loan application", err)
+		return nil, newError(ErrCodeInvalidArgument, "Could not parse loan application: %v", err)
+	}
+	if loanApplicationId == "" {
+		loanApplicationId = participatedLoan.ID
+	}
+	if loanApplicationId == "" {
+		loanApplicationId, err = NextID(stub, LoanIdPrefix, loanKey)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not allocate a loan application ID: %v", err)
+		}
+	}
+	if participatedLoan.ID == "" {
+		participatedLoan.ID = loanApplicationId
+	}
+	if participatedLoan.ID != loanApplicationId {
+		return nil, newError(ErrCodeInvalidArgument, "Loan application ID %s does not match argument %s", participatedLoan.ID, loanApplicationId)
+	}
+	if participatedLoan.Status == "" {
+		participatedLoan.Status = StatusSubmitted
+	}
+	if participatedLoan.Status != StatusSubmitted {
+		return nil, newError(ErrCodeInvalidArgument, "Loan application %s must be created with status %s", loanApplicationId, StatusSubmitted)
+	}
+	err = participatedLoan.normalizeCurrency()
 	if err != nil {
-		logger.Error("Could not save loan application to ledger", err)
 		return nil, err
 	}
-
-	var participatedLoan LoanApplication
-	err = json.Unmarshal([]byte(loanApplicationInput),&participatedLoan)
+	//term loans are funded on creation, facilities start undrawn
+	participatedLoan.UndrawnAmount = ZeroMoney(participatedLoan.Currency)
+	participatedLoan.RedrawableAmount = ZeroMoney(participatedLoan.Currency)
+	if participatedLoan.isFacility() {
+		participatedLoan.UndrawnAmount = participatedLoan.DealAmount
+		participatedLoan.OutStandingSettlementAmount = ZeroMoney(participatedLoan.Currency)
+	} else if participatedLoan.OutStandingSettlementAmount.IsZero() {
+		participatedLoan.OutStandingSettlementAmount = participatedLoan.DealAmount
+	}
+	err = validateLoanApplication(participatedLoan)
 	if err != nil {
 		return nil, err
 	}
-    fmt.Println("CreateLoanParticipation : ParticipatedLoan ID and amount " + participatedLoan.ID, participatedLoan.DealAmount)
-	
-	fmt.Println("CreateLoanParticipation : PropertyId " + participatedLoan.PropertyId)
-   
-    fmt.Println("CreateLoanParticipation:  All In Rate ", participatedLoan.AllInRate)
-	
+	fmt.Println("CreateLoanParticipation : ParticipatedLoan ID and amount "+participatedLoan.ID, participatedLoan.DealAmount)
 	fmt.Println("CreateLoanParticipation : baseRateType " + participatedLoan.BaseRateType)
 
+	existing, err := stub.GetState(loanKey(loanApplicationId))
+	if err != nil {
+		logger.Error("Could not fetch loan application with id "+loanApplicationId+" from ledger", err)
+		return nil, newError(ErrCodeLedger, "Could not read loan application %s: %v", loanApplicationId, err)
+	}
+	if existing != nil {
+		return nil, newError(ErrCodeAlreadyExists, "Loan application %s already exists", loanApplicationId)
+	}
+	deal, err := dealForTranche(stub, &participatedLoan)
+	if err != nil {
+		return nil, err
+	}
 
-	loanbytes2, err := AppendToLoanList(stub,participatedLoan)
-	    
-    err = ParticipateLoan(stub, "part1",loanApplicationId, participatedLoan.DealAmount)
-	err = ParticipateLoan(stub, "part2",loanApplicationId, participatedLoan.DealAmount)
+	var syndicate Syndicate
+	err = json.Unmarshal([]byte(syndicateInput), &syndicate)
+	if err != nil {
+		logger.Error("Could not unmarshal syndicate", err)
+		return nil, newError(ErrCodeInvalidArgument, "Could not parse syndicate: %v", err)
+	}
+	syndicate.LoanId = loanApplicationId
+	err = deriveCommitments(&syndicate, participatedLoan.DealAmount)
+	if err != nil {
+		return nil, err
+	}
+	for i := range syndicate.Members {
+		syndicate.Members[i].CommitmentAmount, err = syndicate.Members[i].CommitmentAmount.InCurrency(participatedLoan.Currency)
+		if err != nil {
+			return nil, newError(ErrCodeInvalidArgument, "Commitment of %s: %v", syndicate.Members[i].ParticipantId, err)
+		}
+	}
+	err = syndicate.deriveShares()
+	if err != nil {
+		return nil, err
+	}
+	err = validateSyndicate(syndicate, participatedLoan.DealAmount)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range syndicate.Members {
+		participant, err := fetchParticipant(stub, member.ParticipantId)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not read participant %s: %v", member.ParticipantId, err)
+		}
+		err = validateLender(participant, member.ParticipantId)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	var customEvent = "{eventType: 'loanApplicationCreation', description:" + loanApplicationId + "' Successfully created'}"
-	err = stub.SetEvent("evtSender", []byte(customEvent))
+	schedule, err := buildInterestSchedule(&participatedLoan)
+	if err != nil {
+		return nil, err
+	}
+	repayments, err := buildRepaymentSchedule(&participatedLoan)
 	if err != nil {
 		return nil, err
 	}
+
+	//everything has been validated, from here on any failure aborts the transaction
+	loanBytes, err := saveLoan(stub, &participatedLoan)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not save loan application %s: %v", loanApplicationId, err)
+	}
+	err = saveSyndicate(stub, &syndicate)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not save syndicate for loan %s: %v", loanApplicationId, err)
+	}
+	if schedule != nil {
+		_, err = saveInterestSchedule(stub, schedule)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not save interest schedule for loan %s: %v", loanApplicationId, err)
+		}
+	}
+	if repayments != nil {
+		err = saveRepaymentSchedule(stub, repayments)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not save repayment schedule for loan %s: %v", loanApplicationId, err)
+		}
+	}
+	if deal != nil {
+		deal.Tranches = append(deal.Tranches, DealTranche{LoanId: loanApplicationId, Name: participatedLoan.Tranche})
+		_, err = saveDeal(stub, deal)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not save deal %s: %v", deal.ID, err)
+		}
+	}
+
+	err = setEvent(stub, "loanApplicationCreation", loanApplicationId+" successfully created")
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not raise creation event for loan %s: %v", loanApplicationId, err)
+	}
 	logger.Info("Successfully saved loan application")
-	return loanbytes2,err
+	return loanBytes, nil
+}
+
+func validateLoanApplication(loan LoanApplication) error {
+	err := validateKeyAttribute("Loan application ID", loan.ID)
+	if err != nil {
+		return newError(ErrCodeInvalidArgument, err.Error())
+	}
+	if loan.DealType == "" {
+		return newError(ErrCodeInvalidArgument, "Loan application %s is missing a deal type", loan.ID)
+	}
+	err = validateCurrency(loan.Currency)
+	if err != nil {
+		return newError(ErrCodeInvalidArgument, "Loan application %s: %v", loan.ID, err)
+	}
+	if loan.BaseRateType == "" {
+		return newError(ErrCodeInvalidArgument, "Loan application %s is missing a base rate type", loan.ID)
+	}
+	if loan.AllInRate.IsNegative() || loan.Spread.IsNegative() {
+		return newError(ErrCodeInvalidArgument, "Loan application %s has a negative rate", loan.ID)
+	}
+	err = validateFloatingRate(loan)
+	if err != nil {
+		return err
+	}
+	if !loan.DealAmount.IsPositive() {
+		return newError(ErrCodeInvalidArgument, "Loan application %s must have a positive deal amount", loan.ID)
+	}
+	if loan.DayCountConvention != "" && !isValidDayCountConvention(loan.DayCountConvention) {
+		return newError(ErrCodeInvalidArgument, "Loan application %s has unknown day-count convention %s", loan.ID, loan.DayCountConvention)
+	}
+	if loan.StartDate != "" {
+		_, err = ParseDate(loan.StartDate)
+		if err != nil {
+			return newError(ErrCodeInvalidArgument, "Loan application %s start date: %v", loan.ID, err)
+		}
+	}
+	if loan.OutStandingSettlementAmount.IsNegative() || loan.OutStandingSettlementAmount.Cmp(loan.DealAmount) > 0 {
+		return newError(ErrCodeInvalidArgument, "Loan application %s outstanding amount must be between 0 and the deal amount", loan.ID)
+	}
+	if loan.DefaultMargin != nil && loan.DefaultMargin.IsNegative() {
+		return newError(ErrCodeInvalidArgument, "Loan application %s has a negative default margin", loan.ID)
+	}
+	err = validateWaterfall(loan.PaymentWaterfall)
+	if err != nil {
+		return newError(ErrCodeInvalidArgument, "Loan application %s: %v", loan.ID, err)
+	}
+	err = validateFees(loan)
+	if err != nil {
+		return err
+	}
+	err = validateFacility(loan)
+	if err != nil {
+		return err
+	}
+	return nil
 }
 
-func AppendToLoanList(stub shim.ChaincodeStubInterface,  participatedLoan LoanApplication) ([]byte, error){
+//validateLender checks that a syndicate member is an active participant allowed to lend
+func validateLender(participant *Participant, participantID string) error {
+	if participant == nil {
+		return newError(ErrCodeNotFound, "Participant %s does not exist", participantID)
+	}
+	if participant.Status != ParticipantActive {
+		return newError(ErrCodeInvalidParticipant, "Participant %s is not active", participantID)
+	}
+	if !hasRole(participant, RoleLender) {
+		return newError(ErrCodeInvalidParticipant, "Participant %s is not registered as a lender", participantID)
+	}
+	return nil
+}
+
+//ParticipateLoan opens a position for a syndicate member; interest accrues from accrualDate
+func ParticipateLoan(stub shim.ChaincodeStubInterface, member SyndicateMember, loan *LoanApplication) (error){
+	var participant = member.ParticipantId
+	var loan_id = loan.ID
 
-    var loanList []LoanApplication
-    bytes , err := stub.GetState("loanlist")
+	existing, err := fetchPosition(stub, participant, loan_id)
 	if err != nil {
-		logger.Error("Could not fetch firstParticipant with id part1 from ledger", err)
+		return newError(ErrCodeLedger, "Could not read position of %s in loan %s: %v", participant, loan_id, err)
+	}
+	if existing != nil {
+		return newError(ErrCodeAlreadyExists, "Participant %s already holds a position in loan %s", participant, loan_id)
+	}
+	logger.Debug("ParticipateLoan: participant " + participant)
+	logger.Debug("ParticipateLoan: commitment " + member.CommitmentAmount.String())
+	logger.Debug("ParticipateLoan: share " + strconv.Itoa(member.ShareBps) + " bps")
+
+	var newAsset Asset
+	newAsset.AssetId = loan_id
+	newAsset.Currency = loan.Currency
+	newAsset.ShareAmount = member.CommitmentAmount
+	newAsset.AccruedInterest = ZeroMoney(member.CommitmentAmount.Currency)
+	newAsset.AccrualDate = loan.StartDate
+	newAsset.Commitment = member.CommitmentAmount
+	newAsset.Undrawn = ZeroMoney(member.CommitmentAmount.Currency)
+	if loan.isFacility() {
+		newAsset.ShareAmount = ZeroMoney(member.CommitmentAmount.Currency)
+		newAsset.Undrawn = member.CommitmentAmount
+	}
+
+	err = savePosition(stub, participant, &newAsset)
+	if err != nil {
+		return newError(ErrCodeLedger, "Could not save position of %s in loan %s: %v", participant, loan_id, err)
+	}
+	return nil
+}
+
+//GetSyndicate returns the syndicate of a loan; args are loan ID and optionally a participant ID,
+//which limits the members to that participant
+func GetSyndicate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering GetSyndicate")
+
+	if len(args) < 1 {
+		logger.Error("Invalid number of arguments")
+		return nil, errors.New("Missing loan application ID")
+	}
+
+	bytes, err := stub.GetState(syndicateKey(args[0]))
+	if err != nil {
+		logger.Error("Could not fetch syndicate for loan "+args[0]+" from ledger", err)
 		return nil, err
 	}
-	if ( bytes == nil) {
-		loanList = append(loanList,participatedLoan);
-	} else {
-		err = json.Unmarshal(bytes,&loanList)
+	if len(args) > 1 && args[1] != "" {
+		syndicate, err := fetchSyndicate(stub, args[0])
 		if err != nil {
-			logger.Error("unable to unmarshall loanlist")
-		return nil, err
+			return nil, newError(ErrCodeNotFound, "Could not read syndicate for loan %s: %v", args[0], err)
 		}
-	
-		loanList = append(loanList,participatedLoan)
-	//fmt.Println("firstParticipant Name" + firstParticipant.Name)
+		syndicate, err = syndicate.forParticipant(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(syndicate)
 	}
-	
-	 loanbytes2, err := json.Marshal (&loanList)
-	 if err != nil {
-        fmt.Println("Could not marshal loanList object", err)
-        return nil, err
-	 }
-	
-	err = stub.PutState("loanlist", loanbytes2)
+	return bytes, nil
+}
+
+//forParticipant limits the syndicate to a single member
+func (syndicate *Syndicate) forParticipant(participantId string) (*Syndicate, error) {
+	for _, member := range syndicate.Members {
+		if member.ParticipantId == participantId {
+			var own = *syndicate
+			own.Members = []SyndicateMember{member}
+			return &own, nil
+		}
+	}
+	return nil, newError(ErrCodeNotFound, "Participant %s is not in the syndicate of loan %s", participantId, syndicate.LoanId)
+}
+
+func fetchSyndicate(stub shim.ChaincodeStubInterface, loanId string) (*Syndicate, error) {
+	bytes, err := stub.GetState(syndicateKey(loanId))
 	if err != nil {
+		logger.Error("Could not fetch syndicate for loan "+loanId+" from ledger", err)
 		return nil, err
-	}	
-//	fmt.Println("LoanList length is %d", len(loanList))
-	
-	return loanbytes2,nil
-
-	
+	}
+	if bytes == nil {
+		return nil, errors.New("No syndicate recorded for loan " + loanId)
+	}
+	var syndicate Syndicate
+	err = json.Unmarshal(bytes, &syndicate)
+	if err != nil {
+		logger.Error("Could not unmarshal syndicate for loan "+loanId, err)
+		return nil, err
+	}
+	return &syndicate, nil
 }
 
-func ParticipateLoan(stub shim.ChaincodeStubInterface, participant string, loan_id string , participationAmount int) (error){
-	
-	partbytes, err := stub.GetState(participant)
-	if err != nil || partbytes == nil {
-		logger.Error("Could not fetch firstParticipant from ledger", err)
-		return  err
+func saveSyndicate(stub shim.ChaincodeStubInterface, syndicate *Syndicate) error {
+	bytes, err := json.Marshal(syndicate)
+	if err != nil {
+		logger.Error("Could not marshal syndicate for loan "+syndicate.LoanId, err)
+		return err
 	}
+	err = stub.PutState(syndicateKey(syndicate.LoanId), bytes)
+	if err != nil {
+		logger.Error("Could not save syndicate for loan "+syndicate.LoanId+" to ledger", err)
+		return err
+	}
+	return nil
+}
 
-	var firstParticipant Participant
-	err = json.Unmarshal(partbytes,&firstParticipant)
+//deriveCommitments fills in commitments from shares when a syndicate is given by shares only,
+//so that the commitments add up to the deal amount exactly
+func deriveCommitments(syndicate *Syndicate, dealAmount Money) error {
+	for _, member := range syndicate.Members {
+		if !member.CommitmentAmount.IsZero() {
+			return nil
+		}
+	}
+	err := validateRoundingRule(*syndicate)
 	if err != nil {
 		return err
 	}
-	fmt.Println("ParticipateLoan: firstParticipant Name" + firstParticipant.Name)
-	fmt.Println("ParticipateLoan: participationAmount" ,participationAmount)
-		fmt.Println("ParticipateLoan: SharePerCent" ,firstParticipant.SharePerCent)
-	
+	commitments, err := syndicate.Allocate(dealAmount)
+	if err != nil {
+		return err
+	}
+	for i := range syndicate.Members {
+		syndicate.Members[i].CommitmentAmount = commitments[i]
+	}
+	return nil
+}
 
-	var newAsset Asset
-	newAsset.AssetId = loan_id
-	//newAsset.SharePerCent = 80
-	newAsset.ShareAmount = ( participationAmount * firstParticipant.SharePerCent / 100 )
-	newAsset.SettlementFees = 0
-	
-	firstParticipant.AssetList = append(firstParticipant.AssetList, newAsset)
-	
-	fmt.Println("Total loans participated")
-	fmt.Println(len(firstParticipant.AssetList))
-	
-	 partbytes2, err := json.Marshal (&firstParticipant)
-	 if err != nil {
-        fmt.Println("Could not marshal firstParticipant info object", err)
-        return err
-	 }
-	err = stub.PutState(participant, partbytes2)
+//validateSyndicate checks that commitments add up to the deal amount and shares add up to
+//100%; shares are expected to have been derived from the commitments by deriveShares
+func validateSyndicate(syndicate Syndicate, dealAmount Money) error {
+	if len(syndicate.Members) == 0 {
+		return newError(ErrCodeInvalidArgument, "Syndicate for loan %s has no members", syndicate.LoanId)
+	}
+	if !dealAmount.IsPositive() {
+		return newError(ErrCodeInvalidArgument, "Loan %s must have a positive deal amount", syndicate.LoanId)
+	}
+	err := validateRoundingRule(syndicate)
 	if err != nil {
 		return err
 	}
-		
+
+	var seen = make(map[string]bool)
+	var totalCommitment = ZeroMoney(dealAmount.Currency)
+	var totalShare int
+	for _, member := range syndicate.Members {
+		if member.ParticipantId == "" {
+			return newError(ErrCodeInvalidArgument, "Syndicate member is missing a participant ID")
+		}
+		if seen[member.ParticipantId] {
+			return newError(ErrCodeInvalidArgument, "Participant %s appears more than once in the syndicate", member.ParticipantId)
+		}
+		seen[member.ParticipantId] = true
+		if !member.CommitmentAmount.IsPositive() || member.ShareBps <= 0 {
+			return newError(ErrCodeInvalidArgument, "Participant %s must have a positive commitment and share", member.ParticipantId)
+		}
+		if member.CommitmentAmount.Currency != dealAmount.Currency {
+			return newError(ErrCodeInvalidArgument, "Participant %s commitment %s is not in %s", member.ParticipantId, member.CommitmentAmount, dealAmount.Currency)
+		}
+		totalCommitment = totalCommitment.Add(member.CommitmentAmount)
+		totalShare += member.ShareBps
+	}
+	if totalCommitment.Cmp(dealAmount) != 0 {
+		return newError(ErrCodeInvalidArgument, "Syndicate commitments total %s but the deal amount is %s", totalCommitment, dealAmount)
+	}
+	if totalShare != FullShareBps {
+		return newError(ErrCodeInvalidArgument, "Syndicate shares total %d bps instead of %d", totalShare, FullShareBps)
+	}
 	return nil
-	
 }
 
+//shareOf returns part as a share of total, rounded to the nearest basis point
+func shareOf(part Money, total Money) int {
+	var share = new(big.Rat).SetFrac(big.NewInt(part.Minor*FullShareBps), big.NewInt(total.Minor))
+	return int(roundRat(share))
+}
+
+//repaymentStatuses are the loan statuses in which principal can be repaid
+var repaymentStatuses = []string{StatusActive, StatusDefaulted, StatusRestructured}
 
+//SettleLoanSyndication applies a principal repayment to a loan and its participants' positions;
+//args are loan ID, amount and the value date (YYYY-MM-DD) interest is accrued to
 func SettleLoanSyndication(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	logger.Debug("Entering SettleLoanSyndication")
 
-	if len(args) < 2 {
+	if len(args) < 3 {
 		logger.Error("Invalid number of args")
-		return nil, errors.New("Expected atleast two arguments for loan settlement")
+		return nil, newError(ErrCodeInvalidArgument, "Expected loan application ID, amount and value date for loan settlement")
 	}
 
 	var loanApplicationId = args[0]
 	var loanSettlementAmount = args[1]
+	var valueDate = args[2]
+	_, err := ParseDate(valueDate)
+	if err != nil {
+		return nil, rejectPayment(stub, loanApplicationId, loanSettlementAmount, newError(ErrCodeInvalidArgument, "Invalid value date: %v", err))
+	}
 
 	fmt.Printf("Settle Loan : %s, for :%s", loanApplicationId, loanSettlementAmount)
 
-	v, err := strconv.Atoi(loanSettlementAmount)
-
-	bytes, err := stub.GetState(loanApplicationId)
+	participatedLoan, err := fetchLoan(stub, loanApplicationId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read loan application %s: %v", loanApplicationId, err)
+	}
+	if participatedLoan == nil {
+		return nil, rejectPayment(stub, loanApplicationId, loanSettlementAmount, newError(ErrCodeNotFound, "Loan application %s not found", loanApplicationId))
+	}
+	if !containsString(repaymentStatuses, participatedLoan.Status) {
+		return nil, rejectPayment(stub, loanApplicationId, loanSettlementAmount, newError(ErrCodeFailedPrecondition, "Loan %s cannot be repaid in status %s", loanApplicationId, participatedLoan.Status))
+	}
+	if participatedLoan.StartDate == "" {
+		return nil, rejectPayment(stub, loanApplicationId, loanSettlementAmount, newError(ErrCodeFailedPrecondition, "Loan %s has no start date to accrue interest from", loanApplicationId))
+	}
+	v, err := ParseMoney(loanSettlementAmount, participatedLoan.Currency)
+	if err != nil {
+		return nil, rejectPayment(stub, loanApplicationId, loanSettlementAmount, newError(ErrCodeInvalidArgument, "%v", err))
+	}
+	if v.Currency != participatedLoan.Currency {
+		return nil, rejectPayment(stub, loanApplicationId, loanSettlementAmount, newError(ErrCodeInvalidArgument, "Payment %s is not in the loan currency %s", v, participatedLoan.Currency))
+	}
+	if !v.IsPositive() {
+		return nil, rejectPayment(stub, loanApplicationId, loanSettlementAmount, newError(ErrCodeInvalidArgument, "Payment amount %s must be positive", v))
+	}
+	if v.Cmp(participatedLoan.OutStandingSettlementAmount) > 0 {
+		return nil, rejectPayment(stub, loanApplicationId, loanSettlementAmount, newError(ErrCodeFailedPrecondition, "Payment %s exceeds the outstanding amount %s of loan %s", v, participatedLoan.OutStandingSettlementAmount, loanApplicationId))
+	}
+	syndicate, err := fetchSyndicate(stub, loanApplicationId)
+	if err != nil {
+		return nil, rejectPayment(stub, loanApplicationId, loanSettlementAmount, newError(ErrCodeFailedPrecondition, "Loan %s cannot be settled: %v", loanApplicationId, err))
+	}
+	portions, err := syndicate.Allocate(v)
 	if err != nil {
-		logger.Error("Could not fetch loan application with id "+loanApplicationId+" from ledger", err)
 		return nil, err
 	}
+	repayments, err := fetchRepaymentSchedule(stub, loanApplicationId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read repayment schedule for loan %s: %v", loanApplicationId, err)
+	}
+	schedule, err := fetchInterestSchedule(stub, loanApplicationId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read interest schedule for loan %s: %v", loanApplicationId, err)
+	}
 
-	var participatedLoan LoanApplication
-    err = json.Unmarshal(bytes,&participatedLoan)
-    fmt.Println("SettleLoanSyndication : participatedLoan ID and amount " + participatedLoan.ID, participatedLoan.DealAmount)
-	
+	fmt.Println("SettleLoanSyndication : participatedLoan ID and amount " + participatedLoan.ID, participatedLoan.DealAmount)
 	fmt.Println("SettleLoanSyndication: All In Rate ", participatedLoan.AllInRate)
-	
 	fmt.Println("SettleLoanSyndication :  baseRateType " + participatedLoan.BaseRateType)
-
 	fmt.Println("SettleLoanSyndication : updating outStandingSettlentAmount for ID for amount " + loanSettlementAmount)
 
-	//participatedLoan.OutStandingSettlementAmount = participatedLoan.ApprovedAmount - v
-	participatedLoan.OutStandingSettlementAmount = participatedLoan.OutStandingSettlementAmount - v
-
-	laBytes, err := json.Marshal(&participatedLoan)
+	//everything has been validated, from here on any failure aborts the transaction
+	participatedLoan.repayPrincipal(v)
+	laBytes, err := saveLoan(stub, participatedLoan)
 	if err != nil {
-		fmt.Println("Could not marshal loan application", err)
-		return nil, err
+		return nil, newError(ErrCodeLedger, "Could not save loan application %s: %v", loanApplicationId, err)
 	}
-	err = stub.PutState(loanApplicationId, laBytes)
-	if err != nil {
-		fmt.Println("Could not save loan application to ledger", err)
-		return nil, err
+	if repayments != nil {
+		repayments.applyRepayment(v)
+		err = saveRepaymentSchedule(stub, repayments)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not save repayment schedule for loan %s: %v", loanApplicationId, err)
+		}
+	}
+	for i, member := range syndicate.Members {
+		err = SettleParticipation(stub, member, participatedLoan, schedule, valueDate, portions[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	if schedule != nil {
+		_, err = saveInterestSchedule(stub, schedule)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not save interest schedule for loan %s: %v", loanApplicationId, err)
+		}
 	}
 
-	err = SettleParticipation(stub,"part1",loanApplicationId,participatedLoan.AllInRate,v)
-	
-	err = SettleParticipation(stub,"part2",loanApplicationId,participatedLoan.AllInRate,v)
-	
-	var customEvent = "{eventType: 'loanApplicationCreation', description:" + loanApplicationId + "' Successfully created'}"
-	err = stub.SetEvent("evtSender", []byte(customEvent))
+	err = setEvent(stub, "loanSettlement", loanApplicationId+" settled "+v.String())
 	if err != nil {
 		return nil, err
 	}
-	logger.Info("Successfully saved loan application")
+	logger.Info("Successfully settled loan application")
 	return laBytes, nil
+}
 
-return nil,nil
+//rejectPayment logs a refused payment and returns the error explaining why. The transaction
+//fails, so the reason reaches the caller through the error code and message rather than an
+//event, which Fabric would discard with the rest of the failed transaction.
+func rejectPayment(stub shim.ChaincodeStubInterface, loanId string, amount string, rejection *ChaincodeError) error {
+	logger.Warning("Rejected payment of " + amount + " on loan " + loanId + ": " + rejection.Code + " " + rejection.Message)
+	return rejection
 }
 
-func SettleParticipation(stub shim.ChaincodeStubInterface, participant string, loan_id string , allinRate int,  settlementAmount int) (error){
+//SettleParticipation accrues interest on a member's position up to valueDate, reduces the
+//position by its allocated portion of the settlement and passes the funded part of the
+//principal on to the member's sub-participants. The accrued interest is only passed through
+//once the borrower pays it.
+func SettleParticipation(stub shim.ChaincodeStubInterface, member SyndicateMember, loan *LoanApplication, schedule *InterestSchedule, valueDate string,  settlementPortion Money) (error){
 	fmt.Println("Entering SettleParticipation")
-	partbytes, err := stub.GetState(participant)
-	if err != nil || partbytes == nil {
-		logger.Error("Could not fetch firstParticipant with id part1 from ledger", err)
+	var participant = member.ParticipantId
+	var loan_id = loan.ID
+	asset, err := fetchPosition(stub, participant, loan_id)
+	if err != nil {
+		return err
+	}
+	if asset == nil {
+		logger.Error("Participant " + participant + " holds no position in loan " + loan_id)
+		return errors.New("Participant " + participant + " holds no position in loan " + loan_id)
+	}
+
+	err = asset.normalizeCurrency(settlementPortion.Currency)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("SettleParticipation:settlementPortion Portion :", settlementPortion)
+	var orginalShareAmt Money
+	orginalShareAmt = asset.ShareAmount
+	fmt.Println("SettleParticipation:orginalShareAmt" , orginalShareAmt)
+	interest, err := accrueSince(stub, schedule, loan, participant, asset, valueDate)
+	if err != nil {
 		return err
 	}
+	asset.AccruedInterest = asset.AccruedInterest.Add(interest)
+	asset.ShareAmount = orginalShareAmt
+	asset.repayPrincipal(loan, settlementPortion)
+
+	fmt.Println("SettleParticipation:Update Participant ShareAmount")
+	fmt.Println(asset.ShareAmount)
 
-	 var firstParticipant Participant
-	 err = json.Unmarshal(partbytes,&firstParticipant)
-	 fmt.Println("SettleParticipation: firstParticipantName " + firstParticipant.Name)
-
-	for i := range firstParticipant.AssetList {
-		fmt.Println("elem.AssetId" , firstParticipant.AssetList[i].AssetId)
-		fmt.Println("loan_id",loan_id)
-		if(firstParticipant.AssetList[i].AssetId == loan_id){
-			fmt.Println("SettleParticipation:Participant Asset Details :" + firstParticipant.AssetList[i].AssetId)
-			fmt.Println("SettleParticipation:Index value is :" , i )
-			var settlementPortion int
-			//settlementPortion = firstParticipant.AssetList[i].SharePerCent*settlementAmount/100
-			settlementPortion = firstParticipant.SharePerCent*settlementAmount/100
-			fmt.Println("SettleParticipation:settlementPortion Portion :", settlementPortion)
-			var orginalShareAmt int
-			orginalShareAmt = firstParticipant.AssetList[i].ShareAmount
-			fmt.Println("SettleParticipation:orginalShareAmt" , orginalShareAmt)
-			firstParticipant.AssetList[i].SettlementFees = firstParticipant.AssetList[i].SettlementFees + (float64(orginalShareAmt*30*allinRate)/(100*365))
-			firstParticipant.AssetList[i].ShareAmount = orginalShareAmt - settlementPortion
-			
-			fmt.Println("SettleParticipation:Update Participant ShareAmount")
-			fmt.Println(firstParticipant.AssetList[i].ShareAmount)
-		}
-	}
-	partbytes2, err := json.Marshal (&firstParticipant)
-	if err != nil {
-       fmt.Println("Could not marshal firstParticipant info object", err)
-       return  err
-	 }
-	 err = stub.PutState(participant, partbytes2)
-	 if err != nil {
-       fmt.Println("Could not put updated firstParticipant in world state", err)
-       return  err
-	 }
-	 	fmt.Println("Exiting SettleParticipation")
+	err = savePosition(stub, participant, asset)
+	if err != nil {
+		return err
+	}
+	err = passThrough(stub, loan_id, participant, valueDate, settlementPortion, ZeroMoney(settlementPortion.Currency))
+	if err != nil {
+		return err
+	}
+	fmt.Println("Exiting SettleParticipation")
 	return nil
 }
 
-
-func NonDeterministicFunction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	fmt.Println("Entering NonDeterministicFunction")
-	//Use random number generator to generate the ID
-	var random = rand.New(rand.NewSource(time.Now().UnixNano()))
-	var loanApplicationID = "la1" + strconv.Itoa(random.Intn(1000))
-	var loanApplication = args[0]
-	var la LoanApplication
-	err := json.Unmarshal([]byte(loanApplication), &la)
+//accrueSince returns the interest on the participant's position from its accrual date to
+//valueDate and moves the accrual date forward, so every stretch of time is accrued once at the
+//principal the position held during it. Each interest period crossed accrues at its own rate,
+//so a value date inside a period uses the fixing of that period, and the interest is recorded
+//against the period for AccrueInterest to complete. Time in a period AccrueInterest has already
+//accrued adds nothing. Positions without an accrual date cannot accrue.
+func accrueSince(stub shim.ChaincodeStubInterface, schedule *InterestSchedule, loan *LoanApplication, participantId string, asset *Asset, valueDate string) (Money, error) {
+	if asset.AccrualDate == "" {
+		return Money{}, newError(ErrCodeFailedPrecondition, "Position in loan %s has no accrual date to accrue interest from", loan.ID)
+	}
+	start, err := ParseDate(asset.AccrualDate)
 	if err != nil {
-		fmt.Println("Could not unmarshal loan application", err)
-		return nil, err
+		return Money{}, newError(ErrCodeFailedPrecondition, "Position in loan %s accrual date: %v", loan.ID, err)
 	}
-	la.ID = loanApplicationID
-	laBytes, err := json.Marshal(&la)
+	end, err := ParseDate(valueDate)
 	if err != nil {
-		fmt.Println("Could not marshal loan application", err)
-		return nil, err
+		return Money{}, newError(ErrCodeInvalidArgument, "Invalid value date: %v", err)
+	}
+	if end.Before(start) {
+		return ZeroMoney(asset.ShareAmount.Currency), nil
 	}
-	err = stub.PutState(loanApplicationID, laBytes)
+	parts, err := splitAccrual(stub, schedule, loan, asset.AccrualDate, valueDate)
 	if err != nil {
-		fmt.Println("Could not save loan application to ledger", err)
-		return nil, err
+		return Money{}, err
 	}
-
-	fmt.Println("Successfully saved loan application")
-	return []byte(loanApplicationID), nil
+	var interest = ZeroMoney(asset.ShareAmount.Currency)
+	for _, part := range parts {
+		if part.Period != nil && part.Period.Status == PeriodAccrued {
+			continue
+		}
+		amount, err := part.interest(asset.ShareAmount, loan.dayCountConvention())
+		if err != nil {
+			return Money{}, err
+		}
+		if part.Period != nil {
+			part.Period.addAccrual(participantId, amount)
+		}
+		interest = interest.Add(amount)
+	}
+	asset.AccrualDate = valueDate
+	return interest, nil
 }
+
 //resets all the things
 func (t *SampleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	if len(args)!=1 {
-				return nil,errors.New("Incorrect number of arguments. Expecting 1")
-	}
-
-	bytes, err := CreateParticipants(stub,args)
+	bytes, err := CreateParticipants(stub, args)
 	if err != nil {
-			logger.Error("Could not create and save participants to ledger", err)
-			return nil, err
-		}
+		logger.Error("Could not create and save participants to ledger", err)
+		return nil, err
+	}
 	return bytes, nil
 }
 
+func (t *SampleChaincode) authorizer() Authorizer {
+	if t.Authorizer == nil {
+		return NewRoleAuthorizer()
+	}
+	return t.Authorizer
+}
+
 func (t *SampleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	err := t.authorizer().Authorize(stub, function, args)
+	if err != nil {
+		logger.Error("Access denied to "+function, err)
+		return nil, err
+	}
+
 	if function == "GetLoanApplication" {
 		return GetLoanApplication(stub, args)
 	} else if function == "GetLoanParticipant" {
 		return GetLoanParticipant(stub, args)
 	} else if (function == "GetParticipatedLoans"){
 		return GetParticipatedLoans(stub, args)
+	} else if function == "GetSyndicate" {
+		return GetSyndicate(stub, args)
+	} else if function == "QueryLoans" {
+		return QueryLoans(stub, args)
+	} else if function == "GetInterestSchedule" {
+		return GetInterestSchedule(stub, args)
+	} else if function == "GetRateFixing" {
+		return GetRateFixing(stub, args)
+	} else if function == "GetRepaymentSchedule" {
+		return GetRepaymentSchedule(stub, args)
+	} else if function == "GetPayments" {
+		return GetPayments(stub, args)
+	} else if function == "GetFeeLedger" {
+		return GetFeeLedger(stub, args)
+	} else if function == "GetDeal" {
+		return GetDeal(stub, args)
+	} else if function == "GetDealExposure" {
+		return GetDealExposure(stub, args)
+	} else if function == "GetFxRate" {
+		return GetFxRate(stub, args)
+	} else if function == "GetPositionReport" {
+		return GetPositionReport(stub, args)
+	} else if function == "GetAssignment" {
+		return GetAssignment(stub, args)
+	} else if function == "GetSubParticipations" {
+		return GetSubParticipations(stub, args)
+	} else if function == "GetTrade" {
+		return GetTrade(stub, args)
+	} else if function == "CalculateTradeEconomics" {
+		return CalculateTradeEconomics(stub, args)
 	}else {
 		return nil, errors.New("Invalid function name")
 	}
@@ -480,18 +1340,90 @@ func GetCertAttribute(stub shim.ChaincodeStubInterface, attributeName string) (s
 
 
 func (t *SampleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	err := t.authorizer().Authorize(stub, function, args)
+	if err != nil {
+		logger.Error("Access denied to "+function, err)
+		return nil, err
+	}
+
 	if (function == "CreateLoanParticipation") {
-		//username, _ := GetCertAttribute(stub, "username")
-		//role, _ := GetCertAttribute(stub, "role")
 		return CreateLoanParticipation(stub, args)
-	/*	if role == "Bank_Admin" {
-		return CreateLoanApplication(stub, args)
-		} else {
-			return nil, errors.New(username + " with role " + role + " does not have access to create a loan application")
-		}*/
-
 	} else if (function == "SettleLoanSyndication") {
 		return SettleLoanSyndication(stub, args)
+	} else if function == "RegisterParticipant" {
+		return RegisterParticipant(stub, args)
+	} else if function == "UpdateParticipant" {
+		return UpdateParticipant(stub, args)
+	} else if function == "DeactivateParticipant" {
+		return DeactivateParticipant(stub, args)
+	} else if function == "MigrateLoanList" {
+		return MigrateLoanList(stub, args)
+	} else if function == "MigrateAmounts" {
+		return MigrateAmounts(stub, args)
+	} else if function == "ReviewLoan" {
+		return ReviewLoan(stub, args)
+	} else if function == "ApproveLoan" {
+		return ApproveLoan(stub, args)
+	} else if function == "SyndicateLoan" {
+		return SyndicateLoan(stub, args)
+	} else if function == "ActivateLoan" {
+		return ActivateLoan(stub, args)
+	} else if function == "MarkLoanRepaid" {
+		return MarkLoanRepaid(stub, args)
+	} else if function == "DefaultLoan" {
+		return DefaultLoan(stub, args)
+	} else if function == "RestructureLoan" {
+		return RestructureLoan(stub, args)
+	} else if function == "CancelLoan" {
+		return CancelLoan(stub, args)
+	} else if function == "AccrueInterest" {
+		return AccrueInterest(stub, args)
+	} else if function == "PublishRateFixing" {
+		return PublishRateFixing(stub, args)
+	} else if function == "TransitionBenchmark" {
+		return TransitionBenchmark(stub, args)
+	} else if function == "ReceivePayment" {
+		return ReceivePayment(stub, args)
+	} else if function == "DefineFee" {
+		return DefineFee(stub, args)
+	} else if function == "AccrueFee" {
+		return AccrueFee(stub, args)
+	} else if function == "InvoiceFee" {
+		return InvoiceFee(stub, args)
+	} else if function == "Drawdown" {
+		return Drawdown(stub, args)
+	} else if function == "Repay" {
+		return Repay(stub, args)
+	} else if function == "Redraw" {
+		return Redraw(stub, args)
+	} else if function == "CreateDeal" {
+		return CreateDeal(stub, args)
+	} else if function == "PublishFxRate" {
+		return PublishFxRate(stub, args)
+	} else if function == "ProposeAssignment" {
+		return ProposeAssignment(stub, args)
+	} else if function == "AcceptAssignment" {
+		return AcceptAssignment(stub, args)
+	} else if function == "WithdrawAssignment" {
+		return WithdrawAssignment(stub, args)
+	} else if function == "ConsentAssignment" {
+		return ConsentAssignment(stub, args)
+	} else if function == "RejectAssignment" {
+		return RejectAssignment(stub, args)
+	} else if function == "SettleAssignment" {
+		return SettleAssignment(stub, args)
+	} else if function == "CreateSubParticipation" {
+		return CreateSubParticipation(stub, args)
+	} else if function == "TerminateSubParticipation" {
+		return TerminateSubParticipation(stub, args)
+	} else if function == "SubmitTradeConfirmation" {
+		return SubmitTradeConfirmation(stub, args)
+	} else if function == "ApproveTrade" {
+		return ApproveTrade(stub, args)
+	} else if function == "SettleTrade" {
+		return SettleTrade(stub, args)
+	} else if function == "CancelTrade" {
+		return CancelTrade(stub, args)
 	} else {
 		return nil, errors.New("Invalid function name")
 	}
@@ -3,14 +3,20 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 )
 
 var loanApplicationID = "la1"
 var loanApplicationID2 = "la2"
+var participant1 = `{"id":"part1","name":"DeucheBank","legalName":"Deutsche Bank AG","lei":"7LTWFZYICNSX8D621K86","roles":["AgentBank","Lender"],"settlementAccount":{"accountName":"Deutsche Bank Loan Ops","accountNumber":"DE89370400440532013000","bic":"DEUTDEFF"}}`
+var participant2 = `{"id":"part2","name":"CitiBank","legalName":"Citibank N.A.","lei":"E57ODZWZ7FF32TWEFA76","roles":["Lender"],"settlementAccount":{"accountName":"Citibank Loan Ops","accountNumber":"US12345678901234","bic":"CITIUS33"}}`
+var syndicate = `{"members":[{"participantId":"part1","commitmentAmount":32000,"shareBps":8000},{"participantId":"part2","commitmentAmount":8000,"shareBps":2000}]}`
 var loanApplication = `{"id":"` + loanApplicationID + `","dealType":"Loan","baseRateType":"LIBOR","allInRate":5,"propertyId":"prop1","landId":"land1","permitId":"permit1","buyerId":"kartikeya","personalInfo":{"firstname":"Kartikeya","lastname":"Gupta","dob":"dob","email":"kartikeya80@gmail.com","mobile":"99999999"},"financialInfo":{"spRating":"BBB+","moodyRating":"Baa2","dcr":1.9,"turnover":4000},"status":"Submitted","requestedAmount":40000,"fairMarketValue":58000,"approvedAmount":40000,"dealAmount":40000,"outstandingSettlementAmount":40000,"reviewedBy":"bond","lastModifiedDate":"21/09/2016 2:30pm"}`
+var loanApplication2 = strings.Replace(loanApplication, `"id":"la1"`, `"id":"la2"`, 1)
 
 // func CreateLoanParticipation(t *testing.T) {
 // 	fmt.Println("Entering CreateLoanParticipation")
@@ -59,7 +65,8 @@ func TestCrtLoanAppWithIdLoanDetails(t *testing.T) {
 	}
 
 	stub.MockTransactionStart("t123")
-	_, err := CreateLoanParticipation(stub, []string{loanApplicationID, loanApplication})
+	CreateParticipants(stub, []string{participant1, participant2})
+	_, err := CreateLoanParticipation(stub, []string{loanApplicationID, loanApplication, syndicate})
 	if err != nil {
 		t.Fatalf("Expected CreateLoanParticipation to succeed")
 	}
@@ -76,7 +83,7 @@ func TestCreateFetchParticipants(t *testing.T) {
 	}
 
 	stub.MockTransactionStart("t123")
-	_, err := CreateParticipants(stub, []string{"part1"})
+	_, err := CreateParticipants(stub, []string{participant1, participant2})
 	if err != nil {
 		t.Fatalf("Expected CreateParticipants to succeed")
 	}
@@ -93,7 +100,7 @@ bytes, err := GetLoanParticipant(stub, []string{"part1"})
 	}
 	fmt.Println("Participant ID :" + firstParticipant.ID)
 	fmt.Println("Participant Name :" + firstParticipant.Name)
-	fmt.Println("Participant SharePerCent :", firstParticipant.SharePerCent)
+	fmt.Println("Participant LEI :" + firstParticipant.LEI)
 	
 //fmt.Println("Participated Asset ID :" + firstParticipant.AssetList[0].AssetId)
 
@@ -108,51 +115,573 @@ bytes2, err2 := GetLoanParticipant(stub, []string{"part2"})
 	}
 	fmt.Println("Participant ID :" + secondParticipant.ID)
 	fmt.Println("Participant Name :" + secondParticipant.Name)
-	fmt.Println("Participant SharePerCent :", secondParticipant.SharePerCent)
+	fmt.Println("Participant LEI :" + secondParticipant.LEI)
 
 }
 	
+func TestRegisterParticipantRejectsDuplicates(t *testing.T) {
+	fmt.Println("Entering TestRegisterParticipantRejectsDuplicates")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	_, err := RegisterParticipant(stub, []string{participant1})
+	if err != nil {
+		t.Fatalf("Expected RegisterParticipant to succeed: %v", err)
+	}
+	_, err = RegisterParticipant(stub, []string{participant1})
+	if err == nil {
+		t.Fatalf("Expected duplicate participant ID to be rejected")
+	}
+
+	var sameLEI = `{"id":"part9","legalName":"Deutsche Bank AG","lei":"7LTWFZYICNSX8D621K86","roles":["Lender"],"settlementAccount":{"accountNumber":"1","bic":"DEUTDEFF"}}`
+	_, err = RegisterParticipant(stub, []string{sameLEI})
+	if err == nil {
+		t.Fatalf("Expected duplicate LEI to be rejected")
+	}
+
+	var badLEI = `{"id":"part9","legalName":"Some Bank","lei":"7LTWFZYICNSX8D621K87","roles":["Lender"],"settlementAccount":{"accountNumber":"1","bic":"SOMEUS33"}}`
+	_, err = RegisterParticipant(stub, []string{badLEI})
+	if err == nil {
+		t.Fatalf("Expected LEI with a bad check digit to be rejected")
+	}
+
+	var badRole = `{"id":"part9","legalName":"Some Bank","lei":"5493001KJTIIGC8Y1R12","roles":["Janitor"],"settlementAccount":{"accountNumber":"1","bic":"SOMEUS33"}}`
+	_, err = RegisterParticipant(stub, []string{badRole})
+	if err == nil {
+		t.Fatalf("Expected unknown role to be rejected")
+	}
+}
+
+func TestUpdateAndDeactivateParticipant(t *testing.T) {
+	fmt.Println("Entering TestUpdateAndDeactivateParticipant")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	_, err := CreateParticipants(stub, []string{participant1, participant2})
+	if err != nil {
+		t.Fatalf("Expected CreateParticipants to succeed: %v", err)
+	}
+
+	var updated = `{"id":"part2","name":"Citi","legalName":"Citibank N.A.","lei":"5493001KJTIIGC8Y1R12","roles":["Lender"],"settlementAccount":{"accountNumber":"US999","bic":"CITIUS33"},"status":"Inactive"}`
+	_, err = UpdateParticipant(stub, []string{updated})
+	if err != nil {
+		t.Fatalf("Expected UpdateParticipant to succeed: %v", err)
+	}
+	participant, err := fetchParticipant(stub, "part2")
+	if err != nil || participant == nil {
+		t.Fatalf("Expected to fetch updated participant")
+	}
+	if participant.Name != "Citi" || participant.LEI != "5493001KJTIIGC8Y1R12" {
+		t.Fatalf("Expected participant details to be updated")
+	}
+	if participant.Status != ParticipantActive {
+		t.Fatalf("Expected UpdateParticipant to leave the status unchanged")
+	}
+	owner, _ := stub.GetState(leiKey("E57ODZWZ7FF32TWEFA76"))
+	if owner != nil {
+		t.Fatalf("Expected the old LEI to be released")
+	}
+
+	var stolenLEI = `{"id":"part2","legalName":"Citibank N.A.","lei":"7LTWFZYICNSX8D621K86","roles":["Lender"],"settlementAccount":{"accountNumber":"US999","bic":"CITIUS33"}}`
+	_, err = UpdateParticipant(stub, []string{stolenLEI})
+	if err == nil {
+		t.Fatalf("Expected UpdateParticipant to reject an LEI owned by another participant")
+	}
+
+	_, err = DeactivateParticipant(stub, []string{"part2"})
+	if err != nil {
+		t.Fatalf("Expected DeactivateParticipant to succeed: %v", err)
+	}
+	participant, _ = fetchParticipant(stub, "part2")
+	if participant.Status != ParticipantInactive {
+		t.Fatalf("Expected participant to be inactive")
+	}
+	_, err = DeactivateParticipant(stub, []string{"part2"})
+	if err == nil {
+		t.Fatalf("Expected second deactivation to fail")
+	}
+	_, err = DeactivateParticipant(stub, []string{"part404"})
+	if err == nil {
+		t.Fatalf("Expected deactivating an unknown participant to fail")
+	}
+}
+	
+func TestCrtLoanAppRejectsInvalidSyndicate(t *testing.T) {
+	fmt.Println("Entering TestCrtLoanAppRejectsInvalidSyndicate")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	CreateParticipants(stub, []string{participant1, participant2})
+
+	var invalidSyndicates = []string{
+		`{"members":[]}`,
+		`{"members":[{"participantId":"part1","commitmentAmount":32000,"shareBps":8000},{"participantId":"part2","commitmentAmount":7000,"shareBps":2000}]}`,
+		`{"members":[{"participantId":"part1","commitmentAmount":30000,"shareBps":8000},{"participantId":"part2","commitmentAmount":10000,"shareBps":2000}]}`,
+		`{"members":[{"participantId":"part1","commitmentAmount":20000,"shareBps":5000},{"participantId":"part1","commitmentAmount":20000,"shareBps":5000}]}`,
+	}
+	for _, invalid := range invalidSyndicates {
+		_, err := CreateLoanParticipation(stub, []string{loanApplicationID, loanApplication, invalid})
+		if err == nil {
+			t.Fatalf("Expected syndicate %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestParticipationUsesPerLoanShares(t *testing.T) {
+	fmt.Println("Entering TestParticipationUsesPerLoanShares")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	CreateParticipants(stub, []string{participant1, participant2})
+
+	var evenSyndicate = `{"members":[{"participantId":"part1","commitmentAmount":20000,"shareBps":5000},{"participantId":"part2","commitmentAmount":20000,"shareBps":5000}]}`
+	_, err := CreateLoanParticipation(stub, []string{loanApplicationID, loanApplication, syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	_, err = CreateLoanParticipation(stub, []string{loanApplicationID2, loanApplication2, evenSyndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	positions, _ := fetchPositions(stub, "part2")
+	if len(positions) != 0 {
+		t.Fatalf("Expected no positions before the loans are syndicated, got %+v", positions)
+	}
+	moveLoanTo(t, stub, loanApplicationID, StatusSyndicated)
+	moveLoanTo(t, stub, loanApplicationID2, StatusSyndicated)
+
+	positions, _ = fetchPositions(stub, "part2")
+	var expected = map[string]Money{loanApplicationID: NewMoney(8000, "USD"), loanApplicationID2: NewMoney(20000, "USD")}
+	if len(positions) != len(expected) {
+		t.Fatalf("Expected part2 to hold %d positions, got %d", len(expected), len(positions))
+	}
+	for _, asset := range positions {
+		if asset.ShareAmount != expected[asset.AssetId] {
+			t.Fatalf("Expected part2 share of %s to be %s, got %s", asset.AssetId, expected[asset.AssetId], asset.ShareAmount)
+		}
+	}
+}
+
+func TestSyndicateSharesTakeRoundingResidue(t *testing.T) {
+	fmt.Println("Entering TestSyndicateSharesTakeRoundingResidue")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	var participant3 = strings.Replace(strings.Replace(participant2, `"part2"`, `"part3"`, 1), "E57ODZWZ7FF32TWEFA76", "MP6I5ZYZBEU3UXPYFY54", 1)
+	CreateParticipants(stub, []string{participant1, participant2, participant3})
+
+	var thirds = `{"members":[{"participantId":"part1","commitmentAmount":"13333.34","shareBps":3333},{"participantId":"part2","commitmentAmount":"13333.33","shareBps":3333},{"participantId":"part3","commitmentAmount":"13333.33","shareBps":3333}]}`
+	_, err := CreateLoanParticipation(stub, []string{loanApplicationID, loanApplication, thirds})
+	if err != nil {
+		t.Fatalf("Expected a syndicate of thirds to be accepted: %v", err)
+	}
+	created, _ := fetchSyndicate(stub, loanApplicationID)
+	if created.Members[0].ShareBps != 3334 || created.Members[1].ShareBps != 3333 || created.Members[2].ShareBps != 3333 {
+		t.Fatalf("Expected the residue basis point to go to the largest remainder, got %+v", created.Members)
+	}
+
+	var pair = Syndicate{LoanId: loanApplicationID, Members: []SyndicateMember{
+		{ParticipantId: "part1", CommitmentAmount: Money{Minor: 2666667, Currency: "USD"}, ShareBps: 6667},
+		{ParticipantId: "part2", CommitmentAmount: Money{Minor: 1333333, Currency: "USD"}, ShareBps: 3333},
+	}}
+	transferred, err := transferShare(&pair, "part1", "part3", Money{Minor: 1333333, Currency: "USD"}, NewMoney(40000, "USD"))
+	if err != nil {
+		t.Fatalf("Expected an assignment leaving thirds to succeed: %v", err)
+	}
+	if transferred != 3333 || pair.Members[0].ShareBps != 3334 || pair.Members[2].ParticipantId != "part3" || pair.Members[2].ShareBps != 3333 {
+		t.Fatalf("Expected shares of 3334, 3333 and 3333 bps after the assignment, got %d moved and %+v", transferred, pair.Members)
+	}
+}
+
+func TestCrtLoanAppIsAllOrNothing(t *testing.T) {
+	fmt.Println("Entering TestCrtLoanAppIsAllOrNothing")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	CreateParticipants(stub, []string{participant1})
+
+	_, err := CreateLoanParticipation(stub, []string{loanApplicationID, loanApplication, syndicate})
+	chaincodeErr, ok := err.(*ChaincodeError)
+	if !ok || chaincodeErr.Code != ErrCodeNotFound {
+		t.Fatalf("Expected a NOT_FOUND error for the missing participant, got %v", err)
+	}
+	if bytes, _ := stub.GetState(loanApplicationID); bytes != nil {
+		t.Fatalf("Expected no loan application to be saved")
+	}
+	if bytes, _ := stub.GetState(syndicateKey(loanApplicationID)); bytes != nil {
+		t.Fatalf("Expected no syndicate to be saved")
+	}
+	positions, _ := fetchPositions(stub, "part1")
+	if len(positions) != 0 {
+		t.Fatalf("Expected part1 to hold no positions")
+	}
+
+	_, err = CreateLoanParticipation(stub, []string{loanApplicationID2, loanApplication, syndicate})
+	chaincodeErr, ok = err.(*ChaincodeError)
+	if !ok || chaincodeErr.Code != ErrCodeInvalidArgument {
+		t.Fatalf("Expected an INVALID_ARGUMENT error for the mismatched ID, got %v", err)
+	}
+}
+
+func TestCrtLoanAppRefusesExistingID(t *testing.T) {
+	fmt.Println("Entering TestCrtLoanAppRefusesExistingID")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	CreateParticipants(stub, []string{participant1, participant2})
+
+	_, err := CreateLoanParticipation(stub, []string{loanApplicationID, loanApplication, syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	moveLoanTo(t, stub, loanApplicationID, StatusSyndicated)
+	_, err = CreateLoanParticipation(stub, []string{loanApplicationID, loanApplication, syndicate})
+	chaincodeErr, ok := err.(*ChaincodeError)
+	if !ok || chaincodeErr.Code != ErrCodeAlreadyExists {
+		t.Fatalf("Expected an ALREADY_EXISTS error, got %v", err)
+	}
+	positions, _ := fetchPositions(stub, "part1")
+	if len(positions) != 1 {
+		t.Fatalf("Expected part1 to still hold a single position, got %d", len(positions))
+	}
+}
+
 func TestGetParticipatedLoans(t *testing.T){
 	
 	fmt.Println("Entering TestGetParticipatedLoans")
 
 	attributes := make(map[string][]byte)
 	attributes["username"] = []byte("vojha24")
-	attributes["role"] = []byte("client")
+	attributes["role"] = []byte("AgentBank")
 
 	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
 	if stub == nil {
 		t.Fatalf("MockStub creation failed")
 	}
 
-	_, err := stub.MockInvoke("t123", "CreateLoanParticipation", []string{loanApplicationID, loanApplication})
+	_, err := stub.MockInit("t123", "init", []string{participant1, participant2})
+	if err != nil {
+		t.Fatalf("Expected Init to register participants: %v", err)
+	}
+
+	_, err = stub.MockInvoke("t123", "CreateLoanParticipation", []string{loanApplicationID, loanApplication, syndicate})
 	if err != nil {
 		fmt.Println(err)
 		t.Fatalf("Expected CreateLoanParticipation to be invoked")
 	}
 	
-	_, err = stub.MockInvoke("t123", "CreateLoanParticipation", []string{loanApplicationID2, loanApplication})
+	_, err = stub.MockInvoke("t123", "CreateLoanParticipation", []string{loanApplicationID2, loanApplication2, syndicate})
 	if err != nil {
 		fmt.Println(err)
 		t.Fatalf("Expected CreateLoanParticipation to be invoked")
 	}
+	advanceLoanTo(t, stub, loanApplicationID, StatusSyndicated)
+	advanceLoanTo(t, stub, loanApplicationID2, StatusSyndicated)
 
-	loanbytes2, err1 := stub.MockInvoke("t123", "GetParticipatedLoans", []string{})
-	if err1 == nil {
-		//t.Fatalf("Expected unauthorized user error to be returned")
+	loanbytes2, err := stub.MockQuery("GetParticipatedLoans", []string{})
+	if err != nil {
+		t.Fatalf("Expected GetParticipatedLoans to succeed: %v", err)
 	}
 	var loanList []LoanApplication
-	if (loanbytes2 != nil) {
-		err = json.Unmarshal(loanbytes2,&loanList)
+	err = json.Unmarshal(loanbytes2, &loanList)
+	if err != nil {
+		t.Fatalf("Could not unmarshal loan list")
+	}
+	fmt.Println("LoanList length is", len(loanList))
+	if len(loanList) != 2 || loanList[0].ID != loanApplicationID || loanList[1].ID != loanApplicationID2 {
+		t.Fatalf("Expected both loans to be returned in ID order")
+	}
+
+	loanbytes2, err = stub.MockQuery("GetParticipatedLoans", []string{"part2"})
+	if err != nil {
+		t.Fatalf("Expected GetParticipatedLoans for part2 to succeed: %v", err)
+	}
+	err = json.Unmarshal(loanbytes2, &loanList)
+	if err != nil || len(loanList) != 2 {
+		t.Fatalf("Expected part2 to participate in both loans")
+	}
+
+	loanbytes2, err = stub.MockQuery("GetParticipatedLoans", []string{"part3"})
+	if err != nil {
+		t.Fatalf("Expected GetParticipatedLoans for part3 to succeed: %v", err)
+	}
+	err = json.Unmarshal(loanbytes2, &loanList)
+	if err != nil || len(loanList) != 0 {
+		t.Fatalf("Expected part3 to participate in no loans")
+	}
+}
+
+func TestMigrateLoanList(t *testing.T) {
+	fmt.Println("Entering TestMigrateLoanList")
+	attributes := make(map[string][]byte)
+	attributes["role"] = []byte("AgentBank")
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	//state as written by the single-key loanlist version of the chaincode
+	stub.MockTransactionStart("t123")
+	stub.PutState("loanlist", []byte("["+loanApplication+"]"))
+	stub.PutState(loanApplicationID, []byte(strings.Replace(loanApplication, `"outstandingSettlementAmount":40000`, `"outstandingSettlementAmount":39000`, 1)))
+	stub.PutState("part1", []byte(`{"id":"part1","name":"DeucheBank","share":80,"AssetList":[{"loanId":"la1","shareAmount":31200}]}`))
+	stub.PutState("part2", []byte(`{"id":"part2","name":"CitiBank","share":20,"AssetList":[{"loanId":"la1","shareAmount":7800}]}`))
+	stub.MockTransactionEnd("t123")
+
+	_, err := stub.MockInvoke("t123", "MigrateLoanList", []string{"part1", "part2"})
+	if err != nil {
+		t.Fatalf("Expected MigrateLoanList to succeed: %v", err)
+	}
+
+	if bytes, _ := stub.GetState("loanlist"); bytes != nil {
+		t.Fatalf("Expected loanlist to be removed")
+	}
+	if bytes, _ := stub.GetState("part1"); bytes != nil {
+		t.Fatalf("Expected legacy participant key to be removed")
+	}
+	loan, _ := fetchLoan(stub, loanApplicationID)
+	if loan == nil || loan.OutStandingSettlementAmount != NewMoney(39000, "USD") {
+		t.Fatalf("Expected the settled copy of the loan to be migrated")
+	}
+	position, _ := fetchPosition(stub, "part1", loanApplicationID)
+	if position == nil || position.ShareAmount.Cmp(NewMoney(31200, "USD")) != 0 {
+		t.Fatalf("Expected part1 position to be migrated")
+	}
+	migratedSyndicate, err := fetchSyndicate(stub, loanApplicationID)
+	if err != nil || len(migratedSyndicate.Members) != 2 || migratedSyndicate.Members[0].CommitmentAmount != NewMoney(32000, "USD") {
+		t.Fatalf("Expected the syndicate to be rebuilt from legacy shares")
+	}
+
+	_, err = stub.MockInvoke("t123", "MigrateLoanList", []string{"part1", "part2"})
+	if err != nil {
+		t.Fatalf("Expected a second MigrateLoanList to be harmless: %v", err)
+	}
+}
+
+
+func TestMoneyParsingAndLegacyNumbers(t *testing.T) {
+	fmt.Println("Entering TestMoneyParsingAndLegacyNumbers")
+	amount, err := ParseMoney("1250.5", "EUR")
+	if err != nil || amount.Minor != 125050 || amount.String() != "1250.50 EUR" {
+		t.Fatalf("Expected 1250.50 EUR, got %v %v", amount, err)
+	}
+	amount, err = ParseMoney("100 JPY", "USD")
+	if err != nil || amount.Minor != 100 || amount.Currency != "JPY" {
+		t.Fatalf("Expected the currency in the text to win, got %v %v", amount, err)
+	}
+	if _, err = ParseMoney("10.001", "USD"); err == nil {
+		t.Fatalf("Expected sub-cent USD amounts to be refused")
+	}
+
+	var asset Asset
+	err = json.Unmarshal([]byte(`{"loanId":"la1","shareAmount":31200,"settlementFees":131.5068493150685}`), &asset)
+	if err != nil {
+		t.Fatalf("Expected legacy numeric amounts to decode: %v", err)
+	}
+	asset.normalizeCurrency("USD")
+	if asset.ShareAmount != NewMoney(31200, "USD") || asset.AccruedInterest.String() != "131.51 USD" {
+		t.Fatalf("Unexpected legacy amounts %s and %s", asset.ShareAmount, asset.AccruedInterest)
+	}
+	bytes, _ := json.Marshal(&asset)
+	if !strings.Contains(string(bytes), `"shareAmount":"31200.00 USD"`) {
+		t.Fatalf("Expected amounts to be encoded as strings, got %s", bytes)
+	}
+
+	if _, err = NewMoney(1, "EUR").InCurrency("USD"); err == nil {
+		t.Fatalf("Expected relabelling an EUR amount as USD to fail")
+	}
+}
+
+func TestAllocateSumsToTotal(t *testing.T) {
+	fmt.Println("Entering TestAllocateSumsToTotal")
+	var members = []SyndicateMember{
+		{ParticipantId: "part1", ShareBps: 3333},
+		{ParticipantId: "part2", ShareBps: 3333},
+		{ParticipantId: "part3", ShareBps: 3334},
+	}
+	var total = Money{Minor: 10001, Currency: "USD"}
+
+	var cases = []struct {
+		rule     string
+		absorber string
+		expected []int64
+	}{
+		{RoundingLargestRemainder, "", []int64{3333, 3333, 3335}},
+		{RoundingAgentAbsorbs, "part1", []int64{3334, 3333, 3334}},
+		{RoundingLeadLender, "part2", []int64{3333, 3334, 3334}},
+	}
+	for _, c := range cases {
+		parts, err := Allocate(total, members, c.rule, c.absorber)
 		if err != nil {
-			logger.Error("unable to unmarshall loanlist")
-		
+			t.Fatalf("Expected %s allocation to succeed: %v", c.rule, err)
+		}
+		for i := range parts {
+			if parts[i].Minor != c.expected[i] || parts[i].Currency != "USD" {
+				t.Fatalf("Expected %s allocation %v, got %v", c.rule, c.expected, parts)
+			}
 		}
 	}
-	
-	fmt.Println("LoanList length is", len(loanList))
+
+	parts, _ := Allocate(Money{Minor: -10001, Currency: "USD"}, members, RoundingLargestRemainder, "")
+	if parts[0].Minor+parts[1].Minor+parts[2].Minor != -10001 {
+		t.Fatalf("Expected a negative allocation to sum to the total, got %v", parts)
+	}
+	if _, err := Allocate(total, members, RoundingAgentAbsorbs, "part9"); err == nil {
+		t.Fatalf("Expected an absorber outside the syndicate to be refused")
+	}
+	if _, err := Allocate(total, members[:2], RoundingLargestRemainder, ""); err == nil {
+		t.Fatalf("Expected shares below 100%% to be refused")
+	}
+}
+
+func TestCreateLoanParticipationDerivesCommitmentsFromShares(t *testing.T) {
+	fmt.Println("Entering TestCreateLoanParticipationDerivesCommitmentsFromShares")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	CreateParticipants(stub, []string{participant1, participant2})
+
+	var oddLoan = strings.Replace(loanApplicationFor(loanApplicationID, 40000, StatusSubmitted), `"40000.00 USD"`, `"40000.01 USD"`, -1)
+	oddLoan = strings.Replace(oddLoan, `"status"`, `"startDate":"2017-01-15","status"`, 1)
+	var byShares = `{"members":[{"participantId":"part1","shareBps":8000},{"participantId":"part2","shareBps":2000}],"roundingRule":"AgentAbsorbs","agentId":"part2"}`
+	_, err := CreateLoanParticipation(stub, []string{loanApplicationID, oddLoan, byShares})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	moveLoanTo(t, stub, loanApplicationID, StatusSyndicated)
+	position1, _ := fetchPosition(stub, "part1", loanApplicationID)
+	position2, _ := fetchPosition(stub, "part2", loanApplicationID)
+	if position1.ShareAmount.String() != "32000.00 USD" || position2.ShareAmount.String() != "8000.01 USD" {
+		t.Fatalf("Expected the agent to absorb the odd cent, got %s and %s", position1.ShareAmount, position2.ShareAmount)
+	}
+
+	stub.MockTransactionEnd("t123")
+	advanceLoanTo(t, stub, loanApplicationID, StatusActive)
+	stub.MockTransactionStart("t123")
+	_, err = SettleLoanSyndication(stub, []string{loanApplicationID, "0.03", "2017-01-15"})
+	if err != nil {
+		t.Fatalf("Expected SettleLoanSyndication to succeed: %v", err)
+	}
+	position1, _ = fetchPosition(stub, "part1", loanApplicationID)
+	position2, _ = fetchPosition(stub, "part2", loanApplicationID)
+	if position1.ShareAmount.String() != "31999.98 USD" || position2.ShareAmount.String() != "8000.00 USD" {
+		t.Fatalf("Expected the settlement portions to sum to the payment, got %s and %s", position1.ShareAmount, position2.ShareAmount)
+	}
+}
+
+func TestSettlementAccruesByDayCountConvention(t *testing.T) {
+	fmt.Println("Entering TestSettlementAccruesByDayCountConvention")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	CreateParticipants(stub, []string{participant1, participant2})
+
+	var datedLoan = strings.Replace(loanApplication, `"status"`, `"dayCountConvention":"ACT/360","startDate":"2017-01-31","status"`, 1)
+	_, err := CreateLoanParticipation(stub, []string{loanApplicationID, datedLoan, syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	stub.MockTransactionEnd("t123")
+	advanceLoanTo(t, stub, loanApplicationID, StatusActive)
+	stub.MockTransactionStart("t123")
+	_, err = SettleLoanSyndication(stub, []string{loanApplicationID, "1000", "2017-04-30"})
+	if err != nil {
+		t.Fatalf("Expected SettleLoanSyndication to succeed: %v", err)
+	}
+	position, _ := fetchPosition(stub, "part1", loanApplicationID)
+	if position.AccruedInterest.String() != "395.56 USD" || position.AccrualDate != "2017-04-30" {
+		t.Fatalf("Expected 89 days of ACT/360 interest up to the value date, got %s to %s", position.AccruedInterest, position.AccrualDate)
+	}
+
+	_, err = SettleLoanSyndication(stub, []string{loanApplicationID, "1000", "2017-03-31"})
+	position, _ = fetchPosition(stub, "part1", loanApplicationID)
+	if err != nil || position.AccruedInterest.String() != "395.56 USD" || position.AccrualDate != "2017-04-30" {
+		t.Fatalf("Expected a value date before the last accrual to add no interest, got %s to %s (%v)", position.AccruedInterest, position.AccrualDate, err)
+	}
+	var badConvention = strings.Replace(loanApplication2, `"status"`, `"dayCountConvention":"ACT/999","status"`, 1)
+	_, err = CreateLoanParticipation(stub, []string{loanApplicationID2, badConvention, syndicate})
+	if err == nil {
+		t.Fatalf("Expected an unknown day-count convention to be refused")
+	}
 }
 
+func TestMigrateAmounts(t *testing.T) {
+	fmt.Println("Entering TestMigrateAmounts")
+	attributes := make(map[string][]byte)
+	attributes["role"] = []byte("AgentBank")
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	//state as written before amounts carried a currency
+	stub.MockTransactionStart("t123")
+	stub.PutState(loanKey(loanApplicationID), []byte(loanApplication))
+	stub.PutState(syndicateKey(loanApplicationID), []byte(syndicate))
+	stub.PutState(positionKey("part1", loanApplicationID), []byte(`{"loanId":"la1","shareAmount":31200,"settlementFees":131.5068493150685}`))
+	stub.MockTransactionEnd("t123")
+
+	_, err := stub.MockInvoke("t123", "MigrateAmounts", []string{})
+	if err != nil {
+		t.Fatalf("Expected MigrateAmounts to succeed: %v", err)
+	}
+
+	for _, key := range []string{loanKey(loanApplicationID), syndicateKey(loanApplicationID), positionKey("part1", loanApplicationID)} {
+		bytes, _ := stub.GetState(key)
+		if !strings.Contains(string(bytes), `0 USD"`) {
+			t.Fatalf("Expected %s to hold string amounts in USD, got %s", key, bytes)
+		}
+	}
+	position, _ := fetchPosition(stub, "part1", loanApplicationID)
+	if position.AccruedInterest != (Money{Minor: 13151, Currency: "USD"}) {
+		t.Fatalf("Expected legacy fees to be rounded to cents, got %s", position.AccruedInterest)
+	}
+}
 
 
 func TestCrtFetchLoanAppAndValidateInputStoredVal(t *testing.T) {
@@ -164,7 +693,8 @@ func TestCrtFetchLoanAppAndValidateInputStoredVal(t *testing.T) {
 	}
 
 	stub.MockTransactionStart("t123")
-	CreateLoanParticipation(stub, []string{loanApplicationID, loanApplication})
+	CreateParticipants(stub, []string{participant1, participant2})
+	CreateLoanParticipation(stub, []string{loanApplicationID, loanApplication, syndicate})
 	stub.MockTransactionEnd("t123")
 
 	var la LoanApplication
@@ -211,9 +741,15 @@ func TestInvokeCrtLoanAppWithUnAuthorizedUser(t *testing.T) {
 		t.Fatalf("MockStub creation failed")
 	}
 
-	_, err := stub.MockInvoke("t123", "CreateLoanParticipation", []string{loanApplicationID, loanApplication})
-	if err == nil {
-		//t.Fatalf("Expected unauthorized user error to be returned")
+	_, err := stub.MockInit("t123", "init", []string{participant1, participant2})
+	if err != nil {
+		t.Fatalf("Expected Init to register participants: %v", err)
+	}
+
+	_, err = stub.MockInvoke("t123", "CreateLoanParticipation", []string{loanApplicationID, loanApplication, syndicate})
+	chaincodeErr, ok := err.(*ChaincodeError)
+	if !ok || chaincodeErr.Code != ErrCodeAccessDenied {
+		t.Fatalf("Expected unauthorized user error to be returned, got %v", err)
 	}
 
 }
@@ -223,7 +759,7 @@ func TestInvokeCrtSttleLoanSyndWithAuthorizedRole(t *testing.T) {
 
 	attributes := make(map[string][]byte)
 	attributes["username"] = []byte("vojha24")
-	attributes["role"] = []byte("Bank_Admin")
+	attributes["role"] = []byte("AgentBank")
 
 	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
 	if stub == nil {
@@ -231,13 +767,14 @@ func TestInvokeCrtSttleLoanSyndWithAuthorizedRole(t *testing.T) {
 	}
 
 	stub.MockTransactionStart("t123")
-	_, err := CreateParticipants(stub, []string{"part1"})
+	_, err := CreateParticipants(stub, []string{participant1, participant2})
 	if err != nil {
 		t.Fatalf("Expected CreateParticipants to succeed")
 	}
 	stub.MockTransactionEnd("t123")
 
-	_, err = stub.MockInvoke("t123", "CreateLoanParticipation", []string{loanApplicationID, loanApplication})
+	var datedLoan = strings.Replace(loanApplication, `"status"`, `"startDate":"2017-01-15","status"`, 1)
+	_, err = stub.MockInvoke("t123", "CreateLoanParticipation", []string{loanApplicationID, datedLoan, syndicate})
 	if err != nil {
 		fmt.Println(err)
 		t.Fatalf("Expected CreateLoanParticipation to be invoked")
@@ -260,7 +797,8 @@ func TestInvokeCrtSttleLoanSyndWithAuthorizedRole(t *testing.T) {
 	
 		}
 
-		_, err = stub.MockInvoke("t123", "SettleLoanSyndication", []string{loanApplicationID, "1000"})
+		advanceLoanTo(t, stub, loanApplicationID, StatusActive)
+		_, err = stub.MockInvoke("t123", "SettleLoanSyndication", []string{loanApplicationID, "1000", "2017-02-15"})
 		if err != nil {
 			fmt.Println(err)
 			t.Fatalf("Expected SettleLoanSyndication to be invoked")
@@ -288,7 +826,7 @@ func TestInvokeCrtSttleLoanSyndWithAuthorizedRole(t *testing.T) {
 		if(firstParticipant.AssetList != nil){
 		fmt.Println("Participated Asset ID : " + firstParticipant.AssetList[0].AssetId)
 		fmt.Println("Participant Reduced Share Amount Post Settlement", firstParticipant.AssetList[0].ShareAmount)
-		fmt.Println("Participant Settlemt Feest", firstParticipant.AssetList[0].SettlementFees)
+		fmt.Println("Participant Settlemt Feest", firstParticipant.AssetList[0].AccruedInterest)
 		}
 
 	fmt.Println("Entering TestInvokeCrtSttleLoanSyndWithAuthorizedRole")
@@ -300,7 +838,7 @@ func TestInvokeInValidFunction(t *testing.T) {
 
 	attributes := make(map[string][]byte)
 	attributes["username"] = []byte("vojha24")
-	attributes["role"] = []byte("Bank_Admin")
+	attributes["role"] = []byte("AgentBank")
 
 	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
 	if stub == nil {
@@ -319,14 +857,14 @@ func TestInvokeInValidFunction(t *testing.T) {
 
 	attributes := make(map[string][]byte)
 	attributes["username"] = []byte("vojha24")
-	attributes["role"] = []byte("Bank_Admin")
+	attributes["role"] = []byte("AgentBank")
 
 	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
 	if stub == nil {
 		t.Fatalf("MockStub creation failed")
 	}
 
-	bytes, err := stub.MockInvoke("t123", "CreateLoanParticipation", []string{loanApplicationID, loanApplication})
+	bytes, err := stub.MockInvoke("t123", "CreateLoanParticipation", []string{loanApplicationID, loanApplication, syndicate})
 	if err != nil {
 		t.Fatalf("Expected CreateLoanParticipation function to be invoked")
 	}
@@ -338,3 +876,1856 @@ func TestInvokeInValidFunction(t *testing.T) {
 	}
 
 }*/
+
+//loanApplicationFor derives a loan fixture with its own ID and amount from loanApplication
+func loanApplicationFor(id string, dealAmount int, status string) string {
+	var la LoanApplication
+	json.Unmarshal([]byte(loanApplication), &la)
+	la.ID = id
+	la.DealAmount = NewMoney(int64(dealAmount), "USD")
+	la.OutStandingSettlementAmount = la.DealAmount
+	la.Status = status
+	bytes, _ := json.Marshal(&la)
+	return string(bytes)
+}
+
+//syndicateFor splits a deal 80/20 between part1 and part2
+func syndicateFor(dealAmount int) string {
+	return fmt.Sprintf(`{"members":[{"participantId":"part1","commitmentAmount":%d,"shareBps":8000},{"participantId":"part2","commitmentAmount":%d,"shareBps":2000}]}`, dealAmount*8/10, dealAmount*2/10)
+}
+
+func TestQueryLoansFiltersAndPages(t *testing.T) {
+	fmt.Println("Entering TestQueryLoansFiltersAndPages")
+	attributes := make(map[string][]byte)
+	attributes["role"] = []byte("AgentBank")
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	CreateParticipants(stub, []string{participant1, participant2})
+	var amounts = map[string]int{"la1": 40000, "la2": 10000, "la3": 25000, "la4": 60000}
+	for _, id := range []string{"la1", "la2", "la3", "la4"} {
+		_, err := CreateLoanParticipation(stub, []string{id, loanApplicationFor(id, amounts[id], "Submitted"), syndicateFor(amounts[id])})
+		if err != nil {
+			t.Fatalf("Expected CreateLoanParticipation of %s to succeed: %v", id, err)
+		}
+	}
+	ReviewLoan(stub, []string{"la4", "bond"})
+	ApproveLoan(stub, []string{"la4", "60000"})
+	stub.MockTransactionEnd("t123")
+
+	var query = func(q string) LoanPage {
+		bytes, err := stub.MockQuery("QueryLoans", []string{q})
+		if err != nil {
+			t.Fatalf("Expected QueryLoans %s to succeed: %v", q, err)
+		}
+		var page LoanPage
+		err = json.Unmarshal(bytes, &page)
+		if err != nil {
+			t.Fatalf("Could not unmarshal loan page")
+		}
+		return page
+	}
+
+	page := query(`{"status":"Submitted","minDealAmount":20000}`)
+	if page.TotalCount != 2 || page.Loans[0].ID != "la1" || page.Loans[1].ID != "la3" {
+		t.Fatalf("Expected la1 and la3 to match, got %+v", page)
+	}
+	page = query(`{"spRating":"BBB+","maxDealAmount":30000}`)
+	if page.TotalCount != 2 {
+		t.Fatalf("Expected two loans rated BBB+ up to 30000, got %d", page.TotalCount)
+	}
+	page = query(`{"moodyRating":"Aaa"}`)
+	if page.TotalCount != 0 || page.Loans == nil {
+		t.Fatalf("Expected an empty page for an unused rating")
+	}
+
+	var seen []string
+	var bookmark = ""
+	for {
+		page = query(`{"sortBy":"dealAmount","sortOrder":"desc","pageSize":3,"bookmark":"` + bookmark + `"}`)
+		if page.TotalCount != 4 {
+			t.Fatalf("Expected a total count of 4, got %d", page.TotalCount)
+		}
+		for _, loan := range page.Loans {
+			seen = append(seen, loan.ID)
+		}
+		if page.Bookmark == "" {
+			break
+		}
+		bookmark = page.Bookmark
+	}
+	if strings.Join(seen, ",") != "la4,la1,la3,la2" {
+		t.Fatalf("Expected loans by descending deal amount, got %v", seen)
+	}
+
+	_, err := stub.MockQuery("QueryLoans", []string{`{"sortBy":"borrowerShoeSize"}`})
+	if err == nil {
+		t.Fatalf("Expected an unknown sort field to be rejected")
+	}
+}
+
+//transactionStub is the part of the custom mock stub the test helpers need
+type transactionStub interface {
+	shim.ChaincodeStubInterface
+	MockTransactionStart(txid string)
+	MockTransactionEnd(uuid string)
+}
+
+//advanceLoanTo walks a submitted loan through the lifecycle up to the given status in a
+//transaction of its own
+func advanceLoanTo(t *testing.T, stub transactionStub, loanId string, status string) {
+	stub.MockTransactionStart("advance")
+	defer stub.MockTransactionEnd("advance")
+	moveLoanTo(t, stub, loanId, status)
+}
+
+//moveLoanTo walks a loan from its current status through the lifecycle up to the given status
+//in the current transaction
+func moveLoanTo(t *testing.T, stub shim.ChaincodeStubInterface, loanId string, status string) {
+	loan, _ := fetchLoan(stub, loanId)
+	var reached = loan == nil || loan.Status == StatusSubmitted
+	var steps = []struct {
+		status string
+		invoke func(stub shim.ChaincodeStubInterface, args []string) ([]byte, error)
+		args   []string
+	}{
+		{StatusUnderReview, ReviewLoan, []string{loanId, "bond"}},
+		{StatusApproved, ApproveLoan, []string{loanId, "40000"}},
+		{StatusSyndicated, SyndicateLoan, []string{loanId}},
+		{StatusActive, ActivateLoan, []string{loanId}},
+	}
+	for _, step := range steps {
+		if !reached {
+			reached = step.status == loan.Status
+			continue
+		}
+		_, err := step.invoke(stub, step.args)
+		if err != nil {
+			t.Fatalf("Expected loan %s to move to %s: %v", loanId, step.status, err)
+		}
+		if step.status == status {
+			return
+		}
+	}
+}
+
+func TestLoanLifecycleTransitions(t *testing.T) {
+	fmt.Println("Entering TestLoanLifecycleTransitions")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	CreateParticipants(stub, []string{participant1, participant2})
+	_, err := CreateLoanParticipation(stub, []string{loanApplicationID, loanApplication, syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+
+	var expectCode = func(err error, code string, what string) {
+		chaincodeErr, ok := err.(*ChaincodeError)
+		if !ok || chaincodeErr.Code != code {
+			t.Fatalf("Expected %s to fail with %s, got %v", what, code, err)
+		}
+	}
+
+	_, err = ActivateLoan(stub, []string{loanApplicationID})
+	expectCode(err, ErrCodeIllegalTransition, "activating a submitted loan")
+	_, err = ReviewLoan(stub, []string{loanApplicationID})
+	expectCode(err, ErrCodeInvalidArgument, "reviewing without a reviewer")
+	_, err = ReviewLoan(stub, []string{loanApplicationID, "bond"})
+	if err != nil {
+		t.Fatalf("Expected ReviewLoan to succeed: %v", err)
+	}
+	_, err = ApproveLoan(stub, []string{loanApplicationID, "0"})
+	expectCode(err, ErrCodeFailedPrecondition, "approving without an amount")
+	_, err = ApproveLoan(stub, []string{loanApplicationID, "40000"})
+	if err != nil {
+		t.Fatalf("Expected ApproveLoan to succeed: %v", err)
+	}
+	_, err = SyndicateLoan(stub, []string{loanApplicationID})
+	if err != nil {
+		t.Fatalf("Expected SyndicateLoan to succeed: %v", err)
+	}
+	_, err = ActivateLoan(stub, []string{loanApplicationID})
+	if err != nil {
+		t.Fatalf("Expected ActivateLoan to succeed: %v", err)
+	}
+	_, err = MarkLoanRepaid(stub, []string{loanApplicationID})
+	expectCode(err, ErrCodeFailedPrecondition, "marking a loan with an outstanding balance as repaid")
+	_, err = DefaultLoan(stub, []string{loanApplicationID, "missed payment"})
+	if err != nil {
+		t.Fatalf("Expected DefaultLoan to succeed: %v", err)
+	}
+	_, err = CancelLoan(stub, []string{loanApplicationID})
+	expectCode(err, ErrCodeIllegalTransition, "cancelling a defaulted loan")
+	stub.MockTransactionEnd("t123")
+
+	la, _ := fetchLoan(stub, loanApplicationID)
+	if la.Status != StatusDefaulted || la.ReviewerId != "bond" || la.ApprovedAmount != NewMoney(40000, "USD") {
+		t.Fatalf("Expected the loan to be defaulted with its review recorded, got %+v", la)
+	}
+}
+
+func TestSyndicateLoanRequiresReviewer(t *testing.T) {
+	fmt.Println("Entering TestSyndicateLoanRequiresReviewer")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	CreateParticipants(stub, []string{participant1, participant2})
+	CreateLoanParticipation(stub, []string{loanApplicationID, loanApplication, syndicate})
+
+	//a loan approved outside the review invoke, e.g. by an older chaincode version
+	la, _ := fetchLoan(stub, loanApplicationID)
+	la.Status = StatusApproved
+	la.ApprovedAmount = NewMoney(40000, "USD")
+	saveLoan(stub, la)
+
+	_, err := SyndicateLoan(stub, []string{loanApplicationID})
+	chaincodeErr, ok := err.(*ChaincodeError)
+	if !ok || chaincodeErr.Code != ErrCodeFailedPrecondition {
+		t.Fatalf("Expected syndication without a reviewer to be refused, got %v", err)
+	}
+}
+
+func TestLenderCanOnlyReadOwnPositions(t *testing.T) {
+	fmt.Println("Entering TestLenderCanOnlyReadOwnPositions")
+	attributes := make(map[string][]byte)
+	attributes["username"] = []byte("citi-ops")
+	attributes["role"] = []byte("Lender")
+	attributes["participantId"] = []byte("part2")
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	CreateParticipants(stub, []string{participant1, participant2})
+	CreateLoanParticipation(stub, []string{loanApplicationID, loanApplication, syndicate})
+	stub.MockTransactionEnd("t123")
+
+	var expectDenied = func(err error, what string) {
+		chaincodeErr, ok := err.(*ChaincodeError)
+		if !ok || chaincodeErr.Code != ErrCodeAccessDenied {
+			t.Fatalf("Expected %s to be denied, got %v", what, err)
+		}
+	}
+
+	_, err := stub.MockQuery("GetLoanParticipant", []string{"part2"})
+	if err != nil {
+		t.Fatalf("Expected a lender to read its own positions: %v", err)
+	}
+	_, err = stub.MockQuery("GetParticipatedLoans", []string{"part2"})
+	if err != nil {
+		t.Fatalf("Expected a lender to list its own loans: %v", err)
+	}
+	_, err = stub.MockQuery("GetLoanApplication", []string{loanApplicationID})
+	if err != nil {
+		t.Fatalf("Expected a lender to read a loan application: %v", err)
+	}
+	_, err = stub.MockQuery("GetLoanParticipant", []string{"part1"})
+	expectDenied(err, "reading another lender's positions")
+	_, err = stub.MockQuery("GetParticipatedLoans", []string{})
+	expectDenied(err, "listing every participant's loans")
+	_, err = stub.MockQuery("QueryLoans", []string{`{"participantId":"part1"}`})
+	expectDenied(err, "querying another lender's loans")
+	_, err = stub.MockInvoke("t123", "SettleLoanSyndication", []string{loanApplicationID, "1000"})
+	expectDenied(err, "settling a loan as a lender")
+
+	bytes, err := stub.MockQuery("GetSyndicate", []string{loanApplicationID, "part2"})
+	var own Syndicate
+	if err != nil || json.Unmarshal(bytes, &own) != nil || len(own.Members) != 1 || own.Members[0].ParticipantId != "part2" {
+		t.Fatalf("Expected a lender to see only its own syndicate membership, got %s (%v)", bytes, err)
+	}
+	for _, query := range []struct {
+		function string
+		args     []string
+	}{
+		{"GetSyndicate", []string{loanApplicationID}},
+		{"GetInterestSchedule", []string{loanApplicationID, "part1"}},
+		{"GetPayments", []string{loanApplicationID}},
+		{"GetAssignment", []string{"as1"}},
+		{"GetTrade", []string{"tr1", "part1"}},
+		{"CalculateTradeEconomics", []string{"tr1", "2017-03-10"}},
+	} {
+		_, err = stub.MockQuery(query.function, query.args)
+		expectDenied(err, "calling "+query.function+" without naming itself")
+	}
+}
+
+type allowAll struct{}
+
+func (allowAll) Authorize(stub shim.ChaincodeStubInterface, function string, args []string) error {
+	return nil
+}
+
+func TestCustomAuthorizerIsUsed(t *testing.T) {
+	fmt.Println("Entering TestCustomAuthorizerIsUsed")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", &SampleChaincode{Authorizer: allowAll{}}, attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	_, err := stub.MockInvoke("t123", "RegisterParticipant", []string{participant1})
+	if err != nil {
+		t.Fatalf("Expected the plugged-in authorizer to allow RegisterParticipant: %v", err)
+	}
+}
+
+func TestCrtLoanAppAllocatesDeterministicIDs(t *testing.T) {
+	fmt.Println("Entering TestCrtLoanAppAllocatesDeterministicIDs")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	CreateParticipants(stub, []string{participant1, participant2})
+
+	//la2 is taken by hand, so the allocator has to skip it
+	_, err := CreateLoanParticipation(stub, []string{"la2", loanApplicationFor("la2", 40000, "Submitted"), syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation of la2 to succeed: %v", err)
+	}
+	for _, expected := range []string{"la1", "la3"} {
+		bytes, err := CreateLoanParticipation(stub, []string{"", loanApplicationFor("", 40000, "Submitted"), syndicate})
+		if err != nil {
+			t.Fatalf("Expected CreateLoanParticipation without an ID to succeed: %v", err)
+		}
+		var la LoanApplication
+		json.Unmarshal(bytes, &la)
+		if la.ID != expected {
+			t.Fatalf("Expected allocated ID %s, got %s", expected, la.ID)
+		}
+		moveLoanTo(t, stub, expected, StatusSyndicated)
+		if position, _ := fetchPosition(stub, "part1", expected); position == nil {
+			t.Fatalf("Expected part1 to hold a position in %s", expected)
+		}
+	}
+}
+
+func TestAccrueInterestPerPeriod(t *testing.T) {
+	fmt.Println("Entering TestAccrueInterestPerPeriod")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	CreateParticipants(stub, []string{participant1, participant2})
+	var scheduledLoan = strings.Replace(loanApplication, `"status"`, `"dayCountConvention":"ACT/360","startDate":"2017-01-15","maturityDate":"2017-07-15","interestFrequency":"Quarterly","status"`, 1)
+	_, err := CreateLoanParticipation(stub, []string{loanApplicationID, scheduledLoan, syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	_, err = AccrueInterest(stub, []string{loanApplicationID, "1"})
+	if chaincodeErr, ok := err.(*ChaincodeError); !ok || chaincodeErr.Code != ErrCodeFailedPrecondition {
+		t.Fatalf("Expected a submitted loan not to accrue interest, got %v", err)
+	}
+	stub.MockTransactionEnd("t123")
+	advanceLoanTo(t, stub, loanApplicationID, StatusActive)
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	_, err = AccrueInterest(stub, []string{loanApplicationID, "2"})
+	if chaincodeErr, ok := err.(*ChaincodeError); !ok || chaincodeErr.Code != ErrCodeFailedPrecondition {
+		t.Fatalf("Expected period 2 to wait for period 1, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		bytes, err := AccrueInterest(stub, []string{loanApplicationID, "1"})
+		if err != nil {
+			t.Fatalf("Expected AccrueInterest to succeed: %v", err)
+		}
+		var period InterestPeriod
+		json.Unmarshal(bytes, &period)
+		if period.Interest.String() != "500.00 USD" || len(period.Accruals) != 2 || period.Accruals[1].Interest.String() != "100.00 USD" {
+			t.Fatalf("Expected 90 days of ACT/360 interest split 80/20, got %+v", period)
+		}
+	}
+
+	position, _ := fetchPosition(stub, "part1", loanApplicationID)
+	if position.AccruedInterest.String() != "400.00 USD" || position.AccrualDate != "2017-04-15" {
+		t.Fatalf("Expected the period to be accrued to part1 exactly once, got %s to %s", position.AccruedInterest, position.AccrualDate)
+	}
+	bytes, err := GetInterestSchedule(stub, []string{loanApplicationID})
+	var schedule InterestSchedule
+	json.Unmarshal(bytes, &schedule)
+	if err != nil || len(schedule.Periods) != 2 || schedule.Periods[0].Status != PeriodAccrued || schedule.Periods[1].Status != PeriodScheduled {
+		t.Fatalf("Expected two quarterly periods with the first accrued, got %+v (%v)", schedule, err)
+	}
+}
+
+func TestFloatingRateUsesPublishedFixing(t *testing.T) {
+	fmt.Println("Entering TestFloatingRateUsesPublishedFixing")
+	attributes := make(map[string][]byte)
+	attributes["username"] = []byte("ice-benchmarks")
+	attributes["role"] = []byte("RatePublisher")
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	_, err := stub.MockInvoke("fix1", "PublishRateFixing", []string{"LIBOR", "3M", "2017-01-13", "1.2"})
+	if err != nil {
+		t.Fatalf("Expected PublishRateFixing to succeed: %v", err)
+	}
+	_, err = stub.MockInvoke("fix2", "PublishRateFixing", []string{"LIBOR", "3M", "2017-01-13", "1.3"})
+	if chaincodeErr, ok := err.(*ChaincodeError); !ok || chaincodeErr.Code != ErrCodeAlreadyExists {
+		t.Fatalf("Expected a published fixing to be immutable, got %v", err)
+	}
+	_, err = stub.MockInvoke("fix3", "CreateLoanParticipation", []string{loanApplicationID, loanApplication, syndicate})
+	if chaincodeErr, ok := err.(*ChaincodeError); !ok || chaincodeErr.Code != ErrCodeAccessDenied {
+		t.Fatalf("Expected a rate publisher not to create loans, got %v", err)
+	}
+
+	stub.MockTransactionStart("t123")
+	CreateParticipants(stub, []string{participant1, participant2})
+	var floatingLoan = strings.Replace(loanApplication, `"status"`, `"spread":"2.5","rateTenor":"3M","rateFloor":"1.5","dayCountConvention":"ACT/360","startDate":"2017-01-15","maturityDate":"2017-07-15","interestFrequency":"Quarterly","status"`, 1)
+	_, err = CreateLoanParticipation(stub, []string{loanApplicationID, floatingLoan, syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	stub.MockTransactionEnd("t123")
+	advanceLoanTo(t, stub, loanApplicationID, StatusActive)
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	bytes, err := AccrueInterest(stub, []string{loanApplicationID, "1"})
+	if err != nil {
+		t.Fatalf("Expected AccrueInterest to succeed: %v", err)
+	}
+	var period InterestPeriod
+	json.Unmarshal(bytes, &period)
+	if period.AllInRate != NewRate(4) || period.Interest.String() != "400.00 USD" {
+		t.Fatalf("Expected the 1.5%% floor plus 2.5%% spread, got %s on %s", period.Interest, period.AllInRate)
+	}
+	if period.Fixing == nil || period.Fixing.FixingDate != "2017-01-13" || period.Fixing.Fixing.String() != "1.2" || period.Fixing.FixingTxId != "fix1" {
+		t.Fatalf("Expected the period to record the weekend fallback fixing, got %+v", period.Fixing)
+	}
+	loan, _ := fetchLoan(stub, loanApplicationID)
+	if loan.AllInRate != NewRate(4) {
+		t.Fatalf("Expected the loan all-in rate to be reset, got %s", loan.AllInRate)
+	}
+	_, err = AccrueInterest(stub, []string{loanApplicationID, "2"})
+	if chaincodeErr, ok := err.(*ChaincodeError); !ok || chaincodeErr.Code != ErrCodeNotFound {
+		t.Fatalf("Expected period 2 to need a fixing, got %v", err)
+	}
+
+	//a settlement inside period 2 accrues at the fixing known at its start, not period 1's rate
+	_, err = PublishRateFixing(stub, []string{"LIBOR", "3M", "2017-04-13", "3"})
+	if err != nil {
+		t.Fatalf("Expected PublishRateFixing to succeed: %v", err)
+	}
+	_, err = SettleLoanSyndication(stub, []string{loanApplicationID, "10000", "2017-05-15"})
+	if err != nil {
+		t.Fatalf("Expected SettleLoanSyndication to succeed: %v", err)
+	}
+	position, _ := fetchPosition(stub, "part1", loanApplicationID)
+	if position.AccruedInterest.String() != "466.67 USD" {
+		t.Fatalf("Expected 320.00 for period 1 plus 30 days at 5.5%%, got %s", position.AccruedInterest)
+	}
+}
+
+func TestSettlementMidPeriodIsNotAccruedTwice(t *testing.T) {
+	fmt.Println("Entering TestSettlementMidPeriodIsNotAccruedTwice")
+	attributes := make(map[string][]byte)
+	attributes["username"] = []byte("vojha24")
+	attributes["role"] = []byte("AgentBank")
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	CreateParticipants(stub, []string{participant1, participant2})
+	var scheduledLoan = strings.Replace(loanApplication, `"status"`, `"dayCountConvention":"ACT/360","startDate":"2017-01-15","maturityDate":"2017-07-15","interestFrequency":"Quarterly","status"`, 1)
+	_, err := CreateLoanParticipation(stub, []string{loanApplicationID, scheduledLoan, syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	stub.MockTransactionEnd("t123")
+	advanceLoanTo(t, stub, loanApplicationID, StatusActive)
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	_, err = SettleLoanSyndication(stub, []string{loanApplicationID, "10000", "2017-02-15"})
+	if err != nil {
+		t.Fatalf("Expected SettleLoanSyndication to succeed: %v", err)
+	}
+	bytes, err := AccrueInterest(stub, []string{loanApplicationID, "1"})
+	if err != nil {
+		t.Fatalf("Expected AccrueInterest to succeed: %v", err)
+	}
+
+	//31 days on the original shares, then 59 days on what is left after the settlement
+	var period InterestPeriod
+	json.Unmarshal(bytes, &period)
+	if period.Interest.String() != "418.06 USD" {
+		t.Fatalf("Expected 137.78 + 196.67 for part1 and 34.44 + 49.17 for part2, got %s", period.Interest)
+	}
+	var total = ZeroMoney("USD")
+	for participant, expected := range map[string]string{"part1": "334.45 USD", "part2": "83.61 USD"} {
+		position, _ := fetchPosition(stub, participant, loanApplicationID)
+		if position.AccruedInterest.String() != expected || position.AccrualDate != "2017-04-15" {
+			t.Fatalf("Expected %s to accrue %s to 2017-04-15, got %s to %s", participant, expected, position.AccruedInterest, position.AccrualDate)
+		}
+		total = total.Add(position.AccruedInterest)
+	}
+	if total != period.Interest {
+		t.Fatalf("Expected the positions to hold the period's interest, got %s and %s", total, period.Interest)
+	}
+}
+
+func TestRateParsing(t *testing.T) {
+	fmt.Println("Entering TestRateParsing")
+	rate, err := ParseRate("5.25")
+	if err != nil || rate.Scaled != 5250000 || rate.String() != "5.25" {
+		t.Fatalf("Expected 5.25, got %s %v", rate, err)
+	}
+	if _, err = ParseRate("0.1234567"); err == nil {
+		t.Fatalf("Expected more than six decimals to be refused")
+	}
+	var loan LoanApplication
+	json.Unmarshal([]byte(loanApplication), &loan)
+	if loan.AllInRate != NewRate(5) {
+		t.Fatalf("Expected the legacy integer rate to decode, got %s", loan.AllInRate)
+	}
+	bytes, _ := json.Marshal(&loan)
+	if !strings.Contains(string(bytes), `"allInRate":"5"`) {
+		t.Fatalf("Expected rates to be encoded as strings, got %s", bytes)
+	}
+}
+
+func TestTransitionBenchmarkToSOFR(t *testing.T) {
+	fmt.Println("Entering TestTransitionBenchmarkToSOFR")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	CreateParticipants(stub, []string{participant1, participant2})
+	PublishRateFixing(stub, []string{"LIBOR", "3M", "2017-01-13", "1.2"})
+	var liborLoan = strings.Replace(loanApplication, `"status"`, `"spread":"2.5","rateTenor":"3M","dayCountConvention":"ACT/360","startDate":"2017-01-15","maturityDate":"2017-07-15","interestFrequency":"Quarterly","status"`, 1)
+	_, err := CreateLoanParticipation(stub, []string{loanApplicationID, liborLoan, syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	stub.MockTransactionEnd("t123")
+	advanceLoanTo(t, stub, loanApplicationID, StatusActive)
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	_, err = AccrueInterest(stub, []string{loanApplicationID, "1"})
+	if err != nil {
+		t.Fatalf("Expected the LIBOR period to accrue: %v", err)
+	}
+
+	var expectCode = func(err error, code string, what string) {
+		chaincodeErr, ok := err.(*ChaincodeError)
+		if !ok || chaincodeErr.Code != code {
+			t.Fatalf("Expected %s to fail with %s, got %v", what, code, err)
+		}
+	}
+	_, err = TransitionBenchmark(stub, []string{loanApplicationID, `{"baseRateType":"SOFR","spread":"2.5","creditAdjustmentSpread":"0.26161","effectiveDate":"2017-01-15"}`})
+	expectCode(err, ErrCodeFailedPrecondition, "transitioning an accrued period")
+	_, err = TransitionBenchmark(stub, []string{loanApplicationID, `{"baseRateType":"EURIBOR","spread":"2.5","effectiveDate":"2017-04-15"}`})
+	expectCode(err, ErrCodeInvalidArgument, "transitioning to a term rate")
+	_, err = TransitionBenchmark(stub, []string{loanApplicationID, `{"baseRateType":"SOFR","spread":"2.5","creditAdjustmentSpread":"0.26161","lookbackDays":5,"observationShift":true,"effectiveDate":"2017-04-15"}`})
+	if err != nil {
+		t.Fatalf("Expected TransitionBenchmark to succeed: %v", err)
+	}
+	_, err = TransitionBenchmark(stub, []string{loanApplicationID, `{"baseRateType":"SONIA","effectiveDate":"2017-04-15"}`})
+	expectCode(err, ErrCodeFailedPrecondition, "transitioning a loan already on an RFR")
+
+	_, err = AccrueInterest(stub, []string{loanApplicationID, "2"})
+	expectCode(err, ErrCodeNotFound, "compounding without daily fixings")
+	for day, _ := ParseDate("2017-04-05"); day.Before(time.Date(2017, time.July, 15, 0, 0, 0, 0, time.UTC)); day = day.AddDate(0, 0, 1) {
+		if isBusinessDay(day) {
+			PublishRateFixing(stub, []string{"SOFR", RFRTenor, day.Format(DateLayout), "1"})
+		}
+	}
+	bytes, err := AccrueInterest(stub, []string{loanApplicationID, "2"})
+	if err != nil {
+		t.Fatalf("Expected the SOFR period to accrue: %v", err)
+	}
+	var period InterestPeriod
+	json.Unmarshal(bytes, &period)
+	if period.Fixing == nil || period.Fixing.Benchmark != "SOFR" || len(period.Fixing.Observations) != 65 {
+		t.Fatalf("Expected every SOFR business day to be observed, got %+v", period.Fixing)
+	}
+	if period.Fixing.Fixing.Cmp(NewRate(1)) <= 0 || period.AllInRate != period.Fixing.Fixing.Add(Rate{Scaled: 2761610}) {
+		t.Fatalf("Expected compounded SOFR plus spread and CAS, got %s from %s", period.AllInRate, period.Fixing.Fixing)
+	}
+
+	loan, _ := fetchLoan(stub, loanApplicationID)
+	if len(loan.BenchmarkHistory) != 1 || loan.BenchmarkHistory[0].Previous.BaseRateType != "LIBOR" || loan.rateTermsOn("2017-01-15").RateTenor != "3M" {
+		t.Fatalf("Expected the LIBOR terms to be kept in the history, got %+v", loan.BenchmarkHistory)
+	}
+}
+
+func TestRepaymentScheduleTracksInstalments(t *testing.T) {
+	fmt.Println("Entering TestRepaymentScheduleTracksInstalments")
+	attributes := make(map[string][]byte)
+	attributes["username"] = []byte("citi-ops")
+	attributes["role"] = []byte("Lender")
+	attributes["participantId"] = []byte("part2")
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	CreateParticipants(stub, []string{participant1, participant2})
+	var amortizingLoan = strings.Replace(loanApplication, `"status"`, `"startDate":"2017-01-15","maturityDate":"2017-07-15","interestFrequency":"Quarterly","repaymentProfile":"StraightLine","repaymentFrequency":"Monthly","status"`, 1)
+	_, err := CreateLoanParticipation(stub, []string{loanApplicationID, amortizingLoan, syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	var badCustom = strings.Replace(loanApplication2, `"status"`, `"startDate":"2017-01-15","maturityDate":"2017-07-15","repaymentProfile":"Custom","customRepayments":[{"dueDate":"2017-04-15","amount":"10000"}],"status"`, 1)
+	_, err = CreateLoanParticipation(stub, []string{loanApplicationID2, badCustom, syndicate})
+	if chaincodeErr, ok := err.(*ChaincodeError); !ok || chaincodeErr.Code != ErrCodeInvalidArgument {
+		t.Fatalf("Expected custom repayments short of the deal amount to be refused, got %v", err)
+	}
+	stub.MockTransactionEnd("t123")
+	advanceLoanTo(t, stub, loanApplicationID, StatusActive)
+	stub.MockTransactionStart("t123")
+	_, err = SettleLoanSyndication(stub, []string{loanApplicationID, "10000", "2017-02-15"})
+	if err != nil {
+		t.Fatalf("Expected SettleLoanSyndication to succeed: %v", err)
+	}
+	stub.MockTransactionEnd("t123")
+
+	_, err = stub.MockQuery("GetRepaymentSchedule", []string{loanApplicationID, "part1"})
+	if chaincodeErr, ok := err.(*ChaincodeError); !ok || chaincodeErr.Code != ErrCodeAccessDenied {
+		t.Fatalf("Expected part2 not to read part1's repayments, got %v", err)
+	}
+	bytes, err := stub.MockQuery("GetRepaymentSchedule", []string{loanApplicationID, "part2"})
+	if err != nil {
+		t.Fatalf("Expected GetRepaymentSchedule to succeed: %v", err)
+	}
+	var schedule RepaymentSchedule
+	json.Unmarshal(bytes, &schedule)
+	if len(schedule.Instalments) != 6 || schedule.ParticipantId != "part2" {
+		t.Fatalf("Expected six monthly instalments for part2, got %+v", schedule)
+	}
+	var first, second = schedule.Instalments[0], schedule.Instalments[1]
+	if first.Principal.String() != "1333.33 USD" || first.Status != InstalmentPaid || second.Paid.String() != "666.67 USD" || second.Status != InstalmentPartiallyPaid {
+		t.Fatalf("Expected part2's 20%% of the paid instalments, got %+v and %+v", first, second)
+	}
+}
+
+func TestParticipantRepaymentsFollowPaymentDistributions(t *testing.T) {
+	fmt.Println("Entering TestParticipantRepaymentsFollowPaymentDistributions")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	var participant3 = strings.Replace(strings.Replace(participant2, `"part2"`, `"part3"`, 1), "E57ODZWZ7FF32TWEFA76", "MP6I5ZYZBEU3UXPYFY54", 1)
+	CreateParticipants(stub, []string{participant1, participant2, participant3})
+	var amortizingLoan = strings.Replace(loanApplication, `"status"`, `"startDate":"2017-01-15","maturityDate":"2017-07-15","interestFrequency":"Quarterly","repaymentProfile":"StraightLine","repaymentFrequency":"Monthly","status"`, 1)
+	_, err := CreateLoanParticipation(stub, []string{loanApplicationID, amortizingLoan, syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	stub.MockTransactionEnd("t123")
+	advanceLoanTo(t, stub, loanApplicationID, StatusActive)
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	//169.86 of interest and the first instalment of 6666.66, then part2 sells its whole position to part3
+	bytes, err := ReceivePayment(stub, []string{loanApplicationID, "6836.52", "2017-02-15"})
+	if err != nil {
+		t.Fatalf("Expected ReceivePayment to succeed: %v", err)
+	}
+	var payment Payment
+	json.Unmarshal(bytes, &payment)
+	if payment.Buckets[len(payment.Buckets)-1].Bucket != BucketPrepayment || !payment.Buckets[len(payment.Buckets)-1].Paid.IsZero() {
+		t.Fatalf("Expected nothing to be prepaid, got %+v", payment.Buckets)
+	}
+	var proposal = `{"loanId":"la1","sellerId":"part2","buyerId":"part3","amount":"8000","price":"100","tradeDate":"2017-02-20","settlementDate":"2017-03-01"}`
+	for _, step := range []struct {
+		invoke func(stub shim.ChaincodeStubInterface, args []string) ([]byte, error)
+		args   []string
+	}{{ProposeAssignment, []string{proposal}}, {AcceptAssignment, []string{"as1", "part3"}}, {ConsentAssignment, []string{"as1"}}, {SettleAssignment, []string{"as1"}}} {
+		_, err = step.invoke(stub, step.args)
+		if err != nil {
+			t.Fatalf("Expected assignment as1 to move on: %v", err)
+		}
+	}
+
+	var instalments = func(participantId string) []Instalment {
+		bytes, err := GetRepaymentSchedule(stub, []string{loanApplicationID, participantId})
+		if err != nil {
+			t.Fatalf("Expected GetRepaymentSchedule to succeed for %s: %v", participantId, err)
+		}
+		var schedule RepaymentSchedule
+		json.Unmarshal(bytes, &schedule)
+		return schedule.Instalments
+	}
+	//part3 bought in after the first instalment was paid to part2 and holds 20% of the rest
+	var bought = instalments("part3")
+	if !bought[0].Principal.IsZero() || !bought[0].Paid.IsZero() || bought[1].Principal.String() != "1333.33 USD" || !bought[1].Paid.IsZero() {
+		t.Fatalf("Expected part3 to have no part of the instalment paid before it joined, got %+v and %+v", bought[0], bought[1])
+	}
+	var held = instalments("part1")
+	if held[0].Principal.String() != "5333.33 USD" || held[0].Paid.String() != "5333.33 USD" || held[1].Principal.String() != "5333.33 USD" {
+		t.Fatalf("Expected part1 to keep what it was paid of the first instalment, got %+v and %+v", held[0], held[1])
+	}
+}
+
+func TestSettleLoanSyndicationRejectsInvalidPayments(t *testing.T) {
+	fmt.Println("Entering TestSettleLoanSyndicationRejectsInvalidPayments")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	CreateParticipants(stub, []string{participant1, participant2})
+	var datedLoan = strings.Replace(loanApplication, `"status"`, `"startDate":"2017-01-15","status"`, 1)
+	_, err := CreateLoanParticipation(stub, []string{loanApplicationID, datedLoan, syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	_, err = CreateLoanParticipation(stub, []string{loanApplicationID2, loanApplication2, syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	var expectCode = func(err error, code string, what string) {
+		chaincodeErr, ok := err.(*ChaincodeError)
+		if !ok || chaincodeErr.Code != code {
+			t.Fatalf("Expected %s to fail with %s, got %v", what, code, err)
+		}
+	}
+	_, err = SettleLoanSyndication(stub, []string{loanApplicationID, "1000", "2017-02-15"})
+	expectCode(err, ErrCodeFailedPrecondition, "repaying a submitted loan")
+	stub.MockTransactionEnd("t123")
+	advanceLoanTo(t, stub, loanApplicationID, StatusActive)
+	advanceLoanTo(t, stub, loanApplicationID2, StatusActive)
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	_, err = SettleLoanSyndication(stub, []string{loanApplicationID2, "1000", "2017-02-15"})
+	expectCode(err, ErrCodeFailedPrecondition, "repaying a loan without a start date to accrue from")
+	_, err = SettleLoanSyndication(stub, []string{"la9", "1000", "2017-02-15"})
+	expectCode(err, ErrCodeNotFound, "repaying an unknown loan")
+	for _, amount := range []string{"abc", "0", "-5", "10.001", "100 EUR"} {
+		_, err = SettleLoanSyndication(stub, []string{loanApplicationID, amount, "2017-02-15"})
+		expectCode(err, ErrCodeInvalidArgument, "paying "+amount)
+	}
+	_, err = SettleLoanSyndication(stub, []string{loanApplicationID, "40000.01", "2017-02-15"})
+	expectCode(err, ErrCodeFailedPrecondition, "overpaying the loan")
+	_, err = SettleLoanSyndication(stub, []string{loanApplicationID, "1000"})
+	expectCode(err, ErrCodeInvalidArgument, "repaying without a value date")
+
+	loan, _ := fetchLoan(stub, loanApplicationID)
+	position, _ := fetchPosition(stub, "part1", loanApplicationID)
+	if loan.OutStandingSettlementAmount != NewMoney(40000, "USD") || position.ShareAmount != NewMoney(32000, "USD") {
+		t.Fatalf("Expected rejected payments to leave the loan untouched, got %s and %s", loan.OutStandingSettlementAmount, position.ShareAmount)
+	}
+	_, err = SettleLoanSyndication(stub, []string{loanApplicationID, "40000", "2017-02-15"})
+	if err != nil {
+		t.Fatalf("Expected the full outstanding amount to be accepted: %v", err)
+	}
+}
+
+func TestReceivePaymentRunsWaterfall(t *testing.T) {
+	fmt.Println("Entering TestReceivePaymentRunsWaterfall")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	CreateParticipants(stub, []string{participant1, participant2})
+	var amortizingLoan = strings.Replace(loanApplication, `"status"`, `"startDate":"2017-01-15","maturityDate":"2017-07-15","interestFrequency":"Quarterly","repaymentProfile":"StraightLine","repaymentFrequency":"Monthly","status"`, 1)
+	_, err := CreateLoanParticipation(stub, []string{loanApplicationID, amortizingLoan, syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	var badWaterfall = strings.Replace(loanApplication2, `"status"`, `"paymentWaterfall":["Fees","Prepayment","Fees"],"status"`, 1)
+	_, err = CreateLoanParticipation(stub, []string{loanApplicationID2, badWaterfall, syndicate})
+	if chaincodeErr, ok := err.(*ChaincodeError); !ok || chaincodeErr.Code != ErrCodeInvalidArgument {
+		t.Fatalf("Expected a waterfall listing a bucket twice to be refused, got %v", err)
+	}
+	stub.MockTransactionEnd("t123")
+	advanceLoanTo(t, stub, loanApplicationID, StatusActive)
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	_, err = AccrueInterest(stub, []string{loanApplicationID, "1"})
+	if err != nil {
+		t.Fatalf("Expected AccrueInterest to succeed: %v", err)
+	}
+	loan, _ := fetchLoan(stub, loanApplicationID)
+	loan.FeesDue = NewMoney(100, "USD")
+	saveLoan(stub, loan)
+
+	//fees 100.00, interest 493.15, three instalments of 6666.66 and 1000.00 prepaid
+	bytes, err := ReceivePayment(stub, []string{loanApplicationID, "21593.13", "2017-04-15"})
+	if err != nil {
+		t.Fatalf("Expected ReceivePayment to succeed: %v", err)
+	}
+	var payment Payment
+	json.Unmarshal(bytes, &payment)
+	var paid = map[string]string{}
+	for _, bucket := range payment.Buckets {
+		paid[bucket.Bucket] = bucket.Paid.String()
+	}
+	if payment.ID != "pm1" || paid[BucketFees] != "100.00 USD" || paid[BucketAccruedInterest] != "493.15 USD" || paid[BucketScheduledPrincipal] != "19999.98 USD" || paid[BucketPrepayment] != "1000.00 USD" || paid[BucketAgencyFees] != "0.00 USD" {
+		t.Fatalf("Expected the payment to run through the waterfall, got %+v", payment)
+	}
+	if len(payment.Distributions) != 2 || payment.Distributions[1].ParticipantId != "part2" || payment.Distributions[1].Total.String() != "4318.63 USD" {
+		t.Fatalf("Expected part2 to receive 20%% of every bucket, got %+v", payment.Distributions)
+	}
+
+	loan, _ = fetchLoan(stub, loanApplicationID)
+	position, _ := fetchPosition(stub, "part2", loanApplicationID)
+	if loan.OutStandingSettlementAmount.String() != "19000.02 USD" || !loan.FeesDue.IsZero() || position.ShareAmount.String() != "3800.00 USD" || !position.AccruedInterest.IsZero() {
+		t.Fatalf("Expected the payment to reduce the loan and positions, got %s, %s, %s and %s", loan.OutStandingSettlementAmount, loan.FeesDue, position.ShareAmount, position.AccruedInterest)
+	}
+	repayments, _ := fetchRepaymentSchedule(stub, loanApplicationID)
+	if repayments.Instalments[2].Status != InstalmentPaid || repayments.Instalments[3].Status != InstalmentDue || repayments.Instalments[5].Paid.String() != "1000.00 USD" {
+		t.Fatalf("Expected scheduled instalments paid and the prepayment applied to the last, got %+v", repayments.Instalments)
+	}
+
+	_, err = ReceivePayment(stub, []string{loanApplicationID, "19100.00", "2017-05-15"})
+	if chaincodeErr, ok := err.(*ChaincodeError); !ok || chaincodeErr.Code != ErrCodeFailedPrecondition {
+		t.Fatalf("Expected a payment above what is owed to be rejected, got %v", err)
+	}
+	bytes, err = GetPayments(stub, []string{loanApplicationID})
+	if err != nil {
+		t.Fatalf("Expected GetPayments to succeed: %v", err)
+	}
+	var payments []Payment
+	json.Unmarshal(bytes, &payments)
+	if len(payments) != 1 || payments[0].ID != "pm1" {
+		t.Fatalf("Expected one recorded payment, got %+v", payments)
+	}
+}
+
+func TestDefaultedLoanAccruesDefaultInterest(t *testing.T) {
+	fmt.Println("Entering TestDefaultedLoanAccruesDefaultInterest")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	CreateParticipants(stub, []string{participant1, participant2})
+	var defaultingLoan = strings.Replace(loanApplication, `"status"`, `"startDate":"2017-01-15","maturityDate":"2017-07-15","interestFrequency":"Quarterly","defaultMargin":"2","status"`, 1)
+	_, err := CreateLoanParticipation(stub, []string{loanApplicationID, defaultingLoan, syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	stub.MockTransactionEnd("t123")
+	advanceLoanTo(t, stub, loanApplicationID, StatusActive)
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	_, err = DefaultLoan(stub, []string{loanApplicationID, "missed payment"})
+	if err != nil {
+		t.Fatalf("Expected DefaultLoan to succeed: %v", err)
+	}
+	_, err = AccrueInterest(stub, []string{loanApplicationID, "1"})
+	if err != nil {
+		t.Fatalf("Expected AccrueInterest to succeed: %v", err)
+	}
+	//2% on 40000.00 for 90 days is 197.26 on top of the 493.15 contractual interest
+	loan, _ := fetchLoan(stub, loanApplicationID)
+	if loan.DefaultInterestDue.String() != "197.26 USD" {
+		t.Fatalf("Expected default interest to be owed on the loan, got %s", loan.DefaultInterestDue)
+	}
+	bytes, err := ReceivePayment(stub, []string{loanApplicationID, "600", "2017-04-15"})
+	if err != nil {
+		t.Fatalf("Expected ReceivePayment to succeed: %v", err)
+	}
+	var payment Payment
+	json.Unmarshal(bytes, &payment)
+	if payment.Buckets[1].Bucket != BucketDefaultInterest || payment.Buckets[1].Paid.String() != "197.26 USD" || payment.Buckets[2].Paid.String() != "402.74 USD" {
+		t.Fatalf("Expected default interest to be paid before accrued interest, got %+v", payment.Buckets)
+	}
+}
+
+func TestFeesAccrueInvoiceAndSettleThroughLedgers(t *testing.T) {
+	fmt.Println("Entering TestFeesAccrueInvoiceAndSettleThroughLedgers")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	CreateParticipants(stub, []string{participant1, participant2})
+	var feeLoan = strings.Replace(loanApplication, `"status"`, `"startDate":"2017-01-15","maturityDate":"2017-07-15","interestFrequency":"Quarterly","status"`, 1)
+	var agentSyndicate = strings.Replace(syndicate, `{"members"`, `{"agentId":"part1","members"`, 1)
+	_, err := CreateLoanParticipation(stub, []string{loanApplicationID, feeLoan, agentSyndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	var expectCode = func(err error, code string, what string) {
+		chaincodeErr, ok := err.(*ChaincodeError)
+		if !ok || chaincodeErr.Code != code {
+			t.Fatalf("Expected %s to fail with %s, got %v", what, code, err)
+		}
+	}
+	for _, fee := range []string{
+		`{"id":"upfront","type":"Upfront","basis":"BpsOfCommitment","rateBps":50}`,
+		`{"id":"agency","type":"Agency","basis":"Flat","amount":"3650"}`,
+		`{"id":"util","type":"Utilization","basis":"TieredUtilization","tiers":[{"fromBps":0,"rateBps":0},{"fromBps":5000,"rateBps":25}]}`,
+		`{"id":"prepay","type":"Prepayment","basis":"BpsOfAmount","rateBps":100}`,
+	} {
+		_, err = DefineFee(stub, []string{loanApplicationID, fee})
+		if err != nil {
+			t.Fatalf("Expected DefineFee to accept %s: %v", fee, err)
+		}
+	}
+	_, err = DefineFee(stub, []string{loanApplicationID, `{"id":"util","type":"Commitment","basis":"BpsOfUndrawn","rateBps":10}`})
+	expectCode(err, ErrCodeInvalidArgument, "defining a fee ID twice")
+	_, err = DefineFee(stub, []string{loanApplicationID, `{"id":"flatutil","type":"Utilization","basis":"Flat","amount":"10"}`})
+	expectCode(err, ErrCodeInvalidArgument, "a utilization fee on a flat basis")
+	stub.MockTransactionEnd("t123")
+	advanceLoanTo(t, stub, loanApplicationID, StatusActive)
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	for _, accrual := range [][]string{{"upfront", "2017-01-15"}, {"agency", "2017-04-15"}, {"util", "2017-04-15"}} {
+		_, err = AccrueFee(stub, []string{loanApplicationID, accrual[0], accrual[1]})
+		if err != nil {
+			t.Fatalf("Expected fee %s to accrue: %v", accrual[0], err)
+		}
+	}
+	_, err = AccrueFee(stub, []string{loanApplicationID, "upfront", "2017-02-15"})
+	expectCode(err, ErrCodeFailedPrecondition, "charging an upfront fee twice")
+	_, err = AccrueFee(stub, []string{loanApplicationID, "prepay", "2017-02-15"})
+	expectCode(err, ErrCodeFailedPrecondition, "accruing a prepayment fee")
+	for _, fee := range []string{"upfront", "agency", "util"} {
+		_, err = InvoiceFee(stub, []string{loanApplicationID, fee, "2017-04-15"})
+		if err != nil {
+			t.Fatalf("Expected fee %s to be invoiced: %v", fee, err)
+		}
+	}
+	_, err = InvoiceFee(stub, []string{loanApplicationID, "upfront", "2017-04-16"})
+	expectCode(err, ErrCodeFailedPrecondition, "invoicing a fee with nothing accrued")
+
+	//200.00 upfront, 90 days of 3650.00 a year to the agent and 25 bps on the fully drawn loan
+	loan, _ := fetchLoan(stub, loanApplicationID)
+	if loan.FeesDue.String() != "224.66 USD" || loan.AgencyFeesDue.String() != "900.00 USD" {
+		t.Fatalf("Expected invoiced fees to be owed on the loan, got %s and %s", loan.FeesDue, loan.AgencyFeesDue)
+	}
+
+	//the fees, 493.15 of interest accrued to the value date and 5000.00 of principal prepaid
+	bytes, err := ReceivePayment(stub, []string{loanApplicationID, "6617.81", "2017-04-15"})
+	if err != nil {
+		t.Fatalf("Expected ReceivePayment to succeed: %v", err)
+	}
+	var payment Payment
+	json.Unmarshal(bytes, &payment)
+	if payment.Distributions[0].Buckets[0].Bucket != BucketAgencyFees || payment.Distributions[0].Buckets[0].Amount.String() != "900.00 USD" {
+		t.Fatalf("Expected the agency fee to go to the agent, got %+v", payment.Distributions[0])
+	}
+	if payment.Distributions[1].Total.String() != "1143.56 USD" || len(payment.Charges) != 1 || payment.Charges[0].Amount.String() != "50.00 USD" {
+		t.Fatalf("Expected part2's fees and prepayment and a 1%% prepayment fee, got %+v", payment)
+	}
+
+	bytes, err = GetFeeLedger(stub, []string{loanApplicationID, "part2"})
+	if err != nil {
+		t.Fatalf("Expected GetFeeLedger to succeed: %v", err)
+	}
+	var ledger FeeLedger
+	json.Unmarshal(bytes, &ledger)
+	var outstanding = map[string]string{}
+	for _, balance := range ledger.Balances {
+		outstanding[balance.FeeId] = balance.Invoiced.Sub(balance.Paid).String()
+	}
+	if len(ledger.Balances) != 3 || outstanding["upfront"] != "0.00 USD" || outstanding["util"] != "0.00 USD" || outstanding["prepay"] != "10.00 USD" {
+		t.Fatalf("Expected part2's fees paid and its prepayment fee outstanding, got %+v", ledger.Balances)
+	}
+	loan, _ = fetchLoan(stub, loanApplicationID)
+	if loan.FeesDue.String() != "50.00 USD" || !loan.AgencyFeesDue.IsZero() || loan.OutStandingSettlementAmount.String() != "35000.00 USD" {
+		t.Fatalf("Expected only the prepayment fee to remain owed, got %s, %s and %s", loan.FeesDue, loan.AgencyFeesDue, loan.OutStandingSettlementAmount)
+	}
+
+	//the prepayment fee, 436.30 of interest and the rest of the principal, repaid at maturity
+	bytes, err = ReceivePayment(stub, []string{loanApplicationID, "35486.30", "2017-07-15"})
+	if err != nil {
+		t.Fatalf("Expected ReceivePayment at maturity to succeed: %v", err)
+	}
+	payment = Payment{}
+	json.Unmarshal(bytes, &payment)
+	var paid = map[string]string{}
+	for _, bucket := range payment.Buckets {
+		paid[bucket.Bucket] = bucket.Paid.String()
+	}
+	if paid[BucketScheduledPrincipal] != "35000.00 USD" || paid[BucketPrepayment] != "0.00 USD" || len(payment.Charges) != 0 {
+		t.Fatalf("Expected principal repaid at maturity to be scheduled and charge no prepayment fee, got %+v", payment)
+	}
+}
+
+func TestFacilityDrawdownRepayAndRedraw(t *testing.T) {
+	fmt.Println("Entering TestFacilityDrawdownRepayAndRedraw")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	var participant3 = strings.Replace(strings.Replace(participant2, `"part2"`, `"part3"`, 1), "E57ODZWZ7FF32TWEFA76", "MP6I5ZYZBEU3UXPYFY54", 1)
+	CreateParticipants(stub, []string{participant1, participant2, participant3})
+	var dates = `"startDate":"2017-01-15","maturityDate":"2017-07-15","interestFrequency":"Quarterly","availabilityEnd":"2017-06-30","status"`
+	var revolver = strings.Replace(loanApplication, `"status"`, `"facilityType":"Revolving",`+dates, 1)
+	var delayedDraw = strings.Replace(loanApplication2, `"status"`, `"facilityType":"DelayedDraw",`+dates, 1)
+	var expectCode = func(err error, code string, what string) {
+		chaincodeErr, ok := err.(*ChaincodeError)
+		if !ok || chaincodeErr.Code != code {
+			t.Fatalf("Expected %s to fail with %s, got %v", what, code, err)
+		}
+	}
+	_, err := CreateLoanParticipation(stub, []string{loanApplicationID, strings.Replace(revolver, `"Revolving"`, `"Evergreen"`, 1), syndicate})
+	expectCode(err, ErrCodeInvalidArgument, "creating an unknown facility type")
+	for _, loan := range []string{revolver, delayedDraw} {
+		_, err = CreateLoanParticipation(stub, []string{"", loan, syndicate})
+		if err != nil {
+			t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+		}
+	}
+	moveLoanTo(t, stub, loanApplicationID, StatusSyndicated)
+	position, _ := fetchPosition(stub, "part2", loanApplicationID)
+	if !position.ShareAmount.IsZero() || position.Undrawn.String() != "8000.00 USD" || position.Commitment.String() != "8000.00 USD" {
+		t.Fatalf("Expected part2's commitment to start undrawn, got %+v", position)
+	}
+	_, err = Drawdown(stub, []string{loanApplicationID, "10000", "2017-02-01"})
+	expectCode(err, ErrCodeFailedPrecondition, "drawing a facility before it is active")
+	stub.MockTransactionEnd("t123")
+	advanceLoanTo(t, stub, loanApplicationID, StatusActive)
+	advanceLoanTo(t, stub, loanApplicationID2, StatusActive)
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	_, err = Drawdown(stub, []string{loanApplicationID, "10000", "2017-02-01"})
+	if err != nil {
+		t.Fatalf("Expected Drawdown to succeed: %v", err)
+	}
+	_, err = Drawdown(stub, []string{loanApplicationID, "30000.01", "2017-02-01"})
+	expectCode(err, ErrCodeFailedPrecondition, "drawing more than the undrawn commitment")
+	_, err = Drawdown(stub, []string{loanApplicationID, "1000", "2017-07-01"})
+	expectCode(err, ErrCodeFailedPrecondition, "drawing after the availability period")
+	_, err = Redraw(stub, []string{loanApplicationID, "1", "2017-02-01"})
+	expectCode(err, ErrCodeFailedPrecondition, "redrawing before anything was repaid")
+	_, err = CreateSubParticipation(stub, []string{`{"loanId":"la1","grantorId":"part2","participantId":"part3","fundedBps":5000}`})
+	if err != nil {
+		t.Fatalf("Expected CreateSubParticipation to succeed: %v", err)
+	}
+	_, err = Repay(stub, []string{loanApplicationID, "4000", "2017-02-15"})
+	if err != nil {
+		t.Fatalf("Expected Repay to succeed: %v", err)
+	}
+	position, _ = fetchPosition(stub, "part2", loanApplicationID)
+	if position.ShareAmount.String() != "1200.00 USD" || position.Undrawn.String() != "6800.00 USD" {
+		t.Fatalf("Expected part2's repaid share to be available again, got %s drawn and %s undrawn", position.ShareAmount, position.Undrawn)
+	}
+	subParticipations, _ := fetchSubParticipations(stub, loanApplicationID, "part2")
+	if len(subParticipations) != 1 || subParticipations[0].PrincipalPassedThrough.String() != "400.00 USD" || !subParticipations[0].InterestPassedThrough.IsZero() {
+		t.Fatalf("Expected half of part2's 800.00 repaid to pass through, got %+v", subParticipations)
+	}
+	bytes, err := Redraw(stub, []string{loanApplicationID, "4000", "2017-03-01"})
+	if err != nil {
+		t.Fatalf("Expected Redraw to succeed: %v", err)
+	}
+	var movement FacilityMovement
+	json.Unmarshal(bytes, &movement)
+	if movement.Drawn.String() != "10000.00 USD" || movement.Undrawn.String() != "30000.00 USD" || !movement.Redrawable.IsZero() || movement.Allocations[1].Amount.String() != "800.00 USD" {
+		t.Fatalf("Expected the redraw to fund 20%% from part2, got %+v", movement)
+	}
+	bytes, err = AccrueInterest(stub, []string{loanApplicationID, "1"})
+	if err != nil {
+		t.Fatalf("Expected AccrueInterest to succeed: %v", err)
+	}
+	//part2 held 2000.00 from 2017-02-01, 1200.00 from the repayment and 2000.00 from the redraw
+	position, _ = fetchPosition(stub, "part2", loanApplicationID)
+	if position.AccruedInterest.String() != "18.47 USD" {
+		t.Fatalf("Expected 3.84 + 2.30 + 12.33 for part2, got %s", position.AccruedInterest)
+	}
+	var period InterestPeriod
+	json.Unmarshal(bytes, &period)
+	if period.Interest.String() != "92.34 USD" {
+		t.Fatalf("Expected 73.87 for part1 and 18.47 for part2, got %s", period.Interest)
+	}
+
+	_, err = Drawdown(stub, []string{loanApplicationID2, "5000", "2017-02-01"})
+	if err != nil {
+		t.Fatalf("Expected Drawdown to succeed: %v", err)
+	}
+	_, err = Repay(stub, []string{loanApplicationID2, "5000", "2017-03-01"})
+	if err != nil {
+		t.Fatalf("Expected Repay to succeed: %v", err)
+	}
+	_, err = Redraw(stub, []string{loanApplicationID2, "5000", "2017-03-01"})
+	expectCode(err, ErrCodeFailedPrecondition, "redrawing a delayed-draw facility")
+	loan, _ := fetchLoan(stub, loanApplicationID2)
+	if loan.UndrawnAmount.String() != "35000.00 USD" || !loan.RedrawableAmount.IsZero() || !loan.OutStandingSettlementAmount.IsZero() {
+		t.Fatalf("Expected delayed-draw repayments to cancel the commitment, got %+v", loan)
+	}
+}
+
+func TestDealRollsUpTranches(t *testing.T) {
+	fmt.Println("Entering TestDealRollsUpTranches")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	CreateParticipants(stub, []string{participant1, participant2})
+	var expectCode = func(err error, code string, what string) {
+		chaincodeErr, ok := err.(*ChaincodeError)
+		if !ok || chaincodeErr.Code != code {
+			t.Fatalf("Expected %s to fail with %s, got %v", what, code, err)
+		}
+	}
+	_, err := CreateDeal(stub, []string{"", `{"name":"Acme credit agreement","agentId":"part2"}`})
+	expectCode(err, ErrCodeInvalidParticipant, "creating a deal with an agent that is not an agent bank")
+	_, err = CreateDeal(stub, []string{"", `{"name":"Acme credit agreement","agentId":"part1"}`})
+	if err != nil {
+		t.Fatalf("Expected CreateDeal to succeed: %v", err)
+	}
+	var termLoan = strings.Replace(loanApplication, `"status"`, `"dealId":"dl1","tranche":"TLA","status"`, 1)
+	var revolver = strings.Replace(loanApplication2, `"status"`, `"dealId":"dl1","tranche":"RCF","currency":"EUR","facilityType":"Revolving","status"`, 1)
+	_, err = CreateLoanParticipation(stub, []string{"", strings.Replace(termLoan, `"dl1"`, `"dl9"`, 1), syndicate})
+	expectCode(err, ErrCodeNotFound, "creating a tranche of an unknown deal")
+	for _, loan := range []string{termLoan, revolver} {
+		_, err = CreateLoanParticipation(stub, []string{"", loan, syndicate})
+		if err != nil {
+			t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+		}
+	}
+	_, err = CreateLoanParticipation(stub, []string{"", strings.Replace(termLoan, `"la1"`, `"la3"`, 1), syndicate})
+	expectCode(err, ErrCodeAlreadyExists, "creating a second tranche named TLA")
+	moveLoanTo(t, stub, loanApplicationID, StatusSyndicated)
+	moveLoanTo(t, stub, loanApplicationID2, StatusSyndicated)
+
+	bytes, err := GetDeal(stub, []string{"dl1"})
+	var deal Deal
+	if err != nil || json.Unmarshal(bytes, &deal) != nil || len(deal.Tranches) != 2 || deal.Tranches[1].Name != "RCF" {
+		t.Fatalf("Expected deal dl1 to hold both tranches, got %s %v", bytes, err)
+	}
+	bytes, err = GetDealExposure(stub, []string{"dl1"})
+	var exposure DealExposure
+	if err != nil || json.Unmarshal(bytes, &exposure) != nil {
+		t.Fatalf("Expected GetDealExposure to succeed: %s %v", bytes, err)
+	}
+	if len(exposure.Totals) != 2 || exposure.Totals[0].Drawn.String() != "40000.00 USD" || exposure.Totals[1].Undrawn.String() != "40000.00 EUR" {
+		t.Fatalf("Expected one total per currency, got %+v", exposure.Totals)
+	}
+	bytes, err = GetDealExposure(stub, []string{"dl1", "part2"})
+	exposure = DealExposure{}
+	if err != nil || json.Unmarshal(bytes, &exposure) != nil {
+		t.Fatalf("Expected GetDealExposure for part2 to succeed: %s %v", bytes, err)
+	}
+	if exposure.Totals[0].Commitment.String() != "8000.00 USD" || exposure.Totals[1].Commitment.String() != "8000.00 EUR" || !exposure.Totals[1].Drawn.IsZero() {
+		t.Fatalf("Expected part2's exposure to the deal, got %+v", exposure.Totals)
+	}
+
+	bytes, err = GetParticipatedLoans(stub, []string{"part2", GroupByDeal})
+	var deals []DealExposure
+	if err != nil || json.Unmarshal(bytes, &deals) != nil {
+		t.Fatalf("Expected GetParticipatedLoans to roll up by deal: %s %v", bytes, err)
+	}
+	if len(deals) != 1 || deals[0].Name != "Acme credit agreement" || len(deals[0].Tranches) != 2 {
+		t.Fatalf("Expected both of part2's tranches under deal dl1, got %s", bytes)
+	}
+	bytes, err = QueryLoans(stub, []string{`{"dealId":"dl1"}`})
+	var page LoanPage
+	if err != nil || json.Unmarshal(bytes, &page) != nil || page.TotalCount != 2 {
+		t.Fatalf("Expected QueryLoans to find both tranches of dl1, got %s %v", bytes, err)
+	}
+}
+
+func TestFxRatesConvertPositionsForReporting(t *testing.T) {
+	fmt.Println("Entering TestFxRatesConvertPositionsForReporting")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	CreateParticipants(stub, []string{participant1, participant2})
+	var expectCode = func(err error, code string, what string) {
+		chaincodeErr, ok := err.(*ChaincodeError)
+		if !ok || chaincodeErr.Code != code {
+			t.Fatalf("Expected %s to fail with %s, got %v", what, code, err)
+		}
+	}
+	if _, err := ParseMoney("10 XYZ", "USD"); err == nil {
+		t.Fatalf("Expected an amount in an unknown currency to be rejected")
+	}
+	var euroLoan = strings.Replace(loanApplication2, `"status"`, `"currency":"EUR","status"`, 1)
+	_, err := CreateLoanParticipation(stub, []string{"", strings.Replace(euroLoan, `"EUR"`, `"EUX"`, 1), syndicate})
+	expectCode(err, ErrCodeInvalidArgument, "creating a loan in an unknown currency")
+	for _, loan := range []string{loanApplication, euroLoan} {
+		_, err = CreateLoanParticipation(stub, []string{"", loan, syndicate})
+		if err != nil {
+			t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+		}
+	}
+	moveLoanTo(t, stub, loanApplicationID, StatusSyndicated)
+	moveLoanTo(t, stub, loanApplicationID2, StatusSyndicated)
+	position, _ := fetchPosition(stub, "part2", loanApplicationID2)
+	if position.Currency != "EUR" {
+		t.Fatalf("Expected the position to carry the loan currency, got %s", position.Currency)
+	}
+
+	_, err = PublishFxRate(stub, []string{"USD", "USD", "2017-03-31", "1"})
+	expectCode(err, ErrCodeInvalidArgument, "publishing a rate between one currency")
+	_, err = PublishFxRate(stub, []string{"EUR", "USD", "2017-03-31", "-1.08"})
+	expectCode(err, ErrCodeInvalidArgument, "publishing a negative rate")
+	_, err = PublishFxRate(stub, []string{"EUR", "USD", "2017-03-31", "1.0825"})
+	if err != nil {
+		t.Fatalf("Expected PublishFxRate to succeed: %v", err)
+	}
+	_, err = PublishFxRate(stub, []string{"EUR", "USD", "2017-03-31", "1.09"})
+	expectCode(err, ErrCodeAlreadyExists, "republishing a rate")
+
+	bytes, err := GetPositionReport(stub, []string{"part2", "USD", "2017-04-02"})
+	var report PositionReport
+	if err != nil || json.Unmarshal(bytes, &report) != nil {
+		t.Fatalf("Expected GetPositionReport to succeed: %s %v", bytes, err)
+	}
+	if len(report.Positions) != 2 || report.Positions[0].FxRate != nil || report.Positions[1].FxRate.RateDate != "2017-03-31" {
+		t.Fatalf("Expected only the EUR position to be converted at the 2017-03-31 rate, got %s", bytes)
+	}
+	if report.Positions[1].Reported.Drawn.String() != "8660.00 USD" || report.Totals.Commitment.String() != "16660.00 USD" {
+		t.Fatalf("Expected part2's EUR position to convert at 1.0825, got %s", bytes)
+	}
+	bytes, err = GetPositionReport(stub, []string{"part2", "EUR", "2017-04-02"})
+	report = PositionReport{}
+	if err != nil || json.Unmarshal(bytes, &report) != nil {
+		t.Fatalf("Expected GetPositionReport in EUR to succeed: %s %v", bytes, err)
+	}
+	if !report.Positions[0].FxRate.Inverted || report.Totals.Drawn.String() != "15390.30 EUR" {
+		t.Fatalf("Expected the USD position to convert at the inverted rate, got %s", bytes)
+	}
+	_, err = GetPositionReport(stub, []string{"part2", "GBP", "2017-04-02"})
+	expectCode(err, ErrCodeNotFound, "reporting in a currency without rates")
+	_, err = GetPositionReport(stub, []string{"part2", "USD", "2017-03-20"})
+	expectCode(err, ErrCodeNotFound, "reporting before any rate was published")
+}
+
+func TestAssignParticipationTransfersPositions(t *testing.T) {
+	fmt.Println("Entering TestAssignParticipationTransfersPositions")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	var participant3 = strings.Replace(strings.Replace(participant2, `"part2"`, `"part3"`, 1), "E57ODZWZ7FF32TWEFA76", "MP6I5ZYZBEU3UXPYFY54", 1)
+	CreateParticipants(stub, []string{participant1, participant2, participant3})
+	var datedLoan = strings.Replace(loanApplication, `"status"`, `"dayCountConvention":"ACT/360","startDate":"2017-01-15","status"`, 1)
+	_, err := CreateLoanParticipation(stub, []string{"", datedLoan, syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	var expectCode = func(err error, code string, what string) {
+		chaincodeErr, ok := err.(*ChaincodeError)
+		if !ok || chaincodeErr.Code != code {
+			t.Fatalf("Expected %s to fail with %s, got %v", what, code, err)
+		}
+	}
+	var proposal = `{"loanId":"la1","sellerId":"part2","buyerId":"part3","amount":"4000","price":"99.5","tradeDate":"2017-03-01","settlementDate":"2017-03-11"}`
+	_, err = ProposeAssignment(stub, []string{proposal})
+	expectCode(err, ErrCodeFailedPrecondition, "assigning a position before the loan is active")
+	stub.MockTransactionEnd("t123")
+	advanceLoanTo(t, stub, loanApplicationID, StatusActive)
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	_, err = ProposeAssignment(stub, []string{strings.Replace(proposal, `"4000"`, `"9000"`, 1)})
+	expectCode(err, ErrCodeFailedPrecondition, "assigning more than the seller's commitment")
+	_, err = ProposeAssignment(stub, []string{strings.Replace(proposal, `"2017-03-11"`, `"2017-02-11"`, 1)})
+	expectCode(err, ErrCodeInvalidArgument, "settling before the trade date")
+	_, err = ProposeAssignment(stub, []string{proposal})
+	if err != nil {
+		t.Fatalf("Expected ProposeAssignment to succeed: %v", err)
+	}
+	_, err = SettleAssignment(stub, []string{"as1"})
+	expectCode(err, ErrCodeIllegalTransition, "settling an assignment without consent")
+	_, err = AcceptAssignment(stub, []string{"as1", "part1"})
+	expectCode(err, ErrCodeAccessDenied, "accepting someone else's assignment")
+	for _, step := range []struct {
+		invoke func(stub shim.ChaincodeStubInterface, args []string) ([]byte, error)
+		args   []string
+	}{{AcceptAssignment, []string{"as1", "part3"}}, {ConsentAssignment, []string{"as1"}}, {SettleAssignment, []string{"as1"}}} {
+		_, err = step.invoke(stub, step.args)
+		if err != nil {
+			t.Fatalf("Expected assignment as1 to move on: %v", err)
+		}
+	}
+
+	_, err = GetAssignment(stub, []string{"as1", "part1"})
+	if chaincodeErr, ok := err.(*ChaincodeError); !ok || chaincodeErr.Code != ErrCodeAccessDenied {
+		t.Fatalf("Expected part1 to be refused an assignment it is not a party to, got %v", err)
+	}
+	bytes, _ := GetAssignment(stub, []string{"as1", "part3"})
+	var assignment Assignment
+	json.Unmarshal(bytes, &assignment)
+	if assignment.Status != AssignmentSettled || assignment.Settlement.TransferredBps != 1000 || assignment.Settlement.Consideration.String() != "3980.00 USD" {
+		t.Fatalf("Expected assignment as1 to settle 1000 bps for 3980.00, got %s", bytes)
+	}
+	if assignment.Settlement.SellerAccruedInterest.String() != "30.55 USD" {
+		t.Fatalf("Expected the buyer to pay the seller 30.55 accrued on the assigned part, got %s", assignment.Settlement.SellerAccruedInterest)
+	}
+	//of the 61.11 part2 accrued to settlement, the claim on the assigned half moves to part3
+	seller, _ := fetchPosition(stub, "part2", loanApplicationID)
+	if seller.ShareAmount.String() != "4000.00 USD" || seller.AccruedInterest.String() != "30.56 USD" || seller.AccrualDate != "2017-03-11" {
+		t.Fatalf("Expected part2 to keep half its position with interest accrued to settlement, got %+v", seller)
+	}
+	buyer, _ := fetchPosition(stub, "part3", loanApplicationID)
+	if buyer.ShareAmount.String() != "4000.00 USD" || buyer.AccruedInterest.String() != "30.55 USD" || buyer.AccrualDate != "2017-03-11" {
+		t.Fatalf("Expected part3 to take over the accrued interest it paid for and accrue from settlement, got %+v", buyer)
+	}
+	members, _ := fetchSyndicate(stub, loanApplicationID)
+	if len(members.Members) != 3 || members.Members[1].ShareBps != 1000 || members.Members[2].ParticipantId != "part3" || members.Members[2].ShareBps != 1000 {
+		t.Fatalf("Expected the syndicate shares to move to part3, got %+v", members.Members)
+	}
+
+	_, err = ProposeAssignment(stub, []string{proposal})
+	if err != nil {
+		t.Fatalf("Expected a second ProposeAssignment to succeed: %v", err)
+	}
+	_, err = WithdrawAssignment(stub, []string{"as2", "part3"})
+	if err != nil {
+		t.Fatalf("Expected WithdrawAssignment to succeed: %v", err)
+	}
+	_, err = ConsentAssignment(stub, []string{"as2"})
+	expectCode(err, ErrCodeIllegalTransition, "consenting to a withdrawn assignment")
+
+	//assigning the rest leaves part2 outside the syndicate with no interest to collect
+	var rest = strings.Replace(strings.Replace(proposal, `"2017-03-11"`, `"2017-03-21"`, 1), `"2017-03-01"`, `"2017-03-11"`, 1)
+	for _, step := range []struct {
+		invoke func(stub shim.ChaincodeStubInterface, args []string) ([]byte, error)
+		args   []string
+	}{{ProposeAssignment, []string{rest}}, {AcceptAssignment, []string{"as3", "part3"}}, {ConsentAssignment, []string{"as3"}}, {SettleAssignment, []string{"as3"}}} {
+		_, err = step.invoke(stub, step.args)
+		if err != nil {
+			t.Fatalf("Expected assignment as3 to move on: %v", err)
+		}
+	}
+	seller, _ = fetchPosition(stub, "part2", loanApplicationID)
+	if !seller.ShareAmount.IsZero() || !seller.AccruedInterest.IsZero() {
+		t.Fatalf("Expected part2 to be paid out in full, got %+v", seller)
+	}
+	//30.55 bought earlier, 5.56 of its own since and part2's 30.56 plus 5.56
+	buyer, _ = fetchPosition(stub, "part3", loanApplicationID)
+	if buyer.ShareAmount.String() != "8000.00 USD" || buyer.AccruedInterest.String() != "72.23 USD" {
+		t.Fatalf("Expected part3 to hold the whole position and its accrued interest, got %+v", buyer)
+	}
+	members, _ = fetchSyndicate(stub, loanApplicationID)
+	if len(members.Members) != 2 || members.Members[1].ParticipantId != "part3" {
+		t.Fatalf("Expected part2 to leave the syndicate, got %+v", members.Members)
+	}
+}
+
+func TestAssignmentMidPeriodAccruesEachHolder(t *testing.T) {
+	fmt.Println("Entering TestAssignmentMidPeriodAccruesEachHolder")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	var participant3 = strings.Replace(strings.Replace(participant2, `"part2"`, `"part3"`, 1), "E57ODZWZ7FF32TWEFA76", "MP6I5ZYZBEU3UXPYFY54", 1)
+	CreateParticipants(stub, []string{participant1, participant2, participant3})
+	var scheduledLoan = strings.Replace(loanApplication, `"status"`, `"dayCountConvention":"ACT/360","startDate":"2017-01-15","maturityDate":"2017-07-15","interestFrequency":"Quarterly","status"`, 1)
+	_, err := CreateLoanParticipation(stub, []string{"", scheduledLoan, syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	stub.MockTransactionEnd("t123")
+	advanceLoanTo(t, stub, loanApplicationID, StatusActive)
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	var proposal = `{"loanId":"la1","sellerId":"part2","buyerId":"part3","amount":"4000","price":"100","tradeDate":"2017-03-01","settlementDate":"2017-03-11"}`
+	for _, step := range []struct {
+		invoke func(stub shim.ChaincodeStubInterface, args []string) ([]byte, error)
+		args   []string
+	}{{ProposeAssignment, []string{proposal}}, {AcceptAssignment, []string{"as1", "part3"}}, {ConsentAssignment, []string{"as1"}}, {SettleAssignment, []string{"as1"}}} {
+		_, err = step.invoke(stub, step.args)
+		if err != nil {
+			t.Fatalf("Expected assignment as1 to move on: %v", err)
+		}
+	}
+	bytes, err := AccrueInterest(stub, []string{loanApplicationID, "1"})
+	if err != nil {
+		t.Fatalf("Expected AccrueInterest to succeed: %v", err)
+	}
+
+	//part2 accrues 55 days on 8000.00 and 35 on 4000.00, part3 35 days on 4000.00; each
+	//stretch is rounded to the cent, so the period is a cent short of 500.00 on the full loan.
+	//part3 also holds the 30.55 of part2's interest it bought with the assigned half.
+	var expected = map[string]string{"part1": "400.00 USD", "part2": "80.55 USD", "part3": "19.44 USD"}
+	var held = map[string]string{"part1": "400.00 USD", "part2": "50.00 USD", "part3": "49.99 USD"}
+	var total = ZeroMoney("USD")
+	for participant, interest := range held {
+		position, _ := fetchPosition(stub, participant, loanApplicationID)
+		if position.AccruedInterest.String() != interest || position.AccrualDate != "2017-04-15" {
+			t.Fatalf("Expected %s to accrue %s to 2017-04-15, got %s to %s", participant, interest, position.AccruedInterest, position.AccrualDate)
+		}
+		total = total.Add(position.AccruedInterest)
+	}
+	var period InterestPeriod
+	json.Unmarshal(bytes, &period)
+	if period.Interest != total || period.Interest.String() != "499.99 USD" {
+		t.Fatalf("Expected the period to hold what the positions accrued, got %s and %s", period.Interest, total)
+	}
+	for _, accrual := range period.Accruals {
+		if accrual.Interest.String() != expected[accrual.ParticipantId] {
+			t.Fatalf("Expected %s to be recorded against the period, got %s", expected[accrual.ParticipantId], accrual.Interest)
+		}
+	}
+}
+
+func TestForwardAssignmentOnFloatingLoanAccruesOnSettlement(t *testing.T) {
+	fmt.Println("Entering TestForwardAssignmentOnFloatingLoanAccruesOnSettlement")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	var participant3 = strings.Replace(strings.Replace(participant2, `"part2"`, `"part3"`, 1), "E57ODZWZ7FF32TWEFA76", "MP6I5ZYZBEU3UXPYFY54", 1)
+	CreateParticipants(stub, []string{participant1, participant2, participant3})
+	_, err := PublishRateFixing(stub, []string{"LIBOR", "3M", "2017-01-13", "2"})
+	if err != nil {
+		t.Fatalf("Expected PublishRateFixing to succeed: %v", err)
+	}
+	var floatingLoan = strings.Replace(loanApplication, `"status"`, `"spread":"2.5","rateTenor":"3M","dayCountConvention":"ACT/360","startDate":"2017-01-15","maturityDate":"2017-07-15","interestFrequency":"Quarterly","status"`, 1)
+	_, err = CreateLoanParticipation(stub, []string{"", floatingLoan, syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	stub.MockTransactionEnd("t123")
+	advanceLoanTo(t, stub, loanApplicationID, StatusActive)
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	//settling in the second period, whose fixing on 2017-04-13 is not published yet
+	var proposal = `{"loanId":"la1","sellerId":"part2","buyerId":"part3","amount":"4000","price":"100","tradeDate":"2017-03-01","settlementDate":"2017-05-01"}`
+	for _, step := range []struct {
+		invoke func(stub shim.ChaincodeStubInterface, args []string) ([]byte, error)
+		args   []string
+	}{{ProposeAssignment, []string{proposal}}, {AcceptAssignment, []string{"as1", "part3"}}, {ConsentAssignment, []string{"as1"}}} {
+		_, err = step.invoke(stub, step.args)
+		if err != nil {
+			t.Fatalf("Expected assignment as1 to move on before its rates are fixed: %v", err)
+		}
+	}
+	_, err = SettleAssignment(stub, []string{"as1"})
+	if chaincodeErr, ok := err.(*ChaincodeError); !ok || chaincodeErr.Code != ErrCodeNotFound {
+		t.Fatalf("Expected settling without the second period's fixing to fail, got %v", err)
+	}
+	_, err = PublishRateFixing(stub, []string{"LIBOR", "3M", "2017-04-13", "2"})
+	if err != nil {
+		t.Fatalf("Expected PublishRateFixing to succeed: %v", err)
+	}
+	_, err = SettleAssignment(stub, []string{"as1"})
+	if err != nil {
+		t.Fatalf("Expected SettleAssignment to succeed once the fixing is published: %v", err)
+	}
+	//106 days on 8000.00 at 4.5%, half of it bought by part3
+	seller, _ := fetchPosition(stub, "part2", loanApplicationID)
+	if seller.AccruedInterest.String() != "53.00 USD" || seller.AccrualDate != "2017-05-01" {
+		t.Fatalf("Expected part2 to accrue to settlement, got %+v", seller)
+	}
+}
+
+func TestSubParticipationPassesThroughSettlements(t *testing.T) {
+	fmt.Println("Entering TestSubParticipationPassesThroughSettlements")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	var participant3 = strings.Replace(strings.Replace(participant2, `"part2"`, `"part3"`, 1), "E57ODZWZ7FF32TWEFA76", "MP6I5ZYZBEU3UXPYFY54", 1)
+	CreateParticipants(stub, []string{participant1, participant2, participant3})
+	var datedLoan = strings.Replace(loanApplication, `"status"`, `"dayCountConvention":"ACT/360","startDate":"2017-01-15","status"`, 1)
+	_, err := CreateLoanParticipation(stub, []string{"", datedLoan, syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	stub.MockTransactionEnd("t123")
+	advanceLoanTo(t, stub, loanApplicationID, StatusActive)
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	var expectCode = func(err error, code string, what string) {
+		chaincodeErr, ok := err.(*ChaincodeError)
+		if !ok || chaincodeErr.Code != code {
+			t.Fatalf("Expected %s to fail with %s, got %v", what, code, err)
+		}
+	}
+	var grant = `{"loanId":"la1","grantorId":"part2","participantId":"part3","fundedBps":5000,"unfundedBps":2000}`
+	_, err = CreateSubParticipation(stub, []string{strings.Replace(grant, `"part3"`, `"part2"`, 1)})
+	expectCode(err, ErrCodeInvalidArgument, "sub-participating a position to its own holder")
+	_, err = CreateSubParticipation(stub, []string{grant})
+	if err != nil {
+		t.Fatalf("Expected CreateSubParticipation to succeed: %v", err)
+	}
+	_, err = CreateSubParticipation(stub, []string{strings.Replace(grant, `"fundedBps":5000`, `"fundedBps":4000`, 1)})
+	expectCode(err, ErrCodeFailedPrecondition, "sub-participating more than the whole position")
+
+	_, err = SettleLoanSyndication(stub, []string{loanApplicationID, "10000", "2017-03-11"})
+	if err != nil {
+		t.Fatalf("Expected SettleLoanSyndication to succeed: %v", err)
+	}
+	bytes, err := GetSubParticipations(stub, []string{loanApplicationID, "part3"})
+	var reports []SubParticipationReport
+	if err != nil || json.Unmarshal(bytes, &reports) != nil || len(reports) != 1 {
+		t.Fatalf("Expected one sub-participation for part3, got %s %v", bytes, err)
+	}
+	var report = reports[0]
+	if report.PrincipalPassedThrough.String() != "1000.00 USD" || !report.InterestPassedThrough.IsZero() || len(report.PassThroughs) != 1 {
+		t.Fatalf("Expected half of part2's 2000.00 to pass through and its unpaid interest not to, got %s", bytes)
+	}
+	if report.Funded.String() != "3000.00 USD" || report.Unfunded.String() != "1200.00 USD" {
+		t.Fatalf("Expected the sub-participation to cover 3000.00 funded and 1200.00 unfunded, got %s", bytes)
+	}
+	position, _ := fetchPosition(stub, "part2", loanApplicationID)
+	if position.ShareAmount.String() != "6000.00 USD" || position.AccruedInterest.String() != "61.11 USD" {
+		t.Fatalf("Expected part2 to remain lender of record for its whole position, got %+v", position)
+	}
+
+	//the borrower pays the 244.44 and 61.11 accrued, so half of part2's interest passes through once
+	_, err = ReceivePayment(stub, []string{loanApplicationID, "305.55", "2017-03-11"})
+	if err != nil {
+		t.Fatalf("Expected ReceivePayment to succeed: %v", err)
+	}
+	subParticipations, _ := fetchSubParticipations(stub, loanApplicationID, "part2")
+	if len(subParticipations) != 1 || subParticipations[0].InterestPassedThrough.String() != "30.55 USD" || len(subParticipations[0].PassThroughs) != 2 {
+		t.Fatalf("Expected the paid interest to pass through once, got %+v", subParticipations)
+	}
+
+	_, err = TerminateSubParticipation(stub, []string{loanApplicationID, "part2", "sp1"})
+	if err != nil {
+		t.Fatalf("Expected TerminateSubParticipation to succeed: %v", err)
+	}
+	_, err = SettleLoanSyndication(stub, []string{loanApplicationID, "10000", "2017-04-11"})
+	if err != nil {
+		t.Fatalf("Expected SettleLoanSyndication to succeed: %v", err)
+	}
+	bytes, _ = GetSubParticipations(stub, []string{loanApplicationID})
+	reports = nil
+	json.Unmarshal(bytes, &reports)
+	if len(reports) != 1 || len(reports[0].PassThroughs) != 2 || !reports[0].Funded.IsZero() {
+		t.Fatalf("Expected nothing more to pass through after termination, got %s", bytes)
+	}
+}
+
+func TestSubParticipationPassesThroughPaymentsFromItsStartDate(t *testing.T) {
+	fmt.Println("Entering TestSubParticipationPassesThroughPaymentsFromItsStartDate")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	var participant3 = strings.Replace(strings.Replace(participant2, `"part2"`, `"part3"`, 1), "E57ODZWZ7FF32TWEFA76", "MP6I5ZYZBEU3UXPYFY54", 1)
+	CreateParticipants(stub, []string{participant1, participant2, participant3})
+	var datedLoan = strings.Replace(loanApplication, `"status"`, `"dayCountConvention":"ACT/360","startDate":"2017-01-15","status"`, 1)
+	_, err := CreateLoanParticipation(stub, []string{"", datedLoan, syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	stub.MockTransactionEnd("t123")
+	advanceLoanTo(t, stub, loanApplicationID, StatusActive)
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	_, err = CreateSubParticipation(stub, []string{`{"loanId":"la1","grantorId":"part2","participantId":"part3","fundedBps":5000,"startDate":"2017-03-01"}`})
+	if err != nil {
+		t.Fatalf("Expected CreateSubParticipation to succeed: %v", err)
+	}
+	_, err = SettleLoanSyndication(stub, []string{loanApplicationID, "10000", "2017-02-20"})
+	if err != nil {
+		t.Fatalf("Expected SettleLoanSyndication to succeed: %v", err)
+	}
+	subParticipations, _ := fetchSubParticipations(stub, loanApplicationID, "part2")
+	if len(subParticipations) != 1 || len(subParticipations[0].PassThroughs) != 0 {
+		t.Fatalf("Expected nothing to pass through before the sub-participation starts, got %+v", subParticipations)
+	}
+
+	//interest of 280.00 and 70.00 accrued to 2017-03-28 and 1000.00 prepaid
+	_, err = ReceivePayment(stub, []string{loanApplicationID, "1350", "2017-03-28"})
+	if err != nil {
+		t.Fatalf("Expected ReceivePayment to succeed: %v", err)
+	}
+	subParticipations, _ = fetchSubParticipations(stub, loanApplicationID, "part2")
+	var subParticipation = subParticipations[0]
+	if len(subParticipation.PassThroughs) != 1 || subParticipation.PassThroughs[0].Date != "2017-03-28" ||
+		subParticipation.PrincipalPassedThrough.String() != "100.00 USD" || subParticipation.InterestPassedThrough.String() != "35.00 USD" {
+		t.Fatalf("Expected half of part2's 200.00 principal and 70.00 interest to pass through, got %+v", subParticipation)
+	}
+}
+
+func TestTradeConfirmationsMatchBeforeSettlement(t *testing.T) {
+	fmt.Println("Entering TestTradeConfirmationsMatchBeforeSettlement")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	var participant3 = strings.Replace(strings.Replace(participant2, `"part2"`, `"part3"`, 1), "E57ODZWZ7FF32TWEFA76", "MP6I5ZYZBEU3UXPYFY54", 1)
+	CreateParticipants(stub, []string{participant1, participant2, participant3})
+	var datedLoan = strings.Replace(loanApplication, `"status"`, `"dayCountConvention":"ACT/360","startDate":"2017-01-15","status"`, 1)
+	_, err := CreateLoanParticipation(stub, []string{"", datedLoan, syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	stub.MockTransactionEnd("t123")
+	advanceLoanTo(t, stub, loanApplicationID, StatusActive)
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	var expectCode = func(err error, code string, what string) {
+		chaincodeErr, ok := err.(*ChaincodeError)
+		if !ok || chaincodeErr.Code != code {
+			t.Fatalf("Expected %s to fail with %s, got %v", what, code, err)
+		}
+	}
+	var sell = `{"side":"Sell","loanId":"la1","sellerId":"part2","buyerId":"part3","amount":"4000","price":"99.5","tradeDate":"2017-03-01","settlementDate":"2017-03-11"}`
+	var buy = strings.Replace(sell, `"Sell"`, `"Buy"`, 1)
+	var getTrade = func(tradeId string) Trade {
+		bytes, _ := GetTrade(stub, []string{tradeId})
+		var trade Trade
+		json.Unmarshal(bytes, &trade)
+		return trade
+	}
+	_, err = SubmitTradeConfirmation(stub, []string{"", strings.Replace(sell, `"99.5"`, `"0"`, 1)})
+	expectCode(err, ErrCodeInvalidArgument, "confirming a trade without a price")
+	_, err = SubmitTradeConfirmation(stub, []string{"", sell})
+	if err != nil || getTrade("tr1").Status != TradeOpen {
+		t.Fatalf("Expected the seller's confirmation to open trade tr1: %v", err)
+	}
+	_, err = GetTrade(stub, []string{"tr1", "part1"})
+	expectCode(err, ErrCodeAccessDenied, "reading a trade as a participant who is not a party to it")
+	_, err = GetTrade(stub, []string{"tr1", "part3"})
+	if err != nil {
+		t.Fatalf("Expected the named buyer to read trade tr1 before confirming it: %v", err)
+	}
+	_, err = SubmitTradeConfirmation(stub, []string{"tr1", strings.Replace(buy, `"buyerId":"part3"`, `"buyerId":"part1"`, 1)})
+	expectCode(err, ErrCodeAccessDenied, "a third lender confirming the side the seller named part3 on")
+	if getTrade("tr1").Buy != nil {
+		t.Fatalf("Expected the buy side to stay open for part3, got %+v", getTrade("tr1").Buy)
+	}
+	var mismatched = strings.Replace(strings.Replace(buy, `"99.5"`, `"99"`, 1), `"2017-03-11"`, `"2017-03-14"`, 1)
+	_, err = SubmitTradeConfirmation(stub, []string{"tr1", mismatched})
+	if err != nil {
+		t.Fatalf("Expected the buyer's confirmation to be recorded: %v", err)
+	}
+	var trade = getTrade("tr1")
+	if trade.Status != TradeUnmatched || len(trade.Breaks) != 2 || trade.Breaks[0].Field != "price" || trade.Breaks[0].Buyer != "99" || trade.Breaks[1].Field != "settlementDate" {
+		t.Fatalf("Expected breaks on price and settlement date, got %+v", trade.Breaks)
+	}
+	_, err = ApproveTrade(stub, []string{"tr1"})
+	expectCode(err, ErrCodeIllegalTransition, "approving an unmatched trade")
+	_, err = SubmitTradeConfirmation(stub, []string{"tr1", strings.Replace(buy, `"buyerId":"part3"`, `"buyerId":"part1"`, 1)})
+	expectCode(err, ErrCodeAccessDenied, "replacing another buyer's confirmation")
+	_, err = SubmitTradeConfirmation(stub, []string{"tr1", buy})
+	if err != nil || getTrade("tr1").Status != TradeMatched || len(getTrade("tr1").Breaks) != 0 {
+		t.Fatalf("Expected the corrected confirmation to match: %v %+v", err, getTrade("tr1"))
+	}
+	_, err = SettleTrade(stub, []string{"tr1"})
+	expectCode(err, ErrCodeIllegalTransition, "settling a trade the agent has not approved")
+	_, err = ApproveTrade(stub, []string{"tr1"})
+	if err != nil {
+		t.Fatalf("Expected ApproveTrade to succeed: %v", err)
+	}
+	_, err = SubmitTradeConfirmation(stub, []string{"tr1", buy})
+	expectCode(err, ErrCodeIllegalTransition, "confirming an approved trade again")
+	_, err = SettleTrade(stub, []string{"tr1"})
+	if err != nil {
+		t.Fatalf("Expected SettleTrade to succeed: %v", err)
+	}
+	trade = getTrade("tr1")
+	if trade.Status != TradeSettled || trade.Settlement.Consideration.String() != "3980.00 USD" {
+		t.Fatalf("Expected trade tr1 to settle for 3980.00, got %+v", trade)
+	}
+	position, _ := fetchPosition(stub, "part3", loanApplicationID)
+	if position == nil || position.ShareAmount.String() != "4000.00 USD" {
+		t.Fatalf("Expected part3 to hold the traded position, got %+v", position)
+	}
+	_, err = CancelTrade(stub, []string{"tr1", "part2"})
+	expectCode(err, ErrCodeIllegalTransition, "cancelling a settled trade")
+
+	_, err = SubmitTradeConfirmation(stub, []string{"", buy})
+	if err != nil {
+		t.Fatalf("Expected the buyer to open trade tr2: %v", err)
+	}
+	_, err = CancelTrade(stub, []string{"tr2", "part1"})
+	expectCode(err, ErrCodeAccessDenied, "cancelling a trade without being party to it")
+	_, err = CancelTrade(stub, []string{"tr2", "part3"})
+	if err != nil || getTrade("tr2").Status != TradeCancelled {
+		t.Fatalf("Expected the buyer to cancel trade tr2: %v", err)
+	}
+}
+
+func TestLateTradeSettlementOwesDelayedCompensation(t *testing.T) {
+	fmt.Println("Entering TestLateTradeSettlementOwesDelayedCompensation")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	var participant3 = strings.Replace(strings.Replace(participant2, `"part2"`, `"part3"`, 1), "E57ODZWZ7FF32TWEFA76", "MP6I5ZYZBEU3UXPYFY54", 1)
+	CreateParticipants(stub, []string{participant1, participant2, participant3})
+	var datedLoan = strings.Replace(loanApplication, `"status"`, `"dayCountConvention":"ACT/360","startDate":"2017-01-15","status"`, 1)
+	_, err := CreateLoanParticipation(stub, []string{"", datedLoan, syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	_, err = DefineFee(stub, []string{loanApplicationID, `{"id":"util","type":"Utilization","basis":"TieredUtilization","tiers":[{"fromBps":0,"rateBps":50}]}`})
+	if err != nil {
+		t.Fatalf("Expected DefineFee to succeed: %v", err)
+	}
+	stub.MockTransactionEnd("t123")
+	advanceLoanTo(t, stub, loanApplicationID, StatusActive)
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	var sell = `{"side":"Sell","loanId":"la1","sellerId":"part2","buyerId":"part3","amount":"4000","price":"99.5","tradeDate":"2017-03-01","settlementDate":"2017-03-10"}`
+	_, err = SubmitTradeConfirmation(stub, []string{"", sell})
+	if err != nil {
+		t.Fatalf("Expected SubmitTradeConfirmation to open trade tr1: %v", err)
+	}
+	_, err = SubmitTradeConfirmation(stub, []string{"tr1", strings.Replace(sell, `"Sell"`, `"Buy"`, 1)})
+	if err != nil {
+		t.Fatalf("Expected the buy confirmation to match: %v", err)
+	}
+
+	bytes, err := CalculateTradeEconomics(stub, []string{"tr1"})
+	var economics TradeEconomics
+	if err != nil || json.Unmarshal(bytes, &economics) != nil {
+		t.Fatalf("Expected CalculateTradeEconomics to succeed: %s %v", bytes, err)
+	}
+	if economics.StandardSettlementDate != "2017-03-10" || !economics.DelayedCompensation.IsZero() || len(economics.Obligations) != 2 || economics.Obligations[1].Type != ObligationAccruedInterest {
+		t.Fatalf("Expected no delayed compensation when settling at T+7, got %s", bytes)
+	}
+	_, err = ApproveTrade(stub, []string{"tr1"})
+	if err != nil {
+		t.Fatalf("Expected ApproveTrade to succeed: %v", err)
+	}
+	_, err = SettleTrade(stub, []string{"tr1", "2017-03-20"})
+	if err != nil {
+		t.Fatalf("Expected SettleTrade to succeed: %v", err)
+	}
+	bytes, _ = GetTrade(stub, []string{"tr1"})
+	var trade Trade
+	json.Unmarshal(bytes, &trade)
+	economics = *trade.Economics
+	if economics.AccruedInterest.String() != "10.56 USD" || economics.DelayedInterest.String() != "5.56 USD" || economics.DelayedFees.String() != "0.56 USD" {
+		t.Fatalf("Expected interest and fees on 4000.00 between trade and settlement, got %s", bytes)
+	}
+	if len(economics.Segments) != 2 || !economics.Segments[1].Delayed || economics.Segments[1].StartDate != "2017-03-10" {
+		t.Fatalf("Expected the delayed segment to start at T+7, got %+v", economics.Segments)
+	}
+	var obligations = economics.Obligations
+	if len(obligations) != 3 || obligations[0].PayerId != "part3" || obligations[0].Amount.String() != "3980.00 USD" ||
+		obligations[1].Type != ObligationDelayedCompensation || obligations[1].PayerId != "part2" || obligations[1].Amount.String() != "6.12 USD" {
+		t.Fatalf("Expected the buyer to pay 3980.00 and the seller 6.12 delayed compensation, got %+v", obligations)
+	}
+	//half of the 71.11 part2 accrued on 8000.00 from 2017-01-15 to settlement
+	if obligations[2].Type != ObligationAccruedInterest || obligations[2].PayerId != "part3" || obligations[2].Amount.String() != "35.55 USD" {
+		t.Fatalf("Expected the buyer to pay the seller the interest accrued on the traded part, got %+v", obligations)
+	}
+	position, _ := fetchPosition(stub, "part3", loanApplicationID)
+	if position.AccrualDate != "2017-03-20" {
+		t.Fatalf("Expected part3 to accrue from the actual settlement date, got %s", position.AccrualDate)
+	}
+}
+
+func TestDelayedCompensationNetsCostOfCarry(t *testing.T) {
+	fmt.Println("Entering TestDelayedCompensationNetsCostOfCarry")
+	attributes := make(map[string][]byte)
+	stub := shim.NewCustomMockStub("mockStub", new(SampleChaincode), attributes)
+	if stub == nil {
+		t.Fatalf("MockStub creation failed")
+	}
+
+	stub.MockTransactionStart("t123")
+	var participant3 = strings.Replace(strings.Replace(participant2, `"part2"`, `"part3"`, 1), "E57ODZWZ7FF32TWEFA76", "MP6I5ZYZBEU3UXPYFY54", 1)
+	CreateParticipants(stub, []string{participant1, participant2, participant3})
+	_, err := PublishRateFixing(stub, []string{"LIBOR", "3M", "2017-01-13", "2"})
+	if err != nil {
+		t.Fatalf("Expected PublishRateFixing to succeed: %v", err)
+	}
+	var floatingLoan = strings.Replace(loanApplication, `"status"`, `"spread":"2.5","rateTenor":"3M","dayCountConvention":"ACT/360","startDate":"2017-01-15","maturityDate":"2017-07-15","interestFrequency":"Quarterly","status"`, 1)
+	_, err = CreateLoanParticipation(stub, []string{"", floatingLoan, syndicate})
+	if err != nil {
+		t.Fatalf("Expected CreateLoanParticipation to succeed: %v", err)
+	}
+	stub.MockTransactionEnd("t123")
+	advanceLoanTo(t, stub, loanApplicationID, StatusActive)
+
+	stub.MockTransactionStart("t123")
+	defer stub.MockTransactionEnd("t123")
+	var sell = `{"side":"Sell","loanId":"la1","sellerId":"part2","buyerId":"part3","amount":"4000","price":"99.5","tradeDate":"2017-03-01","settlementDate":"2017-03-10"}`
+	for _, confirmation := range [][]string{{"", sell}, {"tr1", strings.Replace(sell, `"Sell"`, `"Buy"`, 1)}} {
+		_, err = SubmitTradeConfirmation(stub, confirmation)
+		if err != nil {
+			t.Fatalf("Expected SubmitTradeConfirmation to succeed: %v", err)
+		}
+	}
+	bytes, err := CalculateTradeEconomics(stub, []string{"tr1", "2017-03-20"})
+	var economics TradeEconomics
+	if err != nil || json.Unmarshal(bytes, &economics) != nil {
+		t.Fatalf("Expected CalculateTradeEconomics to succeed: %s %v", bytes, err)
+	}
+
+	//the first period is fixed at 2% LIBOR plus 2.5% before it is accrued; ten delayed days earn
+	//5.00 on 4000.00 and cost the buyer 2.21 of carry on the 3980.00 it has not yet paid
+	var delayed = economics.Segments[len(economics.Segments)-1]
+	if !delayed.Delayed || delayed.AllInRate.String() != "4.5" || delayed.Benchmark == nil || *delayed.Benchmark != NewRate(2) {
+		t.Fatalf("Expected the delayed segment at the period's fixing, got %+v", delayed)
+	}
+	if economics.DelayedInterest.String() != "5.00 USD" || economics.CostOfCarry.String() != "2.21 USD" || economics.DelayedCompensation.String() != "2.79 USD" {
+		t.Fatalf("Expected 5.00 delayed interest less 2.21 cost of carry, got %s", bytes)
+	}
+}
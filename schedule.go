@@ -0,0 +1,494 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const scheduleObjectType = "schedule"
+
+//Interest frequencies and the number of months in each regular period
+const (
+	FrequencyMonthly    = "Monthly"
+	FrequencyQuarterly  = "Quarterly"
+	FrequencySemiAnnual = "SemiAnnual"
+	FrequencyAnnual     = "Annual"
+)
+
+var frequencyMonths = map[string]int{
+	FrequencyMonthly:    1,
+	FrequencyQuarterly:  3,
+	FrequencySemiAnnual: 6,
+	FrequencyAnnual:     12,
+}
+
+//Stub types say where an irregular period goes when the term is not a whole number of regular
+//periods. Short stubs are a period of their own, long stubs are merged into their neighbour.
+const (
+	StubShortFinal   = "ShortFinal"
+	StubLongFinal    = "LongFinal"
+	StubShortInitial = "ShortInitial"
+	StubLongInitial  = "LongInitial"
+)
+
+var stubTypes = []string{StubShortFinal, StubLongFinal, StubShortInitial, StubLongInitial}
+
+const (
+	PeriodScheduled = "Scheduled"
+	PeriodAccrued   = "Accrued"
+)
+
+type InterestSchedule struct {
+	LoanId             string           `json:"loanId"`
+	Frequency          string           `json:"frequency"`
+	StubType           string           `json:"stubType"`
+	DayCountConvention string           `json:"dayCountConvention"`
+	Periods            []InterestPeriod `json:"periods"`
+}
+
+//InterestPeriod runs from StartDate up to but excluding EndDate. The rate, the fixing it came
+//from, Interest and Accruals are filled in once the period is accrued, with one accrual per
+//syndicate member. DefaultInterest is only set for periods accrued while the loan is in default.
+type InterestPeriod struct {
+	Number          int             `json:"number"`
+	StartDate       string          `json:"startDate"`
+	EndDate         string          `json:"endDate"`
+	Stub            bool            `json:"stub,omitempty"`
+	Status          string          `json:"status"`
+	Principal       Money           `json:"principal"`
+	AllInRate       Rate            `json:"allInRate"`
+	Fixing          *AppliedFixing  `json:"fixing,omitempty"`
+	Interest        Money           `json:"interest"`
+	DefaultInterest *Money          `json:"defaultInterest,omitempty"`
+	Accruals        []PeriodAccrual `json:"accruals,omitempty"`
+}
+
+type PeriodAccrual struct {
+	ParticipantId string `json:"participantId"`
+	Interest      Money  `json:"interest"`
+}
+
+func scheduleKey(loanId string) string {
+	return compositeKey(scheduleObjectType, loanId)
+}
+
+//addMonths moves a date by whole months, clamping to the end of shorter months so that
+//2017-01-31 plus one month is 2017-02-28
+func addMonths(date time.Time, months int) time.Time {
+	var firstOfMonth = time.Date(date.Year(), date.Month()+time.Month(months), 1, 0, 0, 0, 0, time.UTC)
+	var lastDay = firstOfMonth.AddDate(0, 1, -1).Day()
+	var day = date.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return time.Date(firstOfMonth.Year(), firstOfMonth.Month(), day, 0, 0, 0, 0, time.UTC)
+}
+
+//GenerateInterestPeriods splits start to maturity into regular periods of the given frequency.
+//Final stubs roll forward from the start date, initial stubs roll back from maturity.
+func GenerateInterestPeriods(start time.Time, maturity time.Time, frequency string, stubType string) ([]InterestPeriod, error) {
+	months, ok := frequencyMonths[frequency]
+	if !ok {
+		return nil, errors.New("Unknown interest frequency " + frequency)
+	}
+	if stubType == "" {
+		stubType = StubShortFinal
+	}
+	if !containsString(stubTypes, stubType) {
+		return nil, errors.New("Unknown stub type " + stubType)
+	}
+	if !maturity.After(start) {
+		return nil, errors.New("Maturity " + maturity.Format(DateLayout) + " must be after the start date " + start.Format(DateLayout))
+	}
+
+	var backward = stubType == StubShortInitial || stubType == StubLongInitial
+	var dates = []time.Time{start}
+	var regular = true
+	if backward {
+		var rolled = []time.Time{maturity}
+		for k := 1; ; k++ {
+			var date = addMonths(maturity, -k*months)
+			if !date.After(start) {
+				regular = date.Equal(start)
+				break
+			}
+			rolled = append(rolled, date)
+		}
+		for i := len(rolled) - 1; i >= 0; i-- {
+			dates = append(dates, rolled[i])
+		}
+	} else {
+		for k := 1; ; k++ {
+			var date = addMonths(start, k*months)
+			if !date.Before(maturity) {
+				regular = date.Equal(maturity)
+				break
+			}
+			dates = append(dates, date)
+		}
+		dates = append(dates, maturity)
+	}
+
+	//a long stub absorbs the irregular period into the neighbouring regular one
+	var stubIndex = -1
+	if !regular {
+		if backward {
+			stubIndex = 0
+		} else {
+			stubIndex = len(dates) - 2
+		}
+		if len(dates) > 2 && (stubType == StubLongFinal || stubType == StubLongInitial) {
+			if backward {
+				dates = append(dates[:1], dates[2:]...)
+			} else {
+				dates = append(dates[:len(dates)-2], dates[len(dates)-1])
+				stubIndex = len(dates) - 2
+			}
+		}
+	}
+
+	var periods []InterestPeriod
+	for i := 0; i+1 < len(dates); i++ {
+		periods = append(periods, InterestPeriod{
+			Number:    i + 1,
+			StartDate: dates[i].Format(DateLayout),
+			EndDate:   dates[i+1].Format(DateLayout),
+			Stub:      i == stubIndex,
+			Status:    PeriodScheduled,
+		})
+	}
+	return periods, nil
+}
+
+//buildInterestSchedule returns nil for loans without a maturity and interest frequency, which
+//keep accruing only when they are settled
+func buildInterestSchedule(loan *LoanApplication) (*InterestSchedule, error) {
+	if loan.MaturityDate == "" && loan.InterestFrequency == "" {
+		return nil, nil
+	}
+	if loan.StartDate == "" || loan.MaturityDate == "" || loan.InterestFrequency == "" {
+		return nil, newError(ErrCodeInvalidArgument, "Loan application %s needs a start date, maturity date and interest frequency for an interest schedule", loan.ID)
+	}
+	start, err := ParseDate(loan.StartDate)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "Loan application %s start date: %v", loan.ID, err)
+	}
+	maturity, err := ParseDate(loan.MaturityDate)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "Loan application %s maturity date: %v", loan.ID, err)
+	}
+	periods, err := GenerateInterestPeriods(start, maturity, loan.InterestFrequency, loan.StubType)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "Loan application %s: %v", loan.ID, err)
+	}
+	var stubType = loan.StubType
+	if stubType == "" {
+		stubType = StubShortFinal
+	}
+	return &InterestSchedule{
+		LoanId:             loan.ID,
+		Frequency:          loan.InterestFrequency,
+		StubType:           stubType,
+		DayCountConvention: loan.dayCountConvention(),
+		Periods:            periods,
+	}, nil
+}
+
+//fetchInterestSchedule returns nil without an error when the loan has no schedule
+func fetchInterestSchedule(stub shim.ChaincodeStubInterface, loanId string) (*InterestSchedule, error) {
+	bytes, err := stub.GetState(scheduleKey(loanId))
+	if err != nil {
+		logger.Error("Could not fetch interest schedule for loan "+loanId+" from ledger", err)
+		return nil, err
+	}
+	if bytes == nil {
+		return nil, nil
+	}
+	var schedule InterestSchedule
+	err = json.Unmarshal(bytes, &schedule)
+	if err != nil {
+		logger.Error("Could not unmarshal interest schedule for loan "+loanId, err)
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+func saveInterestSchedule(stub shim.ChaincodeStubInterface, schedule *InterestSchedule) ([]byte, error) {
+	bytes, err := json.Marshal(schedule)
+	if err != nil {
+		logger.Error("Could not marshal interest schedule for loan "+schedule.LoanId, err)
+		return nil, err
+	}
+	err = stub.PutState(scheduleKey(schedule.LoanId), bytes)
+	if err != nil {
+		logger.Error("Could not save interest schedule for loan "+schedule.LoanId+" to ledger", err)
+		return nil, err
+	}
+	return bytes, nil
+}
+
+//forParticipant keeps only the participant's accruals in every period
+func (schedule *InterestSchedule) forParticipant(participantId string) *InterestSchedule {
+	var own = *schedule
+	own.Periods = nil
+	for _, period := range schedule.Periods {
+		var accruals = period.Accruals
+		period.Accruals = nil
+		for _, accrual := range accruals {
+			if accrual.ParticipantId == participantId {
+				period.Accruals = append(period.Accruals, accrual)
+			}
+		}
+		own.Periods = append(own.Periods, period)
+	}
+	return &own
+}
+
+//GetInterestSchedule returns the interest periods of a loan and what was accrued in each; args
+//are loan ID and optionally a participant ID, which limits the accruals to that participant
+func GetInterestSchedule(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering GetInterestSchedule")
+	if len(args) < 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected loan application ID")
+	}
+	schedule, err := fetchInterestSchedule(stub, args[0])
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read interest schedule for loan %s: %v", args[0], err)
+	}
+	if schedule == nil {
+		return nil, newError(ErrCodeNotFound, "Loan %s has no interest schedule", args[0])
+	}
+	if len(args) > 1 && args[1] != "" {
+		schedule = schedule.forParticipant(args[1])
+	}
+	return json.Marshal(schedule)
+}
+
+//addAccrual records interest accrued to a participant in the period
+func (period *InterestPeriod) addAccrual(participantId string, interest Money) {
+	for i := range period.Accruals {
+		if period.Accruals[i].ParticipantId == participantId {
+			period.Accruals[i].Interest = period.Accruals[i].Interest.Add(interest)
+			return
+		}
+	}
+	period.Accruals = append(period.Accruals, PeriodAccrual{ParticipantId: participantId, Interest: interest})
+}
+
+//accrualPart is a stretch of time within one interest period, or outside the schedule, that
+//accrues at a single rate
+type accrualPart struct {
+	StartDate string
+	EndDate   string
+	Period    *InterestPeriod
+	AllInRate Rate
+	Fixing    *AppliedFixing
+}
+
+//splitAccrual splits start to end at the ends of the loan's interest periods and prices every
+//part at the rate of its period: the recorded rate once the period is accrued, otherwise the
+//rate periodRate fixes at its start. Compounded risk-free rates are compounded over the part
+//only, as later observations may not be published yet. Time outside the schedule, and loans
+//without one, accrue at the loan's rate.
+func splitAccrual(stub shim.ChaincodeStubInterface, schedule *InterestSchedule, loan *LoanApplication, start string, end string) ([]accrualPart, error) {
+	var parts []accrualPart
+	var cursor = start
+	if schedule != nil {
+		for i := range schedule.Periods {
+			var period = &schedule.Periods[i]
+			if period.EndDate <= cursor {
+				continue
+			}
+			if period.StartDate >= end {
+				break
+			}
+			if period.StartDate > cursor {
+				parts = append(parts, accrualPart{StartDate: cursor, EndDate: period.StartDate, AllInRate: loan.AllInRate})
+				cursor = period.StartDate
+			}
+			var part = accrualPart{StartDate: cursor, EndDate: period.EndDate, Period: period, AllInRate: period.AllInRate, Fixing: period.Fixing}
+			if part.EndDate > end {
+				part.EndDate = end
+			}
+			if period.Status != PeriodAccrued {
+				var priced = period
+				if isRFR(loan.rateTermsOn(period.StartDate).BaseRateType) {
+					priced = &InterestPeriod{Number: period.Number, StartDate: part.StartDate, EndDate: part.EndDate}
+				}
+				rate, fixing, err := periodRate(stub, loan, priced)
+				if err != nil {
+					return nil, err
+				}
+				part.AllInRate, part.Fixing = rate, fixing
+			}
+			parts = append(parts, part)
+			cursor = part.EndDate
+		}
+	}
+	if cursor < end {
+		parts = append(parts, accrualPart{StartDate: cursor, EndDate: end, AllInRate: loan.AllInRate})
+	}
+	return parts, nil
+}
+
+//interest is the interest on principal over the part
+func (part *accrualPart) interest(principal Money, convention string) (Money, error) {
+	start, err := ParseDate(part.StartDate)
+	if err != nil {
+		return Money{}, err
+	}
+	end, err := ParseDate(part.EndDate)
+	if err != nil {
+		return Money{}, err
+	}
+	interest, err := AccruedInterest(principal, part.AllInRate.Rat(), convention, start, end)
+	if err != nil {
+		return Money{}, newError(ErrCodeInvalidArgument, "%v", err)
+	}
+	return interest, nil
+}
+
+//interestBearingStatuses are the loan statuses in which periods can be accrued
+var interestBearingStatuses = []string{StatusActive, StatusDefaulted, StatusRestructured}
+
+//AccrueInterest completes the interest of one period; args are loan ID and period number. Every
+//position accrues from its own accrual date to the period end at its principal, so time already
+//accrued by settlements inside the period is not counted again, and the period records what
+//each participant accrued in it. Periods are accrued in order, and accruing an accrued period
+//again returns the recorded period without changes.
+func AccrueInterest(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering AccrueInterest")
+	if len(args) < 2 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected loan application ID and period number")
+	}
+	var loanId = args[0]
+	number, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "Invalid period number %s", args[1])
+	}
+
+	loan, err := fetchLoan(stub, loanId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read loan application %s: %v", loanId, err)
+	}
+	if loan == nil {
+		return nil, newError(ErrCodeNotFound, "Loan application %s not found", loanId)
+	}
+	schedule, err := fetchInterestSchedule(stub, loanId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read interest schedule for loan %s: %v", loanId, err)
+	}
+	if schedule == nil {
+		return nil, newError(ErrCodeNotFound, "Loan %s has no interest schedule", loanId)
+	}
+	if number < 1 || number > len(schedule.Periods) {
+		return nil, newError(ErrCodeInvalidArgument, "Loan %s has no interest period %d", loanId, number)
+	}
+	var period = &schedule.Periods[number-1]
+	if period.Status == PeriodAccrued {
+		return json.Marshal(period)
+	}
+	if number > 1 && schedule.Periods[number-2].Status != PeriodAccrued {
+		return nil, newError(ErrCodeFailedPrecondition, "Interest period %d of loan %s must be accrued first", number-1, loanId)
+	}
+	if !containsString(interestBearingStatuses, loan.Status) {
+		return nil, newError(ErrCodeFailedPrecondition, "Loan %s does not accrue interest in status %s", loanId, loan.Status)
+	}
+	syndicate, err := fetchSyndicate(stub, loanId)
+	if err != nil {
+		return nil, newError(ErrCodeFailedPrecondition, "Loan %s cannot accrue interest: %v", loanId, err)
+	}
+
+	start, err := ParseDate(period.StartDate)
+	if err != nil {
+		return nil, err
+	}
+	end, err := ParseDate(period.EndDate)
+	if err != nil {
+		return nil, err
+	}
+	rate, fixing, err := periodRate(stub, loan, period)
+	if err != nil {
+		return nil, err
+	}
+	//default interest is owed on top of the contractual rate and collected through the payment
+	//waterfall rather than accrued to the positions
+	var defaultInterest *Money
+	if loan.Status == StatusDefaulted && loan.DefaultMargin != nil {
+		extra, err := AccruedInterest(loan.OutStandingSettlementAmount, loan.DefaultMargin.Rat(), schedule.DayCountConvention, start, end)
+		if err != nil {
+			return nil, newError(ErrCodeInvalidArgument, "Loan %s period %d: %v", loanId, number, err)
+		}
+		defaultInterest = &extra
+	}
+
+	//read every position before writing any so a missing one leaves the ledger untouched
+	var positions = make([]*Asset, len(syndicate.Members))
+	for i, member := range syndicate.Members {
+		positions[i], err = fetchPosition(stub, member.ParticipantId, loanId)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not read position of %s in loan %s: %v", member.ParticipantId, loanId, err)
+		}
+		if positions[i] == nil {
+			return nil, newError(ErrCodeNotFound, "Participant %s holds no position in loan %s", member.ParticipantId, loanId)
+		}
+		err = positions[i].normalizeCurrency(loan.Currency)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var accrued = make([]Money, len(syndicate.Members))
+	for i, member := range syndicate.Members {
+		accrued[i], err = accrueSince(stub, schedule, loan, member.ParticipantId, positions[i], period.EndDate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	period.Status = PeriodAccrued
+	period.Principal = loan.OutStandingSettlementAmount
+	period.AllInRate = rate
+	period.Fixing = fixing
+	period.Interest = ZeroMoney(loan.Currency)
+	for _, accrual := range period.Accruals {
+		period.Interest = period.Interest.Add(accrual.Interest)
+	}
+	period.DefaultInterest = defaultInterest
+	for i, member := range syndicate.Members {
+		positions[i].AccruedInterest = positions[i].AccruedInterest.Add(accrued[i])
+		err = savePosition(stub, member.ParticipantId, positions[i])
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not save position of %s in loan %s: %v", member.ParticipantId, loanId, err)
+		}
+	}
+	_, err = saveInterestSchedule(stub, schedule)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not save interest schedule for loan %s: %v", loanId, err)
+	}
+	//the loan shows the rate of its latest accrued period
+	if loan.AllInRate != rate || defaultInterest != nil {
+		loan.AllInRate = rate
+		if defaultInterest != nil {
+			loan.DefaultInterestDue = loan.DefaultInterestDue.Add(*defaultInterest)
+		}
+		_, err = saveLoan(stub, loan)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not save loan application %s: %v", loanId, err)
+		}
+	}
+
+	bytes, err := json.Marshal(period)
+	if err != nil {
+		return nil, err
+	}
+	err = setEvent(stub, "interestAccrued", string(bytes))
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Accrued interest period " + args[1] + " of loan " + loanId)
+	return bytes, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerateInterestPeriods(t *testing.T) {
+	var cases = []struct {
+		start     string
+		maturity  string
+		frequency string
+		stubType  string
+		expected  string
+		stub      int
+	}{
+		{"2017-01-15", "2018-01-15", FrequencyQuarterly, "", "2017-01-15 2017-04-15 2017-07-15 2017-10-15 2018-01-15", 0},
+		{"2017-01-31", "2017-05-31", FrequencyMonthly, StubShortFinal, "2017-01-31 2017-02-28 2017-03-31 2017-04-30 2017-05-31", 0},
+		{"2017-01-15", "2017-11-30", FrequencyQuarterly, StubShortFinal, "2017-01-15 2017-04-15 2017-07-15 2017-10-15 2017-11-30", 4},
+		{"2017-01-15", "2017-11-30", FrequencyQuarterly, StubLongFinal, "2017-01-15 2017-04-15 2017-07-15 2017-11-30", 3},
+		{"2017-01-15", "2017-11-30", FrequencyQuarterly, StubShortInitial, "2017-01-15 2017-02-28 2017-05-30 2017-08-30 2017-11-30", 1},
+		{"2017-01-15", "2017-11-30", FrequencyQuarterly, StubLongInitial, "2017-01-15 2017-05-30 2017-08-30 2017-11-30", 1},
+		{"2017-01-15", "2017-03-01", FrequencySemiAnnual, StubLongFinal, "2017-01-15 2017-03-01", 1},
+		{"2016-06-30", "2018-06-30", FrequencyAnnual, "", "2016-06-30 2017-06-30 2018-06-30", 0},
+	}
+	for _, c := range cases {
+		start, _ := ParseDate(c.start)
+		maturity, _ := ParseDate(c.maturity)
+		periods, err := GenerateInterestPeriods(start, maturity, c.frequency, c.stubType)
+		if err != nil {
+			t.Fatalf("%s %s: expected periods, got %v", c.frequency, c.stubType, err)
+		}
+		var dates = []string{periods[0].StartDate}
+		var stub = 0
+		for _, period := range periods {
+			dates = append(dates, period.EndDate)
+			if period.Stub {
+				stub = period.Number
+			}
+		}
+		if strings.Join(dates, " ") != c.expected || stub != c.stub {
+			t.Fatalf("%s %s: expected %s with stub %d, got %s with stub %d", c.frequency, c.stubType, c.expected, c.stub, strings.Join(dates, " "), stub)
+		}
+	}
+}
+
+func TestGenerateInterestPeriodsRejectsBadInput(t *testing.T) {
+	start, _ := ParseDate("2017-01-15")
+	maturity, _ := ParseDate("2018-01-15")
+	if _, err := GenerateInterestPeriods(start, maturity, "Weekly", ""); err == nil {
+		t.Fatalf("Expected an unknown frequency to be refused")
+	}
+	if _, err := GenerateInterestPeriods(start, maturity, FrequencyMonthly, "MiddleStub"); err == nil {
+		t.Fatalf("Expected an unknown stub type to be refused")
+	}
+	if _, err := GenerateInterestPeriods(maturity, start, FrequencyMonthly, ""); err == nil {
+		t.Fatalf("Expected a maturity before the start to be refused")
+	}
+}
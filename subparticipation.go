@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const subParticipationObjectType = "subpart"
+
+const (
+	SubParticipationActive     = "Active"
+	SubParticipationTerminated = "Terminated"
+)
+
+//SubParticipation sells the risk of part of a grantor's position to a sub-participant without
+//making it a lender of record. The funded part is paid for up front, so principal and interest
+//the grantor receives on it are passed through; the unfunded part is a risk participation that
+//only pays the grantor if the borrower does not. Both are in basis points of the grantor's position.
+type SubParticipation struct {
+	ID                     string        `json:"id"`
+	LoanId                 string        `json:"loanId"`
+	GrantorId              string        `json:"grantorId"`
+	ParticipantId          string        `json:"participantId"`
+	FundedBps              int           `json:"fundedBps"`
+	UnfundedBps            int           `json:"unfundedBps"`
+	StartDate              string        `json:"startDate,omitempty"`
+	Status                 string        `json:"status"`
+	PrincipalPassedThrough Money         `json:"principalPassedThrough"`
+	InterestPassedThrough  Money         `json:"interestPassedThrough"`
+	PassThroughs           []PassThrough `json:"passThroughs"`
+	TxId                   string        `json:"txId"`
+}
+
+//PassThrough is the part of one settlement with the grantor owed on to the sub-participant
+type PassThrough struct {
+	Date      string `json:"date,omitempty"`
+	Principal Money  `json:"principal"`
+	Interest  Money  `json:"interest"`
+	TxId      string `json:"txId"`
+}
+
+//SubParticipationReport adds the amounts of the grantor's current position a sub-participation covers
+type SubParticipationReport struct {
+	SubParticipation
+	Funded   Money `json:"funded"`
+	Unfunded Money `json:"unfunded"`
+}
+
+func subParticipationKey(loanId string, grantorId string, subParticipationId string) string {
+	return compositeKey(subParticipationObjectType, loanId, grantorId, subParticipationId)
+}
+
+//fetchSubParticipations returns the sub-participations in a loan, only those granted by
+//grantorId when it is set
+func fetchSubParticipations(stub shim.ChaincodeStubInterface, loanId string, grantorId string) ([]SubParticipation, error) {
+	var attributes = []string{loanId}
+	if grantorId != "" {
+		attributes = append(attributes, grantorId)
+	}
+	var subParticipations []SubParticipation
+	err := rangeQueryByPartialKey(stub, func(key string, value []byte) error {
+		var subParticipation SubParticipation
+		err := json.Unmarshal(value, &subParticipation)
+		if err != nil {
+			logger.Error("Could not unmarshal sub-participation "+key, err)
+			return err
+		}
+		subParticipations = append(subParticipations, subParticipation)
+		return nil
+	}, subParticipationObjectType, attributes...)
+	if err != nil {
+		return nil, err
+	}
+	return subParticipations, nil
+}
+
+func saveSubParticipation(stub shim.ChaincodeStubInterface, subParticipation *SubParticipation) ([]byte, error) {
+	bytes, err := json.Marshal(subParticipation)
+	if err != nil {
+		logger.Error("Could not marshal sub-participation "+subParticipation.ID, err)
+		return nil, err
+	}
+	err = stub.PutState(subParticipationKey(subParticipation.LoanId, subParticipation.GrantorId, subParticipation.ID), bytes)
+	if err != nil {
+		logger.Error("Could not save sub-participation "+subParticipation.ID+" to ledger", err)
+		return nil, err
+	}
+	return bytes, nil
+}
+
+//CreateSubParticipation grants a sub-participation in a position; args are the sub-participation
+//JSON with loanId, grantorId, participantId, fundedBps, unfundedBps and optionally startDate.
+//The active sub-participations of a position may cover at most all of it.
+func CreateSubParticipation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering CreateSubParticipation")
+	if len(args) < 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected sub-participation")
+	}
+	var subParticipation SubParticipation
+	err := json.Unmarshal([]byte(args[0]), &subParticipation)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "Could not parse sub-participation: %v", err)
+	}
+	if subParticipation.GrantorId == subParticipation.ParticipantId {
+		return nil, newError(ErrCodeInvalidArgument, "Participant %s cannot sub-participate its own position", subParticipation.GrantorId)
+	}
+	if subParticipation.FundedBps < 0 || subParticipation.UnfundedBps < 0 || subParticipation.FundedBps+subParticipation.UnfundedBps == 0 {
+		return nil, newError(ErrCodeInvalidArgument, "Sub-participation needs a positive funded or unfunded share")
+	}
+	if subParticipation.StartDate != "" {
+		_, err = ParseDate(subParticipation.StartDate)
+		if err != nil {
+			return nil, newError(ErrCodeInvalidArgument, "Invalid start date: %v", err)
+		}
+	}
+	loan, err := fetchLoan(stub, subParticipation.LoanId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read loan application %s: %v", subParticipation.LoanId, err)
+	}
+	if loan == nil {
+		return nil, newError(ErrCodeNotFound, "Loan application %s not found", subParticipation.LoanId)
+	}
+	position, err := fetchPosition(stub, subParticipation.GrantorId, loan.ID)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read position of %s in loan %s: %v", subParticipation.GrantorId, loan.ID, err)
+	}
+	if position == nil {
+		return nil, newError(ErrCodeNotFound, "Participant %s holds no position in loan %s", subParticipation.GrantorId, loan.ID)
+	}
+	participant, err := fetchParticipant(stub, subParticipation.ParticipantId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read participant %s: %v", subParticipation.ParticipantId, err)
+	}
+	err = validateLender(participant, subParticipation.ParticipantId)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := fetchSubParticipations(stub, loan.ID, subParticipation.GrantorId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read sub-participations of %s in loan %s: %v", subParticipation.GrantorId, loan.ID, err)
+	}
+	var covered = subParticipation.FundedBps + subParticipation.UnfundedBps
+	for _, other := range existing {
+		if other.Status == SubParticipationActive {
+			covered += other.FundedBps + other.UnfundedBps
+		}
+	}
+	if covered > FullShareBps {
+		return nil, newError(ErrCodeFailedPrecondition, "Sub-participations of %s in loan %s would cover %d bps of its position", subParticipation.GrantorId, loan.ID, covered)
+	}
+
+	subParticipation.ID, err = NextID(stub, SubParticipationIdPrefix, func(id string) string {
+		return subParticipationKey(loan.ID, subParticipation.GrantorId, id)
+	})
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not allocate a sub-participation ID: %v", err)
+	}
+	subParticipation.Status = SubParticipationActive
+	subParticipation.PrincipalPassedThrough = ZeroMoney(loan.Currency)
+	subParticipation.InterestPassedThrough = ZeroMoney(loan.Currency)
+	subParticipation.PassThroughs = []PassThrough{}
+	subParticipation.TxId = stub.GetTxID()
+	bytes, err := saveSubParticipation(stub, &subParticipation)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not save sub-participation %s: %v", subParticipation.ID, err)
+	}
+	err = setEvent(stub, "subParticipationCreated", string(bytes))
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Created sub-participation " + subParticipation.ID + " in the position of " + subParticipation.GrantorId + " in loan " + loan.ID)
+	return bytes, nil
+}
+
+//TerminateSubParticipation ends a sub-participation so nothing more is passed through; args are
+//loan ID, grantor ID and sub-participation ID
+func TerminateSubParticipation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering TerminateSubParticipation")
+	if len(args) < 3 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected loan application ID, grantor ID and sub-participation ID")
+	}
+	subParticipations, err := fetchSubParticipations(stub, args[0], args[1])
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read sub-participations of %s in loan %s: %v", args[1], args[0], err)
+	}
+	for i := range subParticipations {
+		var subParticipation = &subParticipations[i]
+		if subParticipation.ID != args[2] {
+			continue
+		}
+		if subParticipation.Status != SubParticipationActive {
+			return nil, newError(ErrCodeIllegalTransition, "Sub-participation %s is already %s", subParticipation.ID, subParticipation.Status)
+		}
+		subParticipation.Status = SubParticipationTerminated
+		subParticipation.TxId = stub.GetTxID()
+		bytes, err := saveSubParticipation(stub, subParticipation)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not save sub-participation %s: %v", subParticipation.ID, err)
+		}
+		err = setEvent(stub, "subParticipationTerminated", string(bytes))
+		if err != nil {
+			return nil, err
+		}
+		return bytes, nil
+	}
+	return nil, newError(ErrCodeNotFound, "Sub-participation %s of %s in loan %s not found", args[2], args[1], args[0])
+}
+
+//GetSubParticipations reports the sub-participations in a loan with the part of the grantor's
+//current position each covers; args are loan ID and optionally a participant ID to report only
+//those it granted or holds
+func GetSubParticipations(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering GetSubParticipations")
+	if len(args) < 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected loan application ID")
+	}
+	var participantId = ""
+	if len(args) > 1 {
+		participantId = args[1]
+	}
+	loan, err := fetchLoan(stub, args[0])
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read loan application %s: %v", args[0], err)
+	}
+	if loan == nil {
+		return nil, newError(ErrCodeNotFound, "Loan application %s not found", args[0])
+	}
+	subParticipations, err := fetchSubParticipations(stub, loan.ID, "")
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read sub-participations in loan %s: %v", loan.ID, err)
+	}
+	var reports = []SubParticipationReport{}
+	for _, subParticipation := range subParticipations {
+		if participantId != "" && subParticipation.GrantorId != participantId && subParticipation.ParticipantId != participantId {
+			continue
+		}
+		var report = SubParticipationReport{SubParticipation: subParticipation, Funded: ZeroMoney(loan.Currency), Unfunded: ZeroMoney(loan.Currency)}
+		position, err := fetchPosition(stub, subParticipation.GrantorId, loan.ID)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not read position of %s in loan %s: %v", subParticipation.GrantorId, loan.ID, err)
+		}
+		if position != nil && subParticipation.Status == SubParticipationActive {
+			err = position.normalizeCurrency(loan.Currency)
+			if err != nil {
+				return nil, err
+			}
+			report.Funded = position.ShareAmount.MulDiv(int64(subParticipation.FundedBps), FullShareBps)
+			report.Unfunded = position.ShareAmount.MulDiv(int64(subParticipation.UnfundedBps), FullShareBps)
+		}
+		reports = append(reports, report)
+	}
+	return json.Marshal(reports)
+}
+
+//passThrough records the funded part of the principal and interest a grantor received in a
+//settlement or payment as owed to each of its active sub-participants. Sub-participations
+//starting after the value date have no part in it. The pass-throughs are kept on the
+//sub-participations; they raise no event of their own since the transaction already raises one.
+func passThrough(stub shim.ChaincodeStubInterface, loanId string, grantorId string, valueDate string, principal Money, interest Money) error {
+	if principal.IsZero() && interest.IsZero() {
+		return nil
+	}
+	subParticipations, err := fetchSubParticipations(stub, loanId, grantorId)
+	if err != nil {
+		return newError(ErrCodeLedger, "Could not read sub-participations of %s in loan %s: %v", grantorId, loanId, err)
+	}
+	for i := range subParticipations {
+		var subParticipation = &subParticipations[i]
+		if subParticipation.Status != SubParticipationActive || subParticipation.FundedBps == 0 {
+			continue
+		}
+		if subParticipation.StartDate != "" && valueDate < subParticipation.StartDate {
+			continue
+		}
+		var entry = PassThrough{
+			Date:      valueDate,
+			Principal: principal.MulDiv(int64(subParticipation.FundedBps), FullShareBps),
+			Interest:  interest.MulDiv(int64(subParticipation.FundedBps), FullShareBps),
+			TxId:      stub.GetTxID(),
+		}
+		subParticipation.PrincipalPassedThrough = subParticipation.PrincipalPassedThrough.Add(entry.Principal)
+		subParticipation.InterestPassedThrough = subParticipation.InterestPassedThrough.Add(entry.Interest)
+		subParticipation.PassThroughs = append(subParticipation.PassThroughs, entry)
+		_, err = saveSubParticipation(stub, subParticipation)
+		if err != nil {
+			return newError(ErrCodeLedger, "Could not save sub-participation %s: %v", subParticipation.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const tradeObjectType = "trade"
+
+const (
+	TradeBuy  = "Buy"
+	TradeSell = "Sell"
+)
+
+//Trade documentation and trade types follow the LSTA and LMA standard terms
+const (
+	DocumentationLSTA = "LSTA"
+	DocumentationLMA  = "LMA"
+
+	TradeTypePar        = "Par"
+	TradeTypeDistressed = "Distressed"
+)
+
+//Trade statuses, following the LSTA/LMA settlement lifecycle. A trade is Open until both sides
+//have confirmed, then Matched or Unmatched with its breaks listed. Either side may resubmit its
+//confirmation to clear breaks. Only a Matched trade can be approved by the agent, and only an
+//AgentApproved trade settles.
+const (
+	TradeOpen          = "Open"
+	TradeUnmatched     = "Unmatched"
+	TradeMatched       = "Matched"
+	TradeAgentApproved = "AgentApproved"
+	TradeSettled       = "Settled"
+	TradeCancelled     = "Cancelled"
+)
+
+var documentations = []string{DocumentationLSTA, DocumentationLMA}
+
+var tradeTypes = []string{TradeTypePar, TradeTypeDistressed}
+
+//TradeConfirmation is one counterparty's view of a trade. Price is in percent of par.
+type TradeConfirmation struct {
+	Side           string `json:"side"`
+	LoanId         string `json:"loanId"`
+	SellerId       string `json:"sellerId"`
+	BuyerId        string `json:"buyerId"`
+	Amount         Money  `json:"amount"`
+	Price          Rate   `json:"price"`
+	TradeDate      string `json:"tradeDate"`
+	SettlementDate string `json:"settlementDate"`
+	Documentation  string `json:"documentation"`
+	TradeType      string `json:"tradeType"`
+	TxId           string `json:"txId"`
+}
+
+//TradeBreak is an economic field on which buyer and seller disagree
+type TradeBreak struct {
+	Field  string `json:"field"`
+	Buyer  string `json:"buyer"`
+	Seller string `json:"seller"`
+}
+
+type Trade struct {
+	ID         string                `json:"id"`
+	Status     string                `json:"status"`
+	Buy        *TradeConfirmation    `json:"buy,omitempty"`
+	Sell       *TradeConfirmation    `json:"sell,omitempty"`
+	Breaks     []TradeBreak          `json:"breaks"`
+	Reason     string                `json:"reason,omitempty"`
+	Settlement *AssignmentSettlement `json:"settlement,omitempty"`
+	Economics  *TradeEconomics       `json:"economics,omitempty"`
+	TxId       string                `json:"txId"`
+}
+
+//submitter is the participant whose side the confirmation is
+func (confirmation *TradeConfirmation) submitter() string {
+	return confirmation.partyOn(confirmation.Side)
+}
+
+//partyOn is the participant the confirmation names on the given side
+func (confirmation *TradeConfirmation) partyOn(side string) string {
+	if side == TradeSell {
+		return confirmation.SellerId
+	}
+	return confirmation.BuyerId
+}
+
+//loanId is the loan named by the seller, or by the buyer until the seller has confirmed
+func (trade *Trade) loanId() string {
+	if trade.Sell != nil {
+		return trade.Sell.LoanId
+	}
+	return trade.Buy.LoanId
+}
+
+//side returns where the trade holds the confirmation of a side
+func (trade *Trade) side(side string) **TradeConfirmation {
+	if side == TradeSell {
+		return &trade.Sell
+	}
+	return &trade.Buy
+}
+
+//isParty reports whether either confirmation names the participant as seller or buyer
+func (trade *Trade) isParty(participantId string) bool {
+	for _, confirmation := range []*TradeConfirmation{trade.Buy, trade.Sell} {
+		if confirmation != nil && (confirmation.SellerId == participantId || confirmation.BuyerId == participantId) {
+			return true
+		}
+	}
+	return false
+}
+
+//matchTrade lists the fields on which the two confirmations differ and sets the status
+func matchTrade(trade *Trade) {
+	trade.Breaks = []TradeBreak{}
+	if trade.Buy == nil || trade.Sell == nil {
+		trade.Status = TradeOpen
+		return
+	}
+	var buy, sell = trade.Buy, trade.Sell
+	for _, field := range []struct{ name, buyer, seller string }{
+		{"loanId", buy.LoanId, sell.LoanId},
+		{"sellerId", buy.SellerId, sell.SellerId},
+		{"buyerId", buy.BuyerId, sell.BuyerId},
+		{"amount", buy.Amount.String(), sell.Amount.String()},
+		{"price", buy.Price.String(), sell.Price.String()},
+		{"tradeDate", buy.TradeDate, sell.TradeDate},
+		{"settlementDate", buy.SettlementDate, sell.SettlementDate},
+		{"documentation", buy.Documentation, sell.Documentation},
+		{"tradeType", buy.TradeType, sell.TradeType},
+	} {
+		if field.buyer != field.seller {
+			trade.Breaks = append(trade.Breaks, TradeBreak{Field: field.name, Buyer: field.buyer, Seller: field.seller})
+		}
+	}
+	trade.Status = TradeMatched
+	if len(trade.Breaks) > 0 {
+		trade.Status = TradeUnmatched
+	}
+}
+
+func tradeKey(tradeId string) string {
+	return compositeKey(tradeObjectType, tradeId)
+}
+
+func fetchTrade(stub shim.ChaincodeStubInterface, tradeId string) (*Trade, error) {
+	bytes, err := stub.GetState(tradeKey(tradeId))
+	if err != nil {
+		logger.Error("Could not fetch trade "+tradeId+" from ledger", err)
+		return nil, err
+	}
+	if bytes == nil {
+		return nil, nil
+	}
+	var trade Trade
+	err = json.Unmarshal(bytes, &trade)
+	if err != nil {
+		logger.Error("Could not unmarshal trade "+tradeId, err)
+		return nil, err
+	}
+	return &trade, nil
+}
+
+func writeTrade(stub shim.ChaincodeStubInterface, trade *Trade, eventType string) ([]byte, error) {
+	trade.TxId = stub.GetTxID()
+	bytes, err := json.Marshal(trade)
+	if err != nil {
+		logger.Error("Could not marshal trade "+trade.ID, err)
+		return nil, err
+	}
+	err = stub.PutState(tradeKey(trade.ID), bytes)
+	if err != nil {
+		logger.Error("Could not save trade "+trade.ID+" to ledger", err)
+		return nil, newError(ErrCodeLedger, "Could not save trade %s: %v", trade.ID, err)
+	}
+	err = setEvent(stub, eventType, string(bytes))
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Trade " + trade.ID + " is " + trade.Status)
+	return bytes, nil
+}
+
+//validateConfirmation checks one side of a trade on its own; whether it agrees with the other
+//side is left to matching
+func validateConfirmation(stub shim.ChaincodeStubInterface, confirmation *TradeConfirmation) error {
+	if confirmation.Side != TradeBuy && confirmation.Side != TradeSell {
+		return newError(ErrCodeInvalidArgument, "Trade side must be %s or %s", TradeBuy, TradeSell)
+	}
+	if confirmation.SellerId == "" || confirmation.BuyerId == "" || confirmation.SellerId == confirmation.BuyerId {
+		return newError(ErrCodeInvalidArgument, "Trade needs a seller and a different buyer")
+	}
+	if confirmation.Documentation == "" {
+		confirmation.Documentation = DocumentationLSTA
+	}
+	if !containsString(documentations, confirmation.Documentation) {
+		return newError(ErrCodeInvalidArgument, "Unknown trade documentation %s", confirmation.Documentation)
+	}
+	if confirmation.TradeType == "" {
+		confirmation.TradeType = TradeTypePar
+	}
+	if !containsString(tradeTypes, confirmation.TradeType) {
+		return newError(ErrCodeInvalidArgument, "Unknown trade type %s", confirmation.TradeType)
+	}
+	tradeDate, err := ParseDate(confirmation.TradeDate)
+	if err != nil {
+		return newError(ErrCodeInvalidArgument, "Invalid trade date: %v", err)
+	}
+	settlementDate, err := ParseDate(confirmation.SettlementDate)
+	if err != nil {
+		return newError(ErrCodeInvalidArgument, "Invalid settlement date: %v", err)
+	}
+	if settlementDate.Before(tradeDate) {
+		return newError(ErrCodeInvalidArgument, "Trade settles on %s before its trade date %s", confirmation.SettlementDate, confirmation.TradeDate)
+	}
+	if !confirmation.Price.IsPositive() {
+		return newError(ErrCodeInvalidArgument, "Price %s must be positive", confirmation.Price)
+	}
+	loan, err := fetchLoan(stub, confirmation.LoanId)
+	if err != nil {
+		return newError(ErrCodeLedger, "Could not read loan application %s: %v", confirmation.LoanId, err)
+	}
+	if loan == nil {
+		return newError(ErrCodeNotFound, "Loan application %s not found", confirmation.LoanId)
+	}
+	confirmation.Amount, err = confirmation.Amount.InCurrency(loan.Currency)
+	if err != nil {
+		return newError(ErrCodeInvalidArgument, "%v", err)
+	}
+	if !confirmation.Amount.IsPositive() {
+		return newError(ErrCodeInvalidArgument, "Trade amount %s must be positive", confirmation.Amount)
+	}
+	return nil
+}
+
+//SubmitTradeConfirmation records the buyer's or seller's side of a trade and matches it against
+//the other side; args are trade ID, empty to book a new trade, and the confirmation JSON. Only
+//the counterparty named by the other side can confirm a side, and a side may be resubmitted by
+//its submitter to correct breaks until the agent approves the trade.
+func SubmitTradeConfirmation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering SubmitTradeConfirmation")
+	if len(args) < 2 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected trade ID and trade confirmation")
+	}
+	var confirmation TradeConfirmation
+	err := json.Unmarshal([]byte(args[1]), &confirmation)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "Could not parse trade confirmation: %v", err)
+	}
+	err = validateConfirmation(stub, &confirmation)
+	if err != nil {
+		return nil, err
+	}
+	confirmation.TxId = stub.GetTxID()
+
+	var trade *Trade
+	if args[0] == "" {
+		tradeId, err := NextID(stub, TradeIdPrefix, tradeKey)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not allocate a trade ID: %v", err)
+		}
+		trade = &Trade{ID: tradeId}
+	} else {
+		trade, err = fetchTrade(stub, args[0])
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Could not read trade %s: %v", args[0], err)
+		}
+		if trade == nil {
+			return nil, newError(ErrCodeNotFound, "Trade %s not found", args[0])
+		}
+		if !containsString([]string{TradeOpen, TradeUnmatched, TradeMatched}, trade.Status) {
+			return nil, newError(ErrCodeIllegalTransition, "Trade %s can no longer be confirmed in status %s", trade.ID, trade.Status)
+		}
+		var existing = *trade.side(confirmation.Side)
+		if existing != nil && existing.submitter() != confirmation.submitter() {
+			return nil, newError(ErrCodeAccessDenied, "The %s side of trade %s was confirmed by %s", confirmation.Side, trade.ID, existing.submitter())
+		}
+		for _, other := range []*TradeConfirmation{trade.Buy, trade.Sell} {
+			if other != nil && other.Side != confirmation.Side && other.partyOn(confirmation.Side) != confirmation.submitter() {
+				return nil, newError(ErrCodeAccessDenied, "Trade %s names %s, not %s, on the %s side", trade.ID, other.partyOn(confirmation.Side), confirmation.submitter(), confirmation.Side)
+			}
+		}
+	}
+	*trade.side(confirmation.Side) = &confirmation
+	matchTrade(trade)
+	return writeTrade(stub, trade, "trade"+trade.Status)
+}
+
+//ApproveTrade records the agent's approval of a matched trade once the transfer it describes
+//is possible; args are trade ID. Interest is only accrued when the trade settles, so a trade
+//settling after rates that are not fixed yet can be approved.
+func ApproveTrade(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering ApproveTrade")
+	if len(args) < 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected trade ID")
+	}
+	trade, err := fetchTradeIn(stub, args[0], TradeMatched)
+	if err != nil {
+		return nil, err
+	}
+	var terms = trade.Sell
+	_, err = checkTransfer(stub, terms.LoanId, terms.SellerId, terms.BuyerId, terms.Amount, terms.Price, terms.SettlementDate)
+	if err != nil {
+		return nil, err
+	}
+	trade.Status = TradeAgentApproved
+	return writeTrade(stub, trade, "trade"+trade.Status)
+}
+
+//SettleTrade moves the positions and syndicate share of an approved trade and records the
+//cash the counterparties owe each other, including delayed compensation when the trade settles
+//after its standard settlement date; args are trade ID and optionally the actual settlement
+//date, which defaults to the confirmed one
+func SettleTrade(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering SettleTrade")
+	if len(args) < 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected trade ID")
+	}
+	trade, err := fetchTradeIn(stub, args[0], TradeAgentApproved)
+	if err != nil {
+		return nil, err
+	}
+	transfer, economics, err := settleTradeOn(stub, trade, args[1:])
+	if err != nil {
+		return nil, err
+	}
+	err = transfer.save(stub)
+	if err != nil {
+		return nil, err
+	}
+	transfer.settlement.TxId = stub.GetTxID()
+	trade.Settlement = &transfer.settlement
+	trade.Economics = economics
+	trade.Status = TradeSettled
+	return writeTrade(stub, trade, "trade"+trade.Status)
+}
+
+//CancelTrade calls off a trade that has not settled; args are trade ID and the cancelling
+//participant, which must be a counterparty or the agent of the loan
+func CancelTrade(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering CancelTrade")
+	if len(args) < 2 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected trade ID and participant ID")
+	}
+	trade, err := fetchTradeIn(stub, args[0], TradeOpen, TradeUnmatched, TradeMatched, TradeAgentApproved)
+	if err != nil {
+		return nil, err
+	}
+	var allowed = false
+	for _, confirmation := range []*TradeConfirmation{trade.Buy, trade.Sell} {
+		if confirmation != nil && confirmation.submitter() == args[1] {
+			allowed = true
+		}
+	}
+	if !allowed {
+		syndicate, err := fetchSyndicate(stub, trade.loanId())
+		allowed = err == nil && syndicate.AgentId != "" && syndicate.AgentId == args[1]
+	}
+	if !allowed {
+		return nil, newError(ErrCodeAccessDenied, "Only a counterparty or the agent can cancel trade %s", trade.ID)
+	}
+	trade.Status = TradeCancelled
+	trade.Reason = "Cancelled by " + args[1]
+	return writeTrade(stub, trade, "trade"+trade.Status)
+}
+
+//GetTrade returns a trade with both confirmations and any breaks; args are trade ID and
+//optionally the participant asking, who must be a party to the trade
+func GetTrade(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("Entering GetTrade")
+	if len(args) < 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected trade ID")
+	}
+	trade, err := fetchTrade(stub, args[0])
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read trade %s: %v", args[0], err)
+	}
+	if trade == nil {
+		return nil, newError(ErrCodeNotFound, "Trade %s not found", args[0])
+	}
+	if len(args) > 1 && args[1] != "" && !trade.isParty(args[1]) {
+		return nil, newError(ErrCodeAccessDenied, "Participant %s is not a party to trade %s", args[1], trade.ID)
+	}
+	return json.Marshal(trade)
+}
+
+//fetchTradeIn reads a trade that must be in one of statuses
+func fetchTradeIn(stub shim.ChaincodeStubInterface, tradeId string, statuses ...string) (*Trade, error) {
+	trade, err := fetchTrade(stub, tradeId)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Could not read trade %s: %v", tradeId, err)
+	}
+	if trade == nil {
+		return nil, newError(ErrCodeNotFound, "Trade %s not found", tradeId)
+	}
+	if !containsString(statuses, trade.Status) {
+		return nil, newError(ErrCodeIllegalTransition, "Trade %s is %s", tradeId, trade.Status)
+	}
+	return trade, nil
+}